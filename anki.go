@@ -6,12 +6,14 @@ package anki
 import (
 	"archive/zip"
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"path/filepath"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/klauspost/compress/zstd"
 )
 
 // Apkg manages state of an Anki package file during processing.
@@ -19,12 +21,39 @@ type Apkg struct {
 	reader *zip.Reader
 	closer *zip.ReadCloser
 	sqlite *zip.File
-	media  *zipIndex
+	media  mediaIndex
 	db     *DB
+	// version is the version of the package format.
+	version int
+	// added holds the media files added to the package, which are written
+	// when it is saved.
+	added []*mediaFile
+	// collection and split are loaded by the Update methods.
+	collection *Collection
+	split      map[string]bool
+}
+
+// OpenOptions controls how the database of a package or collection is
+// opened. SQLite cannot read a database from within a package, nor modify a
+// collection in place, so the database is copied before it is opened.
+type OpenOptions struct {
+	// InMemory holds the copy of the database in memory, rather than in a
+	// temporary file.
+	InMemory bool
+	// TempDir is the directory the temporary file is created in. If it is
+	// empty, the default directory for temporary files is used (see
+	// os.TempDir).
+	TempDir string
 }
 
 // ReadFile reads an *.apkg file, returning an Apkg struct for processing.
 func ReadFile(f string) (*Apkg, error) {
+	return ReadFileWithOptions(f, nil)
+}
+
+// ReadFileWithOptions reads an *.apkg file, opening its database as opts
+// specifies. If opts is nil, the default options are used.
+func ReadFileWithOptions(f string, opts *OpenOptions) (*Apkg, error) {
 	z, err := zip.OpenReader(f)
 	if err != nil {
 		return nil, err
@@ -33,19 +62,35 @@ func ReadFile(f string) (*Apkg, error) {
 		reader: &z.Reader,
 		closer: z,
 	}
-	return a, a.open()
+	if err := a.open(opts); err != nil {
+		_ = a.Close()
+		return nil, err
+	}
+	return a, nil
 }
 
 // ReadBytes reads an *.apkg file from a bytestring, returning an Apkg struct
 // for processing.
 func ReadBytes(b []byte) (*Apkg, error) {
+	return ReadBytesWithOptions(b, nil)
+}
+
+// ReadBytesWithOptions reads an *.apkg file from a bytestring, opening its
+// database as opts specifies. If opts is nil, the default options are used.
+func ReadBytesWithOptions(b []byte, opts *OpenOptions) (*Apkg, error) {
 	r := bytes.NewReader(b)
-	return ReadReader(r, int64(len(b)))
+	return ReadReaderWithOptions(r, int64(len(b)), opts)
 }
 
 // ReadReader reads an *.apkg file from an io.Reader, returning an Apkg struct
 // for processing.
 func ReadReader(r io.ReaderAt, size int64) (*Apkg, error) {
+	return ReadReaderWithOptions(r, size, nil)
+}
+
+// ReadReaderWithOptions reads an *.apkg file from an io.Reader, opening its
+// database as opts specifies. If opts is nil, the default options are used.
+func ReadReaderWithOptions(r io.ReaderAt, size int64, opts *OpenOptions) (*Apkg, error) {
 	z, err := zip.NewReader(r, size)
 	if err != nil {
 		return nil, err
@@ -53,10 +98,14 @@ func ReadReader(r io.ReaderAt, size int64) (*Apkg, error) {
 	a := &Apkg{
 		reader: z,
 	}
-	return a, a.open()
+	if err := a.open(opts); err != nil {
+		_ = a.Close()
+		return nil, err
+	}
+	return a, nil
 }
 
-func (a *Apkg) open() error {
+func (a *Apkg) open(opts *OpenOptions) error {
 	if err := a.populateIndex(); err != nil {
 		return err
 	}
@@ -65,7 +114,16 @@ func (a *Apkg) open() error {
 		return err
 	}
 	defer rc.Close()
-	db, err := OpenDB(rc)
+	var src io.Reader = rc
+	if a.sqlite.Name == "collection.anki21b" {
+		zr, err := zstd.NewReader(rc)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		src = zr
+	}
+	db, err := OpenDBWithOptions(src, opts)
 	if err != nil {
 		return err
 	}
@@ -73,23 +131,66 @@ func (a *Apkg) open() error {
 	return nil
 }
 
+// mediaIndex provides access to the media files of a collection, by name.
+type mediaIndex interface {
+	list() []string
+	ReadFile(name string) ([]byte, error)
+	// open returns a reader for the file, which decompresses it as it is
+	// read. fs.ErrNotExist is returned if there is no such file.
+	open(name string) (io.ReadCloser, error)
+	// stat describes the file. fs.ErrNotExist is returned if there is no
+	// such file.
+	stat(name string) (fs.FileInfo, error)
+}
+
 type zipIndex struct {
 	index map[string]*zip.File
+	// zstd is true when the files are zstd-compressed.
+	zstd bool
 }
 
 // ListFiles returns a list of all media files in the archive.
 func (a *Apkg) ListFiles() []string {
-	filenames := make([]string, 0, len(a.media.index))
-	for filename := range a.media.index {
-		filenames = append(filenames, filename)
+	filenames := a.media.list()
+	for _, file := range a.added {
+		filenames = append(filenames, file.name)
 	}
 	return filenames
 }
 
 func (a *Apkg) ReadMediaFile(name string) ([]byte, error) {
+	for _, file := range a.added {
+		if file.name == name {
+			return file.data, nil
+		}
+	}
 	return a.media.ReadFile(name)
 }
 
+// AddMedia adds a media file to the package, to be referenced by notes and
+// templates by the provided filename. It is written when the package is
+// saved with WriteTo or WriteFile, or, for a collection opened with
+// OpenCollection, with SaveMedia. An error is returned if the package already
+// has a media file of that name.
+func (a *Apkg) AddMedia(name string, data []byte) error {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("Invalid media file name %q", name)
+	}
+	if _, err := a.ReadMediaFile(name); err == nil {
+		return fmt.Errorf("Media file %q already exists", name)
+	}
+	a.added = append(a.added, &mediaFile{name: name, data: data})
+	return nil
+}
+
+func (zi *zipIndex) list() []string {
+	filenames := make([]string, 0, len(zi.index))
+	for filename := range zi.index {
+		filenames = append(filenames, filename)
+	}
+	return filenames
+}
+
 func (zi *zipIndex) ReadFile(name string) ([]byte, error) {
 	zipFile, ok := zi.index[name]
 	if !ok {
@@ -101,10 +202,46 @@ func (zi *zipIndex) ReadFile(name string) ([]byte, error) {
 	}
 	defer fh.Close()
 	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(fh)
-	return buf.Bytes(), err
+	if _, err := buf.ReadFrom(fh); err != nil {
+		return nil, err
+	}
+	if zi.zstd {
+		return decompress(buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+func (zi *zipIndex) open(name string) (io.ReadCloser, error) {
+	zipFile, ok := zi.index[name]
+	if !ok || zipFile == nil {
+		return nil, fs.ErrNotExist
+	}
+	rc, err := zipFile.Open()
+	if err != nil || !zi.zstd {
+		return rc, err
+	}
+	return newZstdReader(rc)
+}
+
+func (zi *zipIndex) stat(name string) (fs.FileInfo, error) {
+	zipFile, ok := zi.index[name]
+	if !ok || zipFile == nil {
+		return nil, fs.ErrNotExist
+	}
+	size := int64(zipFile.UncompressedSize64)
+	if zi.zstd {
+		var err error
+		if size, err = decompressedSize(zipFile); err != nil {
+			return nil, err
+		}
+	}
+	return &mediaFileInfo{name: name, size: size, modTime: zipFile.Modified}, nil
 }
 
+// collectionFiles lists the names of the collection database within a
+// package, in order of preference.
+var collectionFiles = []string{"collection.anki21b", "collection.anki21", "collection.anki2"}
+
 func (a *Apkg) populateIndex() error {
 	index := &zipIndex{
 		index: make(map[string]*zip.File),
@@ -113,27 +250,42 @@ func (a *Apkg) populateIndex() error {
 		index.index[file.FileHeader.Name] = file
 	}
 
-	if sqlite, ok := index.index["collection.anki2"]; !ok {
+	// Packages exported by Anki 2.1 include a collection.anki21 or
+	// collection.anki21b file, using a newer schema, alongside a stub
+	// collection.anki2 for older clients.
+	for _, name := range collectionFiles {
+		if sqlite, ok := index.index[name]; ok {
+			a.sqlite = sqlite
+			break
+		}
+	}
+	if a.sqlite == nil {
 		return errors.New("Unable to find `collection.anki2` in archive")
-	} else {
-		a.sqlite = sqlite
 	}
 
+	version, err := index.packageVersion()
+	if err != nil {
+		return err
+	}
+	a.version = version
+
 	mediaFile, err := index.ReadFile("media")
 	if err != nil {
 		return err
 	}
 
-	mediaMap := make(map[string]string)
-	if err := json.Unmarshal(mediaFile, &mediaMap); err != nil {
+	mediaMap, err := decodeMediaMap(mediaFile, version)
+	if err != nil {
 		return err
 	}
-	a.media = &zipIndex{
+	media := &zipIndex{
 		index: make(map[string]*zip.File),
+		zstd:  version >= packageVersionLatest,
 	}
 	for idx, filename := range mediaMap {
-		a.media.index[filename] = index.index[idx]
+		media.index[filename] = index.index[idx]
 	}
+	a.media = media
 	return nil
 }
 
@@ -155,7 +307,31 @@ func (a *Apkg) Close() (e error) {
 	return
 }
 
+// Collection returns the collection stored in the package. Newer schemas,
+// which store note types, decks and configuration in tables of their own, are
+// read into the same types as the legacy JSON columns of the `col` table.
 func (a *Apkg) Collection() (*Collection, error) {
+	collection, err := a.readCollection()
+	if err != nil {
+		return nil, err
+	}
+	for _, deck := range collection.Decks {
+		if deck.Dynamic {
+			// Filtered decks use the options of their cards' home decks.
+			continue
+		}
+		conf, ok := collection.DeckConfigs[deck.ConfigID]
+		if !ok {
+			return nil, fmt.Errorf("Deck %d references non-existent config %d", deck.ID, deck.ConfigID)
+		}
+		deck.Config = conf
+	}
+	return collection, nil
+}
+
+// readCollection reads the collection, without resolving the options of its
+// decks.
+func (a *Apkg) readCollection() (*Collection, error) {
 	var deletedDecks []ID
 	if rows, err := a.db.Query("SELECT oid FROM graves WHERE type=2"); err != nil {
 		return nil, err
@@ -168,22 +344,19 @@ func (a *Apkg) Collection() (*Collection, error) {
 			deletedDecks = append(deletedDecks, *id)
 		}
 	}
+	tables, err := a.tables()
+	if err != nil {
+		return nil, err
+	}
 	collection := &Collection{}
-	if err := a.db.Get(collection, "SELECT * FROM col"); err != nil {
+	if err := a.db.Get(collection, "SELECT "+collectionColumns(tables)+" FROM col"); err != nil {
 		return nil, err
 	}
-	for _, deck := range collection.Decks {
-		for _, deleted := range deletedDecks {
-			if deck.ID == deleted {
-				delete(collection.Decks, deck.ID)
-				continue
-			}
-		}
-		conf, ok := collection.DeckConfigs[deck.ConfigID]
-		if !ok {
-			return nil, fmt.Errorf("Deck %d references non-existent config %d", deck.ID, deck.ConfigID)
-		}
-		deck.Config = conf
+	if err := a.readSplitTables(collection, tables); err != nil {
+		return nil, err
+	}
+	for _, deleted := range deletedDecks {
+		delete(collection.Decks, deleted)
 	}
 	return collection, nil
 }
@@ -196,16 +369,19 @@ type Notes struct {
 	*sqlx.Rows
 }
 
-// Notes returns a Notes struct representing all of the Note rows in the *.apkg
-// package file.
+// notesQuery selects the notes which have not been deleted.
+const notesQuery = `
+	SELECT n.id, n.guid, n.mid, n.mod, n.usn, n.tags, n.flds, n.sfld,
+		CAST(n.csum AS text) AS csum -- Work-around for SQL.js trying to treat this as a float
+	FROM notes n
+	LEFT JOIN graves g ON g.oid=n.id AND g.type=1
+	WHERE g.oid IS NULL
+`
+
+// Notes returns a Notes struct representing all of the non-deleted notes in
+// the *.apkg package file.
 func (a *Apkg) Notes() (*Notes, error) {
-	rows, err := a.db.Queryx(`
-		SELECT n.id, n.guid, n.mid, n.mod, n.usn, n.tags, n.flds, n.sfld,
-			CAST(n.csum AS text) AS csum -- Work-around for SQL.js trying to treat this as a float
-		FROM notes n
-		LEFT JOIN graves g ON g.oid=n.id AND g.type=1
-		ORDER BY id DESC
-	`)
+	rows, err := a.db.Queryx(notesQuery + "ORDER BY id DESC")
 	return &Notes{rows}, err
 }
 
@@ -225,32 +401,45 @@ type Cards struct {
 	*sqlx.Rows
 }
 
+// cardsQuery selects the cards which have not been deleted, converting the
+// due date and intervals to seconds.
+const cardsQuery = `
+	SELECT c.id, c.nid, c.did, c.ord, c.mod, c.usn, c.type, c.queue, c.reps, c.lapses, c.left, c.odid, c.flags,
+		CAST(c.factor AS real)/1000 AS factor,
+		CASE
+			WHEN c.type != 0 THEN 0
+			WHEN c.odid != 0 THEN c.odue
+			ELSE c.due
+		END AS pos,
+		CASE
+			WHEN c.queue = 1 THEN c.due
+			WHEN c.queue IN (2, 3) THEN c.due*24*60*60+(SELECT crt FROM col)
+			-- Suspended and buried cards keep the due value of their card type.
+			WHEN c.queue < 0 AND c.type = 1 THEN c.due
+			WHEN c.queue < 0 AND c.type IN (2, 3) THEN c.due*24*60*60+(SELECT crt FROM col)
+		END AS due,
+		CASE
+			WHEN c.ivl == 0 THEN NULL
+			WHEN c.ivl < 0 THEN -ivl
+			ELSE c.ivl*24*60*60
+		END AS ivl,
+		CASE
+			WHEN c.odue = 0 THEN NULL
+			WHEN c.queue = 1 THEN c.odue
+			WHEN c.queue IN (2, 3) THEN c.odue*24*60*60+(SELECT crt FROM col)
+			-- Suspended and buried cards keep the odue value of their card type.
+			WHEN c.queue < 0 AND c.type = 1 THEN c.odue
+			WHEN c.queue < 0 AND c.type IN (2, 3) THEN c.odue*24*60*60+(SELECT crt FROM col)
+		END AS odue
+	FROM cards c
+	LEFT JOIN graves g ON g.oid=c.id AND g.type=0
+	WHERE g.oid IS NULL
+`
+
 // Cards returns a Cards struct represeting all of the non-deleted cards in the
 // *.apkg package file.
 func (a *Apkg) Cards() (*Cards, error) {
-	rows, err := a.db.Queryx(`
-		SELECT c.id, c.nid, c.did, c.ord, c.mod, c.usn, c.type, c.queue, c.reps, c.lapses, c.left, c.odid,
-			CAST(c.factor AS real)/1000 AS factor,
-			CASE c.queue
-				WHEN 0 THEN NULL
-				WHEN 1 THEN c.due
-				WHEN 2 THEN c.due*24*60*60+(SELECT crt FROM col)
-			END AS due,
-			CASE
-				WHEN c.ivl == 0 THEN NULL
-				WHEN c.ivl < 0 THEN -ivl
-				ELSE c.ivl*24*60*60
-			END AS ivl,
-			CASE c.queue
-				WHEN 0 THEN NULL
-				WHEN 1 THEN c.odue
-				WHEN 2 THEN c.odue*24*60*60+(SELECT crt FROM col)
-			END AS odue
-		FROM cards c
-		LEFT JOIN graves g ON g.oid=c.id AND g.type=0
-		WHERE g.oid IS NULL
-		ORDER BY id DESC
-	`)
+	rows, err := a.db.Queryx(cardsQuery + "ORDER BY id DESC")
 	return &Cards{rows}, err
 }
 
@@ -264,26 +453,29 @@ type Reviews struct {
 	*sqlx.Rows
 }
 
+// reviewsQuery selects the reviews of the cards which have not been
+// deleted, converting the intervals to seconds.
+const reviewsQuery = `
+	SELECT r.id, r.cid, r.usn, r.ease, r.time, r.type,
+		CAST(r.factor AS real)/1000 AS factor,
+		CASE
+			WHEN r.ivl < 0 THEN -ivl
+			ELSE r.ivl*24*60*60
+		END AS ivl,
+		CASE
+			WHEN r.lastIvl < 0 THEN -r.lastIvl
+			ELSE r.lastIvl*24*60*60
+		END AS lastIvl
+	FROM revlog r
+	LEFT JOIN graves g ON g.oid=r.cid AND g.type=0
+	WHERE g.oid IS NULL
+`
+
 // Reviews returns a Reviews struct representing all of the reviews of
 // non-deleted cards in the *.apkg package file, in reverse chronological
 // order (newest first).
 func (a *Apkg) Reviews() (*Reviews, error) {
-	rows, err := a.db.Queryx(`
-		SELECT r.id, r.cid, r.usn, r.ease, r.time, r.type,
-			CAST(r.factor AS real)/1000 AS factor,
-			CASE
-				WHEN r.ivl < 0 THEN -ivl
-				ELSE r.ivl*24*60*60
-			END AS ivl,
-			CASE
-				WHEN r.lastIvl < 0 THEN -ivl
-				ELSE r.lastIvl*24*60*60
-			END AS lastIvl
-		FROM revlog r
-		LEFT JOIN graves g ON g.oid=r.cid AND g.type=0
-		WHERE g.oid IS NULL
-		ORDER BY id DESc
-	`)
+	rows, err := a.db.Queryx(reviewsQuery + "ORDER BY id DESC")
 	return &Reviews{rows}, err
 }
 
@@ -0,0 +1,472 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Since schema version 14 (Anki 2.1.28), parts of the collection which were
+// stored as JSON in the `col` table have been moved into tables of their own,
+// with much of their content encoded as protocol buffers. The functions in
+// this file read those tables into the same types used for older schemas.
+
+// splitTables maps each JSON column of the `col` table to the table which
+// replaces it in newer schemas.
+var splitTables = []struct {
+	column string
+	table  string
+}{
+	{column: "conf", table: "config"},
+	{column: "models", table: "notetypes"},
+	{column: "decks", table: "decks"},
+	{column: "dconf", table: "deck_config"},
+	{column: "tags", table: "tags"},
+}
+
+// tables returns the set of tables in the database.
+func (a *Apkg) tables() (map[string]bool, error) {
+	rows, err := a.db.Query("SELECT name FROM sqlite_master WHERE type='table'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables[name] = true
+	}
+	return tables, rows.Err()
+}
+
+// collectionColumns returns the columns of the `col` table to read, which
+// excludes those replaced by the provided tables.
+func collectionColumns(tables map[string]bool) string {
+	columns := []string{"id", "crt", "mod", "scm", "ver", "dty", "usn", "ls"}
+	for _, split := range splitTables {
+		if !tables[split.table] {
+			columns = append(columns, split.column)
+		}
+	}
+	return strings.Join(columns, ", ")
+}
+
+// readSplitTables populates the collection from those of the provided
+// tables which replace columns of the `col` table.
+func (a *Apkg) readSplitTables(collection *Collection, tables map[string]bool) error {
+	if tables["config"] {
+		if err := a.readConfig(&collection.Config); err != nil {
+			return err
+		}
+	}
+	if tables["tags"] {
+		tags, err := a.readTags()
+		if err != nil {
+			return err
+		}
+		collection.Tags = tags
+	}
+	if tables["deck_config"] {
+		dconf, err := a.readDeckConfigs()
+		if err != nil {
+			return err
+		}
+		collection.DeckConfigs = dconf
+	}
+	if tables["notetypes"] {
+		models, err := a.readNotetypes()
+		if err != nil {
+			return err
+		}
+		collection.Models = models
+	}
+	if tables["decks"] {
+		decks, err := a.readDecks()
+		if err != nil {
+			return err
+		}
+		collection.Decks = decks
+	}
+	return nil
+}
+
+// readConfig reads the `config` table, which holds each key of the legacy
+// `conf` object as a separate JSON value.
+func (a *Apkg) readConfig(conf *Config) error {
+	rows, err := a.db.Query("SELECT key, val FROM config")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	values := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var key string
+		var val []byte
+		if err := rows.Scan(&key, &val); err != nil {
+			return err
+		}
+		if json.Valid(val) {
+			values[key] = val
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	blob, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(blob, conf)
+}
+
+// readTags reads the `tags` table into the JSON tag cache format of the
+// legacy `tags` column.
+func (a *Apkg) readTags() (string, error) {
+	rows, err := a.db.Query("SELECT tag, usn FROM tags")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	tags := make(map[string]int)
+	for rows.Next() {
+		var tag string
+		var usn int
+		if err := rows.Scan(&tag, &usn); err != nil {
+			return "", err
+		}
+		tags[tag] = usn
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	blob, err := json.Marshal(tags)
+	return string(blob), err
+}
+
+// readDeckConfigs reads the `deck_config` table. Schema 14 stores each
+// configuration as the legacy JSON object; later schemas use a protocol
+// buffer.
+func (a *Apkg) readDeckConfigs() (DeckConfigs, error) {
+	rows, err := a.db.Query("SELECT id, name, mtime_secs, config FROM deck_config")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	dconf := make(DeckConfigs)
+	for rows.Next() {
+		var id ID
+		var name string
+		var mtime int64
+		var config []byte
+		if err := rows.Scan(&id, &name, &mtime, &config); err != nil {
+			return nil, err
+		}
+		dc := &DeckConfig{}
+		if len(config) > 0 && config[0] == '{' {
+			if err := json.Unmarshal(config, dc); err != nil {
+				return nil, err
+			}
+		} else if err := decodeDeckConfig(dc, config); err != nil {
+			return nil, fmt.Errorf("Deck config %d: %s", id, err)
+		}
+		dc.ID, dc.Name = id, name
+		dc.Modified = timestampSeconds(time.Unix(mtime, 0))
+		dconf[id] = dc
+	}
+	return dconf, rows.Err()
+}
+
+// decodeDeckConfig populates dc from a DeckConfig.Config protocol buffer.
+func decodeDeckConfig(dc *DeckConfig, b []byte) error {
+	msg, err := decodeProto(b)
+	if err != nil {
+		return err
+	}
+	if err := applyOther(dc, msg); err != nil {
+		return err
+	}
+	learnSteps, err := msg.floats(1)
+	if err != nil {
+		return err
+	}
+	relearnSteps, err := msg.floats(2)
+	if err != nil {
+		return err
+	}
+	dc.New.Delays = stepDurations(learnSteps)
+	dc.Lapses.Delays = stepDurations(relearnSteps)
+	dc.New.PerDay = int(msg.uint(9))
+	dc.Reviews.PerDay = int(msg.uint(10))
+	dc.New.InitialFactor = msg.float(11) * 1000
+	dc.Reviews.EasyBonus = msg.float(12)
+	dc.Reviews.HardFactor = msg.float(13)
+	dc.Lapses.NewInterval = msg.float(14)
+	dc.Reviews.IntervalModifier = msg.float(15)
+	dc.Reviews.MaxInterval = DurationDays(msg.uint(16))
+	dc.Lapses.MinimumInterval = DurationDays(msg.uint(17))
+	dc.New.Intervals[0] = DurationDays(msg.uint(18))
+	dc.New.Intervals[1] = DurationDays(msg.uint(19))
+	// The protocol buffer's insertion order enumerates "due" before
+	// "random", the reverse of the legacy order.
+	if msg.uint(20) == 0 {
+		dc.New.Order = NewCardOrderOrderAdded
+	} else {
+		dc.New.Order = NewCardOrderRandomOrder
+	}
+	dc.Lapses.LeechAction = LeechAction(msg.uint(21))
+	dc.Lapses.LeechFails = int(msg.uint(22))
+	dc.AutoPlay = !msg.bool(23)
+	dc.MaxAnswerSeconds = int(msg.uint(24))
+	dc.ShowTimer = BoolInt(msg.bool(25))
+	dc.ReplayAudio = !msg.bool(26)
+	dc.New.Bury = msg.bool(27)
+	dc.Reviews.Bury = msg.bool(28)
+	return nil
+}
+
+// stepDurations converts learning steps, in fractional minutes.
+func stepDurations(steps []float32) []DurationMinutes {
+	if steps == nil {
+		return nil
+	}
+	delays := make([]DurationMinutes, len(steps))
+	for i, step := range steps {
+		delays[i] = DurationMinutes(time.Duration(float64(step) * float64(time.Minute)))
+	}
+	return delays
+}
+
+// readNotetypes reads the `notetypes`, `fields` and `templates` tables.
+func (a *Apkg) readNotetypes() (Models, error) {
+	rows, err := a.db.Query("SELECT id, name, mtime_secs, usn, config FROM notetypes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	models := make(Models)
+	for rows.Next() {
+		var mtime int64
+		var config []byte
+		model := &Model{}
+		if err := rows.Scan(&model.ID, &model.Name, &mtime, &model.UpdateSequence, &config); err != nil {
+			return nil, err
+		}
+		if err := decodeNotetypeConfig(model, config); err != nil {
+			return nil, fmt.Errorf("Note type %d: %s", model.ID, err)
+		}
+		model.Modified = timestampSeconds(time.Unix(mtime, 0))
+		models[model.ID] = model
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := a.readFields(models); err != nil {
+		return nil, err
+	}
+	if err := a.readTemplates(models); err != nil {
+		return nil, err
+	}
+	return models, nil
+}
+
+// decodeNotetypeConfig populates model from a Notetype.Config protocol
+// buffer.
+func decodeNotetypeConfig(model *Model, b []byte) error {
+	msg, err := decodeProto(b)
+	if err != nil {
+		return err
+	}
+	if err := applyOther(model, msg); err != nil {
+		return err
+	}
+	model.Type = ModelType(msg.uint(1))
+	model.SortField = int(msg.uint(2))
+	model.CSS = msg.string(3)
+	model.DeckID = ID(msg.int(4))
+	model.LatexPre = msg.string(5)
+	model.LatexPost = msg.string(6)
+	reqs, err := msg.messages(8)
+	if err != nil {
+		return err
+	}
+	model.RequiredFields = make([]*CardConstraint, len(reqs))
+	for i, req := range reqs {
+		ords, err := req.uints(3)
+		if err != nil {
+			return err
+		}
+		fields := make([]int, len(ords))
+		for j, ord := range ords {
+			fields[j] = int(ord)
+		}
+		model.RequiredFields[i] = &CardConstraint{
+			Index:     int(req.uint(1)),
+			MatchType: requirementKind(req.uint(2)),
+			Fields:    fields,
+		}
+	}
+	return nil
+}
+
+// requirementKind converts a CardRequirement.Kind to the legacy match type.
+func requirementKind(kind uint64) string {
+	switch kind {
+	case 1:
+		return "any"
+	case 2:
+		return "all"
+	}
+	return "none"
+}
+
+func (a *Apkg) readFields(models Models) error {
+	rows, err := a.db.Query("SELECT ntid, ord, name, config FROM fields")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ntid ID
+		var config []byte
+		field := &Field{}
+		if err := rows.Scan(&ntid, &field.Ordinal, &field.Name, &config); err != nil {
+			return err
+		}
+		model, ok := models[ntid]
+		if !ok {
+			return fmt.Errorf("Field %q references non-existent note type %d", field.Name, ntid)
+		}
+		msg, err := decodeProto(config)
+		if err != nil {
+			return fmt.Errorf("Note type %d field %d: %s", ntid, field.Ordinal, err)
+		}
+		field.Sticky = msg.bool(1)
+		field.RTL = msg.bool(2)
+		field.Font = msg.string(3)
+		field.FontSize = int(msg.uint(4))
+		model.Fields = append(model.Fields, field)
+	}
+	for _, model := range models {
+		sort.Slice(model.Fields, func(i, j int) bool {
+			return model.Fields[i].Ordinal < model.Fields[j].Ordinal
+		})
+	}
+	return rows.Err()
+}
+
+func (a *Apkg) readTemplates(models Models) error {
+	rows, err := a.db.Query("SELECT ntid, ord, name, config FROM templates")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ntid ID
+		var config []byte
+		tmpl := &Template{}
+		if err := rows.Scan(&ntid, &tmpl.Ordinal, &tmpl.Name, &config); err != nil {
+			return err
+		}
+		model, ok := models[ntid]
+		if !ok {
+			return fmt.Errorf("Template %q references non-existent note type %d", tmpl.Name, ntid)
+		}
+		msg, err := decodeProto(config)
+		if err != nil {
+			return fmt.Errorf("Note type %d template %d: %s", ntid, tmpl.Ordinal, err)
+		}
+		tmpl.QuestionFormat = msg.string(1)
+		tmpl.AnswerFormat = msg.string(2)
+		tmpl.BrowserQuestionFormat = msg.string(3)
+		tmpl.BrowserAnswerFormat = msg.string(4)
+		tmpl.DeckOverride = ID(msg.int(5))
+		model.Templates = append(model.Templates, tmpl)
+	}
+	for _, model := range models {
+		sort.Slice(model.Templates, func(i, j int) bool {
+			return model.Templates[i].Ordinal < model.Templates[j].Ordinal
+		})
+	}
+	return rows.Err()
+}
+
+// readDecks reads the `decks` table.
+func (a *Apkg) readDecks() (Decks, error) {
+	rows, err := a.db.Query("SELECT id, name, mtime_secs, usn, common, kind FROM decks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	decks := make(Decks)
+	for rows.Next() {
+		var mtime int64
+		var common, kind []byte
+		deck := &Deck{}
+		if err := rows.Scan(&deck.ID, &deck.Name, &mtime, &deck.UpdateSequence, &common, &kind); err != nil {
+			return nil, err
+		}
+		if err := decodeDeck(deck, common, kind); err != nil {
+			return nil, fmt.Errorf("Deck %d: %s", deck.ID, err)
+		}
+		// Components of deck names are separated by \x1f, rather than "::".
+		deck.Name = strings.ReplaceAll(deck.Name, "\x1f", "::")
+		deck.Modified = timestampSeconds(time.Unix(mtime, 0))
+		decks[deck.ID] = deck
+	}
+	return decks, rows.Err()
+}
+
+// decodeDeck populates deck from its Deck.Common and Deck.KindContainer
+// protocol buffers.
+func decodeDeck(deck *Deck, commonBytes, kindBytes []byte) error {
+	common, err := decodeProto(commonBytes)
+	if err != nil {
+		return err
+	}
+	if err := applyOther(deck, common); err != nil {
+		return err
+	}
+	deck.Collapsed = common.bool(1)
+	deck.BrowserCollapsed = common.bool(2)
+	day := int(common.uint(3))
+	deck.NewToday = [2]int{day, int(int32(common.uint(4)))}
+	deck.ReviewsToday = [2]int{day, int(int32(common.uint(5)))}
+	deck.LearnToday = [2]int{day, int(int32(common.uint(6)))}
+	deck.TimeToday = [2]int{day, int(int32(common.uint(7)))}
+
+	kind, err := decodeProto(kindBytes)
+	if err != nil {
+		return err
+	}
+	if kind.has(2) {
+		deck.Dynamic = true
+		return nil
+	}
+	normal, err := kind.message(1)
+	if err != nil {
+		return err
+	}
+	deck.ConfigID = ID(normal.int(1))
+	deck.ExtendedNewCardLimit = int(normal.uint(2))
+	deck.ExtendedReviewCardLimit = int(normal.uint(3))
+	deck.Description = normal.string(4)
+	return nil
+}
+
+// applyOther unmarshals the `other` field (255) of a protocol buffer, which
+// holds any legacy JSON keys without a field of their own, into target.
+func applyOther(target interface{}, msg protoMessage) error {
+	other := msg.bytes(255)
+	if len(other) == 0 {
+		return nil
+	}
+	return json.Unmarshal(other, target)
+}
@@ -0,0 +1,217 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"archive/zip"
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// splitSchema is the subset of the schema 18 tables which replace the JSON
+// columns of the `col` table.
+const splitSchema = `
+CREATE TABLE config (KEY text NOT NULL PRIMARY KEY, usn integer NOT NULL, mtime_secs integer NOT NULL, val blob NOT NULL) without rowid;
+CREATE TABLE deck_config (id integer PRIMARY KEY NOT NULL, name text NOT NULL COLLATE unicase, mtime_secs integer NOT NULL, usn integer NOT NULL, config blob NOT NULL);
+CREATE TABLE decks (id integer PRIMARY KEY NOT NULL, name text NOT NULL COLLATE unicase, mtime_secs integer NOT NULL, usn integer NOT NULL, common blob NOT NULL, kind blob NOT NULL);
+CREATE UNIQUE INDEX idx_decks_name ON decks (name);
+CREATE TABLE notetypes (id integer NOT NULL PRIMARY KEY, name text NOT NULL COLLATE unicase, mtime_secs integer NOT NULL, usn integer NOT NULL, config blob NOT NULL);
+CREATE TABLE fields (ntid integer NOT NULL, ord integer NOT NULL, name text NOT NULL COLLATE unicase, config blob NOT NULL, PRIMARY KEY (ntid, ord)) without rowid;
+CREATE TABLE templates (ntid integer NOT NULL, ord integer NOT NULL, name text NOT NULL COLLATE unicase, mtime_secs integer NOT NULL, usn integer NOT NULL, config blob NOT NULL, PRIMARY KEY (ntid, ord)) without rowid;
+CREATE TABLE tags (tag text NOT NULL PRIMARY KEY COLLATE unicase, usn integer NOT NULL, collapsed boolean NOT NULL, config blob NULL) without rowid;
+`
+
+// proto builds a protocol buffer message for tests.
+type proto []byte
+
+func (p proto) varint(field protowire.Number, v uint64) proto {
+	return protowire.AppendVarint(protowire.AppendTag(p, field, protowire.VarintType), v)
+}
+
+func (p proto) float(field protowire.Number, f float32) proto {
+	return protowire.AppendFixed32(protowire.AppendTag(p, field, protowire.Fixed32Type), math.Float32bits(f))
+}
+
+func (p proto) bytes(field protowire.Number, b []byte) proto {
+	return protowire.AppendBytes(protowire.AppendTag(p, field, protowire.BytesType), b)
+}
+
+func (p proto) floats(field protowire.Number, fs ...float32) proto {
+	var packed []byte
+	for _, f := range fs {
+		packed = protowire.AppendFixed32(packed, math.Float32bits(f))
+	}
+	return p.bytes(field, packed)
+}
+
+// splitSchemaPackage returns a package whose collection.anki21 uses the
+// split tables of schema 18.
+func splitSchemaPackage(t *testing.T) []byte {
+	db, err := newDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	notetype := proto{}.
+		varint(2, 1).
+		bytes(3, []byte(".card {}")).
+		bytes(8, proto{}.varint(1, 0).varint(2, 2).bytes(3, []byte{0, 1})).
+		bytes(255, []byte(`{"tags":["x"]}`))
+	normal := proto{}.varint(1, 1).varint(2, 5).bytes(4, []byte("Default deck"))
+	dconf := proto{}.
+		floats(1, 1, 10).
+		floats(2, 10).
+		varint(9, 20).
+		varint(10, 200).
+		float(11, 2.5).
+		float(12, 1.3).
+		float(13, 1.2).
+		float(15, 1).
+		varint(16, 36500).
+		varint(17, 1).
+		varint(18, 1).
+		varint(19, 4).
+		varint(21, 1).
+		varint(22, 8).
+		varint(24, 60).
+		varint(25, 1).
+		varint(27, 1).
+		varint(40, 7) // Not represented by DeckConfig
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{query: schema},
+		{query: splitSchema},
+		{query: "INSERT INTO col VALUES (1, 1500000000, 0, 0, 18, 0, 0, 0, '', '', '', '', '')"},
+		{query: "INSERT INTO config VALUES ('collapseTime', 0, 0, CAST('1200' AS blob)), ('curDeck', 0, 0, CAST('1' AS blob))"},
+		{query: "INSERT INTO tags VALUES ('x', 3, 0, NULL)"},
+		{query: "INSERT INTO notetypes VALUES (1000, 'Basic', 1600000000, 2, ?)", args: []interface{}{[]byte(notetype)}},
+		{query: "INSERT INTO fields VALUES (1000, 1, 'Back', ?)", args: []interface{}{[]byte(proto{}.bytes(3, []byte("Arial")).varint(4, 20))}},
+		{query: "INSERT INTO fields VALUES (1000, 0, 'Front', ?)", args: []interface{}{[]byte(proto{}.varint(1, 1))}},
+		{query: "INSERT INTO templates VALUES (1000, 0, 'Card 1', 0, 0, ?)", args: []interface{}{[]byte(proto{}.bytes(1, []byte("{{Front}}")).bytes(2, []byte("{{Back}}")).varint(5, 2))}},
+		{query: "INSERT INTO decks VALUES (1, 'Default', 0, 0, ?, ?)", args: []interface{}{[]byte(proto{}.varint(1, 1).varint(3, 10).varint(4, 3)), []byte(proto{}.bytes(1, normal))}},
+		{query: "INSERT INTO decks VALUES (2, 'Lang\x1fFrench', 0, 0, '', ?)", args: []interface{}{[]byte(proto{}.bytes(1, proto{}.varint(1, 2)))}},
+		{query: "INSERT INTO decks VALUES (3, 'Filtered', 0, 0, '', ?)", args: []interface{}{[]byte(proto{}.bytes(2, nil))}},
+		{query: "INSERT INTO deck_config VALUES (1, 'Default', 1600000000, 0, ?)", args: []interface{}{[]byte(dconf)}},
+		{query: "INSERT INTO deck_config VALUES (2, 'Legacy', 0, 0, ?)", args: []interface{}{[]byte(`{"id":2,"name":"Legacy","new":{"perDay":5}}`)}},
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt.query, stmt.args...); err != nil {
+			t.Fatalf("%s: %s", stmt.query, err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	// An empty stub for older clients, which must be ignored.
+	if _, err := z.Create("collection.anki2"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := z.Create("collection.anki21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.dump(f); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = z.Create("media"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSplitSchema(t *testing.T) {
+	apkg, err := ReadBytes(splitSchemaPackage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if collection.Version != 18 || collection.Config.CollapseTime != 1200 || collection.Config.CurrentDeck != 1 {
+		t.Errorf("Unexpected collection: %+v", collection)
+	}
+	if collection.Tags != `{"x":3}` {
+		t.Errorf("Unexpected tags: %s", collection.Tags)
+	}
+
+	model, ok := collection.Models[1000]
+	if !ok {
+		t.Fatalf("Note type not found")
+	}
+	if model.Name != "Basic" || model.SortField != 1 || model.CSS != ".card {}" || model.UpdateSequence != 2 ||
+		time.Time(*model.Modified).Unix() != 1600000000 || !reflect.DeepEqual(model.Tags, []string{"x"}) {
+		t.Errorf("Unexpected note type: %+v", model)
+	}
+	expectedFields := []*Field{
+		{Name: "Front", Ordinal: 0, Sticky: true},
+		{Name: "Back", Ordinal: 1, Font: "Arial", FontSize: 20},
+	}
+	if !reflect.DeepEqual(model.Fields, expectedFields) {
+		t.Errorf("Unexpected fields: %+v, %+v", model.Fields[0], model.Fields[1])
+	}
+	expectedTemplates := []*Template{{Name: "Card 1", QuestionFormat: "{{Front}}", AnswerFormat: "{{Back}}", DeckOverride: 2}}
+	if !reflect.DeepEqual(model.Templates, expectedTemplates) {
+		t.Errorf("Unexpected templates: %+v", model.Templates[0])
+	}
+	expectedReqs := []*CardConstraint{{Index: 0, MatchType: "all", Fields: []int{0, 1}}}
+	if !reflect.DeepEqual(model.RequiredFields, expectedReqs) {
+		t.Errorf("Unexpected requirements: %+v", model.RequiredFields[0])
+	}
+
+	deck := collection.Decks[1]
+	if deck.Name != "Default" || !deck.Collapsed || deck.Description != "Default deck" || deck.ExtendedNewCardLimit != 5 ||
+		deck.NewToday != [2]int{10, 3} || deck.Config == nil || deck.Config.ID != 1 {
+		t.Errorf("Unexpected deck: %+v", deck)
+	}
+	if deck := collection.Decks[2]; deck.Name != "Lang::French" || deck.Config.Name != "Legacy" || deck.Config.New.PerDay != 5 {
+		t.Errorf("Unexpected deck: %+v", deck)
+	}
+	if deck := collection.Decks[3]; !deck.Dynamic || deck.Config != nil {
+		t.Errorf("Unexpected filtered deck: %+v", deck)
+	}
+
+	dc := collection.DeckConfigs[1]
+	expectedDelays := []DurationMinutes{DurationMinutes(time.Minute), DurationMinutes(10 * time.Minute)}
+	if !reflect.DeepEqual(dc.New.Delays, expectedDelays) || len(dc.Lapses.Delays) != 1 {
+		t.Errorf("Unexpected steps: %v, %v", dc.New.Delays, dc.Lapses.Delays)
+	}
+	if dc.New.PerDay != 20 || dc.Reviews.PerDay != 200 || dc.New.InitialFactor != 2500 ||
+		dc.Reviews.EasyBonus != 1.3 || dc.Reviews.HardFactor != 1.2 || dc.Reviews.IntervalModifier != 1 ||
+		dc.Reviews.MaxInterval != 36500 || dc.Lapses.MinimumInterval != 1 || dc.New.Intervals != [3]DurationDays{1, 4, 0} ||
+		dc.New.Order != NewCardOrderOrderAdded || dc.Lapses.LeechAction != LeechActoinTagOnly || dc.Lapses.LeechFails != 8 ||
+		!dc.AutoPlay || !dc.ReplayAudio || dc.MaxAnswerSeconds != 60 || !bool(dc.ShowTimer) || !dc.New.Bury || dc.Reviews.Bury {
+		t.Errorf("Unexpected deck config: %+v", dc)
+	}
+}
+
+func TestDecodeProto(t *testing.T) {
+	msg, err := decodeProto(proto{}.varint(1, 1).varint(1, 2).varint(2, 5).varint(2, 6).bytes(2, []byte{7, 8}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.uint(1) != 2 {
+		t.Errorf("Expected the last value to win, got %d", msg.uint(1))
+	}
+	if values, _ := msg.uints(2); !reflect.DeepEqual(values, []uint64{5, 6, 7, 8}) {
+		t.Errorf("Unexpected repeated values: %v", values)
+	}
+	if _, err := decodeProto([]byte{0x0a, 0x05}); err == nil {
+		t.Errorf("Expected an error for a truncated message")
+	}
+}
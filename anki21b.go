@@ -0,0 +1,249 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Packages exported by Anki 2.1.50 and later contain a `meta` file, holding a
+// PackageMetadata protocol buffer, which records the version of the package
+// format. Packages of the latest version contain a zstd-compressed
+// collection.anki21b database, and a zstd-compressed protocol buffer in place
+// of the JSON `media` file. Their media files are also zstd-compressed.
+const (
+	packageVersionLegacy1 = 1 // collection.anki2
+	packageVersionLegacy2 = 2 // collection.anki21
+	packageVersionLatest  = 3 // collection.anki21b
+)
+
+// packageVersion returns the version of the package format, from the `meta`
+// file. Packages without one are of a legacy version.
+func (zi *zipIndex) packageVersion() (int, error) {
+	if _, ok := zi.index["meta"]; !ok {
+		return packageVersionLegacy1, nil
+	}
+	meta, err := zi.ReadFile("meta")
+	if err != nil {
+		return 0, err
+	}
+	msg, err := decodeProto(meta)
+	if err != nil {
+		return 0, err
+	}
+	return int(msg.uint(1)), nil
+}
+
+// decodeMediaMap decodes the `media` file, returning a map of the names of
+// the files in the archive to the names of the media files they contain.
+func decodeMediaMap(media []byte, version int) (map[string]string, error) {
+	mediaMap := make(map[string]string)
+	if version < packageVersionLatest {
+		if err := json.Unmarshal(media, &mediaMap); err != nil {
+			return nil, err
+		}
+		return mediaMap, nil
+	}
+	media, err := decompress(media)
+	if err != nil {
+		return nil, err
+	}
+	// The MediaEntries message holds a MediaEntry for each file, which is
+	// stored in the archive under its index in the list, unless it has a
+	// legacy_zip_filename.
+	msg, err := decodeProto(media)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := msg.messages(1)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		idx := strconv.Itoa(i)
+		if entry.has(255) {
+			idx = strconv.FormatUint(entry.uint(255), 10)
+		}
+		mediaMap[idx] = entry.string(1)
+	}
+	return mediaMap, nil
+}
+
+// decompress decompresses zstd-compressed data.
+func decompress(data []byte) ([]byte, error) {
+	d, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.DecodeAll(data, nil)
+}
+
+// zstdReader decompresses a zstd-compressed stream as it is read.
+type zstdReader struct {
+	*zstd.Decoder
+	rc io.ReadCloser
+}
+
+func newZstdReader(rc io.ReadCloser) (*zstdReader, error) {
+	d, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	return &zstdReader{Decoder: d, rc: rc}, nil
+}
+
+// Close closes the decoder and the underlying stream.
+func (z *zstdReader) Close() error {
+	z.Decoder.Close()
+	return z.rc.Close()
+}
+
+// decompressedSize returns the size of a zstd-compressed file once it is
+// decompressed. The size is read from the frame header if it is recorded
+// there, and otherwise the file is decompressed to find it.
+func decompressedSize(f *zip.File) (int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, zstd.HeaderMaxSize)
+	n, err := io.ReadFull(rc, header)
+	_ = rc.Close()
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	var h zstd.Header
+	if err := h.Decode(header[:n]); err == nil && h.HasFCS {
+		return int64(h.FrameContentSize), nil
+	}
+	rc, err = f.Open()
+	if err != nil {
+		return 0, err
+	}
+	z, err := newZstdReader(rc)
+	if err != nil {
+		return 0, err
+	}
+	defer z.Close()
+	return io.Copy(ioutil.Discard, z)
+}
+
+// compress compresses data with zstd.
+func compress(data []byte) ([]byte, error) {
+	e, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+	return e.EncodeAll(data, nil), nil
+}
+
+// writeMedia writes the media files added to the package to z, followed by a
+// `media` file listing them along with the package's existing media files.
+func (a *Apkg) writeMedia(z *zip.Writer) error {
+	var manifest []byte
+	used := make(map[string]bool)
+	for _, file := range a.reader.File {
+		used[file.Name] = true
+		if file.Name != "media" {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		manifest, err = ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// Files are stored in the archive under the first unused number.
+	next := 0
+	nextName := func() string {
+		for used[strconv.Itoa(next)] {
+			next++
+		}
+		used[strconv.Itoa(next)] = true
+		return strconv.Itoa(next)
+	}
+	write := func(name string, method uint16, data []byte) error {
+		f, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	if a.version < packageVersionLatest {
+		mediaMap := make(map[string]string)
+		if len(manifest) > 0 {
+			if err := json.Unmarshal(manifest, &mediaMap); err != nil {
+				return err
+			}
+		}
+		for _, file := range a.added {
+			idx := nextName()
+			mediaMap[idx] = file.name
+			if err := write(idx, zip.Deflate, file.data); err != nil {
+				return err
+			}
+		}
+		blob, err := json.Marshal(mediaMap)
+		if err != nil {
+			return err
+		}
+		return write("media", zip.Deflate, blob)
+	}
+
+	data, err := decompress(manifest)
+	if err != nil {
+		return err
+	}
+	msg, err := decodeProto(data)
+	if err != nil {
+		return err
+	}
+	next = len(msg[1])
+	for _, file := range a.added {
+		entry := make(protoMessage)
+		entry.setString(1, file.name)
+		entry.setUint(2, uint64(len(file.data)))
+		sum := sha1.Sum(file.data)
+		entry.setBytes(3, sum[:])
+		// A file is stored under its index in the list, unless that name is
+		// taken, in which case its legacy_zip_filename is set.
+		idx := strconv.Itoa(len(msg[1]))
+		if used[idx] {
+			idx = nextName()
+			n, _ := strconv.ParseUint(idx, 10, 64)
+			entry.setUint(255, n)
+		}
+		used[idx] = true
+		msg[1] = append(msg[1], protoValue{typ: protowire.BytesType, bytes: entry.encode()})
+		compressed, err := compress(file.data)
+		if err != nil {
+			return err
+		}
+		if err := write(idx, zip.Store, compressed); err != nil {
+			return err
+		}
+	}
+	compressed, err := compress(msg.encode())
+	if err != nil {
+		return err
+	}
+	return write("media", zip.Store, compressed)
+}
@@ -0,0 +1,120 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// latestPackage converts the test package to the latest package format, as
+// exported by Anki 2.1.50 and later.
+func latestPackage(t *testing.T) []byte {
+	src, err := zip.OpenReader(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	files := make(map[string][]byte)
+	for _, file := range src.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name], err = ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mediaMap := make(map[string]string)
+	if err := json.Unmarshal(files["media"], &mediaMap); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	compressed := map[string][]byte{
+		"meta":               proto{}.varint(1, packageVersionLatest),
+		"collection.anki2":   []byte("stub"),
+		"collection.anki21b": enc.EncodeAll(files["collection.anki2"], nil),
+	}
+	entries := proto{}
+	for i := 0; i < len(mediaMap); i++ {
+		idx := strconv.Itoa(i)
+		data := files[idx]
+		entry := proto{}.bytes(1, []byte(mediaMap[idx])).varint(2, uint64(len(data)))
+		entries = entries.bytes(1, entry)
+		compressed[idx] = enc.EncodeAll(data, nil)
+	}
+	compressed["media"] = enc.EncodeAll(entries, nil)
+
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	for name, data := range compressed {
+		f, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadLatestPackage(t *testing.T) {
+	legacy, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	apkg, err := ReadBytes(latestPackage(t))
+	if err != nil {
+		t.Fatalf("Error opening package: %s", err)
+	}
+	defer apkg.Close()
+
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	if collection.Config.CollapseTime != 1200 {
+		t.Errorf("Spot-check failed")
+	}
+
+	expected, files := legacy.ListFiles(), apkg.ListFiles()
+	sort.Strings(expected)
+	sort.Strings(files)
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Expected files %v, got %v", expected, files)
+	}
+	for _, name := range files {
+		want, err := legacy.ReadMediaFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := apkg.ReadMediaFile(name)
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content differs", name)
+		}
+	}
+}
@@ -4,27 +4,29 @@
 package anki
 
 import (
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 // Collection is an Anki Collection, stored in the `col` table.
 type Collection struct {
-	ID             ID                     `db:"id"`     // Primary key; should always be 1, as there's only ever one collection per *.apkg file
-	Created        *TimestampSeconds      `db:"crt"`    // Created timestamp (seconds)
-	Modified       *TimestampMilliseconds `db:"mod"`    // Last modified timestamp (milliseconds)
-	SchemaModified *TimestampMilliseconds `db:"scm"`    // Schema modification time (milliseconds)
-	Version        int                    `db:"ver"`    // Version?
-	Dirty          BoolInt                `db:"dty"`    // Dirty? No longer used. See https://github.com/dae/anki/blob/master/anki/collection.py#L90
-	UpdateSequence int                    `db:"usn"`    // update sequence number. used to figure out diffs when syncing
-	LastSync       *TimestampMilliseconds `db:"ls"`     // Last sync time (milliseconds)
-	Config         Config                 `db:"conf"`   // JSON blob containing configuration options
-	Models         Models                 `db:"models"` // JSON array of json objects containing the models (aka Note types)
-	Decks          Decks                  `db:"decks"`  // JSON array of json objects containing decks
-	DeckConfigs    DeckConfigs            `db:"dconf"`  // JSON blob containing deck configuration options
-	Tags           string                 `db:"tags"`   // a cache of tags used in the collection
+	ID             ID                     `db:"id" json:"id"`         // Primary key; should always be 1, as there's only ever one collection per *.apkg file
+	Created        *TimestampSeconds      `db:"crt" json:"crt"`       // Created timestamp (seconds)
+	Modified       *TimestampMilliseconds `db:"mod" json:"mod"`       // Last modified timestamp (milliseconds)
+	SchemaModified *TimestampMilliseconds `db:"scm" json:"scm"`       // Schema modification time (milliseconds)
+	Version        int                    `db:"ver" json:"ver"`       // Version?
+	Dirty          BoolInt                `db:"dty" json:"dty"`       // Dirty? No longer used. See https://github.com/dae/anki/blob/master/anki/collection.py#L90
+	UpdateSequence int                    `db:"usn" json:"usn"`       // update sequence number. used to figure out diffs when syncing
+	LastSync       *TimestampMilliseconds `db:"ls" json:"ls"`         // Last sync time (milliseconds)
+	Config         Config                 `db:"conf" json:"conf"`     // JSON blob containing configuration options
+	Models         Models                 `db:"models" json:"models"` // JSON array of json objects containing the models (aka Note types)
+	Decks          Decks                  `db:"decks" json:"decks"`   // JSON array of json objects containing decks
+	DeckConfigs    DeckConfigs            `db:"dconf" json:"dconf"`   // JSON blob containing deck configuration options
+	Tags           string                 `db:"tags" json:"tags"`     // a cache of tags used in the collection
 }
 
 // Config represents basic global configuration for the Anki client.
@@ -33,7 +35,7 @@ type Config struct {
 	EstimateTimes bool            `json:"estTimes"`
 	ActiveDecks   []ID            `json:"activeDecks"` // Array of active decks(?)
 	SortType      string          `json:"sortType"`
-	TimeLimit     DurationSeconds `json:"timeLimit"`
+	TimeLimit     DurationSeconds `json:"timeLim"`
 	SortBackwards BoolInt         `json:"sortBackwards"`
 	AddToCurrent  bool            `json:"addToCur"` // Add new cards to current deck(?)
 	CurrentDeck   ID              `json:"curDeck"`
@@ -62,6 +64,34 @@ func (c *Config) Scan(src interface{}) error {
 	return scanJSON(src, c)
 }
 
+// MarshalJSON implements the json.Marshaler interface for the Config type.
+func (c Config) MarshalJSON() ([]byte, error) {
+	type config Config
+	if c.ActiveDecks == nil {
+		c.ActiveDecks = []ID{}
+	}
+	// Anki stores sortBackwards as a boolean, rather than as 0 or 1.
+	return json.Marshal(struct {
+		config
+		SortBackwards bool `json:"sortBackwards"`
+	}{config(c), bool(c.SortBackwards)})
+}
+
+// Value implements the driver.Valuer interface for the Config type.
+func (c Config) Value() (driver.Value, error) {
+	return valueJSON(c)
+}
+
+// valueJSON returns the JSON encoding of v, as a string, for storage in a
+// JSON column.
+func valueJSON(v interface{}) (driver.Value, error) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(blob), nil
+}
+
 // Models is a collection of Models (aka note types), stored as JSON in the `models`
 // column of the `col` table.
 type Models map[ID]*Model
@@ -85,9 +115,22 @@ func (m *Models) UnmarshalJSON(src []byte) error {
 	return nil
 }
 
+// MarshalJSON implements the json.Marshaler interface for the Models type.
+// Models are keyed by their IDs, as strings.
+func (m Models) MarshalJSON() ([]byte, error) {
+	tmp := make(map[string]*Model, len(m))
+	for id, v := range m {
+		tmp[strconv.FormatInt(int64(id), 10)] = v
+	}
+	return json.Marshal(tmp)
+}
+
+// Value implements the driver.Valuer interface for the Models type.
+func (m Models) Value() (driver.Value, error) {
+	return valueJSON(m)
+}
+
 // Model (aka Note Type)
-//
-// Excluded from this definition is the `vers` field, which is no longer used by Anki.
 type Model struct {
 	ID             ID                `json:"id"`    // Model ID
 	Name           string            `json:"name"`  // Model name
@@ -103,6 +146,29 @@ type Model struct {
 	Modified       *TimestampSeconds `json:"mod"`       // Modification time in seconds
 	RequiredFields []*CardConstraint `json:"req"`       // Array of card constraints describing which fields are required for each card to be generated
 	UpdateSequence int               `json:"usn"`       // Update sequence number: used in same way as other usn vales in db
+	Versions       []interface{}     `json:"vers"`      // Legacy version list, no longer used by Anki
+}
+
+// MarshalJSON implements the json.Marshaler interface for the Model type.
+// Lists which are not set are stored as empty lists, as Anki expects.
+func (m Model) MarshalJSON() ([]byte, error) {
+	type model Model
+	if m.Tags == nil {
+		m.Tags = []string{}
+	}
+	if m.Fields == nil {
+		m.Fields = []*Field{}
+	}
+	if m.Templates == nil {
+		m.Templates = []*Template{}
+	}
+	if m.RequiredFields == nil {
+		m.RequiredFields = []*CardConstraint{}
+	}
+	if m.Versions == nil {
+		m.Versions = []interface{}{}
+	}
+	return json.Marshal(model(m))
 }
 
 // Returns the model's creation timestamp (based on its ID)
@@ -123,15 +189,23 @@ const (
 )
 
 // A field of a model
-//
-// Excluded from this definition is the `media` field, which appears to no longer be used.
 type Field struct {
-	Name     string `json:"name"`   // Field name
-	Sticky   bool   `json:"sticky"` // Sticky fields retain the value that was last added when adding new notes
-	RTL      bool   `json:"rtl"`    // boolean to indicate if this field uses Right-to-Left script
-	Ordinal  int    `json:"ord"`    // Ordinal of the field. Goes from 0 to num fields -1.
-	Font     string `json:"font"`   // Display font
-	FontSize int    `json:"size"`   // Font size
+	Name     string   `json:"name"`   // Field name
+	Sticky   bool     `json:"sticky"` // Sticky fields retain the value that was last added when adding new notes
+	RTL      bool     `json:"rtl"`    // boolean to indicate if this field uses Right-to-Left script
+	Ordinal  int      `json:"ord"`    // Ordinal of the field. Goes from 0 to num fields -1.
+	Font     string   `json:"font"`   // Display font
+	FontSize int      `json:"size"`   // Font size
+	Media    []string `json:"media"`  // Appears to no longer be used
+}
+
+// MarshalJSON implements the json.Marshaler interface for the Field type.
+func (f Field) MarshalJSON() ([]byte, error) {
+	type field Field
+	if f.Media == nil {
+		f.Media = []string{}
+	}
+	return json.Marshal(field(f))
 }
 
 // A card constraint defines which fields are necessary for a particular card
@@ -160,6 +234,21 @@ func (c *CardConstraint) UnmarshalJSON(src []byte) error {
 	return nil
 }
 
+// MarshalJSON implements the json.Marshaler interface for the CardConstraint
+// type.
+func (c CardConstraint) MarshalJSON() ([]byte, error) {
+	fields := c.Fields
+	if fields == nil {
+		fields = []int{}
+	}
+	return json.Marshal([]interface{}{c.Index, c.MatchType, fields})
+}
+
+// Value implements the driver.Valuer interface for the CardConstraint type.
+func (c CardConstraint) Value() (driver.Value, error) {
+	return valueJSON(c)
+}
+
 // A Template definition. A template definition represents a single card type,
 // and is stored as part of a Model.
 type Template struct {
@@ -172,6 +261,20 @@ type Template struct {
 	DeckOverride          ID     `json:"did"`   // Deck override (null by default) (??)
 }
 
+// MarshalJSON implements the json.Marshaler interface for the Template type.
+// A template without a deck override stores null.
+func (t Template) MarshalJSON() ([]byte, error) {
+	type template Template
+	var did *ID
+	if t.DeckOverride != 0 {
+		did = &t.DeckOverride
+	}
+	return json.Marshal(struct {
+		template
+		DeckOverride *ID `json:"did"`
+	}{template(t), did})
+}
+
 // A collection of Decks
 type Decks map[ID]*Deck
 
@@ -194,23 +297,38 @@ func (d *Decks) UnmarshalJSON(src []byte) error {
 	return nil
 }
 
+// MarshalJSON implements the json.Marshaler interface for the Decks type.
+// Decks are keyed by their IDs, as strings.
+func (d Decks) MarshalJSON() ([]byte, error) {
+	tmp := make(map[string]*Deck, len(d))
+	for id, v := range d {
+		tmp[strconv.FormatInt(int64(id), 10)] = v
+	}
+	return json.Marshal(tmp)
+}
+
+// Value implements the driver.Valuer interface for the Decks type.
+func (d Decks) Value() (driver.Value, error) {
+	return valueJSON(d)
+}
+
 // A Deck definition
 type Deck struct {
-	ID                      ID                `json:"id"`               // Deck ID
-	Name                    string            `json:"name"`             // Deck name
-	Description             string            `json:"desc"`             // Deck description
-	Modified                *TimestampSeconds `json:"mod"`              // Last modification time in seconds
-	UpdateSequence          int               `json:"usn"`              // Update sequence number. Used in the same way as the other USN values
-	Collapsed               bool              `json:"collapsed"`        // True when the deck is collapsed
-	BrowserCollapsed        bool              `json:"browserCollapsed"` // True when the deck is collapsed in the browser
-	ExtendedNewCardLimit    int               `json:"extendedNew"`      // Extended new card limit for custom study
-	ExtendedReviewCardLimit int               `json:"extendedRev"`      // Extended review card limit for custom study
-	Dynamic                 BoolInt           `json:"dyn"`              // True for a dynamic (aka filtered) deck
-	ConfigID                ID                `json:"conf"`             // ID of option group from dconf in `col` table
-	NewToday                [2]int            `json:"newToday"`         // two number array used somehow for custom study
-	ReviewsToday            [2]int            `json:"revToday"`         // two number array used somehow for custom study
-	LearnToday              [2]int            `json:"lrnToday"`         // two number array used somehow for custom study
-	TimeToday               [2]int            `json:"timeToday"`        // two number array used somehow for custom study (in ms)
+	ID                      ID                `json:"id"`                         // Deck ID
+	Name                    string            `json:"name"`                       // Deck name
+	Description             string            `json:"desc"`                       // Deck description
+	Modified                *TimestampSeconds `json:"mod"`                        // Last modification time in seconds
+	UpdateSequence          int               `json:"usn"`                        // Update sequence number. Used in the same way as the other USN values
+	Collapsed               bool              `json:"collapsed"`                  // True when the deck is collapsed
+	BrowserCollapsed        bool              `json:"browserCollapsed,omitempty"` // True when the deck is collapsed in the browser
+	ExtendedNewCardLimit    int               `json:"extendNew"`                  // Extended new card limit for custom study
+	ExtendedReviewCardLimit int               `json:"extendRev"`                  // Extended review card limit for custom study
+	Dynamic                 BoolInt           `json:"dyn"`                        // True for a dynamic (aka filtered) deck
+	ConfigID                ID                `json:"conf"`                       // ID of option group from dconf in `col` table
+	NewToday                [2]int            `json:"newToday"`                   // two number array used somehow for custom study
+	ReviewsToday            [2]int            `json:"revToday"`                   // two number array used somehow for custom study
+	LearnToday              [2]int            `json:"lrnToday"`                   // two number array used somehow for custom study
+	TimeToday               [2]int            `json:"timeToday"`                  // two number array used somehow for custom study (in ms)
 	Config                  *DeckConfig       `json:"-"`
 }
 
@@ -244,9 +362,22 @@ func (dc *DeckConfigs) UnmarshalJSON(src []byte) error {
 	return nil
 }
 
+// MarshalJSON implements the json.Marshaler interface for the DeckConfigs
+// type. Configurations are keyed by their IDs, as strings.
+func (dc DeckConfigs) MarshalJSON() ([]byte, error) {
+	tmp := make(map[string]*DeckConfig, len(dc))
+	for id, v := range dc {
+		tmp[strconv.FormatInt(int64(id), 10)] = v
+	}
+	return json.Marshal(tmp)
+}
+
+// Value implements the driver.Valuer interface for the DeckConfigs type.
+func (dc DeckConfigs) Value() (driver.Value, error) {
+	return valueJSON(dc)
+}
+
 // Per-Deck configuration options.
-//
-// Excluded from this definition is the `minSpace` field from Reviews, as it is no longer used.
 type DeckConfig struct {
 	ID               ID                `json:"id"`       // Deck ID
 	Name             string            `json:"name"`     // Deck Name
@@ -254,6 +385,7 @@ type DeckConfig struct {
 	ShowTimer        BoolInt           `json:"timer"`    // Show answer timer
 	MaxAnswerSeconds int               `json:"maxTaken"` // Ignore answers that take longer than this many seconds
 	Modified         *TimestampSeconds `json:"mod"`      // Modified timestamp
+	UpdateSequence   int               `json:"usn"`      // Update sequence number
 	AutoPlay         bool              `json:"autoplay"` // Automatically play audio
 	Lapses           struct {
 		LeechFails      int               `json:"leechFails"`  // Leech threshold
@@ -263,12 +395,14 @@ type DeckConfig struct {
 		NewInterval     float32           `json:"mult"`        // New Interval Multiplier
 	} `json:"lapse"`
 	Reviews struct {
-		PerDay           int          `json:"perDay"` // Maximum reviews per day
-		Fuzz             float32      `json:"fuzz"`   // Apparently not used?
-		IntervalModifier float32      `json:"ivlFct"` // Interval modifier (fraction)
-		MaxInterval      DurationDays `json:"maxIvl"` // Maximum interval in days
-		EasyBonus        float32      `json:"ease4"`  // Easy bonus
-		Bury             bool         `json:"bury"`   // Bury related reviews until next day
+		PerDay           int          `json:"perDay"`               // Maximum reviews per day
+		Fuzz             float32      `json:"fuzz"`                 // Apparently not used?
+		IntervalModifier float32      `json:"ivlFct"`               // Interval modifier (fraction)
+		MaxInterval      DurationDays `json:"maxIvl"`               // Maximum interval in days
+		EasyBonus        float32      `json:"ease4"`                // Easy bonus
+		HardFactor       float32      `json:"hardFactor,omitempty"` // Hard interval multiplier, used by the v2 scheduler
+		Bury             bool         `json:"bury"`                 // Bury related reviews until next day
+		MinSpace         int          `json:"minSpace"`             // Minimum spacing between siblings; no longer used
 	} `json:"rev"`
 	New struct {
 		PerDay        int               `json:"perDay"`        // Maximum new cards per day
@@ -293,8 +427,8 @@ const (
 type NewCardOrder int
 
 const (
-	NewCardOrderOrderAdded NewCardOrder = iota
-	NewCardOrderRandomOrder
+	NewCardOrderRandomOrder NewCardOrder = iota
+	NewCardOrderOrderAdded
 )
 
 // Note definition
@@ -333,12 +467,27 @@ func (t *Tags) Scan(src interface{}) error {
 	default:
 		return errors.New("Incompatible type for Tags")
 	}
-	tags := Tags(strings.Split(tmp, " "))
+	tags := Tags(strings.Fields(tmp))
 	sort.Strings(tags)
 	*t = tags
 	return nil
 }
 
+// MarshalJSON implements the json.Marshaler interface for the Tags type.
+func (t Tags) MarshalJSON() ([]byte, error) {
+	if t == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]string(t))
+}
+
+// Value implements the driver.Valuer interface for the Tags type, returning
+// the tags space-separated and padded, as Anki stores them.
+func (t Tags) Value() (driver.Value, error) {
+	return joinTags(t), nil
+}
+
+// FieldValues holds the values of a note's fields, in order.
 type FieldValues []string
 
 // Scan implements the sql.Scanner interface for the FieldValues type.
@@ -356,19 +505,37 @@ func (fv *FieldValues) Scan(src interface{}) error {
 	return nil
 }
 
+// MarshalJSON implements the json.Marshaler interface for the FieldValues
+// type.
+func (fv FieldValues) MarshalJSON() ([]byte, error) {
+	if fv == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]string(fv))
+}
+
+// Value implements the driver.Valuer interface for the FieldValues type,
+// returning the values separated by the 0x1f character, as Anki stores them.
+func (fv FieldValues) Value() (driver.Value, error) {
+	return strings.Join(fv, "\x1f"), nil
+}
+
 // Card definition
 //
-// This definition excludes the `flags` and `data` fields, which are no longer
-// used. Additionally, this definition modifies the original senses of `due`,
+// This definition excludes the `data` field, which is no longer used.
+// Additionally, this definition modifies the original senses of `due`,
 // `odue`, and `ivl` by converting them to a consistent representation.
 // `Specifically
 //
 // `due` and `odue` are stored in one of three states:
-//  - For card queue 0 (new), the due time is ignored. Here we convert it to 0.
-//  - For card queue 1 (learning), the due time is stored as seconds since epoch.
-//    We leave this as-is.
-//  - For card queue 2 (due), the due time is stored as days since the collection
-//    was created. We convert this to seconds since epoch.
+//   - For card queue 0 (new), the due time is ignored. Here we convert it to 0.
+//     The card's position in the new card queue is stored in Position instead.
+//   - For card queue 1 (learning), the due time is stored as seconds since epoch.
+//     We leave this as-is.
+//   - For card queue 2 (due), the due time is stored as days since the collection
+//     was created. We convert this to seconds since epoch.
+//   - For card queue 3 (day learn), the due time is also stored as days since
+//     the collection was created, and is likewise converted.
 //
 // `ivl` is stored either as negative seconds, or as positive days. We convert
 // both to positive seconds.
@@ -382,13 +549,15 @@ type Card struct {
 	Type           CardType          `db:"type"`   // Card type: new, learning, due
 	Queue          CardQueue         `db:"queue"`  // Queue: suspended, user buried, sched buried
 	Due            *TimestampSeconds `db:"due"`    // Time when the card is next due
+	Position       int               `db:"pos"`    // Position in the new card queue. Only used for new cards.
 	Interval       *DurationSeconds  `db:"ivl"`    // SRS interval in seconds
 	Factor         float32           `db:"factor"` // SRS factor
 	ReviewCount    int               `db:"reps"`   // Number of reviews
 	Lapses         int               `db:"lapses"` // Number of times card went from "answered correctly" to "answered incorrectly" state
 	Left           int               `db:"left"`   // Reviews remaining until graduation
-	OriginalDue    *TimestampSeconds `db:"odue"`   // Original due time. Only used when card is in filtered deck.
+	OriginalDue    *TimestampSeconds `db:"odue"`   // Original due time. Only used when card is in filtered deck; nil if none.
 	OriginalDeckID ID                `db:"odid"`   // Original Deck ID. Only used when card is in filtered deck.
+	Flags          int               `db:"flags"`  // Flags set by the user. The lowest 3 bits hold the flag color (1-7), or 0 for none.
 }
 
 // Returns the cards's creation timestamp (based on its ID)
@@ -404,6 +573,7 @@ const (
 	CardTypeNew CardType = iota
 	CardTypeLearning
 	CardTypeReview
+	CardTypeRelearning // Used by the v2 scheduler for cards which have lapsed
 )
 
 type CardQueue int
@@ -419,7 +589,7 @@ const (
 	CardQueueNew         CardQueue = 0  // New/Cram
 	CardQueueLearning    CardQueue = 1  // Learning
 	CardQueueReview      CardQueue = 2  // Review
-	CardQueueRelearning  CardQueue = 3  // Day Learn (Relearn?)
+	CardQueueRelearning  CardQueue = 3  // Day Learn: learning or relearning cards due on a later day
 )
 
 // Review definition
@@ -427,15 +597,15 @@ const (
 // `ivl` is stored either as negative seconds, or as positive days. We convert
 // both to positive seconds.
 type Review struct {
-	Timestamp      *TimestampSeconds    `db:"id"`      // Times when the review was done
-	CardID         ID                   `db:"cid"`     // Foreign key to a Card
-	UpdateSequence int                  `db:"usn"`     // Update sequence number
-	Ease           ReviewEase           `db:"ease"`    // Button pushed to score recall: wrong, hard, ok, easy
-	Interval       DurationSeconds      `db:"ivl"`     // SRS interval in seconds
-	LastInterval   DurationSeconds      `db:"lastIvl"` // Prevoius SRS interval in seconds
-	Factor         float32              `db:"factor"`  // SRS factor
-	ReviewTime     DurationMilliseconds `db:"time"`    // Time spent on the review
-	Type           ReviewType           `db:"type"`    // Review type: learn, review, relearn, cram
+	Timestamp      *TimestampMilliseconds `db:"id"`      // Times when the review was done
+	CardID         ID                     `db:"cid"`     // Foreign key to a Card
+	UpdateSequence int                    `db:"usn"`     // Update sequence number
+	Ease           ReviewEase             `db:"ease"`    // Button pushed to score recall: wrong, hard, ok, easy
+	Interval       DurationSeconds        `db:"ivl"`     // SRS interval in seconds
+	LastInterval   DurationSeconds        `db:"lastIvl"` // Prevoius SRS interval in seconds
+	Factor         float32                `db:"factor"`  // SRS factor
+	ReviewTime     DurationMilliseconds   `db:"time"`    // Time spent on the review
+	Type           ReviewType             `db:"type"`    // Review type: learn, review, relearn, cram
 }
 
 type ReviewEase int
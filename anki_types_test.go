@@ -0,0 +1,228 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestCollectionRoundTrip checks that each of the JSON columns of the `col`
+// table in the test package is marshalled back to the same keys and values
+// as are stored. Key order and spacing are not preserved, and the current
+// model's ID, which older versions of Anki stored as a string, is written as
+// a number.
+func TestCollectionRoundTrip(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatalf("Error opening test file: %s", err)
+	}
+	defer apkg.Close()
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	var raw struct {
+		ID       int64  `db:"id"`
+		Created  int64  `db:"crt"`
+		Modified int64  `db:"mod"`
+		Schema   int64  `db:"scm"`
+		Dirty    int64  `db:"dty"`
+		LastSync int64  `db:"ls"`
+		Config   string `db:"conf"`
+		Models   string `db:"models"`
+		Decks    string `db:"decks"`
+		DConf    string `db:"dconf"`
+	}
+	if err := apkg.db.Get(&raw, "SELECT id, crt, mod, scm, dty, ls, conf, models, decks, dconf FROM col"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		stored string
+		value  driver.Valuer
+	}{
+		"conf":   {raw.Config, collection.Config},
+		"models": {raw.Models, collection.Models},
+		"decks":  {raw.Decks, collection.Decks},
+		"dconf":  {raw.DConf, collection.DeckConfigs},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var expected interface{}
+			if err := json.Unmarshal([]byte(test.stored), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if conf, ok := expected.(map[string]interface{}); ok && name == "conf" {
+				if id, ok := conf["curModel"].(string); ok {
+					n, _ := strconv.ParseFloat(id, 64)
+					conf["curModel"] = n
+				}
+			}
+			value, err := test.value.Value()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			var result interface{}
+			if err := json.Unmarshal([]byte(value.(string)), &result); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("Unexpected result:\n%s\nExpected:\n%s", value, test.stored)
+			}
+		})
+	}
+
+	for name, test := range map[string]struct {
+		stored int64
+		value  driver.Valuer
+	}{
+		"id":  {raw.ID, collection.ID},
+		"crt": {raw.Created, collection.Created},
+		"mod": {raw.Modified, collection.Modified},
+		"scm": {raw.Schema, collection.SchemaModified},
+		"dty": {raw.Dirty, collection.Dirty},
+		"ls":  {raw.LastSync, collection.LastSync},
+	} {
+		value, err := test.value.Value()
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %s", name, err)
+		}
+		if value != test.stored {
+			t.Errorf("%s: Expected %d, got %v", name, test.stored, value)
+		}
+	}
+
+	blob, err := json.Marshal(collection)
+	if err != nil {
+		t.Fatalf("Error marshalling collection: %s", err)
+	}
+	var result Collection
+	if err := json.Unmarshal(blob, &result); err != nil {
+		t.Fatalf("Error unmarshalling collection: %s", err)
+	}
+	for _, deck := range collection.Decks {
+		// Not part of the stored deck
+		deck.Config = nil
+	}
+	if !reflect.DeepEqual(&result, collection) {
+		t.Errorf("Collection did not round-trip: %s", blob)
+	}
+}
+
+func TestNoteValuesRoundTrip(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatalf("Error opening test file: %s", err)
+	}
+	defer apkg.Close()
+	var flds string
+	if err := apkg.db.QueryRow("SELECT flds FROM notes").Scan(&flds); err != nil {
+		t.Fatal(err)
+	}
+	var fv FieldValues
+	if err := fv.Scan(flds); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := fv.Value(); value != flds {
+		t.Errorf("Unexpected fields: %q", value)
+	}
+
+	var tags Tags
+	if err := tags.Scan(" b a "); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := tags.Value(); value != " a b " {
+		t.Errorf("Unexpected tags: %q", value)
+	}
+	if blob, _ := json.Marshal(Tags(nil)); string(blob) != "[]" {
+		t.Errorf("Unexpected JSON for no tags: %s", blob)
+	}
+}
+
+func TestConfigSortBackwards(t *testing.T) {
+	for _, stored := range []string{`{"sortBackwards": 1}`, `{"sortBackwards": true}`} {
+		var conf Config
+		if err := json.Unmarshal([]byte(stored), &conf); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !conf.SortBackwards {
+			t.Errorf("%s: Expected SortBackwards", stored)
+		}
+		blob, err := json.Marshal(conf)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		var result map[string]interface{}
+		if err := json.Unmarshal(blob, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result["sortBackwards"] != true {
+			t.Errorf("%s: Unexpected JSON: %s", stored, blob)
+		}
+	}
+}
+
+func TestDurationMinutesSQL(t *testing.T) {
+	for _, test := range []struct {
+		value  DurationMinutes
+		stored driver.Value
+	}{
+		{DurationMinutes(10 * time.Minute), int64(10)},
+		{DurationMinutes(90 * time.Second), 1.5},
+	} {
+		value, err := test.value.Value()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if value != test.stored {
+			t.Errorf("Expected %v (%T), got %v (%T)", test.stored, test.stored, value, value)
+		}
+		var result DurationMinutes
+		if err := result.Scan(value); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if result != test.value {
+			t.Errorf("Expected %v, got %v", time.Duration(test.value), time.Duration(result))
+		}
+	}
+}
+
+func TestScalarJSON(t *testing.T) {
+	ts := TimestampMilliseconds(time.Unix(1388721680, 877*int64(time.Millisecond)).UTC())
+	for _, test := range []struct {
+		value    interface{}
+		target   interface{}
+		expected string
+	}{
+		{ID(1388721680877), new(ID), "1388721680877"},
+		{ts, new(TimestampMilliseconds), "1388721680877"},
+		{DurationMilliseconds(1500 * time.Millisecond), new(DurationMilliseconds), "1500"},
+		{DurationSeconds(90 * time.Second), new(DurationSeconds), "90"},
+		{DurationMinutes(90 * time.Second), new(DurationMinutes), "1.5"},
+		{DurationDays(3), new(DurationDays), "3"},
+		{BoolInt(true), new(BoolInt), "1"},
+		{CardConstraint{Index: 1, MatchType: "any", Fields: []int{0}}, new(CardConstraint), `[1,"any",[0]]`},
+		{Template{Name: "Card 1"}, new(Template), `{"name":"Card 1","ord":0,"qfmt":"","afmt":"","bqfmt":"","bafmt":"","did":null}`},
+	} {
+		blob, err := json.Marshal(test.value)
+		if err != nil {
+			t.Errorf("%T: Unexpected error: %s", test.value, err)
+			continue
+		}
+		if string(blob) != test.expected {
+			t.Errorf("%T: Expected %s, got %s", test.value, test.expected, blob)
+		}
+		if err := json.Unmarshal(blob, test.target); err != nil {
+			t.Errorf("%T: Unexpected error: %s", test.value, err)
+			continue
+		}
+		if result := reflect.ValueOf(test.target).Elem().Interface(); !reflect.DeepEqual(result, test.value) {
+			t.Errorf("%T: Expected %v, got %v", test.value, test.value, result)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDeckID is the ID of the "Default" deck present in every collection.
+const DefaultDeckID ID = 1
+
+// DefaultDeckConfigID is the ID of the "Default" deck options group present
+// in every collection.
+const DefaultDeckConfigID ID = 1
+
+// Builder assembles a new Anki package from models (note types), decks and
+// notes. It assigns IDs and GUIDs, calculates the sort field and checksum of
+// each note, and generates cards for each note the same way Anki does.
+type Builder struct {
+	collection *Collection
+	writer     *Writer
+	lastID     int64
+	tags       map[string]int
+}
+
+// NewBuilder returns a new Builder, with an empty collection containing only
+// the default deck and default deck options.
+func NewBuilder() *Builder {
+	now := time.Now()
+	year, month, day := now.Date()
+	conf := DefaultDeckConfig()
+	collection := &Collection{
+		ID:             1,
+		Created:        timestampSeconds(time.Date(year, month, day, 0, 0, 0, 0, now.Location())),
+		Modified:       timestampMilliseconds(now),
+		SchemaModified: timestampMilliseconds(now),
+		Version:        11,
+		LastSync:       timestampMilliseconds(time.Unix(0, 0)),
+		Config: Config{
+			NextPos:       1,
+			EstimateTimes: true,
+			ActiveDecks:   []ID{DefaultDeckID},
+			SortType:      "noteFld",
+			AddToCurrent:  true,
+			CurrentDeck:   DefaultDeckID,
+			NewBury:       true,
+			DueCounts:     true,
+			CollapseTime:  1200,
+		},
+		Models: Models{},
+		Decks: Decks{
+			DefaultDeckID: {
+				ID:                      DefaultDeckID,
+				Name:                    "Default",
+				Modified:                timestampSeconds(now),
+				ExtendedNewCardLimit:    10,
+				ExtendedReviewCardLimit: 50,
+				ConfigID:                DefaultDeckConfigID,
+				Config:                  conf,
+			},
+		},
+		DeckConfigs: DeckConfigs{
+			DefaultDeckConfigID: conf,
+		},
+	}
+	return &Builder{
+		collection: collection,
+		writer:     NewWriter(collection),
+		tags:       make(map[string]int),
+	}
+}
+
+// DefaultDeckConfig returns a new DeckConfig populated with Anki's default
+// deck options.
+func DefaultDeckConfig() *DeckConfig {
+	dc := &DeckConfig{
+		ID:               DefaultDeckConfigID,
+		Name:             "Default",
+		ReplayAudio:      true,
+		MaxAnswerSeconds: 60,
+		Modified:         timestampSeconds(time.Unix(0, 0)),
+		AutoPlay:         true,
+	}
+	dc.Lapses.LeechFails = 8
+	dc.Lapses.MinimumInterval = 1
+	dc.Lapses.LeechAction = LeechActoinTagOnly
+	dc.Lapses.Delays = []DurationMinutes{DurationMinutes(10 * time.Minute)}
+	dc.Reviews.PerDay = 200
+	dc.Reviews.Fuzz = 0.05
+	dc.Reviews.IntervalModifier = 1
+	dc.Reviews.MaxInterval = 36500
+	dc.Reviews.EasyBonus = 1.3
+	dc.New.PerDay = 20
+	dc.New.Delays = []DurationMinutes{DurationMinutes(time.Minute), DurationMinutes(10 * time.Minute)}
+	dc.New.Separate = true
+	dc.New.Intervals = [3]DurationDays{1, 4, 7}
+	dc.New.InitialFactor = 2500
+	dc.New.Order = NewCardOrderOrderAdded
+	return dc
+}
+
+// Collection returns the collection being built.
+func (b *Builder) Collection() *Collection {
+	return b.collection
+}
+
+// newID returns a new, unique, millisecond-timestamp-based ID, as Anki uses
+// for all of its objects.
+func (b *Builder) newID() ID {
+	id := time.Now().UnixNano() / int64(time.Millisecond)
+	if id <= b.lastID {
+		id = b.lastID + 1
+	}
+	b.lastID = id
+	return ID(id)
+}
+
+// AddDeckConfig adds a deck options group to the collection. If dc.ID is 0,
+// a new ID is assigned.
+func (b *Builder) AddDeckConfig(dc *DeckConfig) error {
+	if dc.ID == 0 {
+		dc.ID = b.newID()
+	}
+	if _, ok := b.collection.DeckConfigs[dc.ID]; ok {
+		return fmt.Errorf("Deck config %d already exists", dc.ID)
+	}
+	if dc.Modified == nil {
+		dc.Modified = timestampSeconds(time.Now())
+	}
+	b.collection.DeckConfigs[dc.ID] = dc
+	return nil
+}
+
+// AddDeck adds a deck to the collection. If d.ID is 0, a new ID is assigned.
+// If d.ConfigID is 0, the deck uses the default deck options. Any missing
+// parent decks (as indicated by '::' in the deck name) are created.
+func (b *Builder) AddDeck(d *Deck) error {
+	if d.Name == "" {
+		return errors.New("Deck name must not be empty")
+	}
+	if b.deckByName(d.Name) != nil {
+		return fmt.Errorf("Deck '%s' already exists", d.Name)
+	}
+	if d.ID == 0 {
+		d.ID = b.newID()
+	}
+	if _, ok := b.collection.Decks[d.ID]; ok {
+		return fmt.Errorf("Deck %d already exists", d.ID)
+	}
+	if d.ConfigID == 0 {
+		d.ConfigID = DefaultDeckConfigID
+	}
+	conf, ok := b.collection.DeckConfigs[d.ConfigID]
+	if !ok {
+		return fmt.Errorf("Deck %d references non-existent config %d", d.ID, d.ConfigID)
+	}
+	d.Config = conf
+	if d.Modified == nil {
+		d.Modified = timestampSeconds(time.Now())
+	}
+	if i := strings.LastIndex(d.Name, "::"); i > 0 {
+		parent := d.Name[:i]
+		if b.deckByName(parent) == nil {
+			if err := b.AddDeck(&Deck{Name: parent, ConfigID: d.ConfigID}); err != nil {
+				return err
+			}
+		}
+	}
+	b.collection.Decks[d.ID] = d
+	return nil
+}
+
+func (b *Builder) deckByName(name string) *Deck {
+	for _, deck := range b.collection.Decks {
+		if strings.EqualFold(deck.Name, name) {
+			return deck
+		}
+	}
+	return nil
+}
+
+// AddModel adds a model (aka note type) to the collection. If m.ID is 0, a
+// new ID is assigned. Field and template ordinals are set according to their
+// order, and for standard models with no RequiredFields, the card constraints
+// are calculated from the templates.
+func (b *Builder) AddModel(m *Model) error {
+	if len(m.Fields) == 0 {
+		return errors.New("Model must have at least one field")
+	}
+	if len(m.Templates) == 0 {
+		return errors.New("Model must have at least one template")
+	}
+	if m.ID == 0 {
+		m.ID = b.newID()
+	}
+	if _, ok := b.collection.Models[m.ID]; ok {
+		return fmt.Errorf("Model %d already exists", m.ID)
+	}
+	for i, field := range m.Fields {
+		field.Ordinal = i
+	}
+	for i, tmpl := range m.Templates {
+		tmpl.Ordinal = i
+	}
+	if m.SortField >= len(m.Fields) {
+		return fmt.Errorf("Sort field %d out of range", m.SortField)
+	}
+	if m.Tags == nil {
+		m.Tags = []string{}
+	}
+	if m.DeckID == 0 {
+		m.DeckID = DefaultDeckID
+	}
+	if m.Modified == nil {
+		m.Modified = timestampSeconds(time.Now())
+	}
+	if m.Type == ModelTypeStandard && m.RequiredFields == nil {
+		m.RequiredFields = requiredFields(m)
+	}
+	b.collection.Models[m.ID] = m
+	if b.collection.Config.CurrentModel == 0 {
+		b.collection.Config.CurrentModel = m.ID
+	}
+	return nil
+}
+
+// AddNote creates a new note of the given model in the given deck, with the
+// provided field values and tags, and generates its cards. If deck is nil,
+// the model's default deck is used. An error is returned if the note would
+// not generate any cards.
+func (b *Builder) AddNote(model *Model, deck *Deck, fields []string, tags []string) (*Note, []*Card, error) {
+	if m, ok := b.collection.Models[model.ID]; !ok || m != model {
+		return nil, nil, fmt.Errorf("Model %d has not been added", model.ID)
+	}
+	deckID := model.DeckID
+	if deck != nil {
+		deckID = deck.ID
+	}
+	if _, ok := b.collection.Decks[deckID]; !ok {
+		return nil, nil, fmt.Errorf("Deck %d has not been added", deckID)
+	}
+	if len(fields) != len(model.Fields) {
+		return nil, nil, fmt.Errorf("Model '%s' has %d fields, but %d values were provided", model.Name, len(model.Fields), len(fields))
+	}
+	now := time.Now()
+	note := &Note{
+		ID:             b.newID(),
+		GUID:           guid64(),
+		ModelID:        model.ID,
+		Modified:       timestampSeconds(now),
+		UpdateSequence: -1,
+		Tags:           joinTags(tags),
+		FieldValues:    FieldValues(append([]string(nil), fields...)),
+	}
+	note.UniqueField, note.Checksum = sortFieldAndChecksum(model, note.FieldValues)
+
+	ords := cardOrdinals(model, note.FieldValues)
+	if len(ords) == 0 {
+		return nil, nil, errors.New("Note does not generate any cards")
+	}
+	cards := make([]*Card, 0, len(ords))
+	for _, ord := range ords {
+		did := deckID
+		if model.Type == ModelTypeStandard && model.Templates[ord].DeckOverride != 0 {
+			did = model.Templates[ord].DeckOverride
+		}
+		card := &Card{
+			ID:             b.newID(),
+			NoteID:         note.ID,
+			DeckID:         did,
+			TemplateID:     ord,
+			Modified:       timestampSeconds(now),
+			UpdateSequence: -1,
+			Type:           CardTypeNew,
+			Queue:          CardQueueNew,
+		}
+		cards = append(cards, card)
+		b.writer.AddCard(card)
+	}
+	b.writer.AddNote(note)
+	for _, tag := range tags {
+		b.tags[tag] = -1
+	}
+	return note, cards, nil
+}
+
+// AddMedia adds a media file to the package.
+func (b *Builder) AddMedia(name string, data []byte) {
+	b.writer.AddMedia(name, data)
+}
+
+// WriteFile writes the package to the named file, creating or truncating it.
+func (b *Builder) WriteFile(f string) error {
+	if err := b.updateTags(); err != nil {
+		return err
+	}
+	return b.writer.WriteFile(f)
+}
+
+// WriteTo writes the package, as a zip archive, to out. It implements the
+// io.WriterTo interface.
+func (b *Builder) WriteTo(out io.Writer) (int64, error) {
+	if err := b.updateTags(); err != nil {
+		return 0, err
+	}
+	return b.writer.WriteTo(out)
+}
+
+// updateTags updates the collection's tag cache, which Anki stores as a JSON
+// object mapping each tag to its update sequence number.
+func (b *Builder) updateTags() error {
+	tags, err := json.Marshal(b.tags)
+	if err != nil {
+		return err
+	}
+	b.collection.Tags = string(tags)
+	return nil
+}
+
+// joinTags formats tags the way Anki stores them in the `notes` table:
+// space-separated, with a leading and trailing space.
+func joinTags(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return " " + strings.Join(tags, " ") + " "
+}
+
+// sortFieldAndChecksum calculates the `sfld` and `csum` values for a note.
+// The sort field is the model's sort field, stripped of HTML. The checksum is
+// the first 8 hex digits of the SHA1 hash of the first field, stripped of
+// HTML.
+func sortFieldAndChecksum(m *Model, fields FieldValues) (string, int64) {
+	var sfld string
+	if m.SortField < len(fields) {
+		sfld = stripHTMLMedia(fields[m.SortField])
+	}
+	var first string
+	if len(fields) > 0 {
+		first = fields[0]
+	}
+	sum := sha1.Sum([]byte(stripHTMLMedia(first)))
+	csum, _ := strconv.ParseInt(hex.EncodeToString(sum[:])[:8], 16, 64)
+	return sfld, csum
+}
+
+// base91Table is the alphabet used by Anki's guid64() function.
+const base91Table = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!#$%&()*+,-./:;<=>?@[]^_`{|}~"
+
+// guid64 returns a random GUID, in the same format produced by Anki.
+func guid64() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	num := new(big.Int).SetUint64(binary.BigEndian.Uint64(buf[:]))
+	base := big.NewInt(int64(len(base91Table)))
+	mod := new(big.Int)
+	var guid []byte
+	for num.Sign() > 0 {
+		num.DivMod(num, base, mod)
+		guid = append([]byte{base91Table[mod.Int64()]}, guid...)
+	}
+	return string(guid)
+}
+
+// requiredFields calculates the card constraints for a standard model, using
+// the same method as Anki: by rendering each template's question format with
+// various combinations of empty and non-empty fields.
+func requiredFields(m *Model) []*CardConstraint {
+	r := NewRenderer()
+	reqs := make([]*CardConstraint, len(m.Templates))
+	for i, tmpl := range m.Templates {
+		reqs[i] = templateRequiredFields(r, m, tmpl)
+	}
+	return reqs
+}
+
+func templateRequiredFields(r *Renderer, m *Model, tmpl *Template) *CardConstraint {
+	render := func(fields []string) string {
+		note := &Note{FieldValues: fields}
+		q, err := r.renderFormat(tmpl.QuestionFormat, templateFields(m, note, tmpl, tmpl.Ordinal, nil), m, note, tmpl.Ordinal, true)
+		if err != nil {
+			return ""
+		}
+		return q
+	}
+	const flag = "ankiflag"
+	full := make([]string, len(m.Fields))
+	empty := make([]string, len(m.Fields))
+	for i := range full {
+		full[i] = flag
+	}
+	emptyQuestion := render(empty)
+	// If the question is the same whether or not the fields are filled in,
+	// there is no way to satisfy the template.
+	if render(full) == emptyQuestion {
+		return &CardConstraint{Index: tmpl.Ordinal, MatchType: "none", Fields: []int{}}
+	}
+	// A field is required if omitting it removes all field content.
+	var req []int
+	for i := range m.Fields {
+		fields := append([]string(nil), full...)
+		fields[i] = ""
+		if !strings.Contains(render(fields), flag) {
+			req = append(req, i)
+		}
+	}
+	if len(req) > 0 {
+		return &CardConstraint{Index: tmpl.Ordinal, MatchType: "all", Fields: req}
+	}
+	// Otherwise, any field that can make the question non-blank will do.
+	req = []int{}
+	for i := range m.Fields {
+		fields := append([]string(nil), empty...)
+		fields[i] = "1"
+		if render(fields) != emptyQuestion {
+			req = append(req, i)
+		}
+	}
+	return &CardConstraint{Index: tmpl.Ordinal, MatchType: "any", Fields: req}
+}
+
+// cardOrdinals returns the template ordinals for which cards should exist
+// for a note with the provided field values.
+func cardOrdinals(m *Model, fields FieldValues) []int {
+	if m.Type == ModelTypeCloze {
+		return clozeCardOrdinals(m, fields)
+	}
+	reqs := m.RequiredFields
+	if reqs == nil {
+		reqs = requiredFields(m)
+	}
+	var ords []int
+	for _, tmpl := range m.Templates {
+		var req *CardConstraint
+		for _, r := range reqs {
+			if r.Index == tmpl.Ordinal {
+				req = r
+				break
+			}
+		}
+		if req == nil || constraintMet(req, fields) {
+			ords = append(ords, tmpl.Ordinal)
+		}
+	}
+	return ords
+}
+
+func constraintMet(req *CardConstraint, fields FieldValues) bool {
+	nonEmpty := func(idx int) bool {
+		return idx < len(fields) && strings.TrimSpace(fields[idx]) != ""
+	}
+	switch req.MatchType {
+	case "all":
+		for _, idx := range req.Fields {
+			if !nonEmpty(idx) {
+				return false
+			}
+		}
+		return true
+	case "any":
+		for _, idx := range req.Fields {
+			if nonEmpty(idx) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func timestampSeconds(t time.Time) *TimestampSeconds {
+	ts := TimestampSeconds(time.Unix(t.Unix(), 0).UTC())
+	return &ts
+}
+
+func timestampMilliseconds(t time.Time) *TimestampMilliseconds {
+	ts := TimestampMilliseconds(t.Round(time.Millisecond).UTC())
+	return &ts
+}
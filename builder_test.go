@@ -0,0 +1,182 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func basicReversedModel() *Model {
+	return &Model{
+		Name: "Basic (optional reversed card)",
+		Fields: []*Field{
+			{Name: "Front", Font: "Arial", FontSize: 20},
+			{Name: "Back", Font: "Arial", FontSize: 20},
+			{Name: "Add Reverse", Font: "Arial", FontSize: 20},
+		},
+		Templates: []*Template{
+			{Name: "Card 1", QuestionFormat: "{{Front}}", AnswerFormat: "{{FrontSide}}<hr id=answer>{{Back}}"},
+			{Name: "Card 2", Ordinal: 1, QuestionFormat: "{{#Add Reverse}}{{Back}}{{/Add Reverse}}", AnswerFormat: "{{FrontSide}}<hr id=answer>{{Front}}"},
+		},
+		CSS: ".card { font-family: arial; }",
+		RequiredFields: []*CardConstraint{
+			{Index: 0, MatchType: "all", Fields: []int{0}},
+			{Index: 1, MatchType: "all", Fields: []int{1, 2}},
+		},
+	}
+}
+
+func clozeModel() *Model {
+	return &Model{
+		Name: "Cloze",
+		Type: ModelTypeCloze,
+		Fields: []*Field{
+			{Name: "Text"},
+			{Name: "Extra"},
+		},
+		Templates: []*Template{
+			{Name: "Cloze", QuestionFormat: "{{cloze:Text}}", AnswerFormat: "{{cloze:Text}}<br>{{Extra}}"},
+		},
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder()
+	basic := basicReversedModel()
+	if err := b.AddModel(basic); err != nil {
+		t.Fatalf("Error adding model: %s", err)
+	}
+	cloze := clozeModel()
+	if err := b.AddModel(cloze); err != nil {
+		t.Fatalf("Error adding cloze model: %s", err)
+	}
+	deck := &Deck{Name: "Languages::Dutch"}
+	if err := b.AddDeck(deck); err != nil {
+		t.Fatalf("Error adding deck: %s", err)
+	}
+	if b.deckByName("Languages") == nil {
+		t.Errorf("Parent deck was not created")
+	}
+	if err := b.AddDeck(&Deck{Name: "languages::dutch"}); err == nil {
+		t.Errorf("Expected an error adding a duplicate deck")
+	}
+
+	tests := []struct {
+		name   string
+		model  *Model
+		fields []string
+		ords   []int
+		err    string
+	}{
+		{name: "front only", model: basic, fields: []string{"hond", "dog", ""}, ords: []int{0}},
+		{name: "reversed", model: basic, fields: []string{"kat", "cat", "y"}, ords: []int{0, 1}},
+		{name: "no cards", model: basic, fields: []string{"", "cat", ""}, err: "Note does not generate any cards"},
+		{name: "wrong field count", model: basic, fields: []string{"kat"}, err: "Model 'Basic (optional reversed card)' has 3 fields, but 1 values were provided"},
+		{name: "cloze", model: cloze, fields: []string{"{{c1::Amsterdam}} is the capital of {{c3::the Netherlands}}", ""}, ords: []int{0, 2}},
+		{name: "empty cloze", model: cloze, fields: []string{"no clozes", ""}, ords: []int{0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			note, cards, err := b.AddNote(test.model, deck, test.fields, []string{"nl"})
+			var msg string
+			if err != nil {
+				msg = err.Error()
+			}
+			if msg != test.err {
+				t.Fatalf("Unexpected error: %s", msg)
+			}
+			if err != nil {
+				return
+			}
+			ords := make([]int, len(cards))
+			for i, card := range cards {
+				ords[i] = card.TemplateID
+				if card.NoteID != note.ID {
+					t.Errorf("Card %d has note ID %d, expected %d", card.ID, card.NoteID, note.ID)
+				}
+				if card.DeckID != deck.ID {
+					t.Errorf("Card %d has deck ID %d, expected %d", card.ID, card.DeckID, deck.ID)
+				}
+			}
+			if !reflect.DeepEqual(ords, test.ords) {
+				t.Errorf("Expected card ordinals %v, got %v", test.ords, ords)
+			}
+			if note.Tags != " nl " {
+				t.Errorf("Unexpected tags: %q", note.Tags)
+			}
+			if len(note.GUID) == 0 {
+				t.Errorf("No GUID assigned")
+			}
+		})
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := b.WriteTo(buf); err != nil {
+		t.Fatalf("Error writing package: %s", err)
+	}
+	apkg, err := ReadBytes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error reading package: %s", err)
+	}
+	defer apkg.Close()
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatalf("Error reading collection: %s", err)
+	}
+	if len(collection.Decks) != 3 {
+		t.Errorf("Expected 3 decks, found %d", len(collection.Decks))
+	}
+	if m := collection.Models[basic.ID]; m == nil || len(m.Templates) != 2 {
+		t.Errorf("Model not written correctly: %+v", m)
+	}
+	cards, err := apkg.Cards()
+	if err != nil {
+		t.Fatalf("Error reading cards: %s", err)
+	}
+	var count int
+	for cards.Next() {
+		count++
+	}
+	_ = cards.Close()
+	if count != 6 {
+		t.Errorf("Expected 6 cards, found %d", count)
+	}
+}
+
+func TestSortFieldAndChecksum(t *testing.T) {
+	m := &Model{Fields: []*Field{{Name: "Front"}, {Name: "Back"}}, SortField: 1}
+	sfld, csum := sortFieldAndChecksum(m, FieldValues{
+		"Todos habíamos alcanzado la cima cuando comenzó a llover.",
+		`<b>We</b>&nbsp;had <img src="top.jpg">`,
+	})
+	if sfld != "We had  top.jpg " {
+		t.Errorf("Unexpected sort field: %q", sfld)
+	}
+	if csum != 1090091728 {
+		t.Errorf("Unexpected checksum: %d", csum)
+	}
+}
+
+func TestRequiredFields(t *testing.T) {
+	m := basicReversedModel()
+	m.RequiredFields = nil
+	m.Templates = append(m.Templates,
+		&Template{Name: "Card 3", Ordinal: 2, QuestionFormat: "{{Front}}{{Back}}"},
+		&Template{Name: "Card 4", Ordinal: 3, QuestionFormat: "Static text"},
+	)
+	reqs := requiredFields(m)
+	expected := []*CardConstraint{
+		{Index: 0, MatchType: "all", Fields: []int{0}},
+		{Index: 1, MatchType: "all", Fields: []int{1, 2}},
+		{Index: 2, MatchType: "any", Fields: []int{0, 1}},
+		{Index: 3, MatchType: "none", Fields: []int{}},
+	}
+	if !reflect.DeepEqual(reqs, expected) {
+		for _, req := range reqs {
+			t.Errorf("Unexpected constraint: %+v", *req)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckOptions controls how a package is checked.
+type CheckOptions struct {
+	// Fix repairs the problems found, as Anki's "Check Database" does. As
+	// with the Update methods, the changes are kept until the package is
+	// saved with WriteTo or WriteFile.
+	Fix bool
+}
+
+// Severity indicates how serious a problem found by Check is.
+type Severity int
+
+const (
+	// SeverityWarning indicates a problem Anki repairs without the user
+	// noticing, such as a stale checksum.
+	SeverityWarning Severity = iota
+	// SeverityError indicates a problem which prevents the collection from
+	// being read or reviewed correctly.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Problem identifies the kind of problem found by Check.
+type Problem int
+
+const (
+	// ProblemMissingDeckConfig indicates a deck whose options group does
+	// not exist. It is fixed by giving the deck the default options.
+	ProblemMissingDeckConfig Problem = iota + 1
+	// ProblemMissingModel indicates a note whose note type does not exist.
+	// It is fixed by deleting the note and its cards.
+	ProblemMissingModel
+	// ProblemFieldCount indicates a note with more or fewer fields than its
+	// note type. It is fixed by adding empty fields, or by joining the extra
+	// fields to the last one.
+	ProblemFieldCount
+	// ProblemDuplicateGUID indicates a note with the same GUID as another.
+	// It is fixed by giving the newer note a new GUID.
+	ProblemDuplicateGUID
+	// ProblemChecksum indicates a note whose sort field or checksum does
+	// not match its fields. It is fixed by recalculating them.
+	ProblemChecksum
+	// ProblemMissingNote indicates a card whose note does not exist. It is
+	// fixed by deleting the card.
+	ProblemMissingNote
+	// ProblemMissingTemplate indicates a card whose template does not exist
+	// in its note type. It is fixed by deleting the card.
+	ProblemMissingTemplate
+	// ProblemMissingDeck indicates a card whose deck, or original deck,
+	// does not exist. It is fixed by adding a deck named "recovered" followed
+	// by the missing ID, as Anki does.
+	ProblemMissingDeck
+	// ProblemInvalidQueue indicates a card whose type or queue is invalid,
+	// or whose queue does not match its type. It is fixed by moving the card
+	// to the queue for its type.
+	ProblemInvalidQueue
+)
+
+// Finding describes a problem found by Check.
+type Finding struct {
+	Problem  Problem
+	Severity Severity
+	ID       ID     // The ID of the deck, note or card concerned
+	Message  string // A description of the problem
+	Fixed    bool   // True if the problem was fixed
+}
+
+func (f *Finding) String() string {
+	if f.Fixed {
+		return fmt.Sprintf("%s: %s (fixed)", f.Severity, f.Message)
+	}
+	return fmt.Sprintf("%s: %s", f.Severity, f.Message)
+}
+
+// Check checks the integrity of the package's collection, and returns the
+// problems it finds. It looks for:
+//
+//   - decks whose options group does not exist, which cause Collection to
+//     fail
+//   - notes whose note type does not exist, or whose number of fields does
+//     not match their note type
+//   - notes sharing a GUID, and notes whose sort field or checksum is wrong
+//   - cards whose note, deck or template does not exist
+//   - cards whose type and queue are invalid, or do not match
+//
+// If opts.Fix is set, each problem is repaired the way Anki's "Check
+// Database" does, and its Finding is marked Fixed. If opts is nil, the
+// default options are used.
+func (a *Apkg) Check(opts *CheckOptions) ([]*Finding, error) {
+	if opts == nil {
+		opts = &CheckOptions{}
+	}
+	col, err := a.readCollection()
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{
+		a:     a,
+		col:   col,
+		fix:   opts.Fix,
+		now:   time.Now(),
+		notes: make(map[ID]*Note),
+	}
+	for _, step := range []func() error{
+		c.checkDeckConfigs,
+		c.checkNotes,
+		c.checkCards,
+	} {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range c.findings {
+		if f.Fixed {
+			return c.findings, a.touch(c.now)
+		}
+	}
+	return c.findings, nil
+}
+
+// checker holds the state of a check.
+type checker struct {
+	a        *Apkg
+	col      *Collection
+	fix      bool
+	now      time.Time
+	notes    map[ID]*Note // The notes which remain after checkNotes
+	findings []*Finding
+}
+
+func (c *checker) report(problem Problem, severity Severity, id ID, format string, args ...interface{}) *Finding {
+	f := &Finding{
+		Problem:  problem,
+		Severity: severity,
+		ID:       id,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	c.findings = append(c.findings, f)
+	return f
+}
+
+// checkDeckConfigs checks the options group of each deck. Once they are
+// fixed, the collection can be read with its decks' options.
+func (c *checker) checkDeckConfigs() error {
+	if c.fix {
+		if err := c.a.findSplitTables(); err != nil {
+			return err
+		}
+	}
+	decks := make([]*Deck, 0, len(c.col.Decks))
+	for _, deck := range c.col.Decks {
+		decks = append(decks, deck)
+	}
+	sort.Slice(decks, func(i, j int) bool { return decks[i].ID < decks[j].ID })
+	var fixed bool
+	for _, deck := range decks {
+		if deck.Dynamic {
+			continue
+		}
+		if _, ok := c.col.DeckConfigs[deck.ConfigID]; ok {
+			continue
+		}
+		f := c.report(ProblemMissingDeckConfig, SeverityError, deck.ID,
+			"Deck %d references non-existent config %d", deck.ID, deck.ConfigID)
+		if _, ok := c.col.DeckConfigs[DefaultDeckConfigID]; !c.fix || !ok {
+			continue
+		}
+		deck.ConfigID = DefaultDeckConfigID
+		deck.Modified = timestampSeconds(c.now)
+		deck.UpdateSequence = usnPending
+		var err error
+		if c.a.split["decks"] {
+			err = c.a.updateDeckRow(deck)
+		} else {
+			err = c.a.updateColObject("decks", deck.ID, deck)
+		}
+		if err != nil {
+			return err
+		}
+		f.Fixed = true
+		fixed = true
+	}
+	if fixed {
+		// Any collection cached by the Update methods is out of date.
+		c.a.collection = nil
+	}
+	return nil
+}
+
+// checkNotes checks each note against its note type, and the others.
+func (c *checker) checkNotes() error {
+	rows, err := c.a.db.Queryx(`
+		SELECT n.id, n.guid, n.mid, n.mod, n.usn, n.tags, n.flds, n.sfld,
+			CAST(n.csum AS text) AS csum
+		FROM notes n
+		LEFT JOIN graves g ON g.oid=n.id AND g.type=1
+		WHERE g.oid IS NULL
+		ORDER BY n.id
+	`)
+	if err != nil {
+		return err
+	}
+	var notes []*Note
+	for rows.Next() {
+		note := &Note{}
+		if err := rows.StructScan(note); err != nil {
+			rows.Close()
+			return err
+		}
+		notes = append(notes, note)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	guids := make(map[string]ID, len(notes))
+	for _, note := range notes {
+		model, ok := c.col.Models[note.ModelID]
+		if !ok {
+			f := c.report(ProblemMissingModel, SeverityError, note.ID,
+				"Note %d references non-existent note type %d", note.ID, note.ModelID)
+			if !c.fix {
+				c.notes[note.ID] = note
+				continue
+			}
+			if err := c.removeNote(note.ID); err != nil {
+				return err
+			}
+			f.Fixed = true
+			continue
+		}
+		c.notes[note.ID] = note
+		wrongCount := len(note.FieldValues) != len(model.Fields)
+		if wrongCount {
+			f := c.report(ProblemFieldCount, SeverityError, note.ID,
+				"Note %d has %d fields, but note type %d has %d", note.ID, len(note.FieldValues), model.ID, len(model.Fields))
+			if c.fix {
+				note.FieldValues = fixFieldCount(note.FieldValues, len(model.Fields))
+				f.Fixed = true
+			}
+		}
+		changed := wrongCount
+		if other, ok := guids[note.GUID]; ok {
+			f := c.report(ProblemDuplicateGUID, SeverityError, note.ID,
+				"Note %d has the same GUID as note %d", note.ID, other)
+			if c.fix {
+				note.GUID = guid64()
+				f.Fixed = true
+			}
+			changed = true
+		}
+		guids[note.GUID] = note.ID
+		// The sort field and checksum of a note with the wrong number of
+		// fields are recalculated along with its fields.
+		sfld, csum := sortFieldAndChecksum(model, note.FieldValues)
+		if !wrongCount && (sfld != note.UniqueField || csum != note.Checksum) {
+			f := c.report(ProblemChecksum, SeverityWarning, note.ID,
+				"Note %d has an incorrect sort field or checksum", note.ID)
+			f.Fixed = c.fix
+			changed = true
+		}
+		note.UniqueField, note.Checksum = sfld, csum
+		if !changed || !c.fix {
+			continue
+		}
+		note.Modified = timestampSeconds(c.now)
+		note.UpdateSequence = usnPending
+		if _, err := c.a.db.Exec("UPDATE notes SET guid=?, mod=?, usn=?, flds=?, sfld=?, csum=? WHERE id=?",
+			note.GUID,
+			seconds(note.Modified),
+			note.UpdateSequence,
+			strings.Join(note.FieldValues, "\x1f"),
+			note.UniqueField,
+			note.Checksum,
+			int64(note.ID),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fixFieldCount pads fields with empty fields, or joins the extra fields to
+// the last one, as Anki does, so that there are n of them.
+func fixFieldCount(fields FieldValues, n int) FieldValues {
+	if len(fields) < n {
+		return append(fields, make(FieldValues, n-len(fields))...)
+	}
+	if n == 0 {
+		return FieldValues{}
+	}
+	fixed := append(FieldValues{}, fields[:n-1]...)
+	return append(fixed, strings.Join(fields[n-1:], "; "))
+}
+
+// checkCards checks the note, deck, template and queue of each card.
+func (c *checker) checkCards() error {
+	type card struct {
+		ID             ID        `db:"id"`
+		NoteID         ID        `db:"nid"`
+		DeckID         ID        `db:"did"`
+		TemplateID     int       `db:"ord"`
+		Type           CardType  `db:"type"`
+		Queue          CardQueue `db:"queue"`
+		Due            int64     `db:"due"`
+		OriginalDeckID ID        `db:"odid"`
+	}
+	var cards []card
+	if err := c.a.db.Select(&cards, `
+		SELECT c.id, c.nid, c.did, c.ord, c.type, c.queue, c.due, c.odid
+		FROM cards c
+		LEFT JOIN graves g ON g.oid=c.id AND g.type=0
+		WHERE g.oid IS NULL
+		ORDER BY c.id
+	`); err != nil {
+		return err
+	}
+
+	for _, card := range cards {
+		note, ok := c.notes[card.NoteID]
+		if !ok {
+			f := c.report(ProblemMissingNote, SeverityError, card.ID,
+				"Card %d references non-existent note %d", card.ID, card.NoteID)
+			if c.fix {
+				if err := c.remove("cards", 0, card.ID); err != nil {
+					return err
+				}
+				f.Fixed = true
+			}
+			continue
+		}
+		if model, ok := c.col.Models[note.ModelID]; ok && !validTemplate(model, card.TemplateID) {
+			f := c.report(ProblemMissingTemplate, SeverityError, card.ID,
+				"Card %d references non-existent template %d of note type %d", card.ID, card.TemplateID, model.ID)
+			if c.fix {
+				if err := c.remove("cards", 0, card.ID); err != nil {
+					return err
+				}
+				f.Fixed = true
+			}
+			continue
+		}
+		for _, did := range []ID{card.DeckID, card.OriginalDeckID} {
+			if _, ok := c.col.Decks[did]; ok || did == 0 {
+				continue
+			}
+			f := c.report(ProblemMissingDeck, SeverityError, card.ID,
+				"Card %d references non-existent deck %d", card.ID, did)
+			if c.fix {
+				if err := c.recoverDeck(did); err != nil {
+					return err
+				}
+				f.Fixed = true
+			}
+		}
+		if cardType, queue := validQueue(card.Type, card.Queue, card.Due); cardType != card.Type || queue != card.Queue {
+			f := c.report(ProblemInvalidQueue, SeverityError, card.ID,
+				"Card %d has type %d and queue %d", card.ID, card.Type, card.Queue)
+			if c.fix {
+				if _, err := c.a.db.Exec("UPDATE cards SET type=?, queue=?, mod=?, usn=? WHERE id=?",
+					int(cardType), int(queue), c.now.Unix(), usnPending, int64(card.ID)); err != nil {
+					return err
+				}
+				f.Fixed = true
+			}
+		}
+	}
+	return nil
+}
+
+// validTemplate returns true if model has a template with the ordinal ord.
+// The cards of a cloze note type have the ordinal of their cloze number,
+// less one, and all use the first template.
+func validTemplate(model *Model, ord int) bool {
+	if model.Type == ModelTypeCloze {
+		return ord >= 0
+	}
+	return ord >= 0 && ord < len(model.Templates)
+}
+
+// validQueue returns the type and queue a card with the given type, queue
+// and raw due value should have. Buried and suspended cards may be of any
+// type.
+func validQueue(cardType CardType, queue CardQueue, due int64) (CardType, CardQueue) {
+	switch cardType {
+	case CardTypeNew:
+		if queue == CardQueueNew || queue < 0 && queue >= CardQueueSchedBuried {
+			return cardType, queue
+		}
+		return cardType, CardQueueNew
+	case CardTypeReview:
+		if queue == CardQueueReview || queue < 0 && queue >= CardQueueSchedBuried {
+			return cardType, queue
+		}
+		return cardType, CardQueueReview
+	case CardTypeLearning, CardTypeRelearning:
+		if queue == CardQueueLearning || queue == CardQueueRelearning || queue < 0 && queue >= CardQueueSchedBuried {
+			return cardType, queue
+		}
+		// Cards in the learning queue are due at a time in seconds, and
+		// those in the day learn queue on a day number.
+		if due > 1e9 {
+			return cardType, CardQueueLearning
+		}
+		return cardType, CardQueueRelearning
+	}
+	return CardTypeNew, CardQueueNew
+}
+
+// recoverDeck adds a deck with the missing ID, with the default options, if
+// it has not already been added.
+func (c *checker) recoverDeck(id ID) error {
+	col, err := c.a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	if _, ok := col.Decks[id]; ok {
+		return nil
+	}
+	deck := &Deck{
+		ID:       id,
+		Name:     "recovered" + strconv.FormatInt(int64(id), 10),
+		ConfigID: DefaultDeckConfigID,
+	}
+	if err := c.a.addDeck(deck, c.now); err != nil {
+		return err
+	}
+	c.col.Decks[id] = deck
+	return nil
+}
+
+// removeNote deletes a note and its cards.
+func (c *checker) removeNote(id ID) error {
+	var cards []int64
+	if err := c.a.db.Select(&cards, "SELECT id FROM cards WHERE nid=?", int64(id)); err != nil {
+		return err
+	}
+	for _, cid := range cards {
+		if err := c.remove("cards", 0, ID(cid)); err != nil {
+			return err
+		}
+	}
+	return c.remove("notes", 1, id)
+}
+
+// remove deletes a card or note, and records its deletion in the `graves`
+// table with the given type, as Anki does.
+func (c *checker) remove(table string, graveType int, id ID) error {
+	if _, err := c.a.db.Exec("DELETE FROM "+table+" WHERE id=?", int64(id)); err != nil {
+		return err
+	}
+	_, err := c.a.db.Exec("INSERT INTO graves (usn, oid, type) VALUES (?, ?, ?)", usnPending, int64(id), graveType)
+	return err
+}
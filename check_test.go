@@ -0,0 +1,174 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"reflect"
+	"testing"
+)
+
+// corruptPackage returns a copy of the test package with one of each of the
+// problems Check looks for.
+func corruptPackage(t *testing.T) *Apkg {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apkg.updateColObject("decks", 1464446999755, map[string]int{"conf": 999}); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"UPDATE notes SET csum=1 WHERE id=1388721680877",
+		// A duplicate with a single field
+		"INSERT INTO notes SELECT 1388721680878, guid, mid, mod, usn, tags, 'Front', sfld, csum, flags, data FROM notes WHERE id=1388721680877",
+		// A note of a missing note type, with a card
+		"INSERT INTO notes SELECT 1388721680879, 'other', 42, mod, usn, tags, flds, sfld, csum, flags, data FROM notes WHERE id=1388721680877",
+		"INSERT INTO cards SELECT 1388721683903, 1388721680879, did, ord, mod, usn, type, queue, due, ivl, factor, reps, lapses, left, odue, odid, flags, data FROM cards WHERE id=1388721683902",
+		// A card of a missing note
+		"INSERT INTO cards SELECT 1388721683904, 999, did, ord, mod, usn, type, queue, due, ivl, factor, reps, lapses, left, odue, odid, flags, data FROM cards WHERE id=1388721683902",
+		// A card of a missing template
+		"INSERT INTO cards SELECT 1388721683905, nid, did, 5, mod, usn, type, queue, due, ivl, factor, reps, lapses, left, odue, odid, flags, data FROM cards WHERE id=1388721683902",
+		// A review card in a missing deck, in the new queue
+		"UPDATE cards SET did=777, queue=0 WHERE id=1388721683902",
+	} {
+		if _, err := apkg.db.Exec(query); err != nil {
+			t.Fatalf("%s: %s", query, err)
+		}
+	}
+	return apkg
+}
+
+func TestCheck(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	if findings, err := apkg.Check(nil); err != nil || len(findings) != 0 {
+		t.Errorf("Expected no problems, got %v (error %v)", findings, err)
+	}
+
+	type result struct {
+		Problem  Problem
+		Severity Severity
+		ID       ID
+	}
+	expected := []result{
+		{ProblemMissingDeckConfig, SeverityError, 1464446999755},
+		{ProblemChecksum, SeverityWarning, 1388721680877},
+		{ProblemFieldCount, SeverityError, 1388721680878},
+		{ProblemDuplicateGUID, SeverityError, 1388721680878},
+		{ProblemMissingModel, SeverityError, 1388721680879},
+		{ProblemMissingDeck, SeverityError, 1388721683902},
+		{ProblemInvalidQueue, SeverityError, 1388721683902},
+		{ProblemMissingNote, SeverityError, 1388721683904},
+		{ProblemMissingTemplate, SeverityError, 1388721683905},
+	}
+	for _, fix := range []bool{false, true} {
+		corrupt := corruptPackage(t)
+		defer corrupt.Close()
+		if _, err := corrupt.Collection(); err == nil {
+			t.Fatal("Expected the corrupt collection to fail to load")
+		}
+		findings, err := corrupt.Check(&CheckOptions{Fix: fix})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		var results []result
+		for _, f := range findings {
+			results = append(results, result{f.Problem, f.Severity, f.ID})
+			if f.Fixed != fix {
+				t.Errorf("Expected fixed to be %t: %s", fix, f)
+			}
+		}
+		if !reflect.DeepEqual(results, expected) {
+			t.Errorf("Unexpected findings (fix %t): %v", fix, findings)
+		}
+	}
+
+	corrupt := corruptPackage(t)
+	defer corrupt.Close()
+	if _, err := corrupt.Check(&CheckOptions{Fix: true}); err != nil {
+		t.Fatal(err)
+	}
+	fixed := reopen(t, corrupt)
+	defer fixed.Close()
+	if findings, err := fixed.Check(nil); err != nil || len(findings) != 0 {
+		t.Errorf("Expected no problems after fixing, got %v (error %v)", findings, err)
+	}
+	collection, err := fixed.Collection()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if deck := collection.Decks[1464446999755]; deck.ConfigID != DefaultDeckConfigID {
+		t.Errorf("Unexpected deck config: %d", deck.ConfigID)
+	}
+	if deck := collection.Decks[777]; deck == nil || deck.Name != "recovered777" {
+		t.Errorf("Unexpected recovered deck: %+v", deck)
+	}
+	var notes []*Note
+	if err := fixed.db.Select(&notes, "SELECT id, guid, mid, flds FROM notes ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || notes[1].GUID == notes[0].GUID || !reflect.DeepEqual(notes[1].FieldValues, FieldValues{"Front", ""}) {
+		t.Errorf("Unexpected notes: %+v", notes)
+	}
+	var cards []ID
+	if err := fixed.db.Select(&cards, "SELECT id FROM cards WHERE queue=2"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cards, []ID{1388721683902}) {
+		t.Errorf("Unexpected cards: %v", cards)
+	}
+	var graves int
+	if err := fixed.db.Get(&graves, "SELECT COUNT(*) FROM graves"); err != nil {
+		t.Fatal(err)
+	}
+	if graves != 4 {
+		t.Errorf("Expected 4 graves, found %d", graves)
+	}
+}
+
+func TestFixFieldCount(t *testing.T) {
+	for _, test := range []struct {
+		fields   FieldValues
+		n        int
+		expected FieldValues
+	}{
+		{FieldValues{"a"}, 3, FieldValues{"a", "", ""}},
+		{FieldValues{"a", "b", "c"}, 2, FieldValues{"a", "b; c"}},
+		{FieldValues{"a", "b"}, 0, FieldValues{}},
+	} {
+		if result := fixFieldCount(test.fields, test.n); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%q to %d: Expected %q, got %q", test.fields, test.n, test.expected, result)
+		}
+	}
+}
+
+func TestCheckLatestFormat(t *testing.T) {
+	apkg, err := ReadBytes(latestPackage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	if _, err := apkg.db.Exec("UPDATE cards SET did=777"); err != nil {
+		t.Fatal(err)
+	}
+	findings, err := apkg.Check(&CheckOptions{Fix: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(findings) == 0 || findings[0].Problem != ProblemMissingDeck || !findings[0].Fixed {
+		t.Errorf("Unexpected findings: %v", findings)
+	}
+	fixed := reopen(t, apkg)
+	defer fixed.Close()
+	collection, err := fixed.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deck := collection.Decks[777]; deck == nil || deck.Name != "recovered777" || deck.Config == nil {
+		t.Errorf("Unexpected recovered deck: %+v", deck)
+	}
+}
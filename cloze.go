@@ -0,0 +1,260 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cloze deletions take the form {{c1::text}} or {{c1::text::hint}}, and may
+// be nested, as in {{c1::The capital of {{c2::France}}}}. The parsing and
+// rendering rules here follow those of Anki's own cloze implementation.
+
+// clozeNode is either a string of plain text, or a *cloze.
+type clozeNode interface{}
+
+type cloze struct {
+	number int
+	nodes  []clozeNode
+	hint   string
+	// open is the literal opening tag, used if the cloze is never closed.
+	open string
+}
+
+var reClozeOpen = regexp.MustCompile(`^{{c(\d+)::`)
+
+// parseClozes parses text into a tree of text and cloze nodes.
+func parseClozes(text string) []clozeNode {
+	root := &cloze{}
+	stack := []*cloze{root}
+	appendText := func(c *cloze, text string) {
+		if text == "" {
+			return
+		}
+		if n := len(c.nodes); n > 0 {
+			if prev, ok := c.nodes[n-1].(string); ok {
+				c.nodes[n-1] = prev + text
+				return
+			}
+		}
+		c.nodes = append(c.nodes, text)
+	}
+	for len(text) > 0 {
+		current := stack[len(stack)-1]
+		open := strings.Index(text, "{{c")
+		closing := -1
+		if len(stack) > 1 {
+			closing = strings.Index(text, "}}")
+		}
+		if closing >= 0 && (open < 0 || closing < open) {
+			appendText(current, text[:closing])
+			text = text[closing+2:]
+			// A hint follows the first '::' of the cloze's trailing text.
+			if n := len(current.nodes); n > 0 {
+				if last, ok := current.nodes[n-1].(string); ok {
+					if i := strings.Index(last, "::"); i >= 0 {
+						current.hint = last[i+2:]
+						current.nodes[n-1] = last[:i]
+					}
+				}
+			}
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1].nodes = append(stack[len(stack)-1].nodes, current)
+			continue
+		}
+		if open < 0 {
+			appendText(current, text)
+			break
+		}
+		appendText(current, text[:open])
+		text = text[open:]
+		m := reClozeOpen.FindStringSubmatch(text)
+		if m == nil {
+			appendText(current, "{{c")
+			text = text[3:]
+			continue
+		}
+		number, err := strconv.Atoi(m[1])
+		if err != nil || number < 1 {
+			appendText(current, m[0])
+			text = text[len(m[0]):]
+			continue
+		}
+		stack = append(stack, &cloze{number: number, open: m[0]})
+		text = text[len(m[0]):]
+	}
+	// Any clozes which were never closed are treated as plain text.
+	for len(stack) > 1 {
+		unclosed := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		parent := stack[len(stack)-1]
+		appendText(parent, unclosed.open)
+		for _, node := range unclosed.nodes {
+			if s, ok := node.(string); ok {
+				appendText(parent, s)
+			} else {
+				parent.nodes = append(parent.nodes, node)
+			}
+		}
+	}
+	return root.nodes
+}
+
+// ClozeNumbers returns the sorted, de-duplicated cloze numbers (1 for c1, 2
+// for c2, etc) present in text, including those of nested clozes.
+func ClozeNumbers(text string) []int {
+	return clozeNumbers(text)
+}
+
+func clozeNumbers(texts ...string) []int {
+	seen := make(map[int]bool)
+	var walk func(nodes []clozeNode)
+	walk = func(nodes []clozeNode) {
+		for _, node := range nodes {
+			if c, ok := node.(*cloze); ok {
+				seen[c.number] = true
+				walk(c.nodes)
+			}
+		}
+	}
+	for _, text := range texts {
+		walk(parseClozes(text))
+	}
+	numbers := make([]int, 0, len(seen))
+	for number := range seen {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// ClozeCardOrdinals returns the ordinals of the cards which should exist for
+// a note of a cloze model: one for each cloze number found in the fields
+// referenced by {{cloze:Field}} in the model's template. As card ordinals are
+// zero-based, the card for c1 has ordinal 0. Anki always generates at least
+// the first card, so the result is never empty.
+func ClozeCardOrdinals(model *Model, note *Note) []int {
+	return clozeCardOrdinals(model, note.FieldValues)
+}
+
+func clozeCardOrdinals(model *Model, fields FieldValues) []int {
+	var texts []string
+	if len(model.Templates) > 0 {
+		for _, name := range clozeFieldNames(model.Templates[0].QuestionFormat) {
+			for i, field := range model.Fields {
+				if field.Name == name && i < len(fields) {
+					texts = append(texts, fields[i])
+				}
+			}
+		}
+	}
+	numbers := clozeNumbers(texts...)
+	if len(numbers) == 0 {
+		return []int{0}
+	}
+	ords := make([]int, len(numbers))
+	for i, number := range numbers {
+		ords[i] = number - 1
+	}
+	return ords
+}
+
+// clozeFieldNames returns the names of the fields passed through the cloze
+// filter in a template format.
+func clozeFieldNames(format string) []string {
+	nodes, err := parseTemplate(format)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	var walk func(nodes []templateNode)
+	walk = func(nodes []templateNode) {
+		for _, node := range nodes {
+			switch n := node.(type) {
+			case *replacementNode:
+				for _, filter := range n.filters {
+					if filter == "cloze" {
+						names = append(names, n.field)
+						break
+					}
+				}
+			case *conditionalNode:
+				walk(n.children)
+			}
+		}
+	}
+	walk(nodes)
+	return names
+}
+
+// RevealCloze renders the clozes in text for the card of the given cloze
+// number. On the question side, the active cloze is hidden behind its hint
+// (or "[...]"); on the answer side, it is revealed and highlighted. Inactive
+// clozes are shown on both sides. If text contains no active cloze, the
+// result is empty, as in Anki.
+func RevealCloze(text string, number int, question bool) string {
+	buf := &strings.Builder{}
+	var found bool
+	for _, node := range parseClozes(text) {
+		revealCloze(buf, node, number, question, &found)
+	}
+	if !found {
+		return ""
+	}
+	return buf.String()
+}
+
+func revealCloze(buf *strings.Builder, node clozeNode, number int, question bool, found *bool) {
+	c, ok := node.(*cloze)
+	if !ok {
+		buf.WriteString(node.(string))
+		return
+	}
+	active := c.number == number
+	if active {
+		*found = true
+	}
+	if active && question {
+		// The hidden content of the cloze is made available to scripts.
+		content := &strings.Builder{}
+		for _, child := range c.nodes {
+			revealCloze(content, child, number, false, new(bool))
+		}
+		buf.WriteString(`<span class="cloze" data-cloze="`)
+		buf.WriteString(html.EscapeString(content.String()))
+		buf.WriteString(`" data-ordinal="`)
+		buf.WriteString(strconv.Itoa(c.number))
+		buf.WriteString(`">`)
+		buf.WriteString(c.hintText())
+		buf.WriteString(`</span>`)
+		return
+	}
+	if active {
+		buf.WriteString(`<span class="cloze" data-ordinal="`)
+	} else {
+		buf.WriteString(`<span class="cloze-inactive" data-ordinal="`)
+	}
+	buf.WriteString(strconv.Itoa(c.number))
+	buf.WriteString(`">`)
+	for _, child := range c.nodes {
+		revealCloze(buf, child, number, question, found)
+	}
+	buf.WriteString(`</span>`)
+}
+
+func (c *cloze) hintText() string {
+	if c.hint == "" {
+		return "[...]"
+	}
+	return "[" + c.hint + "]"
+}
+
+// clozeFilter implements the {{cloze:Field}} template filter.
+func clozeFilter(text string, ctx *FilterContext) string {
+	return RevealCloze(text, ctx.Ordinal+1, ctx.Question)
+}
@@ -0,0 +1,117 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClozeNumbers(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []int
+	}{
+		{text: "no clozes", expected: []int{}},
+		{text: "{{c1::one}} {{c3::three}} {{c1::again}}", expected: []int{1, 3}},
+		{text: "{{c1::The capital of {{c2::France}}}}", expected: []int{1, 2}},
+		{text: "{{c1::unclosed", expected: []int{}},
+		{text: "{{c0::zero}} {{cx::x}}", expected: []int{}},
+	}
+	for _, test := range tests {
+		if numbers := ClozeNumbers(test.text); !reflect.DeepEqual(numbers, test.expected) {
+			t.Errorf("%s: Expected %v, got %v", test.text, test.expected, numbers)
+		}
+	}
+}
+
+func TestRevealCloze(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		number   int
+		question bool
+		expected string
+	}{
+		{
+			name:     "question",
+			text:     "{{c1::Paris}} is in {{c2::France}}",
+			number:   1,
+			question: true,
+			expected: `<span class="cloze" data-cloze="Paris" data-ordinal="1">[...]</span> is in <span class="cloze-inactive" data-ordinal="2">France</span>`,
+		},
+		{
+			name:     "answer",
+			text:     "{{c1::Paris}} is in {{c2::France}}",
+			number:   1,
+			expected: `<span class="cloze" data-ordinal="1">Paris</span> is in <span class="cloze-inactive" data-ordinal="2">France</span>`,
+		},
+		{
+			name:     "hint",
+			text:     "{{c1::Paris::city}}",
+			number:   1,
+			question: true,
+			expected: `<span class="cloze" data-cloze="Paris" data-ordinal="1">[city]</span>`,
+		},
+		{
+			name:     "no active cloze",
+			text:     "{{c1::Paris}}",
+			number:   2,
+			question: true,
+			expected: "",
+		},
+		{
+			name:     "nested outer",
+			text:     "{{c1::The capital of {{c2::France}}}}",
+			number:   1,
+			question: true,
+			expected: `<span class="cloze" data-cloze="The capital of &lt;span class=&#34;cloze-inactive&#34; data-ordinal=&#34;2&#34;&gt;France&lt;/span&gt;" data-ordinal="1">[...]</span>`,
+		},
+		{
+			name:     "nested inner",
+			text:     "{{c1::The capital of {{c2::France}}}}",
+			number:   2,
+			question: true,
+			expected: `<span class="cloze-inactive" data-ordinal="1">The capital of <span class="cloze" data-cloze="France" data-ordinal="2">[...]</span></span>`,
+		},
+		{
+			name:     "nested inner answer",
+			text:     "{{c1::The capital of {{c2::France}}}}",
+			number:   2,
+			expected: `<span class="cloze-inactive" data-ordinal="1">The capital of <span class="cloze" data-ordinal="2">France</span></span>`,
+		},
+		{
+			name:     "unclosed",
+			text:     "{{c1::a}} {{c2::b",
+			number:   1,
+			expected: `<span class="cloze" data-ordinal="1">a</span> {{c2::b`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := RevealCloze(test.text, test.number, test.question); result != test.expected {
+				t.Errorf("Unexpected result.\nExpected: %s\n  Actual: %s", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestRenderCloze(t *testing.T) {
+	model := clozeModel()
+	note := &Note{FieldValues: FieldValues{"{{c1::Amsterdam}} is in {{c2::the Netherlands::country}}", "extra"}}
+	if ords := ClozeCardOrdinals(model, note); !reflect.DeepEqual(ords, []int{0, 1}) {
+		t.Errorf("Unexpected card ordinals: %v", ords)
+	}
+	card, err := Render(model, note, 1, nil)
+	if err != nil {
+		t.Fatalf("Error rendering card: %s", err)
+	}
+	style := "<style></style>"
+	if expected := style + `<span class="cloze-inactive" data-ordinal="1">Amsterdam</span> is in <span class="cloze" data-cloze="the Netherlands" data-ordinal="2">[country]</span>`; card.Question != expected {
+		t.Errorf("Unexpected question: %s", card.Question)
+	}
+	if expected := style + `<span class="cloze-inactive" data-ordinal="1">Amsterdam</span> is in <span class="cloze" data-ordinal="2">the Netherlands</span><br>extra`; card.Answer != expected {
+		t.Errorf("Unexpected answer: %s", card.Answer)
+	}
+}
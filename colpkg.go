@@ -0,0 +1,117 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ReadColpkg reads a *.colpkg collection backup, returning an Apkg struct for
+// processing. A backup is laid out in the same way as an *.apkg package, but
+// contains the user's entire collection.
+func ReadColpkg(f string) (*Apkg, error) {
+	return ReadFile(f)
+}
+
+// OpenCollection opens a bare collection database, such as the
+// collection.anki2 file in an Anki profile folder, returning an Apkg struct
+// for processing. Media files are read from mediaDir, which is normally the
+// collection.media folder alongside the database; if it is empty, the
+// collection has no media files.
+//
+// The database is copied before it is read, so it is never modified. It
+// should not be open in Anki at the time, as changes which Anki has not yet
+// written back from its write-ahead log would be missed.
+func OpenCollection(path, mediaDir string) (*Apkg, error) {
+	return OpenCollectionWithOptions(path, mediaDir, nil)
+}
+
+// OpenCollectionWithOptions opens a bare collection database, as
+// OpenCollection does, copying the database as opts specifies. If opts is
+// nil, the default options are used.
+func OpenCollectionWithOptions(path, mediaDir string, opts *OpenOptions) (*Apkg, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db, err := OpenDBWithOptions(f, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Apkg{
+		db:    db,
+		media: &dirIndex{dir: mediaDir},
+	}, nil
+}
+
+// dirIndex provides access to media files stored in a directory.
+type dirIndex struct {
+	dir string
+}
+
+func (di *dirIndex) list() []string {
+	if di.dir == "" {
+		return []string{}
+	}
+	files, err := ioutil.ReadDir(di.dir)
+	if err != nil {
+		return []string{}
+	}
+	filenames := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			filenames = append(filenames, file.Name())
+		}
+	}
+	return filenames
+}
+
+// path returns the path of the named media file, or false if name is not
+// the name of a file in the directory.
+func (di *dirIndex) path(name string) (string, bool) {
+	// Media files are never in subdirectories, so any path is refused.
+	if di.dir == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", false
+	}
+	return filepath.Join(di.dir, name), true
+}
+
+func (di *dirIndex) ReadFile(name string) ([]byte, error) {
+	notFound := errors.New("File `" + name + "` not found in media directory")
+	path, ok := di.path(name)
+	if !ok {
+		return nil, notFound
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, notFound
+	}
+	return data, err
+}
+
+func (di *dirIndex) open(name string) (io.ReadCloser, error) {
+	if _, err := di.stat(name); err != nil {
+		return nil, err
+	}
+	path, _ := di.path(name)
+	return os.Open(path)
+}
+
+func (di *dirIndex) stat(name string) (fs.FileInfo, error) {
+	path, ok := di.path(name)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() {
+		return nil, fs.ErrNotExist
+	}
+	return info, err
+}
@@ -0,0 +1,126 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReadColpkg(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.colpkg")
+	if err := ioutil.WriteFile(path, latestPackage(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	colpkg, err := ReadColpkg(path)
+	if err != nil {
+		t.Fatalf("Error opening backup: %s", err)
+	}
+	defer colpkg.Close()
+	if _, err := colpkg.Collection(); err != nil {
+		t.Errorf("Error getting collection: %s", err)
+	}
+}
+
+func TestOpenCollection(t *testing.T) {
+	src, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	// Lay out the package as it would be found in a profile folder.
+	dir := t.TempDir()
+	mediaDir := filepath.Join(dir, "collection.media")
+	if err := os.Mkdir(mediaDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	expected := src.ListFiles()
+	sort.Strings(expected)
+	for _, name := range expected {
+		data, err := src.ReadMediaFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(mediaDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dbFile := filepath.Join(dir, "collection.anki2")
+	f, err := os.Create(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.db.dump(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenCollection(filepath.Join(dir, "missing.anki2"), mediaDir); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error opening a missing collection: %v", err)
+	}
+	col, err := OpenCollection(dbFile, mediaDir)
+	if err != nil {
+		t.Fatalf("Error opening collection: %s", err)
+	}
+	defer col.Close()
+
+	collection, err := col.Collection()
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	if collection.Config.CollapseTime != 1200 {
+		t.Errorf("Spot-check failed")
+	}
+	notes, err := col.Notes()
+	if err != nil {
+		t.Fatalf("Error fetching notes: %s", err)
+	}
+	if !notes.Next() {
+		t.Errorf("Expected notes")
+	}
+	_ = notes.Close()
+
+	files := col.ListFiles()
+	sort.Strings(files)
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected files %v, got %v", expected, files)
+	}
+	want, _ := src.ReadMediaFile(expected[0])
+	if got, err := col.ReadMediaFile(expected[0]); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Unexpected media file content (error %v)", err)
+	}
+	for _, name := range []string{"missing.png", "../collection.anki2", ".."} {
+		if _, err := col.ReadMediaFile(name); err == nil {
+			t.Errorf("%s: Expected an error", name)
+		}
+		if err := col.AddMedia(name, []byte("x")); name != "missing.png" && err == nil {
+			t.Errorf("%s: Expected an error adding media", name)
+		}
+	}
+
+	// Added media files are written to the media folder by SaveMedia only.
+	if err := col.AddMedia(expected[0], []byte("x")); err == nil {
+		t.Errorf("Expected an error adding an existing media file")
+	}
+	if _, err := col.WriteTo(ioutil.Discard); err != nil {
+		t.Fatalf("Error saving collection: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(mediaDir, "missing.png")); !os.IsNotExist(err) {
+		t.Errorf("Added media file written by WriteTo: %v", err)
+	}
+	if err := col.SaveMedia(mediaDir); err != nil {
+		t.Fatalf("Error saving media: %s", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(mediaDir, "missing.png")); err != nil || string(data) != "x" {
+		t.Errorf("Added media file not written: %q, %v", data, err)
+	}
+}
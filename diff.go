@@ -0,0 +1,519 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangeType describes how an object differs between two packages.
+type ChangeType string
+
+const (
+	ChangeAdded    ChangeType = "added"
+	ChangeRemoved  ChangeType = "removed"
+	ChangeModified ChangeType = "modified"
+	ChangeRenamed  ChangeType = "renamed" // Media files only
+)
+
+// Changeset describes the differences between two packages, as returned by
+// Diff. Its String method renders it for humans, and it may be marshalled to
+// JSON.
+type Changeset struct {
+	Models []*ModelChange `json:"models,omitempty"`
+	Decks  []*DeckChange  `json:"decks,omitempty"`
+	Notes  []*NoteChange  `json:"notes,omitempty"`
+	Media  []*MediaChange `json:"media,omitempty"`
+}
+
+// PropertyChange is a change to a single property of a note type or deck.
+// Values are rendered as text; options which are not strings are rendered as
+// JSON.
+type PropertyChange struct {
+	Property string `json:"property"`
+	Old      string `json:"old"`
+	New      string `json:"new"`
+}
+
+// ModelChange describes a note type which differs, matched by ID.
+type ModelChange struct {
+	ID      ID                `json:"id"`
+	Name    string            `json:"name"`
+	Type    ChangeType        `json:"type"`
+	Changes []*PropertyChange `json:"changes,omitempty"` // For modified note types
+}
+
+// DeckChange describes a deck which differs, matched by ID. Changes to the
+// options of a deck's options group are included for each deck using it.
+type DeckChange struct {
+	ID      ID                `json:"id"`
+	Name    string            `json:"name"`
+	Type    ChangeType        `json:"type"`
+	Changes []*PropertyChange `json:"changes,omitempty"` // For modified decks
+}
+
+// NoteChange describes a note which differs, matched by GUID. For added and
+// removed notes, all of the note's fields and tags are included.
+type NoteChange struct {
+	GUID    string         `json:"guid"`
+	Type    ChangeType     `json:"type"`
+	Model   string         `json:"model"` // The name of the note's note type
+	Fields  []*FieldChange `json:"fields,omitempty"`
+	OldTags []string       `json:"oldTags,omitempty"`
+	NewTags []string       `json:"newTags,omitempty"`
+}
+
+// FieldChange describes a field of a note which differs, matched by name.
+type FieldChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// MediaChange describes a media file which differs. Files are matched by
+// name, and a file removed under one name and added under another, with the
+// same content, is reported as renamed.
+type MediaChange struct {
+	Name    string     `json:"name"`
+	OldName string     `json:"oldName,omitempty"` // For renamed files
+	Type    ChangeType `json:"type"`
+	OldHash string     `json:"oldHash,omitempty"` // Hex-encoded SHA1 hash
+	NewHash string     `json:"newHash,omitempty"`
+}
+
+// Empty returns true if there are no differences.
+func (c *Changeset) Empty() bool {
+	return len(c.Models) == 0 && len(c.Decks) == 0 && len(c.Notes) == 0 && len(c.Media) == 0
+}
+
+// Diff returns the differences between the packages old and new.
+func Diff(old, new *Apkg) (*Changeset, error) {
+	oldCol, err := old.Collection()
+	if err != nil {
+		return nil, err
+	}
+	newCol, err := new.Collection()
+	if err != nil {
+		return nil, err
+	}
+	c := &Changeset{
+		Models: diffModels(oldCol.Models, newCol.Models),
+		Decks:  diffDecks(oldCol, newCol),
+	}
+	if c.Notes, err = diffNotes(old, new, oldCol, newCol); err != nil {
+		return nil, err
+	}
+	if c.Media, err = diffMedia(old, new); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func diffModels(old, new Models) []*ModelChange {
+	var changes []*ModelChange
+	for id, model := range old {
+		if _, ok := new[id]; !ok {
+			changes = append(changes, &ModelChange{ID: id, Name: model.Name, Type: ChangeRemoved})
+		}
+	}
+	for id, model := range new {
+		oldModel, ok := old[id]
+		if !ok {
+			changes = append(changes, &ModelChange{ID: id, Name: model.Name, Type: ChangeAdded})
+			continue
+		}
+		if props := diffModel(oldModel, model); len(props) > 0 {
+			changes = append(changes, &ModelChange{ID: id, Name: model.Name, Type: ChangeModified, Changes: props})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+	return changes
+}
+
+func diffModel(old, new *Model) []*PropertyChange {
+	d := &propertyDiff{}
+	d.compare("name", old.Name, new.Name)
+	d.compare("type", fmt.Sprint(old.Type), fmt.Sprint(new.Type))
+	d.compare("flds", fieldNames(old), fieldNames(new))
+	d.compare("sortf", sortFieldName(old), sortFieldName(new))
+	d.compare("css", old.CSS, new.CSS)
+	d.compare("latexPre", old.LatexPre, new.LatexPre)
+	d.compare("latexPost", old.LatexPost, new.LatexPost)
+	oldTemplates := make(map[string]*Template, len(old.Templates))
+	oldNames := make([]string, len(old.Templates))
+	for i, tmpl := range old.Templates {
+		oldTemplates[tmpl.Name] = tmpl
+		oldNames[i] = tmpl.Name
+	}
+	newNames := make([]string, len(new.Templates))
+	for i, tmpl := range new.Templates {
+		newNames[i] = tmpl.Name
+	}
+	d.compare("tmpls", strings.Join(oldNames, ", "), strings.Join(newNames, ", "))
+	for _, tmpl := range new.Templates {
+		oldTmpl, ok := oldTemplates[tmpl.Name]
+		if !ok {
+			continue
+		}
+		prefix := "tmpls[" + tmpl.Name + "]."
+		d.compare(prefix+"qfmt", oldTmpl.QuestionFormat, tmpl.QuestionFormat)
+		d.compare(prefix+"afmt", oldTmpl.AnswerFormat, tmpl.AnswerFormat)
+		d.compare(prefix+"bqfmt", oldTmpl.BrowserQuestionFormat, tmpl.BrowserQuestionFormat)
+		d.compare(prefix+"bafmt", oldTmpl.BrowserAnswerFormat, tmpl.BrowserAnswerFormat)
+	}
+	return d.changes
+}
+
+func fieldNames(m *Model) string {
+	names := make([]string, len(m.Fields))
+	for i, field := range m.Fields {
+		names[i] = field.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+func sortFieldName(m *Model) string {
+	if m.SortField < len(m.Fields) {
+		return m.Fields[m.SortField].Name
+	}
+	return ""
+}
+
+// propertyDiff collects the properties which differ.
+type propertyDiff struct {
+	changes []*PropertyChange
+}
+
+func (d *propertyDiff) compare(property, old, new string) {
+	if old != new {
+		d.changes = append(d.changes, &PropertyChange{Property: property, Old: old, New: new})
+	}
+}
+
+func diffDecks(oldCol, newCol *Collection) []*DeckChange {
+	var changes []*DeckChange
+	for id, deck := range oldCol.Decks {
+		if _, ok := newCol.Decks[id]; !ok {
+			changes = append(changes, &DeckChange{ID: id, Name: deck.Name, Type: ChangeRemoved})
+		}
+	}
+	for id, deck := range newCol.Decks {
+		oldDeck, ok := oldCol.Decks[id]
+		if !ok {
+			changes = append(changes, &DeckChange{ID: id, Name: deck.Name, Type: ChangeAdded})
+			continue
+		}
+		d := &propertyDiff{}
+		d.compare("name", oldDeck.Name, deck.Name)
+		d.compare("desc", oldDeck.Description, deck.Description)
+		d.compare("dyn", fmt.Sprint(oldDeck.Dynamic), fmt.Sprint(deck.Dynamic))
+		oldConf, newConf := oldCol.DeckConfigs[oldDeck.ConfigID], newCol.DeckConfigs[deck.ConfigID]
+		if !deck.Dynamic && !oldDeck.Dynamic {
+			d.compare("conf", deckConfigName(oldConf), deckConfigName(newConf))
+			diffDeckOptions(d, oldConf, newConf)
+		}
+		if len(d.changes) > 0 {
+			changes = append(changes, &DeckChange{ID: id, Name: deck.Name, Type: ChangeModified, Changes: d.changes})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		return changes[i].ID < changes[j].ID
+	})
+	return changes
+}
+
+func deckConfigName(dc *DeckConfig) string {
+	if dc == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s (%d)", dc.Name, dc.ID)
+}
+
+// diffDeckOptions compares the options of two deck options groups, by their
+// JSON keys. The ID, name, modification time and update sequence number are
+// not options.
+func diffDeckOptions(d *propertyDiff, old, new *DeckConfig) {
+	oldOptions, newOptions := flattenOptions(old), flattenOptions(new)
+	keys := make([]string, 0, len(newOptions))
+	for key := range oldOptions {
+		keys = append(keys, key)
+	}
+	for key := range newOptions {
+		if _, ok := oldOptions[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		d.compare(key, oldOptions[key], newOptions[key])
+	}
+}
+
+func flattenOptions(dc *DeckConfig) map[string]string {
+	options := make(map[string]string)
+	if dc == nil {
+		return options
+	}
+	blob, err := json.Marshal(dc)
+	if err != nil {
+		return options
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(blob, &v); err != nil {
+		return options
+	}
+	for _, key := range []string{"id", "name", "mod", "usn"} {
+		delete(v, key)
+	}
+	flattenJSON("", v, options)
+	return options
+}
+
+// flattenJSON adds the values in v to options, keyed by their dot-separated
+// paths. Values other than objects are rendered as JSON.
+func flattenJSON(prefix string, v interface{}, options map[string]string) {
+	if obj, ok := v.(map[string]interface{}); ok {
+		for key, value := range obj {
+			flattenJSON(prefix+key+".", value, options)
+		}
+		return
+	}
+	blob, _ := json.Marshal(v)
+	options[strings.TrimSuffix(prefix, ".")] = string(blob)
+}
+
+func diffNotes(old, new *Apkg, oldCol, newCol *Collection) ([]*NoteChange, error) {
+	oldNotes, err := notesByGUID(old)
+	if err != nil {
+		return nil, err
+	}
+	newNotes, err := notesByGUID(new)
+	if err != nil {
+		return nil, err
+	}
+	var changes []*NoteChange
+	for guid, note := range oldNotes {
+		if _, ok := newNotes[guid]; !ok {
+			change := &NoteChange{GUID: guid, Type: ChangeRemoved, Model: modelName(oldCol, note), OldTags: strings.Fields(note.Tags)}
+			for _, field := range namedFields(oldCol, note) {
+				change.Fields = append(change.Fields, &FieldChange{Name: field.name, Old: field.value})
+			}
+			changes = append(changes, change)
+		}
+	}
+	for guid, note := range newNotes {
+		oldNote, ok := oldNotes[guid]
+		if !ok {
+			change := &NoteChange{GUID: guid, Type: ChangeAdded, Model: modelName(newCol, note), NewTags: strings.Fields(note.Tags)}
+			for _, field := range namedFields(newCol, note) {
+				change.Fields = append(change.Fields, &FieldChange{Name: field.name, New: field.value})
+			}
+			changes = append(changes, change)
+			continue
+		}
+		change := &NoteChange{GUID: guid, Type: ChangeModified, Model: modelName(newCol, note)}
+		oldFields := namedFields(oldCol, oldNote)
+		oldValues := make(map[string]string, len(oldFields))
+		for _, field := range oldFields {
+			oldValues[field.name] = field.value
+		}
+		newFields := namedFields(newCol, note)
+		newValues := make(map[string]string, len(newFields))
+		for _, field := range newFields {
+			newValues[field.name] = field.value
+			if oldValues[field.name] != field.value {
+				change.Fields = append(change.Fields, &FieldChange{Name: field.name, Old: oldValues[field.name], New: field.value})
+			}
+		}
+		for _, field := range oldFields {
+			if _, ok := newValues[field.name]; !ok && field.value != "" {
+				change.Fields = append(change.Fields, &FieldChange{Name: field.name, Old: field.value})
+			}
+		}
+		oldTags, newTags := strings.Fields(oldNote.Tags), strings.Fields(note.Tags)
+		if strings.Join(oldTags, " ") != strings.Join(newTags, " ") {
+			change.OldTags, change.NewTags = oldTags, newTags
+		}
+		if len(change.Fields) > 0 || change.OldTags != nil || change.NewTags != nil {
+			changes = append(changes, change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].GUID < changes[j].GUID })
+	return changes, nil
+}
+
+func notesByGUID(a *Apkg) (map[string]*Note, error) {
+	notes, err := a.Notes()
+	if err != nil {
+		return nil, err
+	}
+	defer notes.Close()
+	result := make(map[string]*Note)
+	for notes.Next() {
+		note, err := notes.Note()
+		if err != nil {
+			return nil, err
+		}
+		result[note.GUID] = note
+	}
+	return result, notes.Err()
+}
+
+func modelName(col *Collection, note *Note) string {
+	if model, ok := col.Models[note.ModelID]; ok {
+		return model.Name
+	}
+	return ""
+}
+
+type namedField struct {
+	name, value string
+}
+
+// namedFields pairs a note's field values with the names of its note type's
+// fields. Values without a field are named by their position.
+func namedFields(col *Collection, note *Note) []namedField {
+	fields := make([]namedField, len(note.FieldValues))
+	model := col.Models[note.ModelID]
+	for i, value := range note.FieldValues {
+		fields[i] = namedField{name: fmt.Sprintf("#%d", i+1), value: value}
+		if model != nil && i < len(model.Fields) {
+			fields[i].name = model.Fields[i].Name
+		}
+	}
+	return fields
+}
+
+func diffMedia(old, new *Apkg) ([]*MediaChange, error) {
+	oldHashes, err := mediaHashes(old)
+	if err != nil {
+		return nil, err
+	}
+	newHashes, err := mediaHashes(new)
+	if err != nil {
+		return nil, err
+	}
+	// Removed files, by hash, are candidates for renames.
+	removed := make(map[string][]string)
+	for _, name := range sortedKeys(oldHashes) {
+		if _, ok := newHashes[name]; !ok {
+			removed[oldHashes[name]] = append(removed[oldHashes[name]], name)
+		}
+	}
+	var changes []*MediaChange
+	for _, name := range sortedKeys(newHashes) {
+		hash := newHashes[name]
+		oldHash, ok := oldHashes[name]
+		switch {
+		case !ok && len(removed[hash]) > 0:
+			changes = append(changes, &MediaChange{Name: name, OldName: removed[hash][0], Type: ChangeRenamed, OldHash: hash, NewHash: hash})
+			removed[hash] = removed[hash][1:]
+		case !ok:
+			changes = append(changes, &MediaChange{Name: name, Type: ChangeAdded, NewHash: hash})
+		case oldHash != hash:
+			changes = append(changes, &MediaChange{Name: name, Type: ChangeModified, OldHash: oldHash, NewHash: hash})
+		}
+	}
+	for hash, names := range removed {
+		for _, name := range names {
+			changes = append(changes, &MediaChange{Name: name, Type: ChangeRemoved, OldHash: hash})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mediaHashes(a *Apkg) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, name := range a.ListFiles() {
+		data, err := a.ReadMediaFile(name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha1.Sum(data)
+		hashes[name] = hex.EncodeToString(sum[:])
+	}
+	return hashes, nil
+}
+
+// String renders the changeset as text, one line per change, with the
+// properties, fields and tags which changed indented below each.
+func (c *Changeset) String() string {
+	buf := &strings.Builder{}
+	for _, m := range c.Models {
+		fmt.Fprintf(buf, "%s note type %q (%d)\n", changeSymbol(m.Type), m.Name, m.ID)
+		writeProperties(buf, m.Changes)
+	}
+	for _, d := range c.Decks {
+		fmt.Fprintf(buf, "%s deck %q (%d)\n", changeSymbol(d.Type), d.Name, d.ID)
+		writeProperties(buf, d.Changes)
+	}
+	for _, n := range c.Notes {
+		fmt.Fprintf(buf, "%s note %s (%s)\n", changeSymbol(n.Type), n.GUID, n.Model)
+		for _, f := range n.Fields {
+			switch n.Type {
+			case ChangeAdded:
+				fmt.Fprintf(buf, "    %s: %q\n", f.Name, f.New)
+			case ChangeRemoved:
+				fmt.Fprintf(buf, "    %s: %q\n", f.Name, f.Old)
+			default:
+				fmt.Fprintf(buf, "    %s: %q -> %q\n", f.Name, f.Old, f.New)
+			}
+		}
+		switch {
+		case n.Type == ChangeAdded && len(n.NewTags) > 0:
+			fmt.Fprintf(buf, "    tags: %s\n", strings.Join(n.NewTags, " "))
+		case n.Type == ChangeRemoved && len(n.OldTags) > 0:
+			fmt.Fprintf(buf, "    tags: %s\n", strings.Join(n.OldTags, " "))
+		case n.Type == ChangeModified && (n.OldTags != nil || n.NewTags != nil):
+			fmt.Fprintf(buf, "    tags: %q -> %q\n", strings.Join(n.OldTags, " "), strings.Join(n.NewTags, " "))
+		}
+	}
+	for _, m := range c.Media {
+		switch m.Type {
+		case ChangeRenamed:
+			fmt.Fprintf(buf, "%s media %s -> %s\n", changeSymbol(m.Type), m.OldName, m.Name)
+		case ChangeModified:
+			fmt.Fprintf(buf, "%s media %s (%.8s -> %.8s)\n", changeSymbol(m.Type), m.Name, m.OldHash, m.NewHash)
+		default:
+			fmt.Fprintf(buf, "%s media %s (%.8s)\n", changeSymbol(m.Type), m.Name, m.OldHash+m.NewHash)
+		}
+	}
+	return buf.String()
+}
+
+func changeSymbol(t ChangeType) string {
+	switch t {
+	case ChangeAdded:
+		return "+"
+	case ChangeRemoved:
+		return "-"
+	case ChangeRenamed:
+		return ">"
+	}
+	return "~"
+}
+
+func writeProperties(buf *strings.Builder, changes []*PropertyChange) {
+	for _, p := range changes {
+		fmt.Fprintf(buf, "    %s: %q -> %q\n", p.Property, p.Old, p.New)
+	}
+}
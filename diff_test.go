@@ -0,0 +1,171 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if c, err := Diff(old, old); err != nil || !c.Empty() {
+		t.Errorf("Expected no differences, got %v (error %v)", c, err)
+	}
+
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := collection.Models[1357356563296]
+	model.CSS = ".card {}"
+	if err := apkg.UpdateModel(model); err != nil {
+		t.Fatal(err)
+	}
+	deck := collection.Decks[1464446999755]
+	deck.Name = "Renamed"
+	if err := apkg.UpdateDeck(deck); err != nil {
+		t.Fatal(err)
+	}
+	conf := collection.DeckConfigs[1]
+	conf.New.PerDay = 99
+	if err := apkg.UpdateDeckConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	notes, err := apkg.Notes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes.Next()
+	note, err := notes.Note()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes.Close()
+	note.FieldValues[1] = "Changed"
+	note.Tags = "frase nuevo"
+	if err := apkg.UpdateNote(note); err != nil {
+		t.Fatal(err)
+	}
+	if err := apkg.AddMedia("new.png", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	updated := reopen(t, apkg)
+	defer updated.Close()
+
+	c, err := Diff(old, updated)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(c.Models) != 1 || len(c.Models[0].Changes) != 1 || c.Models[0].Changes[0].Property != "css" || c.Models[0].Changes[0].New != ".card {}" {
+		t.Errorf("Unexpected note type changes: %+v", c.Models)
+	}
+	perDay := &PropertyChange{Property: "new.perDay", Old: "20", New: "99"}
+	expectedDecks := []*DeckChange{
+		{ID: 1, Name: "Default", Type: ChangeModified, Changes: []*PropertyChange{perDay}},
+		{ID: 1464446999755, Name: "Renamed", Type: ChangeModified, Changes: []*PropertyChange{
+			{Property: "name", Old: "Test", New: "Renamed"},
+			perDay,
+		}},
+	}
+	if !reflect.DeepEqual(c.Decks, expectedDecks) {
+		blob, _ := json.Marshal(c.Decks)
+		t.Errorf("Unexpected deck changes: %s", blob)
+	}
+	expectedNotes := []*NoteChange{{
+		GUID:    "MP5xLm~cCq",
+		Type:    ChangeModified,
+		Model:   "Sans-serif-light font note type",
+		Fields:  []*FieldChange{{Name: "Back", Old: "We had reached the top when it started to rain.", New: "Changed"}},
+		OldTags: []string{"frase"},
+		NewTags: []string{"frase", "nuevo"},
+	}}
+	if !reflect.DeepEqual(c.Notes, expectedNotes) {
+		blob, _ := json.Marshal(c.Notes)
+		t.Errorf("Unexpected note changes: %s", blob)
+	}
+	sum := sha1.Sum([]byte("new"))
+	expectedMedia := []*MediaChange{{Name: "new.png", Type: ChangeAdded, NewHash: hex.EncodeToString(sum[:])}}
+	if !reflect.DeepEqual(c.Media, expectedMedia) {
+		t.Errorf("Unexpected media changes: %+v", c.Media)
+	}
+
+	blob, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result Changeset
+	if err := json.Unmarshal(blob, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&result, c) {
+		t.Errorf("Changeset did not round-trip through JSON: %s", blob)
+	}
+
+	text := c.String()
+	for _, line := range []string{
+		`~ note type "Sans-serif-light font note type" (1357356563296)`,
+		`    name: "Test" -> "Renamed"`,
+		`~ note MP5xLm~cCq (Sans-serif-light font note type)`,
+		`    Back: "We had reached the top when it started to rain." -> "Changed"`,
+		`    tags: "frase" -> "frase nuevo"`,
+		`+ media new.png (` + c.Media[0].NewHash[:8] + `)`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, text)
+		}
+	}
+}
+
+func TestDiffMediaRenamed(t *testing.T) {
+	old, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	changes, err := diffMedia(old, &Apkg{media: &renamedIndex{old.media}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Type != ChangeRenamed || changes[0].OldName != "_c.png" || changes[0].Name != "_z.png" {
+		t.Errorf("Unexpected changes: %+v", changes)
+	}
+}
+
+// renamedIndex presents the media files of another index, with _c.png
+// renamed to _z.png.
+type renamedIndex struct {
+	mediaIndex
+}
+
+func (ri *renamedIndex) list() []string {
+	var files []string
+	for _, name := range ri.mediaIndex.list() {
+		if name == "_c.png" {
+			name = "_z.png"
+		}
+		files = append(files, name)
+	}
+	return files
+}
+
+func (ri *renamedIndex) ReadFile(name string) ([]byte, error) {
+	if name == "_z.png" {
+		name = "_c.png"
+	}
+	return ri.mediaIndex.ReadFile(name)
+}
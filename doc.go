@@ -1,7 +1,7 @@
 // Copyright: Jonathan Hall
 // License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
 
-// Package anki provides a library to read *.apkg files produced by Anki
+// Package anki provides a library to read and write *.apkg files used by Anki
 // (http://ankisrs.net/).
 //
 // A *.apkg file is simply a zip-compressed archive, which contains a the
@@ -11,6 +11,15 @@
 //	- media                 -- A JSON blob mapping media file filenames to numbers
 //	- [files numbered 0..n] -- Media files (referenced in the media file above)
 //
+// Packages exported by Anki 2.1 also contain a collection.anki21 database,
+// which is read in preference to collection.anki2. From schema version 14
+// onwards, the JSON columns of the col table are replaced by the config,
+// notetypes, fields, templates, decks, deck_config and tags tables; these are
+// read into the same types described below. Packages exported by Anki 2.1.50
+// and later instead contain a zstd-compressed collection.anki21b database, and
+// the media file and media files themselves are zstd-compressed, with the
+// media file holding a protocol buffer rather than JSON.
+//
 // The SQLite3 Database contains the following tables. Detailed explanations
 // of each column's use can be found inline below, in the struct definitions.
 //
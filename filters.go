@@ -0,0 +1,97 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+)
+
+// builtinFilters are the template filters provided by Anki itself. The
+// {{type:Field}} filter is handled by the renderer directly, as it must see
+// the whole filter chain.
+var builtinFilters = map[string]Filter{
+	"text":     textFilter,
+	"hint":     hintFilter,
+	"furigana": furiganaFilter,
+	"kana":     kanaFilter,
+	"kanji":    kanjiFilter,
+	"tts":      ttsFilter,
+	"cloze":    clozeFilter,
+}
+
+// textFilter implements {{text:Field}}, which strips all HTML.
+func textFilter(text string, _ *FilterContext) string {
+	return stripHTML(text)
+}
+
+// hintFilter implements {{hint:Field}}, which hides the field behind a link
+// that reveals it when clicked.
+func hintFilter(text string, ctx *FilterContext) string {
+	if strings.TrimSpace(text) == "" {
+		return text
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(text))
+	_, _ = h.Write([]byte(ctx.FieldName))
+	id := h.Sum64()
+	return fmt.Sprintf(`
+<a class=hint href="#"
+onclick="this.style.display='none';
+document.getElementById('hint%d').style.display='block';
+return false;" draggable=false>
+%s</a>
+<div id="hint%d" class=hint style="display: none">%s</div>
+`, id, ctx.FieldName, id, text)
+}
+
+// reFurigana matches readings in the form 漢字[かんじ]. A leading space
+// separates the reading's base text from any preceding text, and is
+// consumed.
+var reFurigana = regexp.MustCompile(` ?([^ >]+?)\[(.+?)\]`)
+
+// replaceFurigana calls fn with the base text and reading of each furigana
+// reading in text. References to sounds, such as [sound:foo.mp3], are left
+// untouched.
+func replaceFurigana(text string, fn func(base, reading string) string) string {
+	text = strings.Replace(text, "&nbsp;", " ", -1)
+	return reFurigana.ReplaceAllStringFunc(text, func(match string) string {
+		m := reFurigana.FindStringSubmatch(match)
+		if strings.HasPrefix(m[2], "sound:") {
+			return match
+		}
+		return fn(m[1], m[2])
+	})
+}
+
+// furiganaFilter implements {{furigana:Field}}, which renders readings as
+// ruby text.
+func furiganaFilter(text string, _ *FilterContext) string {
+	return replaceFurigana(text, func(base, reading string) string {
+		return "<ruby><rb>" + base + "</rb><rt>" + reading + "</rt></ruby>"
+	})
+}
+
+// kanaFilter implements {{kana:Field}}, which shows only the readings.
+func kanaFilter(text string, _ *FilterContext) string {
+	return replaceFurigana(text, func(_, reading string) string {
+		return reading
+	})
+}
+
+// kanjiFilter implements {{kanji:Field}}, which shows only the base text.
+func kanjiFilter(text string, _ *FilterContext) string {
+	return replaceFurigana(text, func(base, _ string) string {
+		return base
+	})
+}
+
+// ttsFilter implements {{tts lang:Field}}, which marks the field to be read
+// by a text-to-speech engine. Any options, such as the language and voices,
+// are passed through.
+func ttsFilter(text string, ctx *FilterContext) string {
+	return "[anki:tts lang=" + ctx.Args + "]" + text + "[/anki:tts]"
+}
@@ -0,0 +1,86 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	model := &Model{
+		Fields: []*Field{
+			{Name: "Front"},
+			{Name: "Reading"},
+			{Name: "Text"},
+		},
+		Templates: []*Template{{Name: "Card 1"}},
+	}
+	note := &Note{FieldValues: FieldValues{
+		"<b>bold</b>&nbsp;&amp; plain",
+		"日本[にほん] 語[ご][sound:nihongo.mp3]",
+		"{{c1::Tokyo}}",
+	}}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{format: "{{text:Front}}", expected: "bold & plain"},
+		{format: "{{furigana:Reading}}", expected: "<ruby><rb>日本</rb><rt>にほん</rt></ruby><ruby><rb>語</rb><rt>ご</rt></ruby>[sound:nihongo.mp3]"},
+		{format: "{{kana:Reading}}", expected: "にほんご[sound:nihongo.mp3]"},
+		{format: "{{kanji:Reading}}", expected: "日本語[sound:nihongo.mp3]"},
+		{format: "{{tts en_US:Front}}", expected: "[anki:tts lang=en_US]<b>bold</b>&nbsp;&amp; plain[/anki:tts]"},
+		{format: "{{tts ja_JP voices=Apple_Otoya:kanji:Reading}}", expected: "[anki:tts lang=ja_JP voices=Apple_Otoya]日本語[sound:nihongo.mp3][/anki:tts]"},
+		{format: "{{type:Front}}", expected: "[[type:Front]]"},
+		{format: "{{type:cloze:Text}}", expected: "[[type:cloze:Text]]"},
+		{format: "{{text:cloze:Text}}", expected: `[...]`},
+	}
+	r := NewRenderer()
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			model.Templates[0].QuestionFormat = test.format
+			card, err := r.Render(model, note, 0, nil)
+			if err != nil {
+				t.Fatalf("Error rendering: %s", err)
+			}
+			if q := strings.TrimPrefix(card.Question, "<style></style>"); q != test.expected {
+				t.Errorf("Unexpected result.\nExpected: %s\n  Actual: %s", test.expected, q)
+			}
+		})
+	}
+}
+
+func TestHintFilter(t *testing.T) {
+	ctx := &FilterContext{FieldName: "Extra"}
+	if result := hintFilter("  ", ctx); result != "  " {
+		t.Errorf("Expected empty hint to be unchanged, got %q", result)
+	}
+	result := hintFilter("secret", ctx)
+	if !strings.Contains(result, "<a class=hint href=\"#\"") || !strings.Contains(result, "\nExtra</a>") || !strings.Contains(result, `style="display: none">secret</div>`) {
+		t.Errorf("Unexpected hint: %s", result)
+	}
+}
+
+func TestRegisterFilter(t *testing.T) {
+	model := &Model{
+		Fields:    []*Field{{Name: "Front"}},
+		Templates: []*Template{{Name: "Card 1", QuestionFormat: "{{shout:Front}} {{shout 3:text:Front}}"}},
+	}
+	note := &Note{FieldValues: FieldValues{"<i>hi</i>"}}
+	r := NewRenderer()
+	r.RegisterFilter("shout", func(text string, ctx *FilterContext) string {
+		if ctx.FieldName != "Front" || !ctx.Question {
+			t.Errorf("Unexpected context: %+v", ctx)
+		}
+		return strings.ToUpper(text) + ctx.Args
+	})
+	card, err := r.Render(model, note, 0, nil)
+	if err != nil {
+		t.Fatalf("Error rendering: %s", err)
+	}
+	if expected := "<style></style><I>HI</I> HI3"; card.Question != expected {
+		t.Errorf("Unexpected result: %s", card.Question)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FSRSWeights are the 19 parameters of the FSRS-5 model. See
+// https://github.com/open-spaced-repetition/fsrs4anki/wiki/The-Algorithm
+type FSRSWeights [19]float64
+
+// DefaultFSRSWeights are the default FSRS-5 parameters, as used by Anki
+// before the parameters have been optimized for a collection.
+var DefaultFSRSWeights = FSRSWeights{
+	0.40255, 1.18385, 3.173, 15.69105, 7.1949, 0.5345, 1.4604, 0.0046, 1.54575, 0.1192,
+	1.01925, 1.9395, 0.11, 0.29605, 2.2698, 0.2315, 2.9898, 0.51655, 0.6621,
+}
+
+// fsrsWeightBounds are the ranges within which each parameter is clamped
+// during optimization.
+var fsrsWeightBounds = [19][2]float64{
+	{fsrsMinStability, 100}, {fsrsMinStability, 100}, {fsrsMinStability, 100}, {fsrsMinStability, 100},
+	{1, 10}, {0.001, 4}, {0.001, 4}, {0.001, 0.75}, {0, 4.5}, {0, 0.8},
+	{0.001, 3.5}, {0.001, 5}, {0.001, 0.25}, {0.001, 0.9}, {0, 4},
+	{0, 1}, {1, 6}, {0, 2}, {0, 2},
+}
+
+const (
+	fsrsDecay        = -0.5
+	fsrsFactor       = 19.0 / 81.0
+	fsrsMinStability = 0.01
+	fsrsMaxStability = 36500
+)
+
+// FSRS implements the Free Spaced Repetition Scheduler (FSRS-5) memory
+// model, which estimates the stability and difficulty of a card from its
+// review history.
+//
+// As with Anki, reviews are grouped into days starting at the collection's
+// creation time. Reviews on the same day as the previous review use FSRS's
+// short-term stability formula.
+type FSRS struct {
+	collection *Collection
+	// Weights are the model parameters. They default to DefaultFSRSWeights,
+	// and may be replaced with the result of Optimize.
+	Weights FSRSWeights
+	// DesiredRetention is the probability of recall at which cards are
+	// scheduled for review. It defaults to 0.9.
+	DesiredRetention float64
+	// MaximumInterval is the longest interval, in days, that will be
+	// scheduled. It defaults to 36500.
+	MaximumInterval int
+}
+
+// NewFSRS returns a new FSRS for cards in the provided collection, with the
+// default parameters.
+func NewFSRS(collection *Collection) *FSRS {
+	return &FSRS{
+		collection:       collection,
+		Weights:          DefaultFSRSWeights,
+		DesiredRetention: 0.9,
+		MaximumInterval:  36500,
+	}
+}
+
+// MemoryState describes the FSRS memory state of a card.
+type MemoryState struct {
+	// Stability is the number of days after which the probability of recall
+	// falls to 90%.
+	Stability float64
+	// Difficulty ranges from 1 (easiest) to 10 (hardest).
+	Difficulty float64
+	// Retrievability is the estimated probability of recall at the time for
+	// which the state was computed.
+	Retrievability float64
+}
+
+// fsrsReview is a review reduced to what the FSRS model needs.
+type fsrsReview struct {
+	elapsed int // Days since the previous review
+	rating  int // 1-4
+}
+
+// MemoryState computes the memory state of a card at the given time from
+// its review history. reviews must all belong to the same card, but may be
+// in any order; reviews without a rating, such as manual reschedules, are
+// ignored. nil is returned if the card has never been reviewed.
+func (f *FSRS) MemoryState(reviews []*Review, now time.Time) *MemoryState {
+	history, lastDay := f.history(reviews)
+	if len(history) == 0 {
+		return nil
+	}
+	s, d := f.Weights.replay(history)
+	elapsed := f.day(now) - lastDay
+	return &MemoryState{
+		Stability:      s,
+		Difficulty:     d,
+		Retrievability: retrievability(float64(elapsed), s),
+	}
+}
+
+// Schedule answers a card with the given ease at the given time. It returns
+// the card's new memory state, which includes the retrievability at the time
+// of the answer, and the interval until the card should next be reviewed to
+// achieve the desired retention. reviews is the card's previous history, as
+// for MemoryState.
+func (f *FSRS) Schedule(reviews []*Review, ease ReviewEase, now time.Time) (*MemoryState, DurationSeconds, error) {
+	if ease < ReviewEaseWrong || ease > ReviewEaseEasy {
+		return nil, 0, fmt.Errorf("Invalid ease %d", ease)
+	}
+	history, lastDay := f.history(reviews)
+	today := f.day(now)
+	r := 1.0
+	if len(history) > 0 {
+		s, _ := f.Weights.replay(history)
+		r = retrievability(float64(today-lastDay), s)
+	}
+	history = append(history, fsrsReview{elapsed: today - lastDay, rating: int(ease)})
+	s, d := f.Weights.replay(history)
+	state := &MemoryState{
+		Stability:      s,
+		Difficulty:     d,
+		Retrievability: r,
+	}
+	return state, f.NextInterval(s), nil
+}
+
+// NextInterval returns the interval after which the probability of
+// recalling a card with the given stability falls to the desired retention.
+// Intervals are rounded to whole days, between one day and MaximumInterval.
+func (f *FSRS) NextInterval(stability float64) DurationSeconds {
+	ivl := stability / fsrsFactor * (math.Pow(f.DesiredRetention, 1/fsrsDecay) - 1)
+	days := math.Max(1, math.Round(ivl))
+	if f.MaximumInterval > 0 {
+		days = math.Min(days, float64(f.MaximumInterval))
+	}
+	return DurationSeconds(time.Duration(days) * secondsPerDay * time.Second)
+}
+
+// day returns the number of days between the collection's creation and t.
+func (f *FSRS) day(t time.Time) int {
+	secs := t.Unix() - seconds(f.collection.Created)
+	day := secs / secondsPerDay
+	if secs < 0 && secs%secondsPerDay != 0 {
+		day--
+	}
+	return int(day)
+}
+
+// history sorts the rated reviews of a card chronologically, and returns
+// them along with the day of the last review.
+func (f *FSRS) history(reviews []*Review) ([]fsrsReview, int) {
+	rated := make([]*Review, 0, len(reviews))
+	for _, review := range reviews {
+		if review.Ease >= ReviewEaseWrong && review.Ease <= ReviewEaseEasy && review.Timestamp != nil {
+			rated = append(rated, review)
+		}
+	}
+	sort.SliceStable(rated, func(i, j int) bool {
+		return time.Time(*rated[i].Timestamp).Before(time.Time(*rated[j].Timestamp))
+	})
+	history := make([]fsrsReview, len(rated))
+	var lastDay int
+	for i, review := range rated {
+		day := f.day(time.Time(*review.Timestamp))
+		if i > 0 {
+			history[i].elapsed = day - lastDay
+		}
+		history[i].rating = int(review.Ease)
+		lastDay = day
+	}
+	return history, lastDay
+}
+
+// retrievability returns the probability of recall after elapsed days, for
+// a card with the given stability.
+func retrievability(elapsed, stability float64) float64 {
+	return math.Pow(1+fsrsFactor*elapsed/stability, fsrsDecay)
+}
+
+// replay returns the stability and difficulty after the reviews in history.
+func (w *FSRSWeights) replay(history []fsrsReview) (float64, float64) {
+	s, d := w.init(history[0].rating)
+	for _, review := range history[1:] {
+		s, d = w.next(s, d, review)
+	}
+	return s, d
+}
+
+// init returns the stability and difficulty after a card's first review.
+func (w *FSRSWeights) init(rating int) (float64, float64) {
+	s := math.Max(fsrsMinStability, w[rating-1])
+	d := math.Min(math.Max(w.initDifficulty(rating), 1), 10)
+	return s, d
+}
+
+func (w *FSRSWeights) initDifficulty(rating int) float64 {
+	return w[4] - math.Exp(w[5]*float64(rating-1)) + 1
+}
+
+// next returns the stability and difficulty after a review, given those
+// before it.
+func (w *FSRSWeights) next(s, d float64, review fsrsReview) (float64, float64) {
+	g := float64(review.rating)
+	var newS float64
+	switch {
+	case review.elapsed <= 0:
+		// Short-term review, on the same day as the last.
+		newS = s * math.Exp(w[17]*(g-3+w[18]))
+	case review.rating == 1:
+		r := retrievability(float64(review.elapsed), s)
+		newS = w[11] * math.Pow(d, -w[12]) * (math.Pow(s+1, w[13]) - 1) * math.Exp(w[14]*(1-r))
+		newS = math.Min(newS, s/math.Exp(w[17]*w[18]))
+	default:
+		r := retrievability(float64(review.elapsed), s)
+		hard, easy := 1.0, 1.0
+		if review.rating == 2 {
+			hard = w[15]
+		}
+		if review.rating == 4 {
+			easy = w[16]
+		}
+		newS = s * (1 + math.Exp(w[8])*(11-d)*math.Pow(s, -w[9])*(math.Exp(w[10]*(1-r))-1)*hard*easy)
+	}
+	newS = math.Min(math.Max(newS, fsrsMinStability), fsrsMaxStability)
+
+	newD := d - w[6]*(g-3)*(10-d)/9
+	// Mean reversion towards the initial difficulty of an easy card.
+	newD = w[7]*w.initDifficulty(4) + (1-w[7])*newD
+	newD = math.Min(math.Max(newD, 1), 10)
+	return newS, newD
+}
+
+// Optimize fits the FSRS parameters to a collection's review log, starting
+// from f.Weights, and returns the result. reviews may include the reviews of
+// any number of cards, in any order. The parameters are chosen to minimize
+// the log loss of the model's predicted retrievability at each review on a
+// later day than the card's previous review.
+//
+// Optimization runs entirely in-process; the work is spread across all
+// available CPUs.
+func (f *FSRS) Optimize(reviews []*Review) (FSRSWeights, error) {
+	byCard := make(map[ID][]*Review)
+	for _, review := range reviews {
+		byCard[review.CardID] = append(byCard[review.CardID], review)
+	}
+	histories := make([][]fsrsReview, 0, len(byCard))
+	var items int
+	for _, cardReviews := range byCard {
+		history, _ := f.history(cardReviews)
+		if len(history) < 2 {
+			continue
+		}
+		for _, review := range history[1:] {
+			if review.elapsed > 0 {
+				items++
+			}
+		}
+		histories = append(histories, history)
+	}
+	if items == 0 {
+		return f.Weights, errors.New("Not enough reviews to optimize FSRS parameters")
+	}
+	return optimizeFSRS(f.Weights, histories, items), nil
+}
+
+const (
+	fsrsIterations   = 200
+	fsrsLearningRate = 0.04
+	fsrsGradientStep = 1e-5
+)
+
+// optimizeFSRS minimizes fsrsLoss with the Adam optimizer. Gradients are
+// estimated by central differences.
+func optimizeFSRS(w FSRSWeights, histories [][]fsrsReview, items int) FSRSWeights {
+	const beta1, beta2, epsilon = 0.9, 0.999, 1e-8
+	var m, v FSRSWeights
+	best, bestLoss := w, fsrsLoss(&w, histories)/float64(items)
+	for t := 1; t <= fsrsIterations; t++ {
+		grad := fsrsGradient(w, histories)
+		for i := range w {
+			g := grad[i] / float64(items)
+			m[i] = beta1*m[i] + (1-beta1)*g
+			v[i] = beta2*v[i] + (1-beta2)*g*g
+			mHat := m[i] / (1 - math.Pow(beta1, float64(t)))
+			vHat := v[i] / (1 - math.Pow(beta2, float64(t)))
+			w[i] -= fsrsLearningRate * mHat / (math.Sqrt(vHat) + epsilon)
+			w[i] = math.Min(math.Max(w[i], fsrsWeightBounds[i][0]), fsrsWeightBounds[i][1])
+		}
+		if loss := fsrsLoss(&w, histories) / float64(items); loss < bestLoss {
+			best, bestLoss = w, loss
+		}
+	}
+	return best
+}
+
+// fsrsGradient computes the gradient of fsrsLoss with respect to each
+// parameter, in parallel.
+func fsrsGradient(w FSRSWeights, histories [][]fsrsReview) FSRSWeights {
+	var grad FSRSWeights
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i := range w {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			plus, minus := w, w
+			plus[i] += fsrsGradientStep
+			minus[i] -= fsrsGradientStep
+			grad[i] = (fsrsLoss(&plus, histories) - fsrsLoss(&minus, histories)) / (2 * fsrsGradientStep)
+		}(i)
+	}
+	wg.Wait()
+	return grad
+}
+
+// fsrsLoss returns the total binary cross-entropy between the predicted
+// retrievability and the outcome of each review on a later day than the
+// previous review.
+func fsrsLoss(w *FSRSWeights, histories [][]fsrsReview) float64 {
+	const epsilon = 1e-7
+	var loss float64
+	for _, history := range histories {
+		s, d := w.init(history[0].rating)
+		for _, review := range history[1:] {
+			if review.elapsed > 0 {
+				r := math.Min(math.Max(retrievability(float64(review.elapsed), s), epsilon), 1-epsilon)
+				if review.rating > 1 {
+					loss -= math.Log(r)
+				} else {
+					loss -= math.Log(1 - r)
+				}
+			}
+			s, d = w.next(s, d, review)
+		}
+	}
+	return loss
+}
@@ -0,0 +1,139 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func fsrsTestCollection() (*Collection, time.Time) {
+	collection := NewBuilder().Collection()
+	crt := time.Date(2020, 1, 1, 4, 0, 0, 0, time.UTC)
+	collection.Created = timestampSeconds(crt)
+	return collection, crt
+}
+
+func fsrsTestReview(cardID ID, at time.Time, ease ReviewEase) *Review {
+	return &Review{CardID: cardID, Timestamp: timestampMilliseconds(at), Ease: ease}
+}
+
+func TestFSRSMemoryState(t *testing.T) {
+	collection, crt := fsrsTestCollection()
+	f := NewFSRS(collection)
+	day := func(n int, hour int) time.Time {
+		return crt.AddDate(0, 0, n).Add(time.Duration(hour) * time.Hour)
+	}
+	if state := f.MemoryState(nil, day(0, 1)); state != nil {
+		t.Errorf("Expected nil state for a new card, got %+v", state)
+	}
+	// Deliberately out of order, and with a manual reschedule.
+	reviews := []*Review{
+		fsrsTestReview(1, day(3, 2), ReviewEaseOK),
+		fsrsTestReview(1, day(0, 1), ReviewEaseOK),
+		fsrsTestReview(1, day(2, 0), 0),
+		fsrsTestReview(1, day(0, 2), ReviewEaseOK),
+	}
+	state := f.MemoryState(reviews, day(8, 5))
+	expectFloat(t, "stability", 11.951374948584707, state.Stability)
+	expectFloat(t, "difficulty", 5.263544986114632, state.Difficulty)
+	expectFloat(t, "retrievability", math.Pow(1+19.0/81*5/11.951374948584707, -0.5), state.Retrievability)
+
+	state, ivl, err := f.Schedule(reviews, ReviewEaseWrong, day(13, 0))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expectFloat(t, "stability", 2.2266354368885883, state.Stability)
+	expectFloat(t, "difficulty", 6.784232087673549, state.Difficulty)
+	expectFloat(t, "retrievability", 0.9142935535302019, state.Retrievability)
+	if expected := DurationSeconds(2 * 24 * time.Hour); ivl != expected {
+		t.Errorf("Expected interval %s, got %s", time.Duration(expected), time.Duration(ivl))
+	}
+
+	if _, _, err := f.Schedule(nil, 0, day(0, 0)); err == nil || err.Error() != "Invalid ease 0" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func expectFloat(t *testing.T, name string, expected, actual float64) {
+	t.Helper()
+	if math.Abs(expected-actual) > 1e-9 {
+		t.Errorf("Expected %s %v, got %v", name, expected, actual)
+	}
+}
+
+func TestFSRSNextInterval(t *testing.T) {
+	collection, _ := fsrsTestCollection()
+	f := NewFSRS(collection)
+	tests := []struct {
+		stability float64
+		retention float64
+		expected  int
+	}{
+		{stability: 3.173, retention: 0.9, expected: 3},
+		{stability: 0.1, retention: 0.9, expected: 1},
+		{stability: 10, retention: 0.8, expected: 24},
+		{stability: 1e6, retention: 0.9, expected: 36500},
+	}
+	for _, test := range tests {
+		f.DesiredRetention = test.retention
+		if ivl := f.NextInterval(test.stability); ivl != DurationSeconds(time.Duration(test.expected)*24*time.Hour) {
+			t.Errorf("%v@%v: Expected %d days, got %s", test.stability, test.retention, test.expected, time.Duration(ivl))
+		}
+	}
+}
+
+func TestFSRSOptimize(t *testing.T) {
+	collection, crt := fsrsTestCollection()
+	f := NewFSRS(collection)
+	if _, err := f.Optimize(nil); err == nil || err.Error() != "Not enough reviews to optimize FSRS parameters" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Simulate reviews by a learner whose memory decays more slowly than the
+	// default parameters predict.
+	actual := DefaultFSRSWeights
+	actual[8] = 2.2
+	actual[2] = 6
+	rnd := rand.New(rand.NewSource(1))
+	var reviews []*Review
+	for card := ID(1); card <= 100; card++ {
+		day := rnd.Intn(30)
+		history := []fsrsReview{{rating: 3}}
+		reviews = append(reviews, fsrsTestReview(card, crt.AddDate(0, 0, day), ReviewEaseOK))
+		for i := 0; i < 8; i++ {
+			s, _ := actual.replay(history)
+			elapsed := int(math.Max(1, math.Round(s*(0.5+rnd.Float64()))))
+			rating := 3
+			if rnd.Float64() > retrievability(float64(elapsed), s) {
+				rating = 1
+			}
+			day += elapsed
+			history = append(history, fsrsReview{elapsed: elapsed, rating: rating})
+			reviews = append(reviews, fsrsTestReview(card, crt.AddDate(0, 0, day), ReviewEase(rating)))
+		}
+	}
+
+	weights, err := f.Optimize(reviews)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var histories [][]fsrsReview
+	for card := ID(1); card <= 100; card++ {
+		history, _ := f.history(reviews[(card-1)*9 : card*9])
+		histories = append(histories, history)
+	}
+	before := fsrsLoss(&f.Weights, histories)
+	after := fsrsLoss(&weights, histories)
+	if after >= before {
+		t.Errorf("Expected optimization to reduce loss, got %v -> %v", before, after)
+	}
+	for i, w := range weights {
+		if w < fsrsWeightBounds[i][0] || w > fsrsWeightBounds[i][1] {
+			t.Errorf("Weight %d (%v) out of bounds", i, w)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// These expressions mirror those used by Anki's own stripHTML() and
+// stripHTMLMedia() functions. See https://github.com/dae/anki/blob/master/anki/utils.py
+var (
+	reComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+	reStyle   = regexp.MustCompile(`(?si)<style.*?>.*?</style>`)
+	reScript  = regexp.MustCompile(`(?si)<script.*?>.*?</script>`)
+	reTag     = regexp.MustCompile(`(?s)<.*?>`)
+	reMedia   = regexp.MustCompile(`(?i)<img[^>]+src=["']?([^"'>]+)["']?[^>]*>`)
+)
+
+// stripHTML removes all HTML tags, comments, styles and scripts from s, and
+// converts HTML entities to plain text.
+func stripHTML(s string) string {
+	s = reComment.ReplaceAllString(s, "")
+	s = reStyle.ReplaceAllString(s, "")
+	s = reScript.ReplaceAllString(s, "")
+	s = reTag.ReplaceAllString(s, "")
+	return entitiesToText(s)
+}
+
+// stripHTMLMedia behaves like stripHTML, but preserves the filenames of any
+// embedded images.
+func stripHTMLMedia(s string) string {
+	return stripHTML(reMedia.ReplaceAllString(s, " ${1} "))
+}
+
+func entitiesToText(s string) string {
+	// Anki treats non-breaking spaces as regular spaces.
+	s = strings.Replace(s, "&nbsp;", " ", -1)
+	return html.UnescapeString(s)
+}
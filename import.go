@@ -0,0 +1,734 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ImportOptions controls how a package is imported into a collection.
+type ImportOptions struct {
+	// IncludeScheduling imports the scheduling and review history of the
+	// package's cards. Otherwise, imported cards are added as new cards, and
+	// the review history is not imported.
+	IncludeScheduling bool
+}
+
+// ImportResult summarizes the changes made by Import.
+type ImportResult struct {
+	NotesAdded   int // Notes not already in the collection
+	NotesUpdated int // Notes in the collection which were modified in the package since
+	// NotesSkipped counts notes which were not updated, either as they are
+	// unchanged, or newer in the collection, or as their note type differs.
+	NotesSkipped int
+	CardsAdded   int
+	// MediaAdded lists the media files added to the collection, under the
+	// names they were added as.
+	MediaAdded []string
+	// MediaRenamed maps the names of media files which conflicted with a
+	// different file in the collection to the names they were added as, or
+	// were found under, if imported before.
+	MediaRenamed map[string]string
+}
+
+// Import merges the notes, cards and media of the package src into the
+// package or collection a, following the rules Anki applies when importing a
+// package:
+//
+//   - Note types are matched by ID. A note type whose fields or templates
+//     differ from those of the note type of the same ID in the collection is
+//     added under a new ID, and one which is the same is updated if it was
+//     modified more recently in the package.
+//   - Decks are matched by name. Filtered decks are not imported; their cards
+//     are imported into their original decks.
+//   - Notes are matched by GUID. New notes are added, along with their cards,
+//     and existing ones are updated if they were modified more recently in
+//     the package. Cards the collection lacks are added to existing notes.
+//   - The collection's scheduling is kept, unless opts.IncludeScheduling is
+//     set, in which case the scheduling of the cards of updated notes is
+//     replaced with that in the package.
+//   - Media files are matched by name. A file which differs from the one of
+//     the same name in the collection is added under a name including its
+//     SHA1 hash, and references to it in the imported notes are updated.
+//
+// Notes, cards, decks and note types are given new IDs where theirs are
+// already in use. As with the Update methods, the changes are kept until the
+// package is saved with WriteTo or WriteFile; the media files added to a
+// collection opened with OpenCollection are saved with SaveMedia. If opts is
+// nil, the default options are used.
+func (a *Apkg) Import(src *Apkg, opts *ImportOptions) (*ImportResult, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	col, err := a.cachedCollection()
+	if err != nil {
+		return nil, err
+	}
+	srcCol, err := src.Collection()
+	if err != nil {
+		return nil, err
+	}
+	im := &importer{
+		a:       a,
+		src:     src,
+		col:     col,
+		srcCol:  srcCol,
+		opts:    opts,
+		now:     time.Now(),
+		models:  make(map[ID]ID),
+		decks:   make(map[ID]ID),
+		notes:   make(map[ID]importedNote),
+		nextPos: col.Config.NextPos,
+		result:  &ImportResult{MediaRenamed: make(map[string]string)},
+	}
+	for _, step := range []func() error{
+		im.importMedia,
+		im.importModels,
+		im.importDecks,
+		im.importNotes,
+		im.importCards,
+		im.importReviews,
+	} {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+	if im.nextPos != col.Config.NextPos {
+		conf := col.Config
+		conf.NextPos = im.nextPos
+		if err := a.UpdateConfig(&conf); err != nil {
+			return nil, err
+		}
+	}
+	return im.result, a.touch(im.now)
+}
+
+// importer holds the state of an import, mapping the IDs of the objects in
+// the package to those in the collection.
+type importer struct {
+	a, src      *Apkg
+	col, srcCol *Collection
+	opts        *ImportOptions
+	now         time.Time
+	models      map[ID]ID
+	decks       map[ID]ID
+	notes       map[ID]importedNote
+	cards       map[ID]ID // Cards whose scheduling was imported
+	nextPos     int
+	result      *ImportResult
+}
+
+type importedNote struct {
+	id      ID
+	updated bool
+}
+
+// importMedia adds the package's media files which are not in the
+// collection.
+func (im *importer) importMedia() error {
+	for _, name := range im.src.ListFiles() {
+		data, err := im.src.ReadMediaFile(name)
+		if err != nil {
+			return err
+		}
+		sum := sha1.Sum(data)
+		newName := name
+		existing, err := im.a.ReadMediaFile(name)
+		if err == nil && sha1.Sum(existing) != sum {
+			// The hash in the new name makes it unique to this file, so a
+			// file of that name is the same file, imported before.
+			newName = hashedMediaName(name, sum[:])
+			im.result.MediaRenamed[name] = newName
+			_, err = im.a.ReadMediaFile(newName)
+		}
+		if err == nil {
+			continue
+		}
+		if err := im.a.AddMedia(newName, data); err != nil {
+			return err
+		}
+		im.result.MediaAdded = append(im.result.MediaAdded, newName)
+	}
+	sort.Strings(im.result.MediaAdded)
+	return nil
+}
+
+// hashedMediaName adds the hex-encoded hash to the stem of a media file's
+// name, as Anki does to resolve conflicting names.
+func hashedMediaName(name string, sum []byte) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + hex.EncodeToString(sum) + ext
+}
+
+// These expressions match the media file references Anki rewrites when it
+// renames imported media files.
+var (
+	reImageRef = regexp.MustCompile(`(?i)(<img[^>]+src=["']?)([^"'>]+)`)
+	reSoundRef = regexp.MustCompile(`\[sound:(.+?)\]`)
+)
+
+// renameMediaRefs replaces references to renamed media files in a field.
+func renameMediaRefs(field string, renames map[string]string) string {
+	if len(renames) == 0 {
+		return field
+	}
+	field = reImageRef.ReplaceAllStringFunc(field, func(ref string) string {
+		m := reImageRef.FindStringSubmatch(ref)
+		if name, ok := renames[m[2]]; ok {
+			return m[1] + name
+		}
+		return ref
+	})
+	return reSoundRef.ReplaceAllStringFunc(field, func(ref string) string {
+		m := reSoundRef.FindStringSubmatch(ref)
+		if name, ok := renames[m[1]]; ok {
+			return "[sound:" + name + "]"
+		}
+		return ref
+	})
+}
+
+// importModels maps the package's note types to those in the collection,
+// adding or updating them as needed.
+func (im *importer) importModels() error {
+	for _, model := range sortedModels(im.srcCol.Models) {
+		id := model.ID
+		for {
+			existing, ok := im.col.Models[id]
+			if !ok {
+				m := *model
+				m.ID = id
+				if err := im.a.addModel(&m, im.now); err != nil {
+					return err
+				}
+				break
+			}
+			if sameSchema(existing, model) {
+				if seconds(model.Modified) > seconds(existing.Modified) {
+					m := *model
+					m.ID = id
+					m.Name = existing.Name
+					if err := im.a.UpdateModel(&m); err != nil {
+						return err
+					}
+				}
+				break
+			}
+			id++
+		}
+		im.models[model.ID] = id
+	}
+	return nil
+}
+
+func sortedModels(models Models) []*Model {
+	sorted := make([]*Model, 0, len(models))
+	for _, model := range models {
+		sorted = append(sorted, model)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
+
+// sameSchema returns true if the two note types have the same fields and
+// templates, by name. Anki compares note types the same way when importing.
+func sameSchema(a, b *Model) bool {
+	if len(a.Fields) != len(b.Fields) || len(a.Templates) != len(b.Templates) {
+		return false
+	}
+	for i, field := range a.Fields {
+		if field.Name != b.Fields[i].Name {
+			return false
+		}
+	}
+	for i, tmpl := range a.Templates {
+		if tmpl.Name != b.Templates[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// addModel adds a note type to the collection. If its name is in use, a "+"
+// is appended to it, as Anki does.
+func (a *Apkg) addModel(model *Model, now time.Time) error {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	for nameInUse(col, model.Name) {
+		model.Name += "+"
+	}
+	model.Modified = timestampSeconds(now)
+	model.UpdateSequence = usnPending
+	if a.split["notetypes"] {
+		if _, err := a.db.Exec("INSERT INTO notetypes (id, name, mtime_secs, usn, config) VALUES (?, ?, 0, 0, ?)",
+			int64(model.ID), model.Name, []byte{}); err != nil {
+			return err
+		}
+		err = a.updateNotetypeRows(model, now)
+	} else {
+		err = a.updateColObject("models", model.ID, model)
+	}
+	if err != nil {
+		return err
+	}
+	col.Models[model.ID] = model
+	return nil
+}
+
+func nameInUse(col *Collection, name string) bool {
+	for _, model := range col.Models {
+		if strings.EqualFold(model.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// importDecks maps the package's decks to those in the collection of the
+// same name, adding any the collection lacks, along with their options.
+func (im *importer) importDecks() error {
+	byName := make(map[string]ID, len(im.col.Decks))
+	for _, deck := range im.col.Decks {
+		byName[strings.ToLower(deck.Name)] = deck.ID
+	}
+	decks := make([]*Deck, 0, len(im.srcCol.Decks))
+	for _, deck := range im.srcCol.Decks {
+		decks = append(decks, deck)
+	}
+	// Parents are added before their children.
+	sort.Slice(decks, func(i, j int) bool { return decks[i].Name < decks[j].Name })
+	for _, deck := range decks {
+		if deck.Dynamic {
+			continue
+		}
+		if id, ok := byName[strings.ToLower(deck.Name)]; ok {
+			im.decks[deck.ID] = id
+			continue
+		}
+		if _, ok := im.col.DeckConfigs[deck.ConfigID]; !ok {
+			conf, ok := im.srcCol.DeckConfigs[deck.ConfigID]
+			if !ok {
+				return fmt.Errorf("Deck %d references non-existent config %d", deck.ID, deck.ConfigID)
+			}
+			dc := *conf
+			if err := im.a.addDeckConfig(&dc, im.now); err != nil {
+				return err
+			}
+		}
+		d := *deck
+		for _, ok := im.col.Decks[d.ID]; ok; _, ok = im.col.Decks[d.ID] {
+			d.ID++
+		}
+		if err := im.a.addDeck(&d, im.now); err != nil {
+			return err
+		}
+		im.decks[deck.ID] = d.ID
+		byName[strings.ToLower(d.Name)] = d.ID
+	}
+	return nil
+}
+
+// addDeck adds a deck to the collection.
+func (a *Apkg) addDeck(deck *Deck, now time.Time) error {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	deck.Modified = timestampSeconds(now)
+	deck.UpdateSequence = usnPending
+	if a.split["decks"] {
+		if _, err := a.db.Exec("INSERT INTO decks (id, name, mtime_secs, usn, common, kind) VALUES (?, ?, 0, 0, ?, ?)",
+			int64(deck.ID), deck.Name, []byte{}, []byte{}); err != nil {
+			return err
+		}
+		err = a.updateDeckRow(deck)
+	} else {
+		err = a.updateColObject("decks", deck.ID, deck)
+	}
+	if err != nil {
+		return err
+	}
+	deck.Config = col.DeckConfigs[deck.ConfigID]
+	col.Decks[deck.ID] = deck
+	return nil
+}
+
+// addDeckConfig adds a deck options group to the collection.
+func (a *Apkg) addDeckConfig(dc *DeckConfig, now time.Time) error {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	dc.Modified = timestampSeconds(now)
+	dc.UpdateSequence = usnPending
+	if a.split["deck_config"] {
+		// Schema 14 stores the legacy JSON object, as updateDeckConfigRow
+		// expects to find.
+		config := []byte{}
+		if col.Version < 15 {
+			config = []byte("{}")
+		}
+		if _, err := a.db.Exec("INSERT INTO deck_config (id, name, mtime_secs, usn, config) VALUES (?, ?, 0, 0, ?)",
+			int64(dc.ID), dc.Name, config); err != nil {
+			return err
+		}
+		err = a.updateDeckConfigRow(dc)
+	} else {
+		err = a.updateColObject("dconf", dc.ID, dc)
+	}
+	if err != nil {
+		return err
+	}
+	col.DeckConfigs[dc.ID] = dc
+	return nil
+}
+
+// importNotes adds the package's notes which are not in the collection, and
+// updates those which have since been modified.
+func (im *importer) importNotes() error {
+	type existingNote struct {
+		ID       ID                `db:"id"`
+		ModelID  ID                `db:"mid"`
+		Modified *TimestampSeconds `db:"mod"`
+	}
+	existing := make(map[string]existingNote)
+	rows, err := im.a.db.Queryx("SELECT id, guid, mid, mod FROM notes")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var note struct {
+			existingNote
+			GUID string `db:"guid"`
+		}
+		if err := rows.StructScan(&note); err != nil {
+			return err
+		}
+		existing[note.GUID] = note.existingNote
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	notes, err := im.src.Notes()
+	if err != nil {
+		return err
+	}
+	defer notes.Close()
+	tags := make(map[string]bool)
+	for notes.Next() {
+		note, err := notes.Note()
+		if err != nil {
+			return err
+		}
+		mid, ok := im.models[note.ModelID]
+		if !ok {
+			return fmt.Errorf("Note %d references non-existent note type %d", note.ID, note.ModelID)
+		}
+		model := im.col.Models[mid]
+		for i, field := range note.FieldValues {
+			note.FieldValues[i] = renameMediaRefs(field, im.result.MediaRenamed)
+		}
+		note.ModelID = mid
+		note.Tags = joinTags(strings.Fields(note.Tags))
+		note.UniqueField, note.Checksum = sortFieldAndChecksum(model, note.FieldValues)
+		note.UpdateSequence = usnPending
+
+		srcID := note.ID
+		if old, ok := existing[note.GUID]; ok {
+			if old.ModelID != mid || seconds(note.Modified) <= seconds(old.Modified) {
+				im.result.NotesSkipped++
+				if old.ModelID == mid {
+					im.notes[srcID] = importedNote{id: old.ID}
+				}
+				continue
+			}
+			note.ID = old.ID
+			if _, err := im.a.db.Exec(`UPDATE notes SET mod=?, usn=?, tags=?, flds=?, sfld=?, csum=? WHERE id=?`,
+				seconds(note.Modified),
+				note.UpdateSequence,
+				note.Tags,
+				strings.Join(note.FieldValues, "\x1f"),
+				note.UniqueField,
+				note.Checksum,
+				int64(note.ID),
+			); err != nil {
+				return err
+			}
+			im.notes[srcID] = importedNote{id: note.ID, updated: true}
+			im.result.NotesUpdated++
+		} else {
+			if note.ID, err = im.a.freeID("notes", note.ID); err != nil {
+				return err
+			}
+			if _, err := im.a.db.Exec(`INSERT INTO notes (id, guid, mid, mod, usn, tags, flds, sfld, csum, flags, data)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, '')`,
+				int64(note.ID),
+				note.GUID,
+				int64(note.ModelID),
+				secondsOrNow(note.Modified, im.now),
+				note.UpdateSequence,
+				note.Tags,
+				strings.Join(note.FieldValues, "\x1f"),
+				note.UniqueField,
+				note.Checksum,
+			); err != nil {
+				return err
+			}
+			im.notes[srcID] = importedNote{id: note.ID}
+			im.result.NotesAdded++
+		}
+		for _, tag := range strings.Fields(note.Tags) {
+			tags[tag] = true
+		}
+	}
+	if err := notes.Err(); err != nil {
+		return err
+	}
+	return im.a.registerTags(tags)
+}
+
+// freeID returns id, or if it is in use in table, the next ID after it which
+// is not.
+func (a *Apkg) freeID(table string, id ID) (ID, error) {
+	for {
+		var n int
+		if err := a.db.Get(&n, "SELECT COUNT(*) FROM "+table+" WHERE id=?", int64(id)); err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return id, nil
+		}
+		id++
+	}
+}
+
+// registerTags adds tags to the collection's tag list, if they are not
+// already in it.
+func (a *Apkg) registerTags(tags map[string]bool) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	if a.split["tags"] {
+		for tag := range tags {
+			if _, err := a.db.Exec("INSERT OR IGNORE INTO tags (tag, usn, collapsed, config) VALUES (?, ?, 0, NULL)",
+				tag, usnPending); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return a.updateColJSON("tags", func(blob []byte) ([]byte, error) {
+		cache := make(map[string]json.RawMessage)
+		if err := json.Unmarshal([]byte(collectionTags(string(blob))), &cache); err != nil {
+			return nil, err
+		}
+		for tag := range tags {
+			if _, ok := cache[tag]; !ok {
+				cache[tag] = json.RawMessage("-1")
+			}
+		}
+		return json.Marshal(cache)
+	})
+}
+
+// importCards adds the cards of the imported notes which the collection
+// lacks. The scheduling of the cards of updated notes is replaced if
+// scheduling is being imported.
+func (im *importer) importCards() error {
+	im.cards = make(map[ID]ID)
+	rows, err := im.src.Cards()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var cards []*Card
+	for rows.Next() {
+		card, err := rows.Card()
+		if err != nil {
+			return err
+		}
+		cards = append(cards, card)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// New cards are added to the end of the new card queue, in the order
+	// they have in the package.
+	sort.Slice(cards, func(i, j int) bool {
+		if cards[i].Position != cards[j].Position {
+			return cards[i].Position < cards[j].Position
+		}
+		return cards[i].ID < cards[j].ID
+	})
+	crt := seconds(im.col.Created)
+	for _, card := range cards {
+		note, ok := im.notes[card.NoteID]
+		if !ok {
+			continue
+		}
+		var existing ID
+		err := im.a.db.Get(&existing, "SELECT id FROM cards WHERE nid=? AND ord=?", int64(note.id), card.TemplateID)
+		switch {
+		case err == nil:
+			if !im.opts.IncludeScheduling || !note.updated {
+				continue
+			}
+		case err != sql.ErrNoRows:
+			return err
+		}
+
+		if card.OriginalDeckID != 0 {
+			// Cards in filtered decks are returned to their original decks,
+			// as Anki's importer does: learning cards become new, and the
+			// others return to the queue of their type, due when they
+			// originally were.
+			card.DeckID = card.OriginalDeckID
+			if card.OriginalDue != nil {
+				card.Due = card.OriginalDue
+			}
+			if card.Type == CardTypeLearning {
+				card.Type = CardTypeNew
+			}
+			card.Queue = CardQueue(card.Type)
+			card.OriginalDeckID = 0
+			card.OriginalDue = nil
+		}
+		did, ok := im.decks[card.DeckID]
+		if !ok {
+			did = DefaultDeckID
+		}
+		card.DeckID = did
+		card.NoteID = note.id
+		card.UpdateSequence = usnPending
+		if !im.opts.IncludeScheduling {
+			resetCard(card)
+		}
+		if card.Type == CardTypeNew {
+			card.Position = im.nextPos
+			im.nextPos++
+		}
+		due, ok := encodeDue(card.Queue, card.Type, card.Due, crt, int64(card.Position))
+		if !ok {
+			return fmt.Errorf("Card %d is not new, but has no due time", card.ID)
+		}
+		var ivl int64
+		if card.Interval != nil {
+			ivl = encodeInterval(*card.Interval)
+		}
+
+		srcID := card.ID
+		if existing != 0 {
+			card.ID = existing
+			if _, err := im.a.db.Exec(`UPDATE cards SET did=?, mod=?, usn=?, type=?, queue=?, due=?, ivl=?, factor=?, reps=?, lapses=?, left=?, odue=0, odid=0, flags=? WHERE id=?`,
+				int64(card.DeckID),
+				secondsOrNow(card.Modified, im.now),
+				card.UpdateSequence,
+				int(card.Type),
+				int(card.Queue),
+				due,
+				ivl,
+				encodeFactor(card.Factor),
+				card.ReviewCount,
+				card.Lapses,
+				card.Left,
+				card.Flags,
+				int64(card.ID),
+			); err != nil {
+				return err
+			}
+		} else {
+			if card.ID, err = im.a.freeID("cards", card.ID); err != nil {
+				return err
+			}
+			if _, err := im.a.db.Exec(`INSERT INTO cards (id, nid, did, ord, mod, usn, type, queue, due, ivl, factor, reps, lapses, left, odue, odid, flags, data)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0, ?, '')`,
+				int64(card.ID),
+				int64(card.NoteID),
+				int64(card.DeckID),
+				card.TemplateID,
+				secondsOrNow(card.Modified, im.now),
+				card.UpdateSequence,
+				int(card.Type),
+				int(card.Queue),
+				due,
+				ivl,
+				encodeFactor(card.Factor),
+				card.ReviewCount,
+				card.Lapses,
+				card.Left,
+				card.Flags,
+			); err != nil {
+				return err
+			}
+			im.result.CardsAdded++
+		}
+		if im.opts.IncludeScheduling {
+			im.cards[srcID] = card.ID
+		}
+	}
+	return nil
+}
+
+// resetCard discards a card's scheduling, making it a new card.
+func resetCard(card *Card) {
+	card.Type = CardTypeNew
+	card.Queue = CardQueueNew
+	card.Due = nil
+	card.Interval = nil
+	card.Factor = 0
+	card.ReviewCount = 0
+	card.Lapses = 0
+	card.Left = 0
+}
+
+// importReviews imports the review history of the cards whose scheduling was
+// imported. Reviews already in the collection are skipped.
+func (im *importer) importReviews() error {
+	if len(im.cards) == 0 {
+		return nil
+	}
+	reviews, err := im.src.Reviews()
+	if err != nil {
+		return err
+	}
+	defer reviews.Close()
+	for reviews.Next() {
+		review, err := reviews.Review()
+		if err != nil {
+			return err
+		}
+		cid, ok := im.cards[review.CardID]
+		if !ok {
+			continue
+		}
+		if _, err := im.a.db.Exec(`INSERT OR IGNORE INTO revlog (id, cid, usn, ease, ivl, lastIvl, factor, time, type)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			milliseconds(review.Timestamp),
+			int64(cid),
+			usnPending,
+			int(review.Ease),
+			encodeInterval(review.Interval),
+			encodeInterval(review.LastInterval),
+			encodeFactor(review.Factor),
+			int64(time.Duration(review.ReviewTime)/time.Millisecond),
+			int(review.Type),
+		); err != nil {
+			return err
+		}
+	}
+	return reviews.Err()
+}
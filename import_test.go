@@ -0,0 +1,365 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testNoteGUID = "MP5xLm~cCq"
+
+// importSource builds a package sharing the note type of the test package,
+// with a newer version of its note, and a new note.
+func importSource(t *testing.T) *Apkg {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := json.Marshal(collection.Models[1357356563296])
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := &Model{}
+	if err := json.Unmarshal(blob, model); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBuilder()
+	if err := b.AddModel(model); err != nil {
+		t.Fatal(err)
+	}
+	deck := &Deck{Name: "Test"}
+	if err := b.AddDeck(deck); err != nil {
+		t.Fatal(err)
+	}
+	note, _, err := b.AddNote(model, deck, []string{`Updated <img src="_c.png">`, "Back"}, []string{"new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	note.GUID = testNoteGUID
+	_, cards, err := b.AddNote(model, deck, []string{"New [sound:_c.png]", "Back"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A suspended review card, due 40 days after the test package's
+	// creation.
+	ivl := DurationSeconds(10 * 24 * time.Hour)
+	cards[0].Type = CardTypeReview
+	cards[0].Queue = CardQueueSuspended
+	cards[0].Due = timestampSeconds(time.Unix(1419472800, 0).Add(40 * 24 * time.Hour))
+	cards[0].Interval = &ivl
+	b.AddMedia("_c.png", []byte("different"))
+	b.AddMedia("new.png", []byte("new"))
+	buf := &bytes.Buffer{}
+	if _, err := b.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	src, err := ReadBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func TestImport(t *testing.T) {
+	src := importSource(t)
+	defer src.Close()
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+
+	result, err := apkg.Import(src, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	sum := sha1.Sum([]byte("different"))
+	renamed := hashedMediaName("_c.png", sum[:])
+	expected := &ImportResult{
+		NotesAdded:   1,
+		NotesUpdated: 1,
+		CardsAdded:   1,
+		MediaAdded:   []string{renamed, "new.png"},
+		MediaRenamed: map[string]string{"_c.png": renamed},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	saved := reopen(t, apkg)
+	defer saved.Close()
+	if data, err := saved.ReadMediaFile(renamed); err != nil || string(data) != "different" {
+		t.Errorf("Unexpected media file: %q, %v", data, err)
+	}
+	if data, err := saved.ReadMediaFile("_c.png"); err != nil || string(data) == "different" {
+		t.Errorf("Existing media file was replaced: %v", err)
+	}
+	notes, err := saved.Notes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var newID ID
+	for notes.Next() {
+		note, err := notes.Note()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case note.ID == 1388721680877:
+			if note.GUID != testNoteGUID || note.FieldValues[0] != `Updated <img src="`+renamed+`">` || note.Tags != " new " {
+				t.Errorf("Unexpected updated note: %+v", note)
+			}
+		case strings.HasPrefix(note.FieldValues[0], "New"):
+			newID = note.ID
+			if note.FieldValues[0] != "New [sound:"+renamed+"]" || note.ModelID != 1357356563296 {
+				t.Errorf("Unexpected added note: %+v", note)
+			}
+		default:
+			t.Errorf("Unexpected note: %+v", note)
+		}
+	}
+	notes.Close()
+	cards, err := saved.Cards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cards.Next() {
+		card, err := cards.Card()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if card.DeckID != 1464446999755 {
+			t.Errorf("Card %d is in deck %d", card.ID, card.DeckID)
+		}
+		switch card.NoteID {
+		case 1388721680877:
+			// The existing card keeps its scheduling.
+			if card.Queue != CardQueueReview || time.Duration(*card.Interval) != 12*24*time.Hour {
+				t.Errorf("Unexpected existing card: %+v", card)
+			}
+		case newID:
+			if card.Queue != CardQueueNew || card.Position != 1 {
+				t.Errorf("Unexpected added card: %+v", card)
+			}
+		default:
+			t.Errorf("Unexpected card: %+v", card)
+		}
+	}
+	cards.Close()
+	collection, err := saved.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collection.Models) != 1 || len(collection.Decks) != 2 || collection.Config.NextPos != 2 {
+		t.Errorf("Unexpected collection: %d models, %d decks, next position %d",
+			len(collection.Models), len(collection.Decks), collection.Config.NextPos)
+	}
+
+	// Importing the same package again changes nothing.
+	result, err = saved.Import(src, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected = &ImportResult{
+		NotesSkipped: 2,
+		MediaRenamed: map[string]string{"_c.png": renamed},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected result of second import: %+v", result)
+	}
+}
+
+func TestImportScheduling(t *testing.T) {
+	for _, include := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		if _, err := NewBuilder().WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		apkg, err := ReadBytes(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := ReadFile(ApkgFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := apkg.Import(src, &ImportOptions{IncludeScheduling: include})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if result.NotesAdded != 1 || result.CardsAdded != 1 || len(result.MediaAdded) != 13 {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+		saved := reopen(t, apkg)
+		cards, err := saved.Cards()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cards.Next() {
+			t.Fatal("No cards imported")
+		}
+		card, err := cards.Card()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cards.Close()
+		var reviews int
+		if err := saved.db.Get(&reviews, "SELECT COUNT(*) FROM revlog"); err != nil {
+			t.Fatal(err)
+		}
+		// The due day is kept, relative to the collection's creation time.
+		due := time.Unix(1419472800, 0).Add(28 * 24 * time.Hour)
+		if include {
+			if offset := time.Time(*card.Due).Sub(due); card.Queue != CardQueueReview || offset <= -24*time.Hour || offset >= 24*time.Hour || reviews != 3 {
+				t.Errorf("Scheduling not imported: %+v, %d reviews", card, reviews)
+			}
+		} else if card.Queue != CardQueueNew || card.Position != 1 || card.Interval != nil || reviews != 0 {
+			t.Errorf("Scheduling imported: %+v, %d reviews", card, reviews)
+		}
+		collection, err := saved.Collection()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deck := collection.Decks[card.DeckID]; deck == nil || deck.Name != "Test" || deck.ConfigID != DefaultDeckConfigID {
+			t.Errorf("Unexpected deck: %+v", deck)
+		}
+		saved.Close()
+		src.Close()
+		apkg.Close()
+	}
+}
+
+func TestImportSuspendedCard(t *testing.T) {
+	src := importSource(t)
+	defer src.Close()
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	if _, err := apkg.Import(src, &ImportOptions{IncludeScheduling: true}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	saved := reopen(t, apkg)
+	defer saved.Close()
+	var card struct {
+		Type  CardType  `db:"type"`
+		Queue CardQueue `db:"queue"`
+		Due   int64     `db:"due"`
+		Ivl   int64     `db:"ivl"`
+	}
+	if err := saved.db.Get(&card, `SELECT c.type, c.queue, c.due, c.ivl FROM cards c
+		JOIN notes n ON n.id=c.nid WHERE n.flds LIKE 'New %'`); err != nil {
+		t.Fatal(err)
+	}
+	if card.Type != CardTypeReview || card.Queue != CardQueueSuspended || card.Due != 40 || card.Ivl != 10 {
+		t.Errorf("Unexpected card: %+v", card)
+	}
+}
+
+func TestImportFilteredCard(t *testing.T) {
+	src := importSource(t)
+	defer src.Close()
+	// A learning card in a filtered deck, which has no original due date.
+	if _, err := src.db.Exec(`UPDATE cards SET type=1, queue=1, due=1419472800, odid=did, did=12345, odue=0
+		WHERE nid IN (SELECT id FROM notes WHERE flds LIKE 'New %')`); err != nil {
+		t.Fatal(err)
+	}
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	if _, err := apkg.Import(src, &ImportOptions{IncludeScheduling: true}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var card struct {
+		DeckID ID        `db:"did"`
+		Type   CardType  `db:"type"`
+		Queue  CardQueue `db:"queue"`
+		Due    int64     `db:"due"`
+		ODue   int64     `db:"odue"`
+		ODID   int64     `db:"odid"`
+	}
+	if err := apkg.db.Get(&card, `SELECT c.did, c.type, c.queue, c.due, c.odue, c.odid FROM cards c
+		JOIN notes n ON n.id=c.nid WHERE n.flds LIKE 'New %'`); err != nil {
+		t.Fatal(err)
+	}
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deck, ok := collection.Decks[card.DeckID]; !ok || deck.Name != "Test" {
+		t.Errorf("Card not returned to its original deck: %d", card.DeckID)
+	}
+	// The learning card becomes a new card, at the end of the new queue.
+	if card.Type != CardTypeNew || card.Queue != CardQueueNew || card.ODue != 0 || card.ODID != 0 || card.Due < 1 || card.Due > 10 {
+		t.Errorf("Unexpected card: %+v", card)
+	}
+}
+
+func TestImportNewerFormats(t *testing.T) {
+	for name, pkg := range map[string]func(*testing.T) []byte{
+		"latest":       latestPackage,
+		"split schema": splitSchemaPackage,
+	} {
+		t.Run(name, func(t *testing.T) {
+			apkg, err := ReadBytes(pkg(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer apkg.Close()
+			src := importSource(t)
+			defer src.Close()
+			result, err := apkg.Import(src, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if len(result.MediaAdded) != 2 {
+				t.Errorf("Unexpected media files added: %v", result.MediaAdded)
+			}
+			saved := reopen(t, apkg)
+			defer saved.Close()
+			for _, file := range result.MediaAdded {
+				if data, err := saved.ReadMediaFile(file); err != nil || len(data) == 0 {
+					t.Errorf("Unexpected media file %s: %q, %v", file, data, err)
+				}
+			}
+			collection, err := saved.Collection()
+			if err != nil {
+				t.Fatal(err)
+			}
+			model, ok := collection.Models[1357356563296]
+			if !ok || len(model.Fields) != 2 {
+				t.Fatalf("Note type not imported: %+v", model)
+			}
+			var found bool
+			for _, deck := range collection.Decks {
+				found = found || deck.Name == "Test"
+			}
+			if !found {
+				t.Errorf("Deck not imported")
+			}
+			var notes int
+			if err := saved.db.Get(&notes, "SELECT COUNT(*) FROM notes WHERE mid=?", int64(model.ID)); err != nil {
+				t.Fatal(err)
+			}
+			if notes != 2 {
+				t.Errorf("Expected 2 notes of the imported note type, found %d", notes)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"context"
+	"iter"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// IterOptions limits the rows returned by IterNotes, IterCards and
+// IterReviews. The conditions are applied in the database. A row must meet
+// every condition which is set, and match any of the IDs given by each.
+type IterOptions struct {
+	// DeckIDs limits the rows to the cards in the given decks, including
+	// those moved from them into filtered decks, or to their notes or
+	// reviews.
+	DeckIDs []ID
+	// ModelIDs limits the rows to the notes of the given note types, or to
+	// their cards or reviews.
+	ModelIDs []ID
+	// NoteIDs limits the rows to the given notes, or to their cards or
+	// reviews.
+	NoteIDs []ID
+}
+
+// where returns the conditions of opts, using the subqueries given for
+// each, in which "?" is replaced by the list of IDs.
+func (opts *IterOptions) where(deck, model, note string) (string, []interface{}) {
+	if opts == nil {
+		return "", nil
+	}
+	var (
+		conds []string
+		args  []interface{}
+	)
+	for _, cond := range []struct {
+		ids   []ID
+		query string
+	}{
+		{opts.DeckIDs, deck},
+		{opts.ModelIDs, model},
+		{opts.NoteIDs, note},
+	} {
+		if len(cond.ids) == 0 {
+			continue
+		}
+		conds = append(conds, cond.query)
+		for i := strings.Count(cond.query, "?"); i > 0; i-- {
+			args = append(args, cond.ids)
+		}
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "AND " + strings.Join(conds, " AND ") + "\n", args
+}
+
+// IterNotes returns an iterator over the non-deleted notes in the package,
+// newest first, limited as opts specifies. If opts is nil, every note is
+// returned. The rows are closed once the loop ends; reading stops if ctx is
+// cancelled. An error ends the iteration.
+func (a *Apkg) IterNotes(ctx context.Context, opts *IterOptions) iter.Seq2[*Note, error] {
+	where, args := opts.where(
+		"n.id IN (SELECT nid FROM cards WHERE did IN (?) OR odid IN (?))",
+		"n.mid IN (?)",
+		"n.id IN (?)",
+	)
+	return iterRows[Note](ctx, a.db, notesQuery+where+"ORDER BY id DESC", args)
+}
+
+// IterCards returns an iterator over the non-deleted cards in the package,
+// newest first, limited as opts specifies. If opts is nil, every card is
+// returned. The rows are closed once the loop ends; reading stops if ctx is
+// cancelled. An error ends the iteration.
+func (a *Apkg) IterCards(ctx context.Context, opts *IterOptions) iter.Seq2[*Card, error] {
+	where, args := opts.where(
+		"(c.did IN (?) OR c.odid IN (?))",
+		"c.nid IN (SELECT id FROM notes WHERE mid IN (?))",
+		"c.nid IN (?)",
+	)
+	return iterRows[Card](ctx, a.db, cardsQuery+where+"ORDER BY id DESC", args)
+}
+
+// IterReviews returns an iterator over the reviews of the non-deleted cards
+// in the package, newest first, limited as opts specifies. If opts is nil,
+// every review is returned. The rows are closed once the loop ends; reading
+// stops if ctx is cancelled. An error ends the iteration.
+func (a *Apkg) IterReviews(ctx context.Context, opts *IterOptions) iter.Seq2[*Review, error] {
+	where, args := opts.where(
+		"r.cid IN (SELECT id FROM cards WHERE did IN (?) OR odid IN (?))",
+		"r.cid IN (SELECT c.id FROM cards c JOIN notes n ON n.id=c.nid WHERE n.mid IN (?))",
+		"r.cid IN (SELECT id FROM cards WHERE nid IN (?))",
+	)
+	return iterRows[Review](ctx, a.db, reviewsQuery+where+"ORDER BY id DESC", args)
+}
+
+// iterRows returns an iterator over the rows selected by query, scanned into
+// values of type T. The slices in args are expanded with sqlx.In.
+func iterRows[T any](ctx context.Context, db *DB, query string, args []interface{}) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		if len(args) > 0 {
+			var err error
+			if query, args, err = sqlx.In(query, args...); err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+		rows, err := db.QueryxContext(ctx, db.Rebind(query), args...)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			value := new(T)
+			if err := rows.StructScan(value); err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(value, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
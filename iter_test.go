@@ -0,0 +1,134 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestIter(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	ctx := context.Background()
+
+	noteIDs := func(opts *IterOptions) []ID {
+		var ids []ID
+		for note, err := range apkg.IterNotes(ctx, opts) {
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			ids = append(ids, note.ID)
+		}
+		return ids
+	}
+	cardIDs := func(opts *IterOptions) []ID {
+		var ids []ID
+		for card, err := range apkg.IterCards(ctx, opts) {
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			ids = append(ids, card.ID)
+		}
+		return ids
+	}
+	reviewCount := func(opts *IterOptions) int {
+		var count int
+		for review, err := range apkg.IterReviews(ctx, opts) {
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if review.CardID != 1388721683902 {
+				t.Errorf("Unexpected review: %+v", review)
+			}
+			count++
+		}
+		return count
+	}
+	notes := []ID{1388721680877}
+	cards := []ID{1388721683902}
+	for _, test := range []struct {
+		name         string
+		opts         *IterOptions
+		notes, cards []ID
+		reviews      int
+	}{
+		{"nil", nil, notes, cards, 3},
+		{"empty", &IterOptions{}, notes, cards, 3},
+		{"deck", &IterOptions{DeckIDs: []ID{1, 1464446999755}}, notes, cards, 3},
+		{"other deck", &IterOptions{DeckIDs: []ID{1}}, nil, nil, 0},
+		{"model", &IterOptions{ModelIDs: []ID{1357356563296}}, notes, cards, 3},
+		{"other model", &IterOptions{ModelIDs: []ID{42}}, nil, nil, 0},
+		{"note", &IterOptions{NoteIDs: []ID{1388721680877}}, notes, cards, 3},
+		{"all", &IterOptions{DeckIDs: []ID{1464446999755}, ModelIDs: []ID{1357356563296}, NoteIDs: []ID{42}}, nil, nil, 0},
+	} {
+		if ids := noteIDs(test.opts); !reflect.DeepEqual(ids, test.notes) {
+			t.Errorf("%s: Unexpected notes: %v", test.name, ids)
+		}
+		if ids := cardIDs(test.opts); !reflect.DeepEqual(ids, test.cards) {
+			t.Errorf("%s: Unexpected cards: %v", test.name, ids)
+		}
+		if count := reviewCount(test.opts); count != test.reviews {
+			t.Errorf("%s: Expected %d reviews, got %d", test.name, test.reviews, count)
+		}
+	}
+
+	// Breaking out of the loop closes the rows.
+	for range apkg.IterReviews(ctx, nil) {
+		break
+	}
+	if stats := apkg.db.Stats(); stats.InUse != 0 {
+		t.Errorf("Rows left open: %+v", stats)
+	}
+
+	if _, err := apkg.db.Exec("INSERT INTO graves (usn, oid, type) VALUES (-1, 1388721680877, 1)"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := noteIDs(nil); len(ids) != 0 {
+		t.Errorf("Deleted notes returned: %v", ids)
+	}
+}
+
+func TestIterCancel(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	if _, err := apkg.db.Exec(`INSERT INTO revlog (id, cid, usn, ease, ivl, lastIvl, factor, time, type)
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE i < 100)
+		SELECT i, 1388721683902, -1, 3, 1, 1, 2500, 1000, 1 FROM n`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var count int
+	var lastErr error
+	for review, err := range apkg.IterReviews(ctx, nil) {
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if review == nil {
+			t.Fatal("Expected a review")
+		}
+		if count++; count == 10 {
+			cancel()
+		}
+	}
+	if count != 10 || lastErr != context.Canceled {
+		t.Errorf("Expected cancellation after 10 reviews, read %d (error %v)", count, lastErr)
+	}
+
+	for _, err := range apkg.IterNotes(ctx, nil) {
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned, wrapped in an error naming the object, when the
+// object looked up does not exist. Use errors.Is to check for it.
+var ErrNotFound = errors.New("Not found")
+
+type notFoundError struct {
+	kind string
+	id   ID
+}
+
+func (e *notFoundError) Error() string { return fmt.Sprintf("%s %d not found", e.kind, e.id) }
+func (e *notFoundError) Unwrap() error { return ErrNotFound }
+
+// NoteByID returns the note with the given ID, unless it has been deleted.
+func (a *Apkg) NoteByID(id ID) (*Note, error) {
+	note := &Note{}
+	if err := a.db.Get(note, notesQuery+"AND n.id=?", id); err == sql.ErrNoRows {
+		return nil, &notFoundError{"Note", id}
+	} else if err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// CardByID returns the card with the given ID, unless it has been deleted.
+func (a *Apkg) CardByID(id ID) (*Card, error) {
+	card := &Card{}
+	if err := a.db.Get(card, cardsQuery+"AND c.id=?", id); err == sql.ErrNoRows {
+		return nil, &notFoundError{"Card", id}
+	} else if err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+// ModelByID returns the note type with the given ID. The note types and decks
+// are read once, with the collection, and kept up to date by the Update
+// methods.
+func (a *Apkg) ModelByID(id ID) (*Model, error) {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return nil, err
+	}
+	model, ok := col.Models[id]
+	if !ok {
+		return nil, &notFoundError{"Model", id}
+	}
+	return model, nil
+}
+
+// DeckByID returns the deck with the given ID.
+func (a *Apkg) DeckByID(id ID) (*Deck, error) {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return nil, err
+	}
+	deck, ok := col.Decks[id]
+	if !ok {
+		return nil, &notFoundError{"Deck", id}
+	}
+	return deck, nil
+}
+
+// CardsForNote returns the non-deleted cards of a note, in template order.
+func (a *Apkg) CardsForNote(noteID ID) ([]*Card, error) {
+	var cards []*Card
+	err := a.db.Select(&cards, cardsQuery+"AND c.nid=?\nORDER BY c.ord, id", noteID)
+	return cards, err
+}
+
+// ReviewsForCard returns the reviews of a card, in chronological order
+// (oldest first).
+func (a *Apkg) ReviewsForCard(cardID ID) ([]*Review, error) {
+	var reviews []*Review
+	err := a.db.Select(&reviews, reviewsQuery+"AND r.cid=?\nORDER BY id", cardID)
+	return reviews, err
+}
+
+// NotesByModel returns the non-deleted notes of a note type, newest first.
+func (a *Apkg) NotesByModel(modelID ID) ([]*Note, error) {
+	var notes []*Note
+	err := a.db.Select(&notes, notesQuery+"AND n.mid=?\nORDER BY id DESC", modelID)
+	return notes, err
+}
+
+// CardsInDeck returns the non-deleted cards in a deck, including those moved
+// from it into a filtered deck, newest first. Cards in its subdecks are not
+// included.
+func (a *Apkg) CardsInDeck(deckID ID) ([]*Card, error) {
+	var cards []*Card
+	err := a.db.Select(&cards, cardsQuery+"AND (c.did=? OR c.odid=?)\nORDER BY id DESC", deckID, deckID)
+	return cards, err
+}
+
+// CardNote returns the note of a card.
+func (a *Apkg) CardNote(card *Card) (*Note, error) {
+	return a.NoteByID(card.NoteID)
+}
+
+// NoteModel returns the note type of a note.
+func (a *Apkg) NoteModel(note *Note) (*Model, error) {
+	return a.ModelByID(note.ModelID)
+}
+
+// CardModel returns the note type of a card's note, without reading the note.
+func (a *Apkg) CardModel(card *Card) (*Model, error) {
+	var modelID ID
+	if err := a.db.Get(&modelID, "SELECT mid FROM notes WHERE id=?", card.NoteID); err == sql.ErrNoRows {
+		return nil, &notFoundError{"Note", card.NoteID}
+	} else if err != nil {
+		return nil, err
+	}
+	return a.ModelByID(modelID)
+}
+
+// CardTemplate returns the template a card is rendered with. The cards of a
+// cloze note type all use its first template.
+func (a *Apkg) CardTemplate(card *Card) (*Template, error) {
+	model, err := a.CardModel(card)
+	if err != nil {
+		return nil, err
+	}
+	return cardTemplate(model, card.TemplateID)
+}
+
+// CardDeck returns the deck a card is in. For a card in a filtered deck, this
+// is the filtered deck; its original deck is given by OriginalDeckID.
+func (a *Apkg) CardDeck(card *Card) (*Deck, error) {
+	return a.DeckByID(card.DeckID)
+}
+
+// Siblings returns the other non-deleted cards of a card's note, in template
+// order.
+func (a *Apkg) Siblings(card *Card) ([]*Card, error) {
+	var cards []*Card
+	err := a.db.Select(&cards, cardsQuery+"AND c.nid=? AND c.id!=?\nORDER BY c.ord, id", card.NoteID, card.ID)
+	return cards, err
+}
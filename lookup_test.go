@@ -0,0 +1,107 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLookup(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+
+	card, err := apkg.CardByID(1388721683902)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	note, err := apkg.CardNote(card)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if note.ID != 1388721680877 {
+		t.Errorf("Unexpected note: %d", note.ID)
+	}
+	model, err := apkg.NoteModel(note)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if model.ID != 1357356563296 {
+		t.Errorf("Unexpected model: %d", model.ID)
+	}
+	if model, err := apkg.CardModel(card); err != nil || model.ID != 1357356563296 {
+		t.Errorf("Unexpected card model: %v (error %v)", model, err)
+	}
+	tmpl, err := apkg.CardTemplate(card)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if tmpl != model.Templates[0] {
+		t.Errorf("Unexpected template: %+v", tmpl)
+	}
+	deck, err := apkg.CardDeck(card)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if deck.ID != 1464446999755 {
+		t.Errorf("Unexpected deck: %d", deck.ID)
+	}
+	if _, err := Render(model, note, card.TemplateID, deck); err != nil {
+		t.Errorf("Unexpected error rendering: %s", err)
+	}
+
+	if cards, err := apkg.CardsForNote(note.ID); err != nil || len(cards) != 1 || cards[0].ID != card.ID {
+		t.Errorf("Unexpected cards for note: %v (error %v)", cards, err)
+	}
+	if cards, err := apkg.CardsInDeck(deck.ID); err != nil || len(cards) != 1 || cards[0].ID != card.ID {
+		t.Errorf("Unexpected cards in deck: %v (error %v)", cards, err)
+	}
+	if cards, err := apkg.CardsInDeck(1); err != nil || len(cards) != 0 {
+		t.Errorf("Unexpected cards in the default deck: %v (error %v)", cards, err)
+	}
+	if notes, err := apkg.NotesByModel(model.ID); err != nil || len(notes) != 1 || notes[0].ID != note.ID {
+		t.Errorf("Unexpected notes of model: %v (error %v)", notes, err)
+	}
+	reviews, err := apkg.ReviewsForCard(card.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(reviews) != 3 || time.Time(*reviews[0].Timestamp).After(time.Time(*reviews[2].Timestamp)) {
+		t.Errorf("Unexpected reviews: %v", reviews)
+	}
+
+	if _, err := apkg.db.Exec(`INSERT INTO cards SELECT 1388721683903, nid, did, 1, mod, usn, type, queue, due, ivl, factor, reps, lapses, left, odue, odid, flags, data
+		FROM cards WHERE id=1388721683902`); err != nil {
+		t.Fatal(err)
+	}
+	siblings, err := apkg.Siblings(card)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(siblings) != 1 || siblings[0].ID != 1388721683903 {
+		t.Errorf("Unexpected siblings: %v", siblings)
+	}
+	if cards, err := apkg.CardsForNote(note.ID); err != nil || len(cards) != 2 || cards[0].ID != card.ID {
+		t.Errorf("Unexpected cards for note: %v (error %v)", cards, err)
+	}
+
+	for _, err := range []error{
+		func() error { _, err := apkg.NoteByID(42); return err }(),
+		func() error { _, err := apkg.CardByID(42); return err }(),
+		func() error { _, err := apkg.ModelByID(42); return err }(),
+		func() error { _, err := apkg.DeckByID(42); return err }(),
+		func() error { _, err := apkg.CardModel(&Card{NoteID: 42}); return err }(),
+	} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	}
+	if _, err := apkg.NoteByID(42); err == nil || err.Error() != "Note 42 not found" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// These expressions match the references to media files Anki looks for when
+// checking media: the sources of HTML media tags, and CSS url() values, as
+// well as the scripts and style sheets templates load. Sound references are
+// matched by reSoundRef.
+var (
+	reMediaTag = regexp.MustCompile(`(?i)<(?:img|audio|video|source|object|script|link)\b[^>]*?\b(?:src|data|href)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	reCSSURL   = regexp.MustCompile(`(?i)\burl\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+)
+
+// MediaReferences returns the names of the media files referenced by texts,
+// which may be field values, templates or CSS, in the order in which they are
+// first referenced. HTML entities and URL escapes in references are decoded.
+// References to remote or inline resources, and those which depend on a
+// field's value, such as src="{{Image}}", are ignored.
+func MediaReferences(texts ...string) []string {
+	var refs []string
+	seen := make(map[string]bool)
+	add := func(ref string) {
+		name := mediaName(ref)
+		if name == "" || seen[name] {
+			return
+		}
+		seen[name] = true
+		refs = append(refs, name)
+	}
+	for _, text := range texts {
+		for _, re := range []*regexp.Regexp{reMediaTag, reCSSURL} {
+			for _, m := range re.FindAllStringSubmatch(text, -1) {
+				add(m[1] + m[2] + m[3])
+			}
+		}
+		for _, m := range reSoundRef.FindAllStringSubmatch(text, -1) {
+			add(m[1])
+		}
+	}
+	return refs
+}
+
+// mediaName returns the name of the media file a reference refers to, or ""
+// if it does not refer to one.
+func mediaName(ref string) string {
+	ref = strings.TrimSpace(html.UnescapeString(ref))
+	if ref == "" || strings.Contains(ref, "{{") || strings.Contains(ref, "://") ||
+		strings.HasPrefix(ref, "//") || strings.HasPrefix(strings.ToLower(ref), "data:") {
+		return ""
+	}
+	if name, err := url.PathUnescape(ref); err == nil {
+		return name
+	}
+	return ref
+}
+
+// MediaCheck reports how the media files of a package are used, as Anki's
+// "Check Media" does.
+type MediaCheck struct {
+	Missing []string        // Files which are referenced, but not in the package
+	Unused  []string        // Files in the package which are not referenced
+	Notes   map[ID][]string // The files referenced by each note which references any
+	Models  map[ID][]string // The files referenced by the templates and CSS of each note type which references any
+}
+
+// CheckMedia finds the media files referenced by the package's notes, and by
+// the templates and CSS of its note types, and compares them with the media
+// files in the package. Anki never reports files whose names begin with "_"
+// as unused, as they are assumed to be used by templates; CheckMedia reports
+// them unless a template or CSS references them.
+func (a *Apkg) CheckMedia() (*MediaCheck, error) {
+	col, err := a.readCollection()
+	if err != nil {
+		return nil, err
+	}
+	check := &MediaCheck{
+		Notes:  make(map[ID][]string),
+		Models: make(map[ID][]string),
+	}
+	used := make(map[string]bool)
+	for _, model := range col.Models {
+		texts := []string{model.CSS}
+		for _, tmpl := range model.Templates {
+			texts = append(texts, tmpl.QuestionFormat, tmpl.AnswerFormat, tmpl.BrowserQuestionFormat, tmpl.BrowserAnswerFormat)
+		}
+		if refs := MediaReferences(texts...); len(refs) > 0 {
+			check.Models[model.ID] = refs
+			for _, name := range refs {
+				used[name] = true
+			}
+		}
+	}
+
+	rows, err := a.db.Queryx(`
+		SELECT n.id, n.flds
+		FROM notes n
+		LEFT JOIN graves g ON g.oid=n.id AND g.type=1
+		WHERE g.oid IS NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		note := &Note{}
+		if err := rows.StructScan(note); err != nil {
+			return nil, err
+		}
+		if refs := MediaReferences(note.FieldValues...); len(refs) > 0 {
+			check.Notes[note.ID] = refs
+			for _, name := range refs {
+				used[name] = true
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]bool)
+	for _, name := range a.ListFiles() {
+		files[name] = true
+		if !used[name] {
+			check.Unused = append(check.Unused, name)
+		}
+	}
+	for name := range used {
+		if !files[name] {
+			check.Missing = append(check.Missing, name)
+		}
+	}
+	sort.Strings(check.Missing)
+	sort.Strings(check.Unused)
+	return check, nil
+}
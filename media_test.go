@@ -0,0 +1,87 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMediaReferences(t *testing.T) {
+	for _, test := range []struct {
+		text     string
+		expected []string
+	}{
+		{`No media`, nil},
+		{`<img src="a.png"><IMG class=x SRC='b c.png'><img src=d.png>`, []string{"a.png", "b c.png", "d.png"}},
+		{`[sound:a.mp3] [sound:b.mp3][sound:a.mp3]`, []string{"a.mp3", "b.mp3"}},
+		{`<audio src="a.ogg"></audio><video><source src="b.webm"></video><object data="c.svg">`, []string{"a.ogg", "b.webm", "c.svg"}},
+		{`.card { background: url("_bg.png") } @font-face { src: url(_font.ttf); }`, []string{"_bg.png", "_font.ttf"}},
+		{`<script src="_jquery.js"></script><script>var x;</script>`, []string{"_jquery.js"}},
+		{`<link rel="stylesheet" href='_style.css'><a href="not-media.html">`, []string{"_style.css"}},
+		{`<img src="a%20b.png"><img src="c&amp;d.png">`, []string{"a b.png", "c&d.png"}},
+		{`<img src="https://example.com/a.png"><img src="data:image/png;base64,AA"><img src="{{Image}}">`, nil},
+	} {
+		if result := MediaReferences(test.text); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%s: Expected %q, got %q", test.text, test.expected, result)
+		}
+	}
+}
+
+func TestCheckMedia(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	check, err := apkg.CheckMedia()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(check.Missing) != 0 || len(check.Unused) != 13 || len(check.Notes) != 0 || len(check.Models) != 0 {
+		t.Errorf("Unexpected result: %+v", check)
+	}
+
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := collection.Models[1357356563296]
+	model.CSS = `.card { background: url("_c.png") }`
+	model.Templates[0].QuestionFormat += `<script src="_f.png"></script><link rel="stylesheet" href="_m.png">`
+	if err := apkg.UpdateModel(model); err != nil {
+		t.Fatal(err)
+	}
+	notes, err := apkg.Notes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes.Next()
+	note, err := notes.Note()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes.Close()
+	note.FieldValues[0] = `<img src="_e.png"> [sound:missing.mp3]`
+	if err := apkg.UpdateNote(note); err != nil {
+		t.Fatal(err)
+	}
+
+	check, err = apkg.CheckMedia()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &MediaCheck{
+		Missing: []string{"missing.mp3"},
+		Unused: []string{
+			"_2954523.jpg", "_anki.js~", "_ipa-mouth-alveolar.png", "_ipa-mouth.png",
+			"_nl-flag.jpg", "_nl-gender-m.png", "_nl-gender-o.png", "_nl-gender-v.png", "_nl-gender-vm.png",
+		},
+		Notes:  map[ID][]string{note.ID: {"_e.png", "missing.mp3"}},
+		Models: map[ID][]string{model.ID: {"_c.png", "_f.png", "_m.png"}},
+	}
+	if !reflect.DeepEqual(check, expected) {
+		t.Errorf("Unexpected result: %+v", check)
+	}
+}
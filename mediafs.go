@@ -0,0 +1,246 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MediaFS provides the media files of a package as a file system, for use
+// with the io/fs package, and the standard library functions which accept an
+// fs.FS, such as http.FS and template.ParseFS. The files are in its root
+// directory, under their original names. They are decompressed as they are
+// read, rather than being read into memory in full.
+type MediaFS struct {
+	a *Apkg
+}
+
+var (
+	_ fs.ReadDirFS  = &MediaFS{}
+	_ fs.ReadFileFS = &MediaFS{}
+	_ fs.StatFS     = &MediaFS{}
+)
+
+// MediaFS returns the package's media files as a file system, including any
+// added with AddMedia.
+func (a *Apkg) MediaFS() *MediaFS {
+	return &MediaFS{a: a}
+}
+
+// Open opens the named file. Files implement io.Seeker; seeking backwards
+// reads the file again from the start.
+func (m *MediaFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &mediaDir{fsys: m}, nil
+	}
+	rc, err := m.open(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &mediaFSFile{fsys: m, name: name, rc: rc}, nil
+}
+
+func (m *MediaFS) open(name string) (io.ReadCloser, error) {
+	for _, file := range m.a.added {
+		if file.name == name {
+			return ioutil.NopCloser(bytes.NewReader(file.data)), nil
+		}
+	}
+	return m.a.media.open(name)
+}
+
+// Stat returns a FileInfo describing the named file. Finding the size of a
+// file in a package of the latest format may require decompressing it.
+func (m *MediaFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &mediaFileInfo{name: ".", dir: true}, nil
+	}
+	for _, file := range m.a.added {
+		if file.name == name {
+			return &mediaFileInfo{name: name, size: int64(len(file.data))}, nil
+		}
+	}
+	info, err := m.a.media.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// ReadDir reads the root directory, returning its files sorted by name.
+func (m *MediaFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		err := fs.ErrNotExist
+		if _, statErr := m.Stat(name); statErr == nil {
+			err = errors.New("not a directory")
+		} else if !fs.ValidPath(name) {
+			err = fs.ErrInvalid
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	names := m.a.ListFiles()
+	sort.Strings(names)
+	entries := make([]fs.DirEntry, 0, len(names))
+	for i, name := range names {
+		// Names which are not valid in a file system cannot be opened.
+		if i > 0 && name == names[i-1] || !fs.ValidPath(name) || strings.Contains(name, "/") {
+			continue
+		}
+		entries = append(entries, &mediaDirEntry{fsys: m, name: name})
+	}
+	return entries, nil
+}
+
+// ReadFile reads the named file.
+func (m *MediaFS) ReadFile(name string) ([]byte, error) {
+	f, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if name == "." {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return ioutil.ReadAll(f)
+}
+
+// mediaFSFile is a media file opened from a MediaFS.
+type mediaFSFile struct {
+	fsys   *MediaFS
+	name   string
+	rc     io.ReadCloser
+	offset int64
+}
+
+func (f *mediaFSFile) Stat() (fs.FileInfo, error) {
+	return f.fsys.Stat(f.name)
+}
+
+func (f *mediaFSFile) Read(p []byte) (int, error) {
+	n, err := f.rc.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *mediaFSFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += info.Size()
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < f.offset {
+		_ = f.rc.Close()
+		rc, err := f.fsys.open(f.name)
+		if err != nil {
+			return 0, &fs.PathError{Op: "seek", Path: f.name, Err: err}
+		}
+		f.rc, f.offset = rc, 0
+	}
+	if _, err := io.CopyN(ioutil.Discard, f, offset-f.offset); err != nil && err != io.EOF {
+		return 0, err
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *mediaFSFile) Close() error {
+	return f.rc.Close()
+}
+
+// mediaDir is the root directory of a MediaFS, opened for reading.
+type mediaDir struct {
+	fsys    *MediaFS
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *mediaDir) Stat() (fs.FileInfo, error) {
+	return d.fsys.Stat(".")
+}
+
+func (d *mediaDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+
+func (d *mediaDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(".")
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	entries := d.entries
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(entries) {
+			entries = entries[:n]
+		}
+	}
+	d.entries = d.entries[len(entries):]
+	return entries, nil
+}
+
+func (d *mediaDir) Close() error {
+	return nil
+}
+
+// mediaDirEntry is a file listed by MediaFS.ReadDir. Its FileInfo is only
+// found when it is requested.
+type mediaDirEntry struct {
+	fsys *MediaFS
+	name string
+}
+
+func (e *mediaDirEntry) Name() string               { return e.name }
+func (e *mediaDirEntry) IsDir() bool                { return false }
+func (e *mediaDirEntry) Type() fs.FileMode          { return 0 }
+func (e *mediaDirEntry) Info() (fs.FileInfo, error) { return e.fsys.Stat(e.name) }
+
+// mediaFileInfo describes a media file, or the root directory of a MediaFS.
+type mediaFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *mediaFileInfo) Name() string       { return fi.name }
+func (fi *mediaFileInfo) Size() int64        { return fi.size }
+func (fi *mediaFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *mediaFileInfo) IsDir() bool        { return fi.dir }
+func (fi *mediaFileInfo) Sys() interface{}   { return nil }
+
+func (fi *mediaFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
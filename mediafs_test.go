@@ -0,0 +1,122 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMediaFS(t *testing.T) {
+	// A collection in a profile folder, whose media folder has a file and
+	// a subdirectory.
+	dir := t.TempDir()
+	mediaDir := filepath.Join(dir, "collection.media")
+	if err := os.MkdirAll(filepath.Join(mediaDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mediaDir, "a.png"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dbFile := filepath.Join(dir, "collection.anki2")
+	f, err := os.Create(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.db.dump(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, open := range map[string]func(*testing.T) *Apkg{
+		"legacy": func(t *testing.T) *Apkg {
+			apkg, err := ReadFile(ApkgFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return apkg
+		},
+		"latest": func(t *testing.T) *Apkg {
+			apkg, err := ReadBytes(latestPackage(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return apkg
+		},
+		"directory": func(t *testing.T) *Apkg {
+			apkg, err := OpenCollection(dbFile, mediaDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return apkg
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			apkg := open(t)
+			defer apkg.Close()
+			if err := apkg.AddMedia("added.png", []byte("added")); err != nil {
+				t.Fatal(err)
+			}
+			fsys := apkg.MediaFS()
+			files := apkg.ListFiles()
+			if err := fstest.TestFS(fsys, files...); err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range files {
+				expected, err := apkg.ReadMediaFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := fs.ReadFile(fsys, file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, expected) {
+					t.Errorf("%s: Unexpected contents", file)
+				}
+			}
+			if _, err := fsys.Open("missing.png"); !os.IsNotExist(err) {
+				t.Errorf("Expected a not-exist error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMediaFSServe(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	expected, err := apkg.ReadMediaFile("_c.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/_c.png", nil)
+	req.Header.Set("Range", "bytes=10-19")
+	recorder := httptest.NewRecorder()
+	http.FileServer(http.FS(apkg.MediaFS())).ServeHTTP(recorder, req)
+	resp := recorder.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, expected[10:20]) {
+		t.Errorf("Unexpected response: %s, %q", resp.Status, body)
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// unpickle decodes a Python pickle, as Anki uses to store its preferences in
+// prefs21.db. Only the data types Anki stores are supported: dicts (as
+// map[string]interface{}), lists, tuples and sets (as []interface{}), strings,
+// bytes, ints (as int64), floats, bools and None. Other objects decode as nil,
+// except for the few Anki is known to store, which wrap byte strings.
+func unpickle(data []byte) (interface{}, error) {
+	u := &unpickler{data: data, memo: make(map[uint32]interface{})}
+	v, err := u.run()
+	if err != nil {
+		return nil, err
+	}
+	return pickleValue(v), nil
+}
+
+var errInvalidPickle = errors.New("Invalid pickle data")
+
+// pickleList holds a list while it is being built, as lists may be appended
+// to after being memoized.
+type pickleList struct {
+	items []interface{}
+}
+
+type pickleGlobal struct {
+	module, name string
+}
+
+type pickleMark struct{}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[uint32]interface{}
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || u.pos+n > len(u.data) {
+		return nil, errInvalidPickle
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readUint(size int) (uint64, error) {
+	b, err := u.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for i := size - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	return n, nil
+}
+
+// readLine reads a newline-terminated argument of a text opcode.
+func (u *unpickler) readLine() (string, error) {
+	for i := u.pos; i < len(u.data); i++ {
+		if u.data[i] == '\n' {
+			line := string(u.data[u.pos:i])
+			u.pos = i + 1
+			return line, nil
+		}
+	}
+	return "", errInvalidPickle
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errInvalidPickle
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+// popMark pops the items pushed since the last mark, and the mark itself.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := append([]interface{}{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errInvalidPickle
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errInvalidPickle
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+func (u *unpickler) run() (interface{}, error) {
+	for {
+		op, err := u.read(1)
+		if err != nil {
+			return nil, err
+		}
+		switch op[0] {
+		case 0x80: // PROTO
+			if _, err := u.read(1); err != nil {
+				return nil, err
+			}
+		case 0x95: // FRAME
+			if _, err := u.read(8); err != nil {
+				return nil, err
+			}
+		case '.': // STOP
+			return u.pop()
+		case '(': // MARK
+			u.push(pickleMark{})
+		case '0': // POP
+			if _, err := u.pop(); err != nil {
+				return nil, err
+			}
+		case '1': // POP_MARK
+			if _, err := u.popMark(); err != nil {
+				return nil, err
+			}
+		case '2': // DUP
+			v, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			u.push(v)
+		case 'N': // NONE
+			u.push(nil)
+		case 0x88: // NEWTRUE
+			u.push(true)
+		case 0x89: // NEWFALSE
+			u.push(false)
+		case 'J': // BININT
+			n, err := u.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(int32(n)))
+		case 'K': // BININT1
+			n, err := u.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(n))
+		case 'M': // BININT2
+			n, err := u.readUint(2)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(n))
+		case 0x8a, 0x8b: // LONG1, LONG4
+			size := 1
+			if op[0] == 0x8b {
+				size = 4
+			}
+			n, err := u.readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			b, err := u.read(int(n))
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodePickleLong(b)
+			if err != nil {
+				return nil, err
+			}
+			u.push(v)
+		case 'G': // BINFLOAT
+			b, err := u.read(8)
+			if err != nil {
+				return nil, err
+			}
+			u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+		case 0x8c, 'X', 0x8d, 'U', 'T', 'C', 'B', 0x8e, 0x96:
+			// SHORT_BINUNICODE, BINUNICODE, BINUNICODE8, SHORT_BINSTRING,
+			// BINSTRING, SHORT_BINBYTES, BINBYTES, BINBYTES8, BYTEARRAY8
+			var size int
+			switch op[0] {
+			case 0x8c, 'U', 'C':
+				size = 1
+			case 'X', 'T', 'B':
+				size = 4
+			default:
+				size = 8
+			}
+			n, err := u.readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			if n > uint64(len(u.data)) {
+				return nil, errInvalidPickle
+			}
+			b, err := u.read(int(n))
+			if err != nil {
+				return nil, err
+			}
+			switch op[0] {
+			case 0x8c, 'X', 0x8d, 'U', 'T':
+				u.push(string(b))
+			default:
+				u.push(append([]byte{}, b...))
+			}
+		case '}': // EMPTY_DICT
+			u.push(make(map[string]interface{}))
+		case ']': // EMPTY_LIST
+			u.push(&pickleList{})
+		case ')': // EMPTY_TUPLE
+			u.push([]interface{}{})
+		case 0x8f: // EMPTY_SET
+			u.push(&pickleList{})
+		case 'd', 'l', 't', 0x91: // DICT, LIST, TUPLE, FROZENSET
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			switch op[0] {
+			case 'd':
+				dict := make(map[string]interface{})
+				if err := setPickleItems(dict, items); err != nil {
+					return nil, err
+				}
+				u.push(dict)
+			case 'l':
+				u.push(&pickleList{items: items})
+			default:
+				u.push(items)
+			}
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			n := int(op[0]-0x85) + 1
+			if len(u.stack) < n {
+				return nil, errInvalidPickle
+			}
+			items := append([]interface{}{}, u.stack[len(u.stack)-n:]...)
+			u.stack = u.stack[:len(u.stack)-n]
+			u.push(items)
+		case 'a', 'e', 0x90: // APPEND, APPENDS, ADDITEMS
+			var items []interface{}
+			if op[0] == 'a' {
+				v, err := u.pop()
+				if err != nil {
+					return nil, err
+				}
+				items = []interface{}{v}
+			} else if items, err = u.popMark(); err != nil {
+				return nil, err
+			}
+			list, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			l, ok := list.(*pickleList)
+			if !ok {
+				return nil, errInvalidPickle
+			}
+			l.items = append(l.items, items...)
+		case 's', 'u': // SETITEM, SETITEMS
+			var items []interface{}
+			if op[0] == 's' {
+				if len(u.stack) < 2 {
+					return nil, errInvalidPickle
+				}
+				items = append([]interface{}{}, u.stack[len(u.stack)-2:]...)
+				u.stack = u.stack[:len(u.stack)-2]
+			} else if items, err = u.popMark(); err != nil {
+				return nil, err
+			}
+			dict, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			d, ok := dict.(map[string]interface{})
+			if !ok {
+				return nil, errInvalidPickle
+			}
+			if err := setPickleItems(d, items); err != nil {
+				return nil, err
+			}
+		case 0x94: // MEMOIZE
+			v, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			u.memo[uint32(len(u.memo))] = v
+		case 'q', 'r': // BINPUT, LONG_BINPUT
+			size := 1
+			if op[0] == 'r' {
+				size = 4
+			}
+			n, err := u.readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			v, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			u.memo[uint32(n)] = v
+		case 'h', 'j': // BINGET, LONG_BINGET
+			size := 1
+			if op[0] == 'j' {
+				size = 4
+			}
+			n, err := u.readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			v, ok := u.memo[uint32(n)]
+			if !ok {
+				return nil, errInvalidPickle
+			}
+			u.push(v)
+		case 'c': // GLOBAL
+			module, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			name, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			u.push(pickleGlobal{module: module, name: name})
+		case 0x93: // STACK_GLOBAL
+			name, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			module, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			m, ok1 := module.(string)
+			n, ok2 := name.(string)
+			if !ok1 || !ok2 {
+				return nil, errInvalidPickle
+			}
+			u.push(pickleGlobal{module: m, name: n})
+		case 'R', 0x81: // REDUCE, NEWOBJ
+			args, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			callable, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			u.push(reducePickle(callable, args))
+		case 'b': // BUILD
+			// Object state is not needed, as objects decode as nil.
+			if _, err := u.pop(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported pickle opcode 0x%02x", op[0])
+		}
+	}
+}
+
+// decodePickleLong decodes a little-endian two's complement integer.
+func decodePickleLong(b []byte) (int64, error) {
+	if len(b) > 8 {
+		return 0, errors.New("Pickled integer too large")
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var n uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	// Sign-extend from the most significant byte.
+	shift := uint(64 - 8*len(b))
+	return int64(n<<shift) >> shift, nil
+}
+
+func setPickleItems(dict map[string]interface{}, items []interface{}) error {
+	if len(items)%2 != 0 {
+		return errInvalidPickle
+	}
+	for i := 0; i < len(items); i += 2 {
+		key, ok := items[i].(string)
+		if !ok {
+			key = fmt.Sprint(pickleValue(items[i]))
+		}
+		dict[key] = items[i+1]
+	}
+	return nil
+}
+
+// reducePickle handles the construction of an object. Only the objects which
+// Anki is known to store in its preferences are supported.
+func reducePickle(callable, args interface{}) interface{} {
+	global, ok := callable.(pickleGlobal)
+	if !ok {
+		return nil
+	}
+	argList, _ := pickleValue(args).([]interface{})
+	switch global.module + "." + global.name {
+	case "_codecs.encode":
+		// Protocol 2 stores bytes as a latin-1 encoded string.
+		if len(argList) > 0 {
+			if s, ok := argList[0].(string); ok {
+				b := make([]byte, 0, len(s))
+				for _, r := range s {
+					b = append(b, byte(r))
+				}
+				return b
+			}
+		}
+	case "__builtin__.set", "builtins.set", "builtins.frozenset":
+		if len(argList) > 0 {
+			return argList[0]
+		}
+		return []interface{}{}
+	case "sip._unpickle_type", "PyQt5.sip._unpickle_type", "PyQt6.sip._unpickle_type":
+		// Older versions of Anki stored window geometry as a QByteArray,
+		// which is pickled as its type and constructor arguments.
+		if len(argList) == 3 {
+			if ctorArgs, ok := argList[2].([]interface{}); ok && len(ctorArgs) > 0 {
+				return ctorArgs[0]
+			}
+		}
+	}
+	return nil
+}
+
+// pickleValue converts lists built while unpickling to slices.
+func pickleValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case *pickleList:
+		return pickleValue(t.items)
+	case []interface{}:
+		result := make([]interface{}, len(t))
+		for i, item := range t {
+			result[i] = pickleValue(item)
+		}
+		return result
+	case map[string]interface{}:
+		for key, item := range t {
+			t[key] = pickleValue(item)
+		}
+		return t
+	case pickleGlobal, pickleMark:
+		return nil
+	}
+	return v
+}
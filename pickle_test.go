@@ -0,0 +1,57 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// The pickles below were produced by Python's pickle.dumps() from:
+//
+//	{'syncUser': 'me@example.com', 'autoSync': True, 'lastOptimize': 1700000000,
+//	 'numBackups': 50, 'mainWindowGeom': b'\x01\x02', 'searchHistory': ['a', 'b'],
+//	 'syncKey': None, 'ratio': 1.5, 'big': 2**40, 'neg': -3, 't': (1, 2), 's': {'x'}}
+var testPickles = map[string]string{
+	"protocol 2": "80027d710028580800000073796e63557365727101580e0000006d65406578616d706c652e636f6d710258080000006175746f53796e63710388580c0000006c6173744f7074696d697a6571044a00f15365580a0000006e756d4261636b75707371054b32580e0000006d61696e57696e646f7747656f6d7106635f636f646563730a656e636f64650a710758020000000102710858060000006c6174696e31710986710a52710b580d000000736561726368486973746f7279710c5d710d28580100000061710e580100000062710f65580700000073796e634b657971104e5805000000726174696f7111473ff8000000000000580300000062696771128a0600000000000158030000006e656771134afdffffff58010000007471144b014b028671155801000000737116635f5f6275696c74696e5f5f0a7365740a71175d711858010000007871196185711a52711b752e",
+	"protocol 4": "800495cd000000000000007d94288c0873796e6355736572948c0e6d65406578616d706c652e636f6d948c086175746f53796e6394888c0c6c6173744f7074696d697a65944a00f153658c0a6e756d4261636b757073944b328c0e6d61696e57696e646f7747656f6d9443020102948c0d736561726368486973746f7279945d94288c0161948c016294658c0773796e634b6579944e8c05726174696f94473ff80000000000008c03626967948a060000000000018c036e6567944afdffffff8c0174944b014b0286948c0173948f94288c01789490752e",
+}
+
+func TestUnpickle(t *testing.T) {
+	expected := map[string]interface{}{
+		"syncUser":       "me@example.com",
+		"autoSync":       true,
+		"lastOptimize":   int64(1700000000),
+		"numBackups":     int64(50),
+		"mainWindowGeom": []byte{1, 2},
+		"searchHistory":  []interface{}{"a", "b"},
+		"syncKey":        nil,
+		"ratio":          1.5,
+		"big":            int64(1 << 40),
+		"neg":            int64(-3),
+		"t":              []interface{}{int64(1), int64(2)},
+		"s":              []interface{}{"x"},
+	}
+	for name, data := range testPickles {
+		t.Run(name, func(t *testing.T) {
+			b, err := hex.DecodeString(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := unpickle(b)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(v, expected) {
+				t.Errorf("Unexpected result: %#v", v)
+			}
+		})
+	}
+	for _, data := range [][]byte{nil, {0x80, 0x04, 0x7d}, {0x80, 0x04, 'I', '1', '\n', '.'}} {
+		if _, err := unpickle(data); err == nil {
+			t.Errorf("%x: Expected an error", data)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// ErrCollectionLocked is returned when opening a profile's collection while
+// it appears to be open in a running instance of Anki.
+var ErrCollectionLocked = errors.New("Collection is in use by Anki")
+
+// Profile is an Anki user profile, as listed in the prefs21.db file in Anki's
+// base folder. Each profile has a folder of its own, named after it, which
+// holds its collection and media.
+type Profile struct {
+	Name string
+	// Dir is the profile's folder.
+	Dir string
+	// SyncUser is the AnkiWeb account the profile syncs with, if any.
+	SyncUser string
+	// AutoSync is true when the profile syncs when opened and closed.
+	AutoSync bool
+	// LastOptimize is the time the collection was last optimized.
+	LastOptimize *TimestampSeconds
+	// Prefs holds all of the profile's preferences, as stored by Anki. Values
+	// are strings, []byte, int64, float64, bool, nil, []interface{} (for
+	// lists, tuples and sets) or map[string]interface{}.
+	Prefs map[string]interface{}
+}
+
+// DefaultBaseDir returns the location of Anki's base folder for the current
+// user, as Anki would choose it: the ANKI_BASE environment variable if it is
+// set, and otherwise the platform's standard location.
+func DefaultBaseDir() (string, error) {
+	if dir := os.Getenv("ANKI_BASE"); dir != "" {
+		return dir, nil
+	}
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		// %APPDATA% or ~/Library/Application Support
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "Anki2"), nil
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "Anki2"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", "Anki2"), nil
+}
+
+// Profiles returns the profiles listed in the prefs21.db file in the Anki
+// base folder base, sorted by name.
+func Profiles(base string) ([]*Profile, error) {
+	f, err := os.Open(filepath.Join(base, "prefs21.db"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db, err := OpenDBWithOptions(f, &OpenOptions{InMemory: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT name, CAST(data AS blob) FROM profiles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var profiles []*Profile
+	for rows.Next() {
+		var name string
+		var data []byte
+		if err := rows.Scan(&name, &data); err != nil {
+			return nil, err
+		}
+		// The _global row holds preferences shared by all profiles.
+		if name == "_global" {
+			continue
+		}
+		profile, err := newProfile(base, name, data)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles, nil
+}
+
+func newProfile(base, name string, data []byte) (*Profile, error) {
+	v, err := unpickle(data)
+	if err != nil {
+		return nil, fmt.Errorf("Profile %q: %s", name, err)
+	}
+	prefs, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Profile %q: Invalid preferences", name)
+	}
+	p := &Profile{
+		Name:  name,
+		Dir:   filepath.Join(base, name),
+		Prefs: prefs,
+	}
+	p.SyncUser, _ = prefs["syncUser"].(string)
+	p.AutoSync, _ = prefs["autoSync"].(bool)
+	if t, ok := prefs["lastOptimize"].(int64); ok {
+		p.LastOptimize = timestampSeconds(time.Unix(t, 0))
+	}
+	return p, nil
+}
+
+// CollectionPath returns the path to the profile's collection database.
+func (p *Profile) CollectionPath() string {
+	return filepath.Join(p.Dir, "collection.anki2")
+}
+
+// MediaDir returns the path to the profile's media folder.
+func (p *Profile) MediaDir() string {
+	return filepath.Join(p.Dir, "collection.media")
+}
+
+// Locked reports whether the profile's collection appears to be open in a
+// running instance of Anki. While the collection is open, SQLite keeps a
+// write-ahead log or rollback journal alongside it. One left behind when
+// Anki crashed also counts, as it may hold changes not yet in the
+// collection.
+func (p *Profile) Locked() (bool, error) {
+	path := p.CollectionPath()
+	if _, err := os.Stat(path + "-wal"); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	fi, err := os.Stat(path + "-journal")
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// An empty journal may be left behind after each transaction.
+	return fi.Size() > 0, nil
+}
+
+// Open opens the profile's collection and media, as OpenCollection does. It
+// returns ErrCollectionLocked if the collection appears to be open in Anki.
+func (p *Profile) Open() (*Apkg, error) {
+	locked, err := p.Locked()
+	if err != nil {
+		return nil, err
+	}
+	if locked {
+		return nil, ErrCollectionLocked
+	}
+	return OpenCollection(p.CollectionPath(), p.MediaDir())
+}
@@ -0,0 +1,118 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testBaseDir creates an Anki base folder with a single profile, whose
+// collection is that of the test package.
+func testBaseDir(t *testing.T) string {
+	base := t.TempDir()
+	prefs, err := hex.DecodeString(testPickles["protocol 4"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := newDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE profiles (name text PRIMARY KEY COLLATE NOCASE, data blob NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	// The global preferences are not a profile.
+	if _, err := db.Exec("INSERT INTO profiles VALUES ('_global', ?), ('User 1', ?)", prefs, prefs); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(base, "prefs21.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.dump(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(base, "User 1")
+	if err := os.MkdirAll(filepath.Join(dir, "collection.media"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	src, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	col, err := os.Create(filepath.Join(dir, "collection.anki2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.db.dump(col); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+func TestProfiles(t *testing.T) {
+	base := testBaseDir(t)
+	profiles, err := Profiles(base)
+	if err != nil {
+		t.Fatalf("Error reading profiles: %s", err)
+	}
+	if len(profiles) != 1 {
+		t.Fatalf("Expected 1 profile, got %d", len(profiles))
+	}
+	p := profiles[0]
+	if p.Name != "User 1" || p.Dir != filepath.Join(base, "User 1") || p.SyncUser != "me@example.com" || !p.AutoSync ||
+		time.Time(*p.LastOptimize).Unix() != 1700000000 || p.Prefs["numBackups"] != int64(50) {
+		t.Errorf("Unexpected profile: %+v", p)
+	}
+
+	col, err := p.Open()
+	if err != nil {
+		t.Fatalf("Error opening profile: %s", err)
+	}
+	if _, err := col.Collection(); err != nil {
+		t.Errorf("Error getting collection: %s", err)
+	}
+	if err := col.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty rollback journal does not indicate that Anki is running.
+	if err := ioutil.WriteFile(p.CollectionPath()+"-journal", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := p.Locked(); err != nil || locked {
+		t.Errorf("Expected the collection to be unlocked (error %v)", err)
+	}
+	if err := ioutil.WriteFile(p.CollectionPath()+"-wal", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Open(); err != ErrCollectionLocked {
+		t.Errorf("Expected ErrCollectionLocked, got %v", err)
+	}
+
+	if _, err := Profiles(filepath.Join(base, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error for a missing base folder: %v", err)
+	}
+}
+
+func TestDefaultBaseDir(t *testing.T) {
+	t.Setenv("ANKI_BASE", "/anki")
+	if dir, err := DefaultBaseDir(); err != nil || dir != "/anki" {
+		t.Errorf("Unexpected base folder %q (error %v)", dir, err)
+	}
+}
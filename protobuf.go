@@ -0,0 +1,261 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoMessage is a decoded protocol buffer message, mapping each field number
+// to the values found for it, in order. Newer versions of Anki store much of
+// their configuration as protocol buffers, and as only a handful of fields are
+// of interest to us, they are decoded without the generated message types.
+type protoMessage map[protowire.Number][]protoValue
+
+type protoValue struct {
+	typ   protowire.Type
+	num   uint64 // Varint, fixed32 and fixed64 values
+	bytes []byte // Length-delimited values
+}
+
+var errInvalidProtobuf = errors.New("Invalid protocol buffer")
+
+// decodeProto decodes the fields of a protocol buffer message.
+func decodeProto(b []byte) (protoMessage, error) {
+	msg := make(protoMessage)
+	for len(b) > 0 {
+		field, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, errInvalidProtobuf
+		}
+		b = b[n:]
+		value := protoValue{typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			value.num, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			value.num = uint64(v)
+		case protowire.Fixed64Type:
+			value.num, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			value.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(field, typ, b)
+		}
+		if n < 0 {
+			return nil, errInvalidProtobuf
+		}
+		b = b[n:]
+		msg[field] = append(msg[field], value)
+	}
+	return msg, nil
+}
+
+// last returns the last value of a field, which takes precedence over any
+// earlier ones, or false if the field is not set.
+func (m protoMessage) last(field protowire.Number) (protoValue, bool) {
+	values := m[field]
+	if len(values) == 0 {
+		return protoValue{}, false
+	}
+	return values[len(values)-1], true
+}
+
+func (m protoMessage) has(field protowire.Number) bool {
+	_, ok := m.last(field)
+	return ok
+}
+
+func (m protoMessage) uint(field protowire.Number) uint64 {
+	v, _ := m.last(field)
+	return v.num
+}
+
+func (m protoMessage) int(field protowire.Number) int64 {
+	return int64(m.uint(field))
+}
+
+func (m protoMessage) bool(field protowire.Number) bool {
+	return m.uint(field) != 0
+}
+
+func (m protoMessage) float(field protowire.Number) float32 {
+	return math.Float32frombits(uint32(m.uint(field)))
+}
+
+func (m protoMessage) bytes(field protowire.Number) []byte {
+	v, _ := m.last(field)
+	return v.bytes
+}
+
+func (m protoMessage) string(field protowire.Number) string {
+	return string(m.bytes(field))
+}
+
+// message decodes an embedded message. An unset field yields an empty
+// message.
+func (m protoMessage) message(field protowire.Number) (protoMessage, error) {
+	return decodeProto(m.bytes(field))
+}
+
+// messages decodes a repeated embedded message field.
+func (m protoMessage) messages(field protowire.Number) ([]protoMessage, error) {
+	msgs := make([]protoMessage, 0, len(m[field]))
+	for _, v := range m[field] {
+		msg, err := decodeProto(v.bytes)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// uints returns the values of a repeated varint field, which may be packed
+// or not.
+func (m protoMessage) uints(field protowire.Number) ([]uint64, error) {
+	var result []uint64
+	for _, v := range m[field] {
+		if v.typ != protowire.BytesType {
+			result = append(result, v.num)
+			continue
+		}
+		for b := v.bytes; len(b) > 0; {
+			num, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, errInvalidProtobuf
+			}
+			result = append(result, num)
+			b = b[n:]
+		}
+	}
+	return result, nil
+}
+
+// floats returns the values of a repeated float field, which may be packed
+// or not.
+func (m protoMessage) floats(field protowire.Number) ([]float32, error) {
+	var result []float32
+	for _, v := range m[field] {
+		if v.typ != protowire.BytesType {
+			result = append(result, math.Float32frombits(uint32(v.num)))
+			continue
+		}
+		for b := v.bytes; len(b) > 0; {
+			num, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return nil, errInvalidProtobuf
+			}
+			result = append(result, math.Float32frombits(num))
+			b = b[n:]
+		}
+	}
+	return result, nil
+}
+
+// The set methods below replace the values of a field. As in proto3, fields
+// with the default value are omitted, except for embedded messages, so that
+// a `oneof` remains set.
+
+func (m protoMessage) setUint(field protowire.Number, v uint64) {
+	if v == 0 {
+		delete(m, field)
+		return
+	}
+	m[field] = []protoValue{{typ: protowire.VarintType, num: v}}
+}
+
+func (m protoMessage) setInt(field protowire.Number, v int64) {
+	m.setUint(field, uint64(v))
+}
+
+func (m protoMessage) setBool(field protowire.Number, v bool) {
+	if v {
+		m.setUint(field, 1)
+	} else {
+		m.setUint(field, 0)
+	}
+}
+
+func (m protoMessage) setFloat(field protowire.Number, v float32) {
+	if v == 0 {
+		delete(m, field)
+		return
+	}
+	m[field] = []protoValue{{typ: protowire.Fixed32Type, num: uint64(math.Float32bits(v))}}
+}
+
+func (m protoMessage) setBytes(field protowire.Number, v []byte) {
+	if len(v) == 0 {
+		delete(m, field)
+		return
+	}
+	m[field] = []protoValue{{typ: protowire.BytesType, bytes: v}}
+}
+
+func (m protoMessage) setString(field protowire.Number, v string) {
+	m.setBytes(field, []byte(v))
+}
+
+func (m protoMessage) setMessage(field protowire.Number, v protoMessage) {
+	m[field] = []protoValue{{typ: protowire.BytesType, bytes: v.encode()}}
+}
+
+func (m protoMessage) setMessages(field protowire.Number, vs []protoMessage) {
+	delete(m, field)
+	for _, v := range vs {
+		m[field] = append(m[field], protoValue{typ: protowire.BytesType, bytes: v.encode()})
+	}
+}
+
+// setUints sets a packed repeated varint field.
+func (m protoMessage) setUints(field protowire.Number, vs []uint64) {
+	var b []byte
+	for _, v := range vs {
+		b = protowire.AppendVarint(b, v)
+	}
+	m.setBytes(field, b)
+}
+
+// setFloats sets a packed repeated float field.
+func (m protoMessage) setFloats(field protowire.Number, vs []float32) {
+	var b []byte
+	for _, v := range vs {
+		b = protowire.AppendFixed32(b, math.Float32bits(v))
+	}
+	m.setBytes(field, b)
+}
+
+// encode encodes the message, with its fields in order.
+func (m protoMessage) encode() []byte {
+	fields := make([]protowire.Number, 0, len(m))
+	for field := range m {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i] < fields[j] })
+	// An empty message is stored as an empty blob, rather than NULL.
+	b := []byte{}
+	for _, field := range fields {
+		for _, v := range m[field] {
+			b = protowire.AppendTag(b, field, v.typ)
+			switch v.typ {
+			case protowire.VarintType:
+				b = protowire.AppendVarint(b, v.num)
+			case protowire.Fixed32Type:
+				b = protowire.AppendFixed32(b, uint32(v.num))
+			case protowire.Fixed64Type:
+				b = protowire.AppendFixed64(b, v.num)
+			default:
+				b = protowire.AppendBytes(b, v.bytes)
+			}
+		}
+	}
+	return b
+}
@@ -0,0 +1,396 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StudyQueue describes the cards Anki would show when studying a deck.
+type StudyQueue struct {
+	NewCount      int // Number of new cards to be shown today
+	LearningCount int // Number of (re)learning cards due today
+	ReviewCount   int // Number of review cards to be shown today
+	// Cards are the cards to be studied, in the order they would be
+	// presented.
+	Cards []*Card
+}
+
+// dynamicDeckLimit is the limit applied to filtered decks, which are not
+// subject to daily limits. This matches the limit Anki reports.
+const dynamicDeckLimit = 99999
+
+// BuildStudyQueue returns the queue of cards Anki's v2 scheduler would show
+// at the given time, when studying the deck with the provided ID. cards
+// should include all of the collection's cards; those outside the deck and
+// its subdecks are ignored, as are suspended and buried cards.
+//
+// New and review cards are subject to the daily limits of the deck options,
+// less the cards already studied today. New cards are further limited by the
+// options of each subdeck, and those of every parent deck. When burying of
+// new or review siblings is enabled, only the first card of each note is
+// queued; as in Anki, whose siblings are buried only once a card is answered,
+// the counts include the cards which would be buried. Learning cards are
+// shown when due, including those due within the collection's learn ahead
+// limit.
+func BuildStudyQueue(collection *Collection, deckID ID, cards []*Card, now time.Time) (*StudyQueue, error) {
+	deck, ok := collection.Decks[deckID]
+	if !ok {
+		return nil, fmt.Errorf("Deck %d not found", deckID)
+	}
+	q := &queueBuilder{
+		collection: collection,
+		crt:        seconds(collection.Created),
+		now:        now.Unix(),
+		byName:     make(map[string]*Deck, len(collection.Decks)),
+		byDeck:     make(map[ID][]*Card),
+	}
+	q.today = (q.now - q.crt) / secondsPerDay
+	for _, d := range collection.Decks {
+		q.byName[strings.ToLower(d.Name)] = d
+	}
+	active := q.activeDecks(deck)
+	for _, d := range active {
+		q.byDeck[d.ID] = nil
+	}
+	for _, card := range cards {
+		if _, ok := q.byDeck[card.DeckID]; ok {
+			q.byDeck[card.DeckID] = append(q.byDeck[card.DeckID], card)
+		}
+	}
+
+	learning, dayLearning := q.learningCards(active)
+	reviews, err := q.reviewCards(deck, active)
+	if err != nil {
+		return nil, err
+	}
+	newCards, err := q.newCards(active)
+	if err != nil {
+		return nil, err
+	}
+	queue := &StudyQueue{
+		NewCount:      len(newCards),
+		LearningCount: len(learning) + len(dayLearning),
+		ReviewCount:   len(reviews),
+	}
+
+	// Build the queues again, this time burying the siblings of the cards
+	// already queued, learning cards first.
+	q.siblings = make(map[ID]bool)
+	for _, cards := range [][]*Card{learning, dayLearning} {
+		for _, card := range cards {
+			q.siblings[card.NoteID] = true
+		}
+	}
+	if reviews, err = q.reviewCards(deck, active); err != nil {
+		return nil, err
+	}
+	if newCards, err = q.newCards(active); err != nil {
+		return nil, err
+	}
+	queue.Cards = q.order(learning, dayLearning, reviews, newCards)
+	return queue, nil
+}
+
+type queueBuilder struct {
+	collection *Collection
+	crt        int64
+	now        int64
+	today      int64
+	byName     map[string]*Deck
+	byDeck     map[ID][]*Card
+	// siblings holds the notes which already have a card queued, for sibling
+	// burying. It is nil while the counts are taken, when no card is buried.
+	siblings map[ID]bool
+}
+
+// activeDecks returns the deck and its subdecks, sorted by name.
+func (q *queueBuilder) activeDecks(deck *Deck) []*Deck {
+	active := []*Deck{deck}
+	prefix := strings.ToLower(deck.Name) + "::"
+	for _, d := range q.collection.Decks {
+		if strings.HasPrefix(strings.ToLower(d.Name), prefix) {
+			active = append(active, d)
+		}
+	}
+	sort.Slice(active[1:], func(i, j int) bool {
+		return strings.ToLower(active[i+1].Name) < strings.ToLower(active[j+1].Name)
+	})
+	return active
+}
+
+// parents returns the deck's parents, from the top level down.
+func (q *queueBuilder) parents(deck *Deck) []*Deck {
+	parts := strings.Split(deck.Name, "::")
+	var parents []*Deck
+	for i := 1; i < len(parts); i++ {
+		if parent, ok := q.byName[strings.ToLower(strings.Join(parts[:i], "::"))]; ok {
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+func (q *queueBuilder) deckConfig(deck *Deck) (*DeckConfig, error) {
+	if deck.Config != nil {
+		return deck.Config, nil
+	}
+	conf, ok := q.collection.DeckConfigs[deck.ConfigID]
+	if !ok {
+		return nil, fmt.Errorf("Deck %d references non-existent config %d", deck.ID, deck.ConfigID)
+	}
+	return conf, nil
+}
+
+// remaining returns the number of cards left today, given a daily limit and
+// a deck's [day, count] counter.
+func (q *queueBuilder) remaining(perDay int, today [2]int) int {
+	if int64(today[0]) == q.today {
+		perDay -= today[1]
+	}
+	return maxInt(perDay, 0)
+}
+
+func (q *queueBuilder) newLimit(deck *Deck) (int, error) {
+	if deck.Dynamic {
+		return dynamicDeckLimit, nil
+	}
+	conf, err := q.deckConfig(deck)
+	if err != nil {
+		return 0, err
+	}
+	return q.remaining(conf.New.PerDay, deck.NewToday), nil
+}
+
+func (q *queueBuilder) reviewLimit(deck *Deck) (int, error) {
+	if deck.Dynamic {
+		return dynamicDeckLimit, nil
+	}
+	conf, err := q.deckConfig(deck)
+	if err != nil {
+		return 0, err
+	}
+	return q.remaining(conf.Reviews.PerDay, deck.ReviewsToday), nil
+}
+
+// buryOptions returns whether new and review siblings are buried in the
+// deck. Siblings are never buried in filtered decks.
+func (q *queueBuilder) buryOptions(deck *Deck) (bool, bool, error) {
+	if deck.Dynamic {
+		return false, false, nil
+	}
+	conf, err := q.deckConfig(deck)
+	if err != nil {
+		return false, false, err
+	}
+	return conf.New.Bury, conf.Reviews.Bury, nil
+}
+
+// bury reports whether a card should be skipped because a sibling has
+// already been queued, and otherwise records the card's note as queued.
+func (q *queueBuilder) bury(card *Card, enabled bool) bool {
+	if q.siblings == nil {
+		return false
+	}
+	if enabled && q.siblings[card.NoteID] {
+		return true
+	}
+	q.siblings[card.NoteID] = true
+	return false
+}
+
+// learningCards returns the intraday learning cards due before the learn
+// ahead cutoff, and the interday learning cards due today.
+func (q *queueBuilder) learningCards(active []*Deck) ([]*Card, []*Card) {
+	cutoff := q.now + int64(q.collection.Config.CollapseTime)
+	var learning, dayLearning []*Card
+	for _, deck := range active {
+		for _, card := range q.byDeck[deck.ID] {
+			switch card.Queue {
+			case CardQueueLearning:
+				if seconds(card.Due) < cutoff {
+					learning = append(learning, card)
+				}
+			case CardQueueRelearning:
+				if daysSince(card.Due, q.crt) <= q.today {
+					dayLearning = append(dayLearning, card)
+				}
+			}
+		}
+	}
+	sortCards(learning, func(c *Card) int64 { return seconds(c.Due) })
+	sortCards(dayLearning, func(c *Card) int64 { return daysSince(c.Due, q.crt) })
+	return learning, dayLearning
+}
+
+// reviewCards returns the review cards due today, in order of due date,
+// limited by the review limit of the selected deck and its parents.
+func (q *queueBuilder) reviewCards(deck *Deck, active []*Deck) ([]*Card, error) {
+	limit, err := q.reviewLimit(deck)
+	if err != nil {
+		return nil, err
+	}
+	for _, parent := range q.parents(deck) {
+		parentLimit, err := q.reviewLimit(parent)
+		if err != nil {
+			return nil, err
+		}
+		limit = minInt(limit, parentLimit)
+	}
+	var due []*Card
+	for _, d := range active {
+		for _, card := range q.byDeck[d.ID] {
+			if card.Queue == CardQueueReview && daysSince(card.Due, q.crt) <= q.today {
+				due = append(due, card)
+			}
+		}
+	}
+	sortCards(due, func(c *Card) int64 { return daysSince(c.Due, q.crt) })
+	reviews := make([]*Card, 0, minInt(limit, len(due)))
+	for _, card := range due {
+		if len(reviews) >= limit {
+			break
+		}
+		_, bury, err := q.buryOptions(q.collection.Decks[card.DeckID])
+		if err != nil {
+			return nil, err
+		}
+		if !q.bury(card, bury) {
+			reviews = append(reviews, card)
+		}
+	}
+	return reviews, nil
+}
+
+// newCards returns the new cards to be shown today. Each deck contributes up
+// to its own limit, further limited by what remains of its parents' limits,
+// as in Anki's _walkingCount.
+func (q *queueBuilder) newCards(active []*Deck) ([]*Card, error) {
+	parentCounts := make(map[ID]int)
+	var newCards []*Card
+	for _, deck := range active {
+		limit, err := q.newLimit(deck)
+		if err != nil {
+			return nil, err
+		}
+		if limit == 0 {
+			continue
+		}
+		parents := q.parents(deck)
+		for _, parent := range parents {
+			if _, ok := parentCounts[parent.ID]; !ok {
+				if parentCounts[parent.ID], err = q.newLimit(parent); err != nil {
+					return nil, err
+				}
+			}
+			limit = minInt(limit, parentCounts[parent.ID])
+		}
+		bury, _, err := q.buryOptions(deck)
+		if err != nil {
+			return nil, err
+		}
+		var candidates []*Card
+		for _, card := range q.byDeck[deck.ID] {
+			if card.Queue == CardQueueNew {
+				candidates = append(candidates, card)
+			}
+		}
+		sortCards(candidates, func(c *Card) int64 { return int64(c.Position) })
+		count := 0
+		for _, card := range candidates {
+			if count >= limit {
+				break
+			}
+			if !q.bury(card, bury) {
+				newCards = append(newCards, card)
+				count++
+			}
+		}
+		for _, parent := range parents {
+			parentCounts[parent.ID] -= count
+		}
+		parentCounts[deck.ID] = limit - count
+	}
+	return newCards, nil
+}
+
+// sortCards sorts cards by the provided key, then by template ordinal and
+// ID, as Anki does.
+func sortCards(cards []*Card, key func(*Card) int64) {
+	sort.SliceStable(cards, func(i, j int) bool {
+		ki, kj := key(cards[i]), key(cards[j])
+		if ki != kj {
+			return ki < kj
+		}
+		if cards[i].TemplateID != cards[j].TemplateID {
+			return cards[i].TemplateID < cards[j].TemplateID
+		}
+		return cards[i].ID < cards[j].ID
+	})
+}
+
+// Values of Config.NewSpread
+const (
+	newSpreadDistribute = 0
+	newSpreadLast       = 1
+	newSpreadFirst      = 2
+)
+
+// order interleaves the queues in the order Anki's v2 scheduler presents
+// them. Learning cards which are already due come first. New cards are
+// shown before, after or mixed in with the reviews, according to the
+// collection's new card spread setting. Learning cards which are due within
+// the learn ahead limit come last.
+func (q *queueBuilder) order(learning, dayLearning, reviews, newCards []*Card) []*Card {
+	ordered := make([]*Card, 0, len(learning)+len(dayLearning)+len(reviews)+len(newCards))
+	var ahead []*Card
+	for _, card := range learning {
+		if seconds(card.Due) <= q.now {
+			ordered = append(ordered, card)
+		} else {
+			ahead = append(ahead, card)
+		}
+	}
+
+	var modulus int
+	if q.collection.Config.NewSpread == newSpreadDistribute && len(newCards) > 0 {
+		modulus = (len(newCards) + len(reviews)) / len(newCards)
+		if len(reviews) > 0 {
+			modulus = maxInt(2, modulus)
+		}
+	}
+	// As in Anki, reps counts the cards already shown.
+	reps := len(ordered)
+	for len(dayLearning)+len(reviews)+len(newCards) > 0 {
+		var next *Card
+		switch {
+		case len(newCards) == 0:
+		case q.collection.Config.NewSpread == newSpreadFirst,
+			len(reviews)+len(dayLearning) == 0,
+			modulus > 0 && reps > 0 && reps%modulus == 0:
+			next, newCards = newCards[0], newCards[1:]
+		}
+		if next == nil {
+			switch {
+			case len(reviews) > 0:
+				next, reviews = reviews[0], reviews[1:]
+			case len(dayLearning) > 0:
+				next, dayLearning = dayLearning[0], dayLearning[1:]
+			}
+		}
+		ordered = append(ordered, next)
+		reps++
+	}
+	return append(ordered, ahead...)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
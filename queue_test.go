@@ -0,0 +1,119 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuildStudyQueue(t *testing.T) {
+	b := NewBuilder()
+	crt := time.Date(2020, 1, 1, 4, 0, 0, 0, time.UTC)
+	b.Collection().Created = timestampSeconds(crt)
+	now := crt.AddDate(0, 0, 10).Add(12 * time.Hour)
+
+	parentConf := DefaultDeckConfig()
+	parentConf.ID = 2
+	parentConf.New.PerDay = 4
+	parentConf.Reviews.PerDay = 3
+	childConf := DefaultDeckConfig()
+	childConf.ID = 3
+	childConf.New.PerDay = 2
+	childConf.New.Bury = true
+	childConf.Reviews.Bury = true
+	for _, conf := range []*DeckConfig{parentConf, childConf} {
+		if err := b.AddDeckConfig(conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decks := []*Deck{
+		{ID: 10, Name: "Lang", ConfigID: 2, NewToday: [2]int{9, 3}, ReviewsToday: [2]int{10, 1}},
+		{ID: 11, Name: "Lang::French", ConfigID: 3},
+		{ID: 12, Name: "Lang::German", ConfigID: 3},
+		{ID: 20, Name: "Other"},
+	}
+	for _, deck := range decks {
+		if err := b.AddDeck(deck); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	day := func(n int) *TimestampSeconds {
+		return timestampSeconds(crt.AddDate(0, 0, n))
+	}
+	at := func(d time.Duration) *TimestampSeconds {
+		return timestampSeconds(now.Add(d))
+	}
+	newCard := func(id, nid, did ID, ord, pos int) *Card {
+		return &Card{ID: id, NoteID: nid, DeckID: did, TemplateID: ord, Position: pos, Queue: CardQueueNew}
+	}
+	card := func(id, did ID, queue CardQueue, due *TimestampSeconds) *Card {
+		return &Card{ID: id, NoteID: id, DeckID: did, Queue: queue, Due: due}
+	}
+	cards := []*Card{
+		newCard(300, 300, 10, 0, 6),
+		newCard(702, 102, 11, 0, 2),
+		newCard(701, 100, 11, 1, 1),
+		newCard(700, 100, 11, 0, 1),
+		newCard(703, 103, 11, 0, 3),
+		newCard(800, 200, 12, 0, 4),
+		newCard(801, 201, 12, 0, 5),
+		card(400, 10, CardQueueReview, day(9)),
+		card(401, 11, CardQueueReview, day(10)),
+		card(402, 12, CardQueueReview, day(8)),
+		card(403, 11, CardQueueReview, day(11)),
+		{ID: 404, NoteID: 500, DeckID: 11, Queue: CardQueueReview, Due: day(10)},
+		card(500, 11, CardQueueLearning, at(-time.Minute)),
+		card(501, 11, CardQueueLearning, at(10*time.Minute)),
+		card(502, 11, CardQueueLearning, at(time.Hour)),
+		card(503, 12, CardQueueRelearning, day(10)),
+		card(504, 11, CardQueueSuspended, nil),
+		card(505, 11, CardQueueBuried, nil),
+		newCard(600, 600, 20, 0, 1),
+	}
+
+	tests := []struct {
+		name     string
+		deckID   ID
+		counts   [3]int
+		expected []ID
+	}{
+		{
+			name:     "parent",
+			deckID:   10,
+			counts:   [3]int{4, 3, 2},
+			expected: []ID{500, 402, 300, 400, 700, 503, 702, 800, 501},
+		},
+		{
+			name:     "child",
+			deckID:   11,
+			counts:   [3]int{2, 2, 2},
+			expected: []ID{500, 401, 700, 702, 501},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue, err := BuildStudyQueue(b.Collection(), test.deckID, cards, now)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if counts := [3]int{queue.NewCount, queue.LearningCount, queue.ReviewCount}; counts != test.counts {
+				t.Errorf("Expected counts %v, got %v", test.counts, counts)
+			}
+			ids := make([]ID, len(queue.Cards))
+			for i, card := range queue.Cards {
+				ids[i] = card.ID
+			}
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("Expected cards %v, got %v", test.expected, ids)
+			}
+		})
+	}
+
+	if _, err := BuildStudyQueue(b.Collection(), 99, cards, now); err == nil || err.Error() != "Deck 99 not found" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,571 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Scheduler implements Anki's v2 (SM-2 based) scheduler. See
+// https://github.com/ankitects/anki/blob/2.1.15/anki/schedv2.py
+//
+// Internally, the scheduler works with the same units Anki stores in the
+// database (days, seconds and permille factors), converting to and from the
+// representation used by the Card type as needed.
+type Scheduler struct {
+	collection *Collection
+	// Rand, if non-nil, is used to add random fuzz to intervals and
+	// learning steps, as Anki does. If nil, no fuzz is applied, and
+	// scheduling is deterministic.
+	Rand *rand.Rand
+}
+
+// NewScheduler returns a new Scheduler for cards in the provided collection.
+// The collection's creation time and deck options are used for scheduling.
+func NewScheduler(collection *Collection) *Scheduler {
+	return &Scheduler{collection: collection}
+}
+
+// schedCard holds the scheduling state of a card, in Anki's native units.
+type schedCard struct {
+	cardType CardType
+	queue    CardQueue
+	due      int64 // Position for new cards; seconds for learning; days for review & day learn
+	ivl      int64 // Days
+	factor   int64 // Permille
+	reps     int
+	lapses   int
+	left     int
+	odue     int64
+	odid     ID
+	did      ID
+}
+
+// schedDay describes the scheduler's notion of "now".
+type schedDay struct {
+	now       int64 // Seconds since epoch
+	today     int64 // Days since collection creation
+	dayCutoff int64 // Seconds since epoch when the next day starts
+}
+
+// Answer answers a card with the given ease (1-4) at the given time, as
+// Anki's reviewer would. It returns an updated copy of the card, and the
+// Review which should be appended to the review log. The review's
+// ReviewTime is not known to the scheduler, and is left at zero.
+//
+// If the card becomes a leech, it is suspended when the deck options call
+// for it. Tagging the note as a leech is left to the caller; see IsLeech.
+func (s *Scheduler) Answer(card *Card, ease ReviewEase, now time.Time) (*Card, *Review, error) {
+	if ease < ReviewEaseWrong || ease > ReviewEaseEasy {
+		return nil, nil, fmt.Errorf("Invalid ease %d", ease)
+	}
+	conf, err := s.deckConfig(card)
+	if err != nil {
+		return nil, nil, err
+	}
+	crt := seconds(s.collection.Created)
+	day := schedDay{now: now.Unix()}
+	day.today = (day.now - crt) / secondsPerDay
+	day.dayCutoff = crt + (day.today+1)*secondsPerDay
+
+	c := s.fromCard(card, crt)
+	c.reps++
+	var review *schedReview
+	switch c.queue {
+	case CardQueueNew:
+		// Came from the new queue; move to learning.
+		c.queue = CardQueueLearning
+		c.cardType = CardTypeLearning
+		c.left = s.startingLeft(c, conf, day)
+		fallthrough
+	case CardQueueLearning, CardQueueRelearning:
+		review = s.answerLearning(c, conf, ease, day)
+	case CardQueueReview:
+		review = s.answerReview(c, conf, ease, day)
+	default:
+		return nil, nil, fmt.Errorf("Card %d is not in the new, learning or review queue", card.ID)
+	}
+	// Once a card has been answered, the original due date no longer applies.
+	c.odue = 0
+
+	updated := s.toCard(card, c, crt, now)
+	ts := TimestampMilliseconds(time.Unix(0, now.UnixNano()/int64(time.Millisecond)*int64(time.Millisecond)).UTC())
+	return updated, &Review{
+		Timestamp:      &ts,
+		CardID:         card.ID,
+		UpdateSequence: -1,
+		Ease:           ease,
+		Interval:       review.ivl,
+		LastInterval:   review.lastIvl,
+		Factor:         float32(c.factor) / 1000,
+		Type:           review.reviewType,
+	}, nil
+}
+
+// IsLeech returns true if the card, after being answered incorrectly, has
+// just reached its deck's leech threshold (or every half threshold
+// thereafter), in which case Anki tags the note as a leech.
+func (s *Scheduler) IsLeech(card *Card) bool {
+	conf, err := s.deckConfig(card)
+	if err != nil {
+		return false
+	}
+	return isLeech(card.Lapses, conf)
+}
+
+func isLeech(lapses int, conf *DeckConfig) bool {
+	lf := conf.Lapses.LeechFails
+	if lf == 0 {
+		return false
+	}
+	return lapses >= lf && (lapses-lf)%maxInt(lf/2, 1) == 0
+}
+
+// deckConfig returns the options of the card's deck, or of its original deck
+// for cards in filtered decks.
+func (s *Scheduler) deckConfig(card *Card) (*DeckConfig, error) {
+	did := card.DeckID
+	if card.OriginalDeckID != 0 {
+		did = card.OriginalDeckID
+	}
+	deck, ok := s.collection.Decks[did]
+	if !ok {
+		return nil, fmt.Errorf("Card %d references non-existent deck %d", card.ID, did)
+	}
+	conf := deck.Config
+	if conf == nil {
+		if conf, ok = s.collection.DeckConfigs[deck.ConfigID]; !ok {
+			return nil, fmt.Errorf("Deck %d references non-existent config %d", deck.ID, deck.ConfigID)
+		}
+	}
+	return conf, nil
+}
+
+func (s *Scheduler) fromCard(card *Card, crt int64) *schedCard {
+	c := &schedCard{
+		cardType: card.Type,
+		queue:    card.Queue,
+		factor:   encodeFactor(card.Factor),
+		reps:     card.ReviewCount,
+		lapses:   card.Lapses,
+		left:     card.Left,
+		odid:     card.OriginalDeckID,
+		did:      card.DeckID,
+	}
+	if card.Interval != nil {
+		c.ivl = int64(time.Duration(*card.Interval)/time.Second) / secondsPerDay
+	}
+	switch c.queue {
+	case CardQueueLearning:
+		c.due = seconds(card.Due)
+	case CardQueueReview, CardQueueRelearning:
+		c.due = daysSince(card.Due, crt)
+	}
+	if c.odid != 0 {
+		c.odue = daysSince(card.OriginalDue, crt)
+	}
+	return c
+}
+
+func (s *Scheduler) toCard(orig *Card, c *schedCard, crt int64, now time.Time) *Card {
+	card := *orig
+	card.Type = c.cardType
+	card.Queue = c.queue
+	card.Factor = float32(c.factor) / 1000
+	card.ReviewCount = c.reps
+	card.Lapses = c.lapses
+	card.Left = c.left
+	card.DeckID = c.did
+	card.OriginalDeckID = c.odid
+	card.OriginalDue = nil
+	card.Modified = timestampSeconds(now)
+	card.UpdateSequence = -1
+	ivl := DurationSeconds(time.Duration(c.ivl) * secondsPerDay * time.Second)
+	card.Interval = &ivl
+	var due int64
+	switch c.queue {
+	case CardQueueLearning:
+		due = c.due
+	default:
+		due = crt + c.due*secondsPerDay
+	}
+	card.Due = timestampSeconds(time.Unix(due, 0))
+	return &card
+}
+
+// schedReview holds the values for the review log entry.
+type schedReview struct {
+	ivl        DurationSeconds
+	lastIvl    DurationSeconds
+	reviewType ReviewType
+}
+
+func daysDuration(days int64) DurationSeconds {
+	return DurationSeconds(time.Duration(days) * secondsPerDay * time.Second)
+}
+
+func secondsDuration(secs int64) DurationSeconds {
+	return DurationSeconds(time.Duration(secs) * time.Second)
+}
+
+// learningDelays returns the learning steps, in seconds, which apply to the
+// card: the relearning steps for review and relearning cards, and the new
+// card steps otherwise.
+func learningDelays(c *schedCard, conf *DeckConfig) []int64 {
+	steps := conf.New.Delays
+	if c.cardType == CardTypeReview || c.cardType == CardTypeRelearning {
+		steps = conf.Lapses.Delays
+	}
+	delays := make([]int64, len(steps))
+	for i, step := range steps {
+		delays[i] = int64(time.Duration(step) / time.Second)
+	}
+	return delays
+}
+
+// startingLeft returns the initial value of `left` for a card entering
+// (re)learning. The value encodes both the total number of steps, and, in the
+// thousands, the number of steps which can be completed today.
+func (s *Scheduler) startingLeft(c *schedCard, conf *DeckConfig, day schedDay) int {
+	delays := learningDelays(c, conf)
+	total := len(delays)
+	return total + s.leftToday(delays, total, day)*1000
+}
+
+// leftToday returns the number of the remaining steps which can be completed
+// before the day cutoff.
+func (s *Scheduler) leftToday(delays []int64, left int, day schedDay) int {
+	if left < len(delays) {
+		delays = delays[len(delays)-left:]
+	}
+	now := day.now
+	ok := 0
+	for i, delay := range delays {
+		now += delay
+		if now > day.dayCutoff {
+			break
+		}
+		ok = i
+	}
+	return ok + 1
+}
+
+func (s *Scheduler) answerLearning(c *schedCard, conf *DeckConfig, ease ReviewEase, day schedDay) *schedReview {
+	delays := learningDelays(c, conf)
+	reviewType := ReviewTypeRelearn
+	if c.cardType == CardTypeNew || c.cardType == CardTypeLearning {
+		reviewType = ReviewTypeLearn
+	}
+	lastLeft := c.left
+	var leaving bool
+	switch ease {
+	case ReviewEaseEasy:
+		// Immediate graduation
+		s.rescheduleAsReview(c, conf, true, day)
+		leaving = true
+	case ReviewEaseOK:
+		if c.left%1000-1 <= 0 {
+			// Graduation time
+			s.rescheduleAsReview(c, conf, false, day)
+			leaving = true
+		} else {
+			// Next step
+			left := c.left%1000 - 1
+			c.left = s.leftToday(delays, left, day)*1000 + left
+			s.rescheduleLearning(c, delays, delayForGrade(delays, c.left), day)
+		}
+	case ReviewEaseHard:
+		s.rescheduleLearning(c, delays, delayForRepeatingGrade(delays, c.left), day)
+	default:
+		s.moveToFirstStep(c, conf, day)
+	}
+
+	review := &schedReview{
+		reviewType: reviewType,
+		lastIvl:    secondsDuration(delayForGrade(delays, lastLeft)),
+	}
+	switch {
+	case leaving:
+		review.ivl = daysDuration(c.ivl)
+	case ease == ReviewEaseHard:
+		review.ivl = secondsDuration(delayForRepeatingGrade(delays, c.left))
+	default:
+		review.ivl = secondsDuration(delayForGrade(delays, c.left))
+	}
+	return review
+}
+
+// moveToFirstStep restarts (re)learning, returning the delay in seconds.
+func (s *Scheduler) moveToFirstStep(c *schedCard, conf *DeckConfig, day schedDay) int64 {
+	c.left = s.startingLeft(c, conf, day)
+	if c.cardType == CardTypeRelearning {
+		c.ivl = lapseInterval(c, conf)
+	}
+	delays := learningDelays(c, conf)
+	delay := delayForGrade(delays, c.left)
+	s.rescheduleLearning(c, delays, delay, day)
+	return delay
+}
+
+// rescheduleLearning schedules a (re)learning card delay seconds from now.
+// Cards due before the day cutoff go into the learning queue; others go into
+// the day learn queue.
+func (s *Scheduler) rescheduleLearning(c *schedCard, delays []int64, delay int64, day schedDay) {
+	due := day.now + delay
+	if due < day.dayCutoff {
+		// Add some randomness, up to 5 minutes or 25%.
+		maxExtra := minInt64(300, int64(float64(delay)*0.25))
+		if s.Rand != nil {
+			due += s.Rand.Int63n(maxInt64(1, maxExtra))
+		}
+		c.due = minInt64(day.dayCutoff-1, due)
+		c.queue = CardQueueLearning
+		return
+	}
+	ahead := (due-day.dayCutoff)/secondsPerDay + 1
+	c.due = day.today + ahead
+	c.queue = CardQueueRelearning
+}
+
+// delayForGrade returns the delay, in seconds, of the current learning step.
+func delayForGrade(delays []int64, left int) int64 {
+	left = left % 1000
+	if left > 0 && left <= len(delays) {
+		return delays[len(delays)-left]
+	}
+	if len(delays) > 0 {
+		return delays[0]
+	}
+	return 60
+}
+
+// delayForRepeatingGrade returns the delay, in seconds, used when Hard is
+// pressed on a learning card: halfway between the current and next steps.
+func delayForRepeatingGrade(delays []int64, left int) int64 {
+	delay1 := delayForGrade(delays, left)
+	delay2 := delay1 * 2
+	if len(delays) > 1 {
+		delay2 = delayForGrade(delays, left-1)
+	}
+	return (delay1 + maxInt64(delay1, delay2)) / 2
+}
+
+// rescheduleAsReview graduates a (re)learning card to the review queue.
+func (s *Scheduler) rescheduleAsReview(c *schedCard, conf *DeckConfig, early bool, day schedDay) {
+	if c.cardType == CardTypeReview || c.cardType == CardTypeRelearning {
+		// Graduating lapse
+		if early {
+			c.ivl++
+		}
+	} else {
+		// Graduating new card
+		ideal := int64(conf.New.Intervals[0])
+		if early {
+			ideal = int64(conf.New.Intervals[1])
+		}
+		c.ivl = s.fuzzedInterval(ideal)
+		c.factor = int64(conf.New.InitialFactor)
+	}
+	c.due = day.today + c.ivl
+	c.queue = CardQueueReview
+	c.cardType = CardTypeReview
+	s.removeFromFiltered(c)
+}
+
+// removeFromFiltered returns a card in a filtered deck to its original deck.
+func (s *Scheduler) removeFromFiltered(c *schedCard) {
+	if c.odid != 0 {
+		c.did = c.odid
+		c.odid = 0
+	}
+}
+
+func (s *Scheduler) answerReview(c *schedCard, conf *DeckConfig, ease ReviewEase, day schedDay) *schedReview {
+	reviewType := ReviewTypeReview
+	// Reviewed early, in a filtered deck
+	early := c.odid != 0 && c.odue > day.today
+	if early {
+		reviewType = ReviewTypeCram
+	}
+	lastIvl := c.ivl
+	var delay int64
+	if ease == ReviewEaseWrong {
+		delay = s.rescheduleLapse(c, conf, day)
+	} else {
+		if early {
+			c.ivl = s.earlyReviewInterval(c, conf, ease, day)
+		} else {
+			c.ivl = s.nextReviewInterval(c, conf, ease, day)
+		}
+		c.factor = maxInt64(1300, c.factor+[]int64{-150, 0, 150}[ease-2])
+		c.due = day.today + c.ivl
+		s.removeFromFiltered(c)
+	}
+	review := &schedReview{
+		reviewType: reviewType,
+		lastIvl:    daysDuration(lastIvl),
+		ivl:        daysDuration(c.ivl),
+	}
+	if delay > 0 {
+		review.ivl = secondsDuration(delay)
+	}
+	return review
+}
+
+// rescheduleLapse handles a review card answered incorrectly, returning the
+// relearning delay in seconds, or 0 if there are no relearning steps.
+func (s *Scheduler) rescheduleLapse(c *schedCard, conf *DeckConfig, day schedDay) int64 {
+	c.lapses++
+	c.factor = maxInt64(1300, c.factor-200)
+	suspended := false
+	if isLeech(c.lapses, conf) && conf.Lapses.LeechAction == LeechActionSuspendCard {
+		suspended = true
+	}
+	if len(conf.Lapses.Delays) > 0 && !suspended {
+		c.cardType = CardTypeRelearning
+		return s.moveToFirstStep(c, conf, day)
+	}
+	// No relearning steps
+	c.ivl = lapseInterval(c, conf)
+	s.rescheduleAsReview(c, conf, false, day)
+	if suspended {
+		c.queue = CardQueueSuspended
+	}
+	return 0
+}
+
+// lapseInterval returns the new interval, in days, of a lapsed card.
+func lapseInterval(c *schedCard, conf *DeckConfig) int64 {
+	ivl := int64(float64(c.ivl) * float64(conf.Lapses.NewInterval))
+	return maxInt64(1, maxInt64(int64(conf.Lapses.MinimumInterval), ivl))
+}
+
+// nextReviewInterval returns the next interval, in days, for a review card
+// answered with the given ease.
+func (s *Scheduler) nextReviewInterval(c *schedCard, conf *DeckConfig, ease ReviewEase, day schedDay) int64 {
+	due := c.due
+	if c.odid != 0 {
+		due = c.odue
+	}
+	delay := maxInt64(0, day.today-due)
+	fct := float64(c.factor) / 1000
+	hardFactor := hardFactor(conf)
+	var hardMin int64
+	if hardFactor > 1 {
+		hardMin = c.ivl
+	}
+	ivl2 := s.constrainedInterval(float64(c.ivl)*hardFactor, conf, hardMin, true)
+	if ease == ReviewEaseHard {
+		return ivl2
+	}
+	ivl3 := s.constrainedInterval(float64(c.ivl+delay/2)*fct, conf, ivl2, true)
+	if ease == ReviewEaseOK {
+		return ivl3
+	}
+	return s.constrainedInterval(float64(c.ivl+delay)*fct*float64(conf.Reviews.EasyBonus), conf, ivl3, true)
+}
+
+// earlyReviewInterval returns the next interval, in days, for a review card
+// in a filtered deck answered correctly before it was due. The interval is
+// based on the time elapsed since the last review, as in Anki's
+// _earlyReviewIvl, and is not fuzzed.
+func (s *Scheduler) earlyReviewInterval(c *schedCard, conf *DeckConfig, ease ReviewEase, day schedDay) int64 {
+	elapsed := float64(c.ivl - (c.odue - day.today))
+	fct := float64(c.factor) / 1000
+	easyBonus := 1.0
+	// Early good and easy reviews do not decrease the interval
+	minFactor := 1.0
+	switch ease {
+	case ReviewEaseHard:
+		fct = hardFactor(conf)
+		// Early hard reviews decrease the interval by at most half the hard
+		// factor
+		minFactor = fct / 2
+	case ReviewEaseEasy:
+		// Half the easy bonus: 1.3 becomes 1.15
+		ease4 := float64(conf.Reviews.EasyBonus)
+		easyBonus = ease4 - (ease4-1)/2
+	}
+	ivl := math.Max(elapsed*fct, 1)
+	ivl = math.Max(float64(c.ivl)*minFactor, ivl) * easyBonus
+	return s.constrainedInterval(ivl, conf, 0, false)
+}
+
+// hardFactor returns the interval multiplier for reviews answered hard.
+func hardFactor(conf *DeckConfig) float64 {
+	if conf.Reviews.HardFactor == 0 {
+		return 1.2
+	}
+	return float64(conf.Reviews.HardFactor)
+}
+
+// constrainedInterval applies the interval modifier, fuzz if requested, and
+// the maximum interval to ivl, ensuring it is greater than prev.
+func (s *Scheduler) constrainedInterval(ivl float64, conf *DeckConfig, prev int64, fuzz bool) int64 {
+	modifier := float64(conf.Reviews.IntervalModifier)
+	if modifier == 0 {
+		modifier = 1
+	}
+	days := int64(ivl * modifier)
+	if fuzz {
+		days = s.fuzzedInterval(days)
+	}
+	days = maxInt64(days, maxInt64(prev+1, 1))
+	if max := int64(conf.Reviews.MaxInterval); max > 0 {
+		days = minInt64(days, max)
+	}
+	return days
+}
+
+// fuzzedInterval returns ivl with random fuzz applied, if s.Rand is set.
+func (s *Scheduler) fuzzedInterval(ivl int64) int64 {
+	if s.Rand == nil {
+		return ivl
+	}
+	min, max := fuzzIntervalRange(ivl)
+	return min + s.Rand.Int63n(max-min+1)
+}
+
+func fuzzIntervalRange(ivl int64) (int64, int64) {
+	var fuzz int64
+	switch {
+	case ivl < 2:
+		return 1, 1
+	case ivl == 2:
+		return 2, 3
+	case ivl < 7:
+		fuzz = int64(float64(ivl) * 0.25)
+	case ivl < 30:
+		fuzz = maxInt64(2, int64(float64(ivl)*0.15))
+	default:
+		fuzz = maxInt64(4, int64(float64(ivl)*0.05))
+	}
+	// Fuzz at least a day
+	fuzz = maxInt64(fuzz, 1)
+	return ivl - fuzz, ivl + fuzz
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
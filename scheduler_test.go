@@ -0,0 +1,196 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSchedulerAnswer(t *testing.T) {
+	collection := NewBuilder().Collection()
+	crt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	collection.Created = timestampSeconds(crt)
+	s := NewScheduler(collection)
+	day := func(n int) time.Time {
+		return crt.Add(time.Duration(n)*24*time.Hour + 12*time.Hour)
+	}
+	minutes := func(n int) DurationSeconds {
+		return DurationSeconds(time.Duration(n) * time.Minute)
+	}
+	days := func(n int) DurationSeconds {
+		return DurationSeconds(time.Duration(n) * 24 * time.Hour)
+	}
+
+	card := &Card{ID: 1, DeckID: DefaultDeckID, Type: CardTypeNew, Queue: CardQueueNew}
+	now := day(10)
+	steps := []struct {
+		name     string
+		ease     ReviewEase
+		at       time.Time
+		cardType CardType
+		queue    CardQueue
+		due      time.Time
+		ivl      DurationSeconds
+		factor   float32
+		left     int
+		lapses   int
+		revType  ReviewType
+		revIvl   DurationSeconds
+		revLast  DurationSeconds
+	}{
+		{
+			name: "new, good", ease: ReviewEaseOK, at: now,
+			cardType: CardTypeLearning, queue: CardQueueLearning, due: now.Add(10 * time.Minute), left: 1001,
+			revType: ReviewTypeLearn, revIvl: minutes(10), revLast: minutes(1),
+		},
+		{
+			name: "learning, hard", ease: ReviewEaseHard, at: now.Add(10 * time.Minute),
+			cardType: CardTypeLearning, queue: CardQueueLearning, due: now.Add(20 * time.Minute), left: 1001,
+			revType: ReviewTypeLearn, revIvl: minutes(10), revLast: minutes(10),
+		},
+		{
+			name: "learning, good, graduates", ease: ReviewEaseOK, at: now.Add(20 * time.Minute),
+			cardType: CardTypeReview, queue: CardQueueReview, due: crt.AddDate(0, 0, 11), ivl: days(1), factor: 2.5, left: 1001,
+			revType: ReviewTypeLearn, revIvl: days(1), revLast: minutes(10),
+		},
+		{
+			name: "review, good", ease: ReviewEaseOK, at: day(11),
+			cardType: CardTypeReview, queue: CardQueueReview, due: crt.AddDate(0, 0, 14), ivl: days(3), factor: 2.5, left: 1001,
+			revType: ReviewTypeReview, revIvl: days(3), revLast: days(1),
+		},
+		{
+			name: "review, easy, late", ease: ReviewEaseEasy, at: day(16),
+			cardType: CardTypeReview, queue: CardQueueReview, due: crt.AddDate(0, 0, 32), ivl: days(16), factor: 2.65, left: 1001,
+			revType: ReviewTypeReview, revIvl: days(16), revLast: days(3),
+		},
+		{
+			name: "review, again", ease: ReviewEaseWrong, at: day(33),
+			cardType: CardTypeRelearning, queue: CardQueueLearning, due: day(33).Add(10 * time.Minute), ivl: days(1), factor: 2.45, left: 1001, lapses: 1,
+			revType: ReviewTypeReview, revIvl: minutes(10), revLast: days(16),
+		},
+		{
+			name: "relearning, good, graduates", ease: ReviewEaseOK, at: day(33).Add(10 * time.Minute),
+			cardType: CardTypeReview, queue: CardQueueReview, due: crt.AddDate(0, 0, 34), ivl: days(1), factor: 2.45, left: 1001, lapses: 1,
+			revType: ReviewTypeRelearn, revIvl: days(1), revLast: minutes(10),
+		},
+	}
+	for i, step := range steps {
+		updated, review, err := s.Answer(card, step.ease, step.at)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %s", step.name, err)
+		}
+		if updated.Type != step.cardType || updated.Queue != step.queue {
+			t.Errorf("%s: Expected type/queue %d/%d, got %d/%d", step.name, step.cardType, step.queue, updated.Type, updated.Queue)
+		}
+		if due := time.Time(*updated.Due); !due.Equal(step.due) {
+			t.Errorf("%s: Expected due %s, got %s", step.name, step.due, due)
+		}
+		if *updated.Interval != step.ivl {
+			t.Errorf("%s: Expected interval %s, got %s", step.name, time.Duration(step.ivl), time.Duration(*updated.Interval))
+		}
+		if step.factor != 0 && updated.Factor != step.factor {
+			t.Errorf("%s: Expected factor %v, got %v", step.name, step.factor, updated.Factor)
+		}
+		if updated.Left != step.left {
+			t.Errorf("%s: Expected left %d, got %d", step.name, step.left, updated.Left)
+		}
+		if updated.Lapses != step.lapses {
+			t.Errorf("%s: Expected %d lapses, got %d", step.name, step.lapses, updated.Lapses)
+		}
+		if updated.ReviewCount != i+1 {
+			t.Errorf("%s: Expected %d reps, got %d", step.name, i+1, updated.ReviewCount)
+		}
+		if review.Type != step.revType || review.Interval != step.revIvl || review.LastInterval != step.revLast {
+			t.Errorf("%s: Unexpected review: %+v", step.name, review)
+		}
+		if review.CardID != card.ID || review.Ease != step.ease {
+			t.Errorf("%s: Unexpected review: %+v", step.name, review)
+		}
+		card = updated
+	}
+}
+
+func TestSchedulerEasyNewCard(t *testing.T) {
+	collection := NewBuilder().Collection()
+	s := NewScheduler(collection)
+	card := &Card{ID: 1, DeckID: DefaultDeckID, Type: CardTypeNew, Queue: CardQueueNew}
+	updated, _, err := s.Answer(card, ReviewEaseEasy, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if updated.Queue != CardQueueReview || *updated.Interval != DurationSeconds(4*24*time.Hour) {
+		t.Errorf("Unexpected card: %+v", updated)
+	}
+	if card.Queue != CardQueueNew {
+		t.Errorf("Original card was modified")
+	}
+}
+
+func TestSchedulerEarlyFilteredReview(t *testing.T) {
+	collection := NewBuilder().Collection()
+	crt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	collection.Created = timestampSeconds(crt)
+	// Early reviews are not fuzzed.
+	s := NewScheduler(collection)
+	s.Rand = rand.New(rand.NewSource(1))
+	ivl := DurationSeconds(10 * 24 * time.Hour)
+	card := &Card{
+		ID: 1, DeckID: 50, OriginalDeckID: DefaultDeckID, Type: CardTypeReview, Queue: CardQueueReview,
+		Due: timestampSeconds(crt), OriginalDue: timestampSeconds(crt.AddDate(0, 0, 20)), Interval: &ivl, Factor: 2.5,
+	}
+	// Answered on day 15, five days after the last review.
+	now := crt.Add(15*24*time.Hour + 12*time.Hour)
+	for _, test := range []struct {
+		ease   ReviewEase
+		ivl    int
+		factor float32
+	}{
+		{ReviewEaseHard, 6, 2.35},
+		{ReviewEaseOK, 12, 2.5},
+		{ReviewEaseEasy, 14, 2.65},
+	} {
+		updated, review, err := s.Answer(card, test.ease, now)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		expectedIvl := DurationSeconds(time.Duration(test.ivl) * 24 * time.Hour)
+		if *updated.Interval != expectedIvl || updated.Factor != test.factor {
+			t.Errorf("Ease %d: Expected interval %s and factor %v, got %s and %v", test.ease, time.Duration(expectedIvl), test.factor, time.Duration(*updated.Interval), updated.Factor)
+		}
+		if due := time.Time(*updated.Due); !due.Equal(crt.AddDate(0, 0, 15+test.ivl)) {
+			t.Errorf("Ease %d: Unexpected due date %s", test.ease, due)
+		}
+		if updated.DeckID != DefaultDeckID || updated.OriginalDeckID != 0 {
+			t.Errorf("Ease %d: Card not returned to its deck: %+v", test.ease, updated)
+		}
+		if review.Type != ReviewTypeCram || review.Interval != expectedIvl || review.LastInterval != ivl {
+			t.Errorf("Ease %d: Unexpected review: %+v", test.ease, review)
+		}
+	}
+}
+
+func TestSchedulerErrors(t *testing.T) {
+	collection := NewBuilder().Collection()
+	s := NewScheduler(collection)
+	if _, _, err := s.Answer(&Card{ID: 1, DeckID: DefaultDeckID}, 5, time.Now()); err == nil || err.Error() != "Invalid ease 5" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, _, err := s.Answer(&Card{ID: 1, DeckID: 99}, ReviewEaseOK, time.Now()); err == nil || err.Error() != "Card 1 references non-existent deck 99" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, _, err := s.Answer(&Card{ID: 1, DeckID: DefaultDeckID, Queue: CardQueueSuspended}, ReviewEaseOK, time.Now()); err == nil || err.Error() != "Card 1 is not in the new, learning or review queue" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestFuzzedInterval(t *testing.T) {
+	s := &Scheduler{Rand: rand.New(rand.NewSource(1))}
+	for i := 0; i < 100; i++ {
+		if ivl := s.fuzzedInterval(100); ivl < 95 || ivl > 105 {
+			t.Fatalf("Fuzzed interval %d out of range", ivl)
+		}
+	}
+}
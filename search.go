@@ -0,0 +1,313 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SearchNode is a node in the syntax tree of a parsed search query. It is
+// one of SearchAnd, SearchOr, SearchNot or SearchTerm.
+type SearchNode interface {
+	fmt.Stringer
+	searchNode()
+}
+
+// SearchAnd matches cards matched by all of its nodes. An empty SearchAnd
+// matches every card.
+type SearchAnd []SearchNode
+
+// SearchOr matches cards matched by any of its nodes.
+type SearchOr []SearchNode
+
+// SearchNot matches cards not matched by its node.
+type SearchNot struct {
+	Node SearchNode
+}
+
+// SearchTerm is a single search term, such as `dog`, `tag:animal` or
+// `"front:a dog"`.
+type SearchTerm struct {
+	// Key is the lower-cased text before the first unescaped colon, such as
+	// "tag", "deck" or a field name. It is empty for unqualified text.
+	Key string
+	// Value is the text to search for. Quotes are removed, but backslash
+	// escapes are retained, as their meaning depends on the key.
+	Value string
+}
+
+func (SearchAnd) searchNode()  {}
+func (SearchOr) searchNode()   {}
+func (SearchNot) searchNode()  {}
+func (SearchTerm) searchNode() {}
+
+func (n SearchAnd) String() string { return joinSearchNodes(n, " ") }
+func (n SearchOr) String() string  { return joinSearchNodes(n, " OR ") }
+
+func (n SearchNot) String() string {
+	switch n.Node.(type) {
+	case SearchAnd, SearchOr:
+		return "-(" + n.Node.String() + ")"
+	}
+	return "-" + n.Node.String()
+}
+
+func (n SearchTerm) String() string {
+	text := n.Value
+	if n.Key != "" {
+		text = n.Key + ":" + text
+	}
+	if strings.ContainsAny(text, " ()") || len(text) > 1 && text[0] == '-' {
+		return `"` + text + `"`
+	}
+	return text
+}
+
+func joinSearchNodes(nodes []SearchNode, sep string) string {
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = node.String()
+		switch node.(type) {
+		case SearchAnd, SearchOr:
+			if len(nodes) > 1 {
+				parts[i] = "(" + parts[i] + ")"
+			}
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+// ParseSearch parses a query written in Anki's search syntax, as used in the
+// card browser. See https://docs.ankiweb.net/searching.html
+//
+// Terms separated by spaces must all match. Terms may be combined with "or",
+// grouped with parentheses, and negated with a leading "-". Quotes may
+// surround a whole term, or the text after its colon, to include spaces or
+// parentheses. The meaning of each term is only checked when the search is
+// run, by Apkg.SearchCards or Apkg.SearchNotes.
+func ParseSearch(query string) (SearchNode, error) {
+	tokens, err := tokenizeSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &searchParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		// Only an unmatched closing parenthesis stops the parser early.
+		return nil, errors.New("Unmatched ')' in search")
+	}
+	return node, nil
+}
+
+type searchTokenType int
+
+const (
+	searchTokenText searchTokenType = iota
+	searchTokenAnd
+	searchTokenOr
+	searchTokenNot
+	searchTokenOpen
+	searchTokenClose
+)
+
+type searchToken struct {
+	typ  searchTokenType
+	text string
+}
+
+// tokenizeSearch splits a query into tokens. Quotes are removed from text
+// tokens, but escapes are left for the evaluator.
+func tokenizeSearch(query string) ([]searchToken, error) {
+	var tokens []searchToken
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, searchToken{typ: searchTokenOpen})
+			i++
+		case c == ')':
+			tokens = append(tokens, searchToken{typ: searchTokenClose})
+			i++
+		case c == '-' && i+1 < len(query) && !strings.ContainsRune(" \t\n\r)", rune(query[i+1])):
+			tokens = append(tokens, searchToken{typ: searchTokenNot})
+			i++
+		default:
+			text, quoted, n, err := readSearchText(query[i:])
+			if err != nil {
+				return nil, err
+			}
+			i += n
+			typ := searchTokenText
+			if !quoted {
+				switch strings.ToLower(text) {
+				case "and":
+					typ = searchTokenAnd
+				case "or":
+					typ = searchTokenOr
+				}
+			}
+			tokens = append(tokens, searchToken{typ: typ, text: text})
+		}
+	}
+	return tokens, nil
+}
+
+// readSearchText reads a single text token, which ends at the first space
+// or parenthesis outside of quotes. It returns the text without quotes,
+// whether any part of it was quoted, and the number of bytes consumed.
+func readSearchText(query string) (string, bool, int, error) {
+	buf := &strings.Builder{}
+	var inQuotes, quoted bool
+	i := 0
+loop:
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == '\\' && i+1 < len(query):
+			buf.WriteString(query[i : i+2])
+			i += 2
+			continue
+		case c == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		case inQuotes:
+			buf.WriteByte(c)
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '(' || c == ')':
+			break loop
+		default:
+			buf.WriteByte(c)
+		}
+		i++
+	}
+	if inQuotes {
+		return "", false, 0, errors.New("Unmatched quote in search")
+	}
+	return buf.String(), quoted, i, nil
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+func (p *searchParser) peek() *searchToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *searchParser) parseOr() (SearchNode, error) {
+	var nodes SearchOr
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		if tok := p.peek(); tok == nil || tok.typ != searchTokenOr {
+			break
+		}
+		p.pos++
+	}
+	for _, node := range nodes {
+		if and, ok := node.(SearchAnd); ok && len(and) == 0 && len(nodes) > 1 {
+			return nil, errors.New("Missing search term next to 'or'")
+		}
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *searchParser) parseAnd() (SearchNode, error) {
+	nodes := SearchAnd{}
+	for {
+		tok := p.peek()
+		if tok == nil || tok.typ == searchTokenClose || tok.typ == searchTokenOr {
+			break
+		}
+		if tok.typ == searchTokenAnd {
+			p.pos++
+			continue
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *searchParser) parseUnary() (SearchNode, error) {
+	tok := p.peek()
+	p.pos++
+	switch tok.typ {
+	case searchTokenNot:
+		if next := p.peek(); next == nil || next.typ != searchTokenText && next.typ != searchTokenOpen && next.typ != searchTokenNot {
+			return nil, errors.New("Nothing to negate after '-' in search")
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return SearchNot{Node: node}, nil
+	case searchTokenOpen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next := p.peek(); next == nil || next.typ != searchTokenClose {
+			return nil, errors.New("Unmatched '(' in search")
+		}
+		p.pos++
+		return node, nil
+	}
+	return parseSearchTerm(tok.text), nil
+}
+
+// parseSearchTerm splits a term at its first unescaped colon.
+func parseSearchTerm(text string) SearchTerm {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case ':':
+			if i == 0 {
+				return SearchTerm{Value: text}
+			}
+			return SearchTerm{
+				Key:   strings.ToLower(unescapeSearch(text[:i])),
+				Value: text[i+1:],
+			}
+		}
+	}
+	return SearchTerm{Value: text}
+}
+
+// unescapeSearch removes backslash escapes from text.
+func unescapeSearch(text string) string {
+	if !strings.Contains(text, `\`) {
+		return text
+	}
+	buf := &strings.Builder{}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			i++
+		}
+		buf.WriteByte(text[i])
+	}
+	return buf.String()
+}
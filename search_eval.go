@@ -0,0 +1,644 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// SearchCards returns the cards matching a query written in Anki's search
+// syntax, in the same order as Cards. See ParseSearch for the syntax.
+//
+// The following terms are supported, with the same meaning as in Anki:
+// unqualified text, "field:text", deck:, did:, tag:, note:, mid:, card:,
+// is:new/learn/review/due/suspended/buried/buried-manually/buried-sibling,
+// flag:, prop:ivl/due/reps/lapses/ease/pos, rated:, introduced:, added:,
+// edited:, nid:, cid:, dupe:, nc:, re: and w:. In text, * matches any
+// sequence of characters, and _ a single character, unless escaped with a
+// backslash. Matching is case-insensitive.
+func (a *Apkg) SearchCards(query string) ([]*Card, error) {
+	s, err := a.search(query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return s.cards, nil
+}
+
+// SearchNotes returns the notes with at least one card matching a query
+// written in Anki's search syntax, in the same order as Notes. See
+// SearchCards for the supported search terms.
+func (a *Apkg) SearchNotes(query string) ([]*Note, error) {
+	s, err := a.search(query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	matched := make(map[ID]bool, len(s.cards))
+	for _, card := range s.cards {
+		matched[card.NoteID] = true
+	}
+	notes := make([]*Note, 0, len(matched))
+	for _, note := range s.notes {
+		if matched[note.ID] {
+			notes = append(notes, note)
+		}
+	}
+	return notes, nil
+}
+
+// searcher evaluates a search against the contents of a package, which are
+// loaded into memory.
+type searcher struct {
+	collection *Collection
+	now        int64
+	today      int64
+	dayCutoff  int64
+	notes      []*Note
+	notesByID  map[ID]*Note
+	reviews    map[ID][]*Review
+	// needReviews is set when compiling terms which consult the review log.
+	needReviews bool
+	// cards holds the search results.
+	cards []*Card
+}
+
+// searchItem is a card being matched, along with its note and model.
+type searchItem struct {
+	card  *Card
+	note  *Note
+	model *Model
+}
+
+type searchMatcher func(*searchItem) bool
+
+func (a *Apkg) search(query string, now time.Time) (*searcher, error) {
+	node, err := ParseSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	collection, err := a.Collection()
+	if err != nil {
+		return nil, err
+	}
+	s := &searcher{
+		collection: collection,
+		now:        now.Unix(),
+		notesByID:  make(map[ID]*Note),
+	}
+	crt := seconds(collection.Created)
+	s.today = (s.now - crt) / secondsPerDay
+	s.dayCutoff = crt + (s.today+1)*secondsPerDay
+
+	match, err := s.compile(node)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadNotes(a); err != nil {
+		return nil, err
+	}
+	if s.needReviews {
+		if err := s.loadReviews(a); err != nil {
+			return nil, err
+		}
+	}
+	cards, err := a.Cards()
+	if err != nil {
+		return nil, err
+	}
+	defer cards.Close()
+	for cards.Next() {
+		card, err := cards.Card()
+		if err != nil {
+			return nil, err
+		}
+		item := &searchItem{card: card, note: s.notesByID[card.NoteID]}
+		if item.note == nil {
+			continue
+		}
+		item.model = collection.Models[item.note.ModelID]
+		if match(item) {
+			s.cards = append(s.cards, card)
+		}
+	}
+	return s, cards.Err()
+}
+
+func (s *searcher) loadNotes(a *Apkg) error {
+	notes, err := a.Notes()
+	if err != nil {
+		return err
+	}
+	defer notes.Close()
+	for notes.Next() {
+		note, err := notes.Note()
+		if err != nil {
+			return err
+		}
+		s.notes = append(s.notes, note)
+		s.notesByID[note.ID] = note
+	}
+	return notes.Err()
+}
+
+func (s *searcher) loadReviews(a *Apkg) error {
+	s.reviews = make(map[ID][]*Review)
+	reviews, err := a.Reviews()
+	if err != nil {
+		return err
+	}
+	defer reviews.Close()
+	for reviews.Next() {
+		review, err := reviews.Review()
+		if err != nil {
+			return err
+		}
+		s.reviews[review.CardID] = append(s.reviews[review.CardID], review)
+	}
+	return reviews.Err()
+}
+
+func (s *searcher) compile(node SearchNode) (searchMatcher, error) {
+	switch n := node.(type) {
+	case SearchAnd:
+		matchers, err := s.compileAll(n)
+		if err != nil {
+			return nil, err
+		}
+		return func(item *searchItem) bool {
+			for _, match := range matchers {
+				if !match(item) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case SearchOr:
+		matchers, err := s.compileAll(n)
+		if err != nil {
+			return nil, err
+		}
+		return func(item *searchItem) bool {
+			for _, match := range matchers {
+				if match(item) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case SearchNot:
+		match, err := s.compile(n.Node)
+		if err != nil {
+			return nil, err
+		}
+		return func(item *searchItem) bool {
+			return !match(item)
+		}, nil
+	case SearchTerm:
+		return s.compileTerm(n)
+	}
+	return nil, fmt.Errorf("Unknown search node type %T", node)
+}
+
+func (s *searcher) compileAll(nodes []SearchNode) ([]searchMatcher, error) {
+	matchers := make([]searchMatcher, len(nodes))
+	for i, node := range nodes {
+		var err error
+		if matchers[i], err = s.compile(node); err != nil {
+			return nil, err
+		}
+	}
+	return matchers, nil
+}
+
+func invalidSearch(t SearchTerm) error {
+	return fmt.Errorf("Invalid search: %s", t)
+}
+
+func (s *searcher) compileTerm(t SearchTerm) (searchMatcher, error) {
+	switch t.Key {
+	case "":
+		return fieldsMatcher(`(?is)`+searchGlob(t.Value, ".", "."), nil)
+	case "nc":
+		value := stripCombining(t.Value)
+		return fieldsMatcher(`(?is)`+searchGlob(value, ".", "."), stripCombining)
+	case "re":
+		return fieldsMatcher(`(?i)`+strings.Replace(t.Value, `\"`, `"`, -1), nil)
+	case "w":
+		return fieldsMatcher(`(?i)\b`+searchGlob(t.Value, `\S`, `\S`)+`\b`, nil)
+	case "deck":
+		return s.deckMatcher(t)
+	case "tag":
+		return tagMatcher(t)
+	case "note":
+		re, err := regexp.Compile(`(?i)^` + searchGlob(t.Value, ".", ".") + `$`)
+		if err != nil {
+			return nil, err
+		}
+		return func(item *searchItem) bool {
+			return item.model != nil && re.MatchString(item.model.Name)
+		}, nil
+	case "card":
+		return cardMatcher(t)
+	case "is":
+		return s.stateMatcher(t)
+	case "flag":
+		flag, err := strconv.Atoi(t.Value)
+		if err != nil || flag < 0 || flag > 7 {
+			return nil, invalidSearch(t)
+		}
+		return func(item *searchItem) bool {
+			return item.card.Flags&7 == flag
+		}, nil
+	case "prop":
+		return s.propMatcher(t)
+	case "rated", "introduced", "added", "edited":
+		return s.dateMatcher(t)
+	case "nid", "cid", "mid", "did":
+		return idMatcher(t)
+	case "dupe":
+		return dupeMatcher(t)
+	}
+	return fieldMatcher(t)
+}
+
+// searchGlob converts search text to a regular expression. Unescaped * and _
+// are replaced with many and one, respectively; all other characters,
+// including those escaped with a backslash, match literally.
+func searchGlob(text, many, one string) string {
+	buf := &strings.Builder{}
+	escaped := false
+	for _, r := range text {
+		switch {
+		case escaped:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			buf.WriteString(many + "*")
+		case r == '_':
+			buf.WriteString(one)
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return buf.String()
+}
+
+// stripCombining removes combining characters, such as accents, from text.
+func stripCombining(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, norm.NFD.String(text))
+}
+
+// fieldsMatcher matches notes with any field matching the regular
+// expression, after passing the fields through transform, if non-nil.
+func fieldsMatcher(expr string, transform func(string) string) (searchMatcher, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(item *searchItem) bool {
+		text := strings.Join(item.note.FieldValues, "\x1f")
+		if transform != nil {
+			text = transform(text)
+		}
+		return re.MatchString(text)
+	}, nil
+}
+
+// fieldMatcher handles searches of a single field, such as "front:dog".
+// The field name may contain wildcards. The whole field must match, unless
+// the value starts with re:, in which case it is a regular expression.
+func fieldMatcher(t SearchTerm) (searchMatcher, error) {
+	nameRe, err := regexp.Compile(`(?i)^` + searchGlob(t.Key, ".", ".") + `$`)
+	if err != nil {
+		return nil, err
+	}
+	expr := `(?is)^` + searchGlob(t.Value, ".", ".") + `$`
+	if strings.HasPrefix(t.Value, "re:") {
+		expr = `(?i)` + strings.Replace(t.Value[3:], `\"`, `"`, -1)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	// Field ordinals matching the name, by model
+	ordinals := make(map[ID][]int)
+	return func(item *searchItem) bool {
+		if item.model == nil {
+			return false
+		}
+		ords, ok := ordinals[item.model.ID]
+		if !ok {
+			ords = []int{}
+			for i, field := range item.model.Fields {
+				if nameRe.MatchString(field.Name) {
+					ords = append(ords, i)
+				}
+			}
+			ordinals[item.model.ID] = ords
+		}
+		for _, i := range ords {
+			if i < len(item.note.FieldValues) && re.MatchString(item.note.FieldValues[i]) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// deckMatcher matches cards in the named deck or its subdecks, including
+// cards moved from those decks into filtered decks.
+func (s *searcher) deckMatcher(t SearchTerm) (searchMatcher, error) {
+	name := unescapeSearch(t.Value)
+	decks := make(map[ID]bool)
+	switch strings.ToLower(name) {
+	case "*":
+		return func(*searchItem) bool { return true }, nil
+	case "filtered":
+		for _, deck := range s.collection.Decks {
+			if deck.Dynamic {
+				decks[deck.ID] = true
+			}
+		}
+		return func(item *searchItem) bool {
+			return decks[item.card.DeckID]
+		}, nil
+	case "current":
+		current, ok := s.collection.Decks[s.collection.Config.CurrentDeck]
+		if !ok {
+			return func(*searchItem) bool { return false }, nil
+		}
+		t.Value = searchEscape(current.Name)
+	}
+	re, err := regexp.Compile(`(?is)^` + searchGlob(t.Value, ".", ".") + `(::.*)?$`)
+	if err != nil {
+		return nil, err
+	}
+	for _, deck := range s.collection.Decks {
+		if re.MatchString(deck.Name) {
+			decks[deck.ID] = true
+		}
+	}
+	return func(item *searchItem) bool {
+		return decks[item.card.DeckID] || decks[item.card.OriginalDeckID]
+	}, nil
+}
+
+// searchEscape escapes wildcards in text.
+func searchEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`).Replace(text)
+}
+
+// tagMatcher matches notes with the tag, or any of its child tags.
+func tagMatcher(t SearchTerm) (searchMatcher, error) {
+	if strings.EqualFold(t.Value, "none") {
+		return func(item *searchItem) bool {
+			return strings.TrimSpace(item.note.Tags) == ""
+		}, nil
+	}
+	re, err := regexp.Compile(`(?i) ` + searchGlob(t.Value, `\S`, `\S`) + `(::\S*)? `)
+	if err != nil {
+		return nil, err
+	}
+	return func(item *searchItem) bool {
+		return re.MatchString(" " + strings.TrimSpace(item.note.Tags) + " ")
+	}, nil
+}
+
+// cardMatcher matches cards by template name, or by card number, which is
+// the template ordinal, or cloze number, plus one.
+func cardMatcher(t SearchTerm) (searchMatcher, error) {
+	if n, err := strconv.Atoi(t.Value); err == nil {
+		return func(item *searchItem) bool {
+			return item.card.TemplateID == n-1
+		}, nil
+	}
+	re, err := regexp.Compile(`(?i)^` + searchGlob(t.Value, ".", ".") + `$`)
+	if err != nil {
+		return nil, err
+	}
+	return func(item *searchItem) bool {
+		if item.model == nil {
+			return false
+		}
+		tmpl, err := cardTemplate(item.model, item.card.TemplateID)
+		return err == nil && re.MatchString(tmpl.Name)
+	}, nil
+}
+
+// Queues of buried cards, as named by Anki.
+const (
+	cardQueueManuallyBuried = CardQueueSchedBuried
+	cardQueueSiblingBuried  = CardQueueBuried
+)
+
+// stateMatcher handles is: searches.
+func (s *searcher) stateMatcher(t SearchTerm) (searchMatcher, error) {
+	var match func(*Card) bool
+	switch strings.ToLower(t.Value) {
+	case "new":
+		match = func(c *Card) bool { return c.Type == CardTypeNew }
+	case "learn":
+		match = func(c *Card) bool {
+			return c.Queue == CardQueueLearning || c.Queue == CardQueueRelearning ||
+				c.Type == CardTypeRelearning && c.Queue < 0
+		}
+	case "review":
+		match = func(c *Card) bool { return c.Type == CardTypeReview || c.Type == CardTypeRelearning }
+	case "due":
+		crt := seconds(s.collection.Created)
+		match = func(c *Card) bool {
+			switch c.Queue {
+			case CardQueueReview, CardQueueRelearning:
+				return daysSince(c.Due, crt) <= s.today
+			case CardQueueLearning:
+				return seconds(c.Due) <= s.dayCutoff
+			}
+			return false
+		}
+	case "suspended":
+		match = func(c *Card) bool { return c.Queue == CardQueueSuspended }
+	case "buried":
+		match = func(c *Card) bool { return c.Queue == cardQueueManuallyBuried || c.Queue == cardQueueSiblingBuried }
+	case "buried-manually":
+		match = func(c *Card) bool { return c.Queue == cardQueueManuallyBuried }
+	case "buried-sibling":
+		match = func(c *Card) bool { return c.Queue == cardQueueSiblingBuried }
+	default:
+		return nil, invalidSearch(t)
+	}
+	return func(item *searchItem) bool {
+		return match(item.card)
+	}, nil
+}
+
+var rePropSearch = regexp.MustCompile(`^(?i)(ivl|due|reps|lapses|ease|pos)(<=|>=|!=|=|<|>)(-?\d+(?:\.\d+)?)$`)
+
+// propMatcher handles prop: searches, such as prop:ivl>=10.
+func (s *searcher) propMatcher(t SearchTerm) (searchMatcher, error) {
+	m := rePropSearch.FindStringSubmatch(t.Value)
+	if m == nil {
+		return nil, invalidSearch(t)
+	}
+	prop, op := strings.ToLower(m[1]), m[2]
+	value, err := strconv.ParseFloat(m[3], 64)
+	if err != nil {
+		return nil, invalidSearch(t)
+	}
+	if prop != "ease" && value != float64(int64(value)) {
+		return nil, invalidSearch(t)
+	}
+	compare := func(x float64) bool {
+		switch op {
+		case "<":
+			return x < value
+		case ">":
+			return x > value
+		case "<=":
+			return x <= value
+		case ">=":
+			return x >= value
+		case "!=":
+			return x != value
+		}
+		return x == value
+	}
+	crt := seconds(s.collection.Created)
+	return func(item *searchItem) bool {
+		c := item.card
+		switch prop {
+		case "ivl":
+			var days int64
+			if c.Interval != nil {
+				days = int64(time.Duration(*c.Interval)/time.Second) / secondsPerDay
+			}
+			return compare(float64(days))
+		case "due":
+			switch c.Queue {
+			case CardQueueReview, CardQueueRelearning:
+				return compare(float64(daysSince(c.Due, crt) - s.today))
+			case CardQueueLearning:
+				return compare(float64((seconds(c.Due) - s.dayCutoff) / secondsPerDay))
+			}
+			return false
+		case "reps":
+			return compare(float64(c.ReviewCount))
+		case "lapses":
+			return compare(float64(c.Lapses))
+		case "ease":
+			return compare(float64(c.Factor))
+		}
+		return c.Type == CardTypeNew && compare(float64(c.Position))
+	}, nil
+}
+
+// dateMatcher handles the rated:, introduced:, added: and edited: searches,
+// which match cards by events in the last n days.
+func (s *searcher) dateMatcher(t SearchTerm) (searchMatcher, error) {
+	value := t.Value
+	ease := 0
+	if t.Key == "rated" {
+		if i := strings.Index(value, ":"); i >= 0 {
+			var err error
+			if ease, err = strconv.Atoi(value[i+1:]); err != nil || ease < 1 || ease > 4 {
+				return nil, invalidSearch(t)
+			}
+			value = value[:i]
+		}
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 1 {
+		return nil, invalidSearch(t)
+	}
+	cutoff := s.dayCutoff - int64(days)*secondsPerDay
+	switch t.Key {
+	case "added":
+		return func(item *searchItem) bool {
+			return int64(item.card.ID) > cutoff*1000
+		}, nil
+	case "edited":
+		return func(item *searchItem) bool {
+			return seconds(item.note.Modified) > cutoff
+		}, nil
+	}
+	s.needReviews = true
+	since := time.Unix(cutoff, 0)
+	if t.Key == "introduced" {
+		return func(item *searchItem) bool {
+			var first *Review
+			for _, review := range s.reviews[item.card.ID] {
+				if review.Ease > 0 && review.Timestamp != nil && (first == nil || time.Time(*review.Timestamp).Before(time.Time(*first.Timestamp))) {
+					first = review
+				}
+			}
+			return first != nil && time.Time(*first.Timestamp).After(since)
+		}, nil
+	}
+	return func(item *searchItem) bool {
+		for _, review := range s.reviews[item.card.ID] {
+			if review.Timestamp == nil || !time.Time(*review.Timestamp).After(since) {
+				continue
+			}
+			if ease == 0 && review.Ease > 0 || ease != 0 && int(review.Ease) == ease {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// idMatcher handles searches for comma-separated lists of IDs.
+func idMatcher(t SearchTerm) (searchMatcher, error) {
+	ids := make(map[ID]bool)
+	for _, field := range strings.Split(t.Value, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil {
+			return nil, invalidSearch(t)
+		}
+		ids[ID(id)] = true
+	}
+	return func(item *searchItem) bool {
+		switch t.Key {
+		case "nid":
+			return ids[item.card.NoteID]
+		case "cid":
+			return ids[item.card.ID]
+		case "mid":
+			return ids[item.note.ModelID]
+		}
+		return ids[item.card.DeckID] || ids[item.card.OriginalDeckID]
+	}, nil
+}
+
+// dupeMatcher handles dupe:mid,text searches, which match notes of the
+// model whose first field is the same as text.
+func dupeMatcher(t SearchTerm) (searchMatcher, error) {
+	parts := strings.SplitN(t.Value, ",", 2)
+	if len(parts) != 2 {
+		return nil, invalidSearch(t)
+	}
+	mid, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, invalidSearch(t)
+	}
+	text := strings.TrimSpace(stripHTMLMedia(unescapeSearch(parts[1])))
+	return func(item *searchItem) bool {
+		if item.note.ModelID != ID(mid) || len(item.note.FieldValues) == 0 {
+			return false
+		}
+		return strings.TrimSpace(stripHTMLMedia(item.note.FieldValues[0])) == text
+	}, nil
+}
@@ -0,0 +1,201 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseSearch(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		err      string
+	}{
+		{query: "", expected: ""},
+		{query: "dog  cat", expected: "dog cat"},
+		{query: "dog or cat", expected: "dog OR cat"},
+		{query: "dog and cat OR mouse", expected: "(dog cat) OR mouse"},
+		{query: "-(a or b) c", expected: "-(a OR b) c"},
+		{query: "--a", expected: "--a"},
+		{query: `"deck:a b"`, expected: `"deck:a b"`},
+		{query: `deck:"a b"`, expected: `"deck:a b"`},
+		{query: `Front:dog`, expected: `front:dog`},
+		{query: `a-b \-c`, expected: `a-b \-c`},
+		{query: `field\:x:y`, expected: `field:x:y`},
+		{query: `"or"`, expected: `or`},
+		{query: "(dog", err: "Unmatched '(' in search"},
+		{query: "dog)", err: "Unmatched ')' in search"},
+		{query: `"dog`, err: "Unmatched quote in search"},
+		{query: "dog or", err: "Missing search term next to 'or'"},
+		{query: "dog -", expected: "dog -"},
+		{query: "dog -or a", err: "Nothing to negate after '-' in search"},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			node, err := ParseSearch(test.query)
+			var errMsg string
+			if err != nil {
+				errMsg = err.Error()
+			}
+			if errMsg != test.err {
+				t.Fatalf("Unexpected error: %s", errMsg)
+			}
+			if err != nil {
+				return
+			}
+			if s := node.String(); s != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, s)
+			}
+		})
+	}
+}
+
+func TestParseSearchTree(t *testing.T) {
+	node, err := ParseSearch(`tag:x -"front:a b" (y or z)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SearchAnd{
+		SearchTerm{Key: "tag", Value: "x"},
+		SearchNot{Node: SearchTerm{Key: "front", Value: "a b"}},
+		SearchOr{SearchTerm{Value: "y"}, SearchTerm{Value: "z"}},
+	}
+	if !reflect.DeepEqual(node, expected) {
+		t.Errorf("Unexpected tree: %#v", node)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	b := NewBuilder()
+	basic, cloze := basicReversedModel(), clozeModel()
+	for _, model := range []*Model{basic, cloze} {
+		if err := b.AddModel(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"Lang::French", "Other"} {
+		if err := b.AddDeck(&Deck{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	labels := make(map[ID]string)
+	add := func(label string, model *Model, deck string, fields []string, tags ...string) []*Card {
+		_, cards, err := b.AddNote(model, b.deckByName(deck), fields, tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, card := range cards {
+			labels[card.ID] = label + string(rune('1'+card.TemplateID))
+		}
+		return cards
+	}
+	dog := add("dog", basic, "Lang::French", []string{"chien", "dog", "y"}, "animal::mammal", "french")
+	coffee := add("coffee", basic, "Other", []string{"café", "coffee", ""}, "drink")
+	add("paris", cloze, "Lang", []string{"{{c1::Paris}} is in {{c2::France}}", ""})
+
+	now := time.Now()
+	dog[1].Queue = CardQueueSuspended
+	ivl := DurationSeconds(10 * 24 * time.Hour)
+	c := coffee[0]
+	c.Type, c.Queue, c.Due, c.Interval = CardTypeReview, CardQueueReview, timestampSeconds(now), &ivl
+	c.Factor, c.ReviewCount, c.Flags = 2.5, 5, 2
+	b.writer.AddReview(&Review{CardID: c.ID, Timestamp: timestampMilliseconds(now), Ease: ReviewEaseOK, Interval: ivl, Factor: 2.5})
+
+	buf := &bytes.Buffer{}
+	if _, err := b.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	apkg, err := ReadBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{query: "", expected: []string{"coffee1", "dog1", "dog2", "paris1", "paris2"}},
+		{query: "dog", expected: []string{"dog1", "dog2"}},
+		{query: "-dog", expected: []string{"coffee1", "paris1", "paris2"}},
+		{query: "DOG or coffee", expected: []string{"coffee1", "dog1", "dog2"}},
+		{query: "(dog or coffee) -is:suspended", expected: []string{"coffee1", "dog1"}},
+		{query: "Paris is", expected: []string{"paris1", "paris2"}},
+		{query: `"in c2"`, expected: []string{}},
+		{query: "deck:Lang", expected: []string{"dog1", "dog2", "paris1", "paris2"}},
+		{query: "deck:lang::french", expected: []string{"dog1", "dog2"}},
+		{query: "deck:Lang -deck:Lang::French", expected: []string{"paris1", "paris2"}},
+		{query: "deck:La*", expected: []string{"dog1", "dog2", "paris1", "paris2"}},
+		{query: "deck:La", expected: []string{}},
+		{query: "tag:animal", expected: []string{"dog1", "dog2"}},
+		{query: "tag:mammal", expected: []string{}},
+		{query: "tag:*mammal", expected: []string{"dog1", "dog2"}},
+		{query: "tag:none", expected: []string{"paris1", "paris2"}},
+		{query: "front:chien", expected: []string{"dog1", "dog2"}},
+		{query: "front:chi", expected: []string{}},
+		{query: "front:chi*", expected: []string{"dog1", "dog2"}},
+		{query: "front:ch_en", expected: []string{"dog1", "dog2"}},
+		{query: "f*:café", expected: []string{"coffee1"}},
+		{query: `front:re:^ch`, expected: []string{"dog1", "dog2"}},
+		{query: "cafe", expected: []string{}},
+		{query: "nc:cafe", expected: []string{"coffee1"}},
+		{query: "re:^chien", expected: []string{"dog1", "dog2"}},
+		{query: "w:paris", expected: []string{"paris1", "paris2"}},
+		{query: "w:par", expected: []string{}},
+		{query: "is:new", expected: []string{"dog1", "dog2", "paris1", "paris2"}},
+		{query: "is:review is:due", expected: []string{"coffee1"}},
+		{query: "is:suspended", expected: []string{"dog2"}},
+		{query: "is:buried", expected: []string{}},
+		{query: "prop:ivl>=10", expected: []string{"coffee1"}},
+		{query: "prop:ivl>10", expected: []string{}},
+		{query: "prop:ease=2.5 prop:reps>4 prop:due=0", expected: []string{"coffee1"}},
+		{query: "flag:2", expected: []string{"coffee1"}},
+		{query: "card:2", expected: []string{"dog2", "paris2"}},
+		{query: "card:cloze", expected: []string{"paris1", "paris2"}},
+		{query: `"card:card 1"`, expected: []string{"coffee1", "dog1"}},
+		{query: "note:cloze", expected: []string{"paris1", "paris2"}},
+		{query: "rated:1", expected: []string{"coffee1"}},
+		{query: "rated:1:1", expected: []string{}},
+		{query: "introduced:1", expected: []string{"coffee1"}},
+		{query: "added:1 edited:1", expected: []string{"coffee1", "dog1", "dog2", "paris1", "paris2"}},
+		{query: "cid:" + strconv.FormatInt(int64(c.ID), 10), expected: []string{"coffee1"}},
+		{query: "dupe:" + strconv.FormatInt(int64(basic.ID), 10) + ",<b>chien</b>", expected: []string{"dog1", "dog2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			cards, err := apkg.SearchCards(test.query)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			result := make([]string, len(cards))
+			for i, card := range cards {
+				result[i] = labels[card.ID]
+			}
+			sort.Strings(result)
+			if !reflect.DeepEqual(result, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	notes, err := apkg.SearchNotes("dog or coffee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 {
+		t.Errorf("Expected 2 notes, got %d", len(notes))
+	}
+
+	for _, query := range []string{"is:bogus", "prop:foo>1", "flag:9", "rated:x", "rated:1:5", "nid:x", "re:(", "(dog"} {
+		if _, err := apkg.SearchCards(query); err == nil {
+			t.Errorf("%s: Expected an error", query)
+		}
+	}
+}
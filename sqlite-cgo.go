@@ -0,0 +1,80 @@
+//go:build !js && cgo && !purego
+// +build !js,cgo,!purego
+
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// driverName is the name of the SQLite driver registered with Anki's custom
+// collations.
+const driverName = "sqlite3-anki"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterCollation("unicase", compareUnicase)
+		},
+	})
+	sqlx.BindDriver(driverName, sqlx.QUESTION)
+}
+
+// cgoDriver opens databases with github.com/mattn/go-sqlite3.
+type cgoDriver struct{}
+
+var backend sqliteDriver = cgoDriver{}
+
+func (cgoDriver) open(dsn string) (*sqlx.DB, error) {
+	return sqlx.Connect(driverName, dsn)
+}
+
+// restore deserializes data into a private in-memory database, which is
+// then copied to the database conn is connected to with SQLite's backup API.
+// A deserialized database cannot grow, nor be shared between connections.
+func (cgoDriver) restore(conn *sql.Conn, _ string, data []byte) error {
+	src, err := sql.Open(driverName, ":memory:")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcConn, err := src.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return srcConn.Raw(func(s interface{}) error {
+		from := s.(*sqlite3.SQLiteConn)
+		if err := from.Deserialize(data, "main"); err != nil {
+			return err
+		}
+		return conn.Raw(func(d interface{}) error {
+			backup, err := d.(*sqlite3.SQLiteConn).Backup("main", from, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				_ = backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+func (cgoDriver) serialize(conn *sql.Conn) ([]byte, error) {
+	var data []byte
+	err := conn.Raw(func(c interface{}) error {
+		var err error
+		data, err = c.(*sqlite3.SQLiteConn).Serialize("main")
+		return err
+	})
+	return data, err
+}
@@ -0,0 +1,92 @@
+//go:build !js && (!cgo || purego)
+// +build !js
+// +build !cgo purego
+
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"modernc.org/sqlite"
+)
+
+// driverName is the name modernc.org/sqlite registers its driver under.
+const driverName = "sqlite"
+
+func init() {
+	// Collations registered with modernc.org/sqlite are available to every
+	// connection opened after they are registered.
+	if err := sqlite.RegisterCollationUtf8("unicase", compareUnicase); err != nil {
+		panic(err)
+	}
+	sqlx.BindDriver(driverName, sqlx.QUESTION)
+}
+
+// pureGoDriver opens databases with modernc.org/sqlite, a translation of
+// SQLite to Go, which does not require cgo.
+type pureGoDriver struct{}
+
+var backend sqliteDriver = pureGoDriver{}
+
+func (pureGoDriver) open(dsn string) (*sqlx.DB, error) {
+	return sqlx.Connect(driverName, dsn)
+}
+
+// restore deserializes data into a private in-memory database, which is
+// then copied to the database at dsn with SQLite's backup API. A
+// deserialized database cannot be shared between connections.
+func (pureGoDriver) restore(_ *sql.Conn, dsn string, data []byte) error {
+	src, err := sql.Open(driverName, ":memory:")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcConn, err := src.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return srcConn.Raw(func(c interface{}) error {
+		from, ok := c.(interface {
+			Deserialize([]byte) error
+			NewBackup(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return errors.New("SQLite driver does not support in-memory databases")
+		}
+		if err := from.Deserialize(data); err != nil {
+			return err
+		}
+		backup, err := from.NewBackup(dsn)
+		if err != nil {
+			return err
+		}
+		for more := true; more; {
+			if more, err = backup.Step(-1); err != nil {
+				_ = backup.Finish()
+				return err
+			}
+		}
+		return backup.Finish()
+	})
+}
+
+func (pureGoDriver) serialize(conn *sql.Conn) ([]byte, error) {
+	var data []byte
+	err := conn.Raw(func(c interface{}) error {
+		s, ok := c.(interface{ Serialize() ([]byte, error) })
+		if !ok {
+			return errors.New("SQLite driver does not support in-memory databases")
+		}
+		var err error
+		data, err = s.Serialize()
+		return err
+	})
+	return data, err
+}
@@ -1,3 +1,4 @@
+//go:build !js
 // +build !js
 
 // Copyright: Jonathan Hall
@@ -6,24 +7,55 @@
 package anki
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"sync/atomic"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/text/cases"
 )
 
+// sqliteDriver opens SQLite databases. It is implemented in sqlite-cgo.go,
+// using github.com/mattn/go-sqlite3, and in sqlite-purego.go, using the
+// cgo-free modernc.org/sqlite. The latter is used when cgo is disabled, or
+// when built with the `purego` tag.
+type sqliteDriver interface {
+	// open opens the database at dsn, which may be a file name or a URI,
+	// with Anki's `unicase` collation registered. Newer collections declare
+	// names with it, without which those tables cannot be queried.
+	open(dsn string) (*sqlx.DB, error)
+	// restore replaces the empty in-memory database at dsn, which conn is
+	// connected to, with a copy of the database file data.
+	restore(conn *sql.Conn, dsn string, data []byte) error
+	// serialize returns the database conn is connected to, as a database
+	// file.
+	serialize(conn *sql.Conn) ([]byte, error)
+}
+
+// compareUnicase compares two strings case-insensitively, using Unicode case
+// folding.
+func compareUnicase(a, b string) int {
+	folder := cases.Fold()
+	return strings.Compare(folder.String(a), folder.String(b))
+}
+
 type DB struct {
 	*sqlx.DB
 	tmpFile string
+	// conn holds a connection to an in-memory database open, as SQLite
+	// discards it once its last connection is closed.
+	conn *sql.Conn
 }
 
 func (db *DB) Close() (e error) {
-	if db.tmpFile != "" {
-		if err := os.Remove(db.tmpFile); err != nil {
-			fmt.Printf("Cannot remove file: %s", err)
+	if db.conn != nil {
+		if err := db.conn.Close(); err != nil {
 			e = err
 		}
 	}
@@ -32,32 +64,116 @@ func (db *DB) Close() (e error) {
 			e = err
 		}
 	}
+	if db.tmpFile != "" {
+		if err := os.Remove(db.tmpFile); err != nil && e == nil {
+			e = err
+		}
+	}
 	return
 }
 
-func OpenDB(src io.Reader) (db *DB, e error) {
-	db = &DB{}
-	dbFile, err := dumpToTemp(src)
-	db.tmpFile = dbFile
-	if err != nil {
-		return db, err
+// OpenDB opens a copy of the SQLite database read from src, in a temporary
+// file.
+func OpenDB(src io.Reader) (*DB, error) {
+	return OpenDBWithOptions(src, nil)
+}
+
+// OpenDBWithOptions opens a copy of the SQLite database read from src, in
+// memory or in a temporary file, as opts specifies. If opts is nil, the
+// default options are used.
+func OpenDBWithOptions(src io.Reader, opts *OpenOptions) (*DB, error) {
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
+	db := &DB{}
+	var err error
+	if opts.InMemory {
+		err = db.openMemory(src)
+	} else {
+		err = db.openFile(src, opts.TempDir)
 	}
-	sqldb, err := sqlx.Connect("sqlite3", dbFile)
 	if err != nil {
-		return db, err
+		_ = db.Close()
+		return nil, err
 	}
-	db.DB = sqldb
 	return db, nil
 }
 
-func dumpToTemp(src io.Reader) (string, error) {
-	tmp, err := ioutil.TempFile("/tmp", "anki-sqlite3-")
+// openFile opens a copy of the database read from src, written to a
+// temporary file in dir.
+func (db *DB) openFile(src io.Reader, dir string) error {
+	tmp, err := ioutil.TempFile(dir, "anki-sqlite3-")
 	if err != nil {
-		return "", err
+		return err
+	}
+	db.tmpFile = tmp.Name()
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if db.DB, err = backend.open(db.tmpFile); err != nil {
+		return err
 	}
-	defer tmp.Close()
-	if _, err := io.Copy(tmp, src); err != nil {
-		return "", err
+	// A collection in use by Anki is in WAL mode, in which changes are
+	// written to a separate file, which dump() would not copy.
+	_, err = db.Exec("PRAGMA journal_mode=DELETE")
+	return err
+}
+
+// memoryDBs counts the in-memory databases opened, to give each a unique
+// name.
+var memoryDBs uint64
+
+// openMemory opens a copy of the database read from src, in memory. The
+// database is stored with SQLite's memdb VFS, under a name unique to the
+// process, so that every connection in the pool shares it.
+func (db *DB) openMemory(src io.Reader) error {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	dsn := fmt.Sprintf("file:/anki-%d?vfs=memdb", atomic.AddUint64(&memoryDBs, 1))
+	if db.DB, err = backend.open(dsn); err != nil {
+		return err
+	}
+	if db.conn, err = db.DB.Conn(context.Background()); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	// SQLite cannot deserialize a database in WAL mode, so it is marked as
+	// using a rollback journal, as Anki's collections are when not open.
+	if len(data) >= 20 && bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		data[18], data[19] = 1, 1
+	}
+	return backend.restore(db.conn, dsn, data)
+}
+
+// newDB creates a new, empty SQLite database, to be populated and then
+// written out with dump().
+func newDB() (*DB, error) {
+	return OpenDB(bytes.NewReader(nil))
+}
+
+// dump writes the raw SQLite database file to w.
+func (db *DB) dump(w io.Writer) error {
+	if db.conn != nil {
+		data, err := backend.serialize(db.conn)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	f, err := os.Open(db.tmpFile)
+	if err != nil {
+		return err
 	}
-	return tmp.Name(), nil
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
 }
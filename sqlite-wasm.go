@@ -0,0 +1,533 @@
+//go:build js && wasm
+// +build js,wasm
+
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// When built for WebAssembly, databases are opened with sql.js
+// (https://github.com/sql-js/sql.js), an Emscripten build of SQLite, which
+// holds them in memory. sql.js is found in the following order:
+//
+//   - An initialized sql.js module, assigned to the global variable SQL, as
+//     returned by `await initSqlJs(config)`. This allows the location of
+//     sql-wasm.wasm to be configured.
+//   - The global initSqlJs function, defined by loading sql-wasm.js with a
+//     script tag, or importScripts() in a Web Worker, which is called with no
+//     configuration.
+//   - Under Node.js, the sql.js package, required relative to the working
+//     directory.
+//
+// Loading sql.js waits for a JavaScript promise, which blocks forever if
+// called from within a js.FuncOf callback; start a goroutine instead.
+//
+// sql.js cannot register Anki's `unicase` collation, so while a database is
+// open, columns declared with it are declared with SQLite's NOCASE collation
+// instead, which folds only the case of ASCII letters. The original
+// declarations are restored when the database is written.
+
+// DB is an SQLite database, held in memory by sql.js.
+type DB struct {
+	*sqlx.DB
+	conn *sqljsDB
+}
+
+func (db *DB) Close() (e error) {
+	if db.DB != nil {
+		e = db.DB.Close()
+	}
+	if db.conn != nil {
+		if err := db.conn.close(); err != nil && e == nil {
+			e = err
+		}
+	}
+	return
+}
+
+// OpenDB opens a copy of the SQLite database read from src, in memory.
+func OpenDB(src io.Reader) (*DB, error) {
+	return OpenDBWithOptions(src, nil)
+}
+
+// OpenDBWithOptions opens a copy of the SQLite database read from src. sql.js
+// always holds databases in memory, so opts is ignored.
+func OpenDBWithOptions(src io.Reader, _ *OpenOptions) (*DB, error) {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := openSQLJS(data)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{
+		DB:   sqlx.NewDb(sql.OpenDB(conn), "sqlite3"),
+		conn: conn,
+	}
+	if err := conn.replaceCollation(reUnicase, "COLLATE NOCASE", true); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// newDB creates a new, empty SQLite database, to be populated and then
+// written out with dump().
+func newDB() (*DB, error) {
+	return OpenDB(bytes.NewReader(nil))
+}
+
+// dump writes the raw SQLite database file to w.
+func (db *DB) dump(w io.Writer) error {
+	data, err := db.conn.export()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+var (
+	sqlJSMu     sync.Mutex
+	sqlJSModule js.Value
+)
+
+// loadSQLJS returns the sql.js module, initializing it if necessary.
+func loadSQLJS() (module js.Value, err error) {
+	sqlJSMu.Lock()
+	defer sqlJSMu.Unlock()
+	if sqlJSModule.Truthy() {
+		return sqlJSModule, nil
+	}
+	defer catchJSError(&err)
+	global := js.Global()
+	if sql := global.Get("SQL"); sql.Type() == js.TypeObject && sql.Get("Database").Type() == js.TypeFunction {
+		sqlJSModule = sql
+		return sqlJSModule, nil
+	}
+	init := global.Get("initSqlJs")
+	if init.Type() != js.TypeFunction && global.Get("process").Type() == js.TypeObject && global.Get("require").Type() == js.TypeFunction {
+		cwd := global.Get("process").Call("cwd").String()
+		init = global.Call("require", "module").Call("createRequire", cwd+"/").Invoke("sql.js")
+	}
+	if init.Type() != js.TypeFunction {
+		return js.Value{}, errors.New("sql.js is not loaded")
+	}
+	if sqlJSModule, err = await(init.Invoke()); err != nil {
+		return js.Value{}, err
+	}
+	return sqlJSModule, nil
+}
+
+// await waits for promise to settle, returning the value it is resolved with,
+// or the reason it is rejected.
+func await(promise js.Value) (js.Value, error) {
+	var (
+		result js.Value
+		err    error
+	)
+	done := make(chan struct{})
+	resolve := js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		result = args[0]
+		close(done)
+		return nil
+	})
+	defer resolve.Release()
+	reject := js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		err = jsError(args[0])
+		close(done)
+		return nil
+	})
+	defer reject.Release()
+	promise.Call("then", resolve, reject)
+	<-done
+	return result, err
+}
+
+// jsError converts a JavaScript exception to an error. sql.js reports SQLite
+// errors as exceptions whose message is SQLite's.
+func jsError(v js.Value) error {
+	if v.Type() == js.TypeObject {
+		if msg := v.Get("message"); msg.Type() == js.TypeString {
+			return errors.New(msg.String())
+		}
+	}
+	return errors.New(js.Global().Call("String", v).String())
+}
+
+// catchJSError recovers from the panic caused by calling a JavaScript
+// function which throws an exception, storing the exception in err.
+func catchJSError(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(js.Error)
+		if !ok {
+			panic(r)
+		}
+		*err = jsError(e.Value)
+	}
+}
+
+// reUnicase matches declarations of Anki's `unicase` collation, and
+// reNoCase those of SQLite's NOCASE collation, which replaces it while a
+// database is open.
+var (
+	reUnicase = regexp.MustCompile(`(?i)\bCOLLATE\s+"?unicase"?`)
+	reNoCase  = regexp.MustCompile(`(?i)\bCOLLATE\s+"?nocase"?`)
+)
+
+// sqljsDB is an sql.js database. It is the driver.Connector of a DB; every
+// connection in the pool uses the same database, as sql.js cannot share an
+// in-memory database between database connections. Statements executed by
+// one connection during a transaction begun by another are part of that
+// transaction.
+type sqljsDB struct {
+	db js.Value
+	// unicase is set once the database declares the `unicase` collation.
+	unicase bool
+}
+
+var _ driver.Connector = &sqljsDB{}
+
+// openSQLJS opens the database file data, or a new database if data is
+// empty. sql.js does not read the database until it is queried.
+func openSQLJS(data []byte) (c *sqljsDB, err error) {
+	module, err := loadSQLJS()
+	if err != nil {
+		return nil, err
+	}
+	defer catchJSError(&err)
+	if len(data) == 0 {
+		return &sqljsDB{db: module.Get("Database").New()}, nil
+	}
+	return &sqljsDB{db: module.Get("Database").New(uint8Array(data))}, nil
+}
+
+func (c *sqljsDB) Connect(context.Context) (driver.Conn, error) {
+	return &sqljsConn{c}, nil
+}
+
+func (c *sqljsDB) Driver() driver.Driver {
+	return sqljsDriver{}
+}
+
+func (c *sqljsDB) close() (err error) {
+	defer catchJSError(&err)
+	c.db.Call("close")
+	return nil
+}
+
+// prepare replaces declarations of the `unicase` collation in query.
+func (c *sqljsDB) prepare(query string) string {
+	if !reUnicase.MatchString(query) {
+		return query
+	}
+	c.unicase = true
+	return reUnicase.ReplaceAllString(query, "COLLATE NOCASE")
+}
+
+func (c *sqljsDB) exec(query string, args []driver.Value) (result driver.Result, err error) {
+	defer catchJSError(&err)
+	c.db.Call("run", c.prepare(query), bindValues(args))
+	rows := c.db.Call("exec", "SELECT changes(), last_insert_rowid()").Index(0).Get("values").Index(0)
+	return sqljsResult{rowsAffected: int64(rows.Index(0).Float()), lastInsertID: int64(rows.Index(1).Float())}, nil
+}
+
+func (c *sqljsDB) query(query string, args []driver.Value) (rows *sqljsRows, err error) {
+	defer catchJSError(&err)
+	stmt := c.db.Call("prepare", c.prepare(query))
+	defer func() {
+		if err != nil {
+			stmt.Call("free")
+		}
+	}()
+	stmt.Call("bind", bindValues(args))
+	names := stmt.Call("getColumnNames")
+	columns := make([]string, names.Length())
+	for i := range columns {
+		columns[i] = names.Index(i).String()
+	}
+	return &sqljsRows{stmt: stmt, columns: columns}, nil
+}
+
+// replaceCollation replaces the collations matched by re in the schema of
+// the database with repl. If reload is set, the schema is reloaded, as it is
+// otherwise only read again when the database is reopened.
+func (c *sqljsDB) replaceCollation(re *regexp.Regexp, repl string, reload bool) error {
+	rows, err := c.query("SELECT type, name, sql FROM sqlite_master WHERE sql IS NOT NULL", nil)
+	if err != nil {
+		return err
+	}
+	type object struct{ typ, name, sql string }
+	var objects []object
+	dest := make([]driver.Value, 3)
+	for {
+		if err := rows.Next(dest); err == io.EOF {
+			break
+		} else if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if sql := dest[2].(string); re.MatchString(sql) {
+			objects = append(objects, object{dest[0].(string), dest[1].(string), re.ReplaceAllString(sql, repl)})
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+	if re == reUnicase {
+		c.unicase = true
+	}
+	if _, err := c.exec("PRAGMA writable_schema=ON", nil); err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if _, err := c.exec("UPDATE sqlite_master SET sql=? WHERE type=? AND name=?", []driver.Value{o.sql, o.typ, o.name}); err != nil {
+			return err
+		}
+	}
+	if reload {
+		rows, err := c.query("PRAGMA schema_version", nil)
+		if err != nil {
+			return err
+		}
+		err = rows.Next(dest[:1])
+		_ = rows.Close()
+		if err != nil {
+			return err
+		}
+		// Changing the schema version makes SQLite read the schema again.
+		if _, err := c.exec("PRAGMA schema_version="+strconv.FormatInt(dest[0].(int64)+1, 10), nil); err != nil {
+			return err
+		}
+	}
+	_, err = c.exec("PRAGMA writable_schema=OFF", nil)
+	return err
+}
+
+// export returns the database file, with the `unicase` collation restored.
+// sql.js closes and reopens the database to export it, which frees any
+// statements being read.
+func (c *sqljsDB) export() (data []byte, err error) {
+	if c.unicase {
+		if err := c.replaceCollation(reNoCase, "COLLATE unicase", false); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if e := c.replaceCollation(reUnicase, "COLLATE NOCASE", true); err == nil {
+				err = e
+			}
+		}()
+	}
+	defer catchJSError(&err)
+	file := c.db.Call("export")
+	data = make([]byte, file.Length())
+	js.CopyBytesToGo(data, file)
+	return data, nil
+}
+
+// sqljsDriver is the driver of a DB. Databases are opened with openSQLJS,
+// rather than by name.
+type sqljsDriver struct{}
+
+func (sqljsDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("sql.js databases cannot be opened by name")
+}
+
+// sqljsConn is a connection to a DB's database.
+type sqljsConn struct {
+	db *sqljsDB
+}
+
+var (
+	_ driver.ExecerContext  = &sqljsConn{}
+	_ driver.QueryerContext = &sqljsConn{}
+)
+
+func (c *sqljsConn) Prepare(query string) (driver.Stmt, error) {
+	return &sqljsStmt{conn: c, query: query}, nil
+}
+
+func (c *sqljsConn) Close() error {
+	return nil
+}
+
+func (c *sqljsConn) Begin() (driver.Tx, error) {
+	if _, err := c.db.exec("BEGIN", nil); err != nil {
+		return nil, err
+	}
+	return &sqljsTx{c}, nil
+}
+
+func (c *sqljsConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	values, err := positionalValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.db.exec(query, values)
+}
+
+func (c *sqljsConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values, err := positionalValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.db.query(query, values)
+}
+
+func positionalValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("Named parameters are not supported")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+type sqljsTx struct {
+	conn *sqljsConn
+}
+
+func (tx *sqljsTx) Commit() error {
+	_, err := tx.conn.db.exec("COMMIT", nil)
+	return err
+}
+
+func (tx *sqljsTx) Rollback() error {
+	_, err := tx.conn.db.exec("ROLLBACK", nil)
+	return err
+}
+
+// sqljsStmt is a prepared statement, which sql.js prepares each time it is
+// executed.
+type sqljsStmt struct {
+	conn  *sqljsConn
+	query string
+}
+
+func (s *sqljsStmt) Close() error  { return nil }
+func (s *sqljsStmt) NumInput() int { return -1 }
+
+func (s *sqljsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.db.exec(s.query, args)
+}
+
+func (s *sqljsStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.db.query(s.query, args)
+}
+
+type sqljsResult struct {
+	rowsAffected int64
+	lastInsertID int64
+}
+
+func (r sqljsResult) LastInsertId() (int64, error) { return r.lastInsertID, nil }
+func (r sqljsResult) RowsAffected() (int64, error) { return r.rowsAffected, nil }
+
+// sqljsRows reads the rows returned by an sql.js statement.
+type sqljsRows struct {
+	stmt    js.Value
+	columns []string
+}
+
+func (r *sqljsRows) Columns() []string {
+	return r.columns
+}
+
+func (r *sqljsRows) Close() (err error) {
+	defer catchJSError(&err)
+	r.stmt.Call("free")
+	return nil
+}
+
+func (r *sqljsRows) Next(dest []driver.Value) (err error) {
+	defer catchJSError(&err)
+	if !r.stmt.Call("step").Bool() {
+		return io.EOF
+	}
+	row := r.stmt.Call("get")
+	for i := range dest {
+		dest[i] = goValue(row.Index(i))
+	}
+	return nil
+}
+
+// sqliteTimestampFormat is the format in which times are stored, as by
+// github.com/mattn/go-sqlite3.
+const sqliteTimestampFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+// bindValues converts args to the JavaScript values sql.js binds to a
+// statement's parameters.
+func bindValues(args []driver.Value) interface{} {
+	if len(args) == 0 {
+		return js.Undefined()
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case bool:
+			if v {
+				values[i] = 1
+			} else {
+				values[i] = 0
+			}
+		case []byte:
+			values[i] = uint8Array(v)
+		case time.Time:
+			values[i] = v.Format(sqliteTimestampFormat)
+		default:
+			values[i] = v
+		}
+	}
+	return values
+}
+
+// goValue converts a value read by sql.js to a driver.Value. sql.js reads
+// all numbers as JavaScript numbers, so those which are whole are returned as
+// integers, which are exact up to 2^53.
+func goValue(v js.Value) driver.Value {
+	switch v.Type() {
+	case js.TypeNumber:
+		f := v.Float()
+		if f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+			return int64(f)
+		}
+		return f
+	case js.TypeString:
+		return v.String()
+	case js.TypeObject:
+		data := make([]byte, v.Length())
+		js.CopyBytesToGo(data, v)
+		return data
+	}
+	return nil
+}
+
+func uint8Array(data []byte) js.Value {
+	array := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(array, data)
+	return array
+}
@@ -0,0 +1,55 @@
+//go:build js && wasm
+// +build js,wasm
+
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnicaseCollation(t *testing.T) {
+	apkg, err := ReadBytes(splitSchemaPackage(t))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer apkg.Close()
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deck := collection.Decks[DefaultDeckID]
+	deck.Name = "Renamed"
+	if err := apkg.UpdateDeck(deck); err != nil {
+		t.Fatalf("Unexpected error updating a deck: %s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := apkg.db.dump(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("COLLATE unicase")) || bytes.Contains(buf.Bytes(), []byte("COLLATE NOCASE")) {
+		t.Errorf("The unicase collation was not restored")
+	}
+	// The database can still be written once dumped.
+	var names []string
+	if err := apkg.db.Select(&names, "SELECT name FROM decks ORDER BY name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apkg.db.Exec("UPDATE decks SET name='renamed' WHERE id=?", DefaultDeckID); err != nil {
+		t.Errorf("Unexpected error after dumping: %s", err)
+	}
+
+	saved := reopen(t, apkg)
+	defer saved.Close()
+	if collection, err := saved.Collection(); err != nil || collection.Decks[DefaultDeckID].Name != "renamed" {
+		t.Errorf("Update not saved: %v", err)
+	}
+
+	if _, err := OpenDB(bytes.NewReader([]byte("not a database"))); err == nil {
+		t.Errorf("Expected an error opening an invalid database")
+	}
+}
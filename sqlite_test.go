@@ -0,0 +1,177 @@
+//go:build !js
+// +build !js
+
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenInMemory(t *testing.T) {
+	apkg, err := ReadFileWithOptions(ApkgFile, &OpenOptions{InMemory: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer apkg.Close()
+	if apkg.db.tmpFile != "" {
+		t.Errorf("Database written to %s", apkg.db.tmpFile)
+	}
+	other, err := ReadFileWithOptions(ApkgFile, &OpenOptions{InMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	// The database must grow, and be shared by each connection.
+	if _, err := apkg.db.Exec(`CREATE TABLE filler AS
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE i < 5000)
+		SELECT i, randomblob(1000) AS data FROM n`); err != nil {
+		t.Fatalf("Unexpected error growing the database: %s", err)
+	}
+	rows, err := apkg.db.Query("SELECT i FROM filler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := apkg.db.Get(&count, "SELECT COUNT(*) FROM filler"); err != nil || count != 5000 {
+		t.Errorf("Unexpected count from a second connection: %d, %v", count, err)
+	}
+	rows.Close()
+	if err := other.db.Get(&count, "SELECT COUNT(*) FROM filler"); err == nil {
+		t.Errorf("In-memory databases are not separate")
+	}
+
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deck := collection.Decks[1464446999755]
+	deck.Name = "In memory"
+	if err := apkg.UpdateDeck(deck); err != nil {
+		t.Fatal(err)
+	}
+	saved := reopen(t, apkg)
+	defer saved.Close()
+	if collection, err := saved.Collection(); err != nil || collection.Decks[1464446999755].Name != "In memory" {
+		t.Errorf("Update not saved: %v", err)
+	}
+
+	if _, err := OpenDBWithOptions(bytes.NewReader([]byte("not a database")), &OpenOptions{InMemory: true}); err == nil {
+		t.Errorf("Expected an error opening an invalid database")
+	}
+}
+
+func TestOpenTempDir(t *testing.T) {
+	dir := t.TempDir()
+	apkg, err := ReadFileWithOptions(ApkgFile, &OpenOptions{TempDir: dir})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected the database in %s, found %d files", dir, len(files))
+	}
+	if err := apkg.Close(); err != nil {
+		t.Errorf("Unexpected error closing: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Temporary file not removed")
+	}
+
+	// Errors removing the temporary file are returned.
+	apkg, err = ReadFileWithOptions(ApkgFile, &OpenOptions{TempDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(apkg.db.tmpFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := apkg.Close(); !os.IsNotExist(err) {
+		t.Errorf("Expected a not-exist error, got %v", err)
+	}
+
+	if _, err := ReadFileWithOptions(ApkgFile, &OpenOptions{TempDir: dir + "/missing"}); !os.IsNotExist(err) {
+		t.Errorf("Expected a not-exist error, got %v", err)
+	}
+}
+
+// walCollection returns the path of a copy of the test package's database,
+// in WAL mode, as Anki leaves a collection it has open.
+func walCollection(t *testing.T) string {
+	src, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	path := filepath.Join(t.TempDir(), "collection.anki2")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.db.dump(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := backend.open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var mode string
+	if err := db.Get(&mode, "PRAGMA journal_mode=WAL"); err != nil || mode != "wal" {
+		t.Fatalf("Failed to enable WAL mode: %s, %v", mode, err)
+	}
+	return path
+}
+
+func TestOpenWALCollection(t *testing.T) {
+	for _, opts := range []*OpenOptions{nil, {InMemory: true}} {
+		testOpenWALCollection(t, opts)
+	}
+}
+
+func testOpenWALCollection(t *testing.T, opts *OpenOptions) {
+	col, err := OpenCollectionWithOptions(walCollection(t), "", opts)
+	if err != nil {
+		t.Fatalf("Unexpected error (options %+v): %s", opts, err)
+	}
+	defer col.Close()
+	note, err := col.NoteByID(1388721680877)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note.FieldValues[0] = "Changed"
+	if err := col.UpdateNote(note); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := col.WriteTo(buf); err != nil {
+		t.Fatalf("Unexpected error writing: %s", err)
+	}
+	saved, err := OpenDB(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	var flds string
+	if err := saved.Get(&flds, "SELECT flds FROM notes WHERE id=1388721680877"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(flds, "Changed\x1f") {
+		t.Errorf("Update not saved (options %+v): %q", opts, flds)
+	}
+}
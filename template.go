@@ -0,0 +1,286 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RenderedCard holds the rendered HTML of a card. As with Anki's own
+// card.q() and card.a(), the question and answer each begin with a <style>
+// element containing the model's CSS.
+type RenderedCard struct {
+	Question string
+	Answer   string
+}
+
+// Renderer renders card templates (Template.QuestionFormat and
+// Template.AnswerFormat) for a note, following the rules of Anki's template
+// engine.
+type Renderer struct {
+	filters map[string]Filter
+}
+
+// FilterContext describes the field being passed through a template filter.
+type FilterContext struct {
+	FieldName string // Name of the field being rendered
+	Args      string // Filter arguments, such as "en_US" in {{tts en_US:Field}}
+	Model     *Model // Model of the note being rendered
+	Note      *Note  // Note being rendered
+	Ordinal   int    // Ordinal of the card being rendered
+	Question  bool   // True when rendering the question side of the card
+}
+
+// A Filter transforms the text of a field referenced in a template, as in
+// {{name:Field}}. Filters may be chained, as in {{text:hint:Field}}, in which
+// case they are applied from right to left.
+type Filter func(text string, ctx *FilterContext) string
+
+// NewRenderer returns a new Renderer, with Anki's built-in filters
+// registered.
+func NewRenderer() *Renderer {
+	r := &Renderer{
+		filters: make(map[string]Filter, len(builtinFilters)),
+	}
+	for name, filter := range builtinFilters {
+		r.filters[name] = filter
+	}
+	return r
+}
+
+// RegisterFilter registers a filter with the given name, for use in
+// templates as {{name:Field}}. Registering a filter with the same name as an
+// existing filter replaces it. Filter names may not contain spaces or colons;
+// any text following a space is passed to the filter as FilterContext.Args.
+func (r *Renderer) RegisterFilter(name string, filter Filter) {
+	r.filters[name] = filter
+}
+
+// Render renders the question and answer of the card with the given
+// ordinal for a note of the provided model. For standard models, the ordinal
+// is the template's ordinal. For cloze models, it is the cloze number minus
+// one. deck is used for the {{Deck}} and {{Subdeck}} replacements, and may be
+// nil.
+func Render(model *Model, note *Note, ord int, deck *Deck) (*RenderedCard, error) {
+	return NewRenderer().Render(model, note, ord, deck)
+}
+
+// Render renders the question and answer of the card with the given
+// ordinal for a note of the provided model. See the package-level Render
+// function for details.
+func (r *Renderer) Render(model *Model, note *Note, ord int, deck *Deck) (*RenderedCard, error) {
+	tmpl, err := cardTemplate(model, ord)
+	if err != nil {
+		return nil, err
+	}
+	fields := templateFields(model, note, tmpl, ord, deck)
+	question, err := r.renderFormat(tmpl.QuestionFormat, fields, model, note, ord, true)
+	if err != nil {
+		return nil, err
+	}
+	fields["FrontSide"] = stripSounds(question)
+	answer, err := r.renderFormat(tmpl.AnswerFormat, fields, model, note, ord, false)
+	if err != nil {
+		return nil, err
+	}
+	style := "<style>" + model.CSS + "</style>"
+	return &RenderedCard{
+		Question: style + question,
+		Answer:   style + answer,
+	}, nil
+}
+
+// cardTemplate returns the template used to render the card with the given
+// ordinal. Cloze models have a single template, used for all cards.
+func cardTemplate(model *Model, ord int) (*Template, error) {
+	if model.Type == ModelTypeCloze {
+		if len(model.Templates) == 0 {
+			return nil, fmt.Errorf("Model %d has no templates", model.ID)
+		}
+		return model.Templates[0], nil
+	}
+	for _, tmpl := range model.Templates {
+		if tmpl.Ordinal == ord {
+			return tmpl, nil
+		}
+	}
+	return nil, fmt.Errorf("Model %d has no template with ordinal %d", model.ID, ord)
+}
+
+// templateFields returns the values available to a template: the note's
+// fields, plus Anki's special fields.
+func templateFields(model *Model, note *Note, tmpl *Template, ord int, deck *Deck) map[string]string {
+	fields := make(map[string]string, len(model.Fields)+7)
+	for i, field := range model.Fields {
+		if i < len(note.FieldValues) {
+			fields[field.Name] = note.FieldValues[i]
+		} else {
+			fields[field.Name] = ""
+		}
+	}
+	fields["Tags"] = strings.TrimSpace(note.Tags)
+	fields["Type"] = model.Name
+	fields["Card"] = tmpl.Name
+	if deck != nil {
+		fields["Deck"] = deck.Name
+		parts := strings.Split(deck.Name, "::")
+		fields["Subdeck"] = parts[len(parts)-1]
+	} else {
+		fields["Deck"] = ""
+		fields["Subdeck"] = ""
+	}
+	fields["c"+strconv.Itoa(ord+1)] = "1"
+	return fields
+}
+
+func (r *Renderer) renderFormat(format string, fields map[string]string, model *Model, note *Note, ord int, question bool) (string, error) {
+	nodes, err := parseTemplate(format)
+	if err != nil {
+		return "", err
+	}
+	buf := &strings.Builder{}
+	r.renderNodes(buf, nodes, fields, &FilterContext{
+		Model:    model,
+		Note:     note,
+		Ordinal:  ord,
+		Question: question,
+	})
+	return buf.String(), nil
+}
+
+func (r *Renderer) renderNodes(buf *strings.Builder, nodes []templateNode, fields map[string]string, ctx *FilterContext) {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case textNode:
+			buf.WriteString(string(n))
+		case *replacementNode:
+			buf.WriteString(r.replace(n, fields, ctx))
+		case *conditionalNode:
+			if fieldIsEmpty(fields[n.field]) == n.negated {
+				r.renderNodes(buf, n.children, fields, ctx)
+			}
+		}
+	}
+}
+
+func (r *Renderer) replace(n *replacementNode, fields map[string]string, ctx *FilterContext) string {
+	text, ok := fields[n.field]
+	if !ok {
+		return "{unknown field " + n.field + "}"
+	}
+	// The type filter produces a placeholder, which is replaced with an
+	// input box by the reviewer. Any other filters form part of the
+	// placeholder, as in [[type:cloze:Field]].
+	if len(n.filters) > 0 && n.filters[0] == "type" {
+		return "[[" + strings.Join(n.filters, ":") + ":" + n.field + "]]"
+	}
+	// Filters are applied from right to left; the filter nearest the field
+	// name is applied first.
+	for i := len(n.filters) - 1; i >= 0; i-- {
+		name, args := n.filters[i], ""
+		if j := strings.Index(name, " "); j >= 0 {
+			name, args = name[:j], strings.TrimSpace(name[j+1:])
+		}
+		filter, ok := r.filters[name]
+		if !ok {
+			// Unknown filters are ignored, as in Anki, so that templates
+			// relying on add-ons still render.
+			continue
+		}
+		fctx := *ctx
+		fctx.FieldName = n.field
+		fctx.Args = args
+		text = filter(text, &fctx)
+	}
+	return text
+}
+
+var reEmptyField = regexp.MustCompile(`^[\s\x{200b}]*$`)
+
+// fieldIsEmpty returns true if the field contains nothing but HTML and
+// whitespace. Media references count as content.
+func fieldIsEmpty(text string) bool {
+	return reEmptyField.MatchString(stripHTMLMedia(text))
+}
+
+var reSound = regexp.MustCompile(`\[sound:[^]]+\]`)
+
+// stripSounds removes [sound:...] references, so that audio on the front of
+// a card is not replayed when the {{FrontSide}} is shown with the answer.
+func stripSounds(text string) string {
+	return reSound.ReplaceAllString(text, "")
+}
+
+type templateNode interface{}
+
+type textNode string
+
+type replacementNode struct {
+	field   string
+	filters []string
+}
+
+type conditionalNode struct {
+	field    string
+	negated  bool
+	children []templateNode
+}
+
+// parseTemplate parses a template format into a tree of nodes.
+func parseTemplate(format string) ([]templateNode, error) {
+	root := &conditionalNode{}
+	stack := []*conditionalNode{root}
+	for len(format) > 0 {
+		current := stack[len(stack)-1]
+		start := strings.Index(format, "{{")
+		if start < 0 {
+			current.children = append(current.children, textNode(format))
+			break
+		}
+		end := strings.Index(format[start+2:], "}}")
+		if end < 0 {
+			current.children = append(current.children, textNode(format))
+			break
+		}
+		if start > 0 {
+			current.children = append(current.children, textNode(format[:start]))
+		}
+		tag := strings.TrimSpace(format[start+2 : start+2+end])
+		format = format[start+2+end+2:]
+		switch {
+		case strings.HasPrefix(tag, "#"), strings.HasPrefix(tag, "^"):
+			section := &conditionalNode{
+				field:   strings.TrimSpace(tag[1:]),
+				negated: tag[0] == '^',
+			}
+			current.children = append(current.children, section)
+			stack = append(stack, section)
+		case strings.HasPrefix(tag, "/"):
+			name := strings.TrimSpace(tag[1:])
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("Found '{{/%s}}', but there is no matching '{{#%s}}'", name, name)
+			}
+			if name != current.field {
+				return nil, fmt.Errorf("Found '{{/%s}}', but expected '{{/%s}}'", name, current.field)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			parts := strings.Split(tag, ":")
+			for i := range parts {
+				parts[i] = strings.TrimSpace(parts[i])
+			}
+			current.children = append(current.children, &replacementNode{
+				field:   parts[len(parts)-1],
+				filters: parts[:len(parts)-1],
+			})
+		}
+	}
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("Missing '{{/%s}}'", stack[len(stack)-1].field)
+	}
+	return root.children, nil
+}
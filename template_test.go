@@ -0,0 +1,135 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	model := basicReversedModel()
+	model.Templates = append(model.Templates, &Template{
+		Name:           "Card 3",
+		Ordinal:        2,
+		QuestionFormat: "{{Type}}|{{Card}}|{{Deck}}|{{Subdeck}}|{{Tags}}|{{#Tags}}tagged{{/Tags}}",
+		AnswerFormat:   "{{FrontSide}}|{{^Add Reverse}}forward only{{/Add Reverse}}|{{Missing}}|{{unknownfilter:Back}}",
+	})
+	note := &Note{
+		Tags:        " nl animals ",
+		FieldValues: FieldValues{"hond [sound:hond.mp3]", "dog", "<br>"},
+	}
+	deck := &Deck{Name: "Languages::Dutch"}
+	style := "<style>" + model.CSS + "</style>"
+
+	tests := []struct {
+		name     string
+		ord      int
+		question string
+		answer   string
+		err      string
+	}{
+		{
+			name:     "basic",
+			ord:      0,
+			question: style + "hond [sound:hond.mp3]",
+			answer:   style + "hond <hr id=answer>dog",
+		},
+		{
+			name:     "empty section",
+			ord:      1,
+			question: style,
+			answer:   style + "<hr id=answer>hond [sound:hond.mp3]",
+		},
+		{
+			name:     "special fields",
+			ord:      2,
+			question: style + "Basic (optional reversed card)|Card 3|Languages::Dutch|Dutch|nl animals|tagged",
+			answer:   style + "Basic (optional reversed card)|Card 3|Languages::Dutch|Dutch|nl animals|tagged|forward only|{unknown field Missing}|dog",
+		},
+		{
+			name: "invalid ordinal",
+			ord:  3,
+			err:  "Model 0 has no template with ordinal 3",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			card, err := Render(model, note, test.ord, deck)
+			var msg string
+			if err != nil {
+				msg = err.Error()
+			}
+			if msg != test.err {
+				t.Fatalf("Unexpected error: %s", msg)
+			}
+			if err != nil {
+				return
+			}
+			if card.Question != test.question {
+				t.Errorf("Unexpected question.\nExpected: %q\n  Actual: %q", test.question, card.Question)
+			}
+			if card.Answer != test.answer {
+				t.Errorf("Unexpected answer.\nExpected: %q\n  Actual: %q", test.answer, card.Answer)
+			}
+		})
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		err    string
+	}{
+		{format: "{{#Front}}", err: "Missing '{{/Front}}'"},
+		{format: "{{/Front}}", err: "Found '{{/Front}}', but there is no matching '{{#Front}}'"},
+		{format: "{{#Front}}{{#Back}}{{/Front}}{{/Back}}", err: "Found '{{/Front}}', but expected '{{/Back}}'"},
+		{format: "{{Front", err: ""},
+	}
+	for _, test := range tests {
+		_, err := parseTemplate(test.format)
+		var msg string
+		if err != nil {
+			msg = err.Error()
+		}
+		if msg != test.err {
+			t.Errorf("%s: Unexpected error: %s", test.format, msg)
+		}
+	}
+}
+
+func TestRenderApkg(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatalf("Error opening test file: %s", err)
+	}
+	defer apkg.Close()
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	notes, err := apkg.Notes()
+	if err != nil {
+		t.Fatalf("Error fetching notes: %s", err)
+	}
+	defer notes.Close()
+	if !notes.Next() {
+		t.Fatalf("No notes found")
+	}
+	note, err := notes.Note()
+	if err != nil {
+		t.Fatalf("Error reading note: %s", err)
+	}
+	model := collection.Models[note.ModelID]
+	card, err := Render(model, note, 0, collection.Decks[1464446999755])
+	if err != nil {
+		t.Fatalf("Error rendering card: %s", err)
+	}
+	style := "<style>" + model.CSS + "</style>"
+	if expected := style + "Todos habíamos alcanzado la cima cuando comenzó a llover."; card.Question != expected {
+		t.Errorf("Unexpected question: %q", card.Question)
+	}
+	if expected := style + "Todos habíamos alcanzado la cima cuando comenzó a llover.\n\n<hr id=answer>\n\nWe had reached the top when it started to rain."; card.Answer != expected {
+		t.Errorf("Unexpected answer: %q", card.Answer)
+	}
+}
@@ -4,6 +4,7 @@
 package anki
 
 import (
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -46,6 +47,16 @@ func (i *ID) UnmarshalJSON(src []byte) error {
 	return i.Scan(id)
 }
 
+// MarshalJSON implements the json.Marshaler interface for the ID type.
+func (i ID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int64(i))
+}
+
+// Value implements the driver.Valuer interface for the ID type.
+func (i ID) Value() (driver.Value, error) {
+	return int64(i), nil
+}
+
 // TimestampSeconds represents a time.Time value stored as seconds.
 type TimestampSeconds time.Time
 
@@ -79,6 +90,17 @@ func (t *TimestampSeconds) UnmarshalJSON(src []byte) error {
 	return t.Scan(ts)
 }
 
+// MarshalJSON implements the json.Marshaler interface for the
+// TimestampSeconds type.
+func (t TimestampSeconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).Unix())
+}
+
+// Value implements the driver.Valuer interface for the TimestampSeconds type.
+func (t TimestampSeconds) Value() (driver.Value, error) {
+	return time.Time(t).Unix(), nil
+}
+
 // Scan implements the sql.Scanner interface for the TimestampMilliseconds
 // type.
 func (t *TimestampMilliseconds) Scan(src interface{}) error {
@@ -93,10 +115,32 @@ func (t *TimestampMilliseconds) Scan(src interface{}) error {
 	default:
 		return errors.New("Incompatible type for TimestampMillieconds")
 	}
-	*t = TimestampMilliseconds(time.Unix(ms/1000, ms%1000).UTC())
+	*t = TimestampMilliseconds(time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC())
 	return nil
 }
 
+// UnmarshalJSON implements the json.Unmarshaler interface for the
+// TimestampMilliseconds type.
+func (t *TimestampMilliseconds) UnmarshalJSON(src []byte) error {
+	var ts interface{}
+	if err := json.Unmarshal(src, &ts); err != nil {
+		return err
+	}
+	return t.Scan(ts)
+}
+
+// MarshalJSON implements the json.Marshaler interface for the
+// TimestampMilliseconds type.
+func (t TimestampMilliseconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).UnixNano() / int64(time.Millisecond))
+}
+
+// Value implements the driver.Valuer interface for the TimestampMilliseconds
+// type.
+func (t TimestampMilliseconds) Value() (driver.Value, error) {
+	return time.Time(t).UnixNano() / int64(time.Millisecond), nil
+}
+
 func scanInt64(src interface{}) (int64, error) {
 	var num int64
 	switch src.(type) {
@@ -121,6 +165,29 @@ func (d *DurationMilliseconds) Scan(src interface{}) error {
 	return err
 }
 
+// UnmarshalJSON implements the json.Unmarshaler interface for the
+// DurationMilliseconds type.
+func (d *DurationMilliseconds) UnmarshalJSON(src []byte) error {
+	var ms int64
+	if err := json.Unmarshal(src, &ms); err != nil {
+		return err
+	}
+	*d = DurationMilliseconds(time.Duration(ms) * time.Millisecond)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface for the
+// DurationMilliseconds type.
+func (d DurationMilliseconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int64(time.Duration(d) / time.Millisecond))
+}
+
+// Value implements the driver.Valuer interface for the DurationMilliseconds
+// type.
+func (d DurationMilliseconds) Value() (driver.Value, error) {
+	return int64(time.Duration(d) / time.Millisecond), nil
+}
+
 // DurationSeconds represents a time.Duration value stored as seconds.
 type DurationSeconds time.Duration
 
@@ -131,25 +198,96 @@ func (d *DurationSeconds) Scan(src interface{}) error {
 	return err
 }
 
-// DurationMinutes represents a time.Duration value stored as minutes.
+// UnmarshalJSON implements the json.Unmarshaler interface for the
+// DurationSeconds type.
+func (d *DurationSeconds) UnmarshalJSON(src []byte) error {
+	var seconds int64
+	if err := json.Unmarshal(src, &seconds); err != nil {
+		return err
+	}
+	*d = DurationSeconds(time.Duration(seconds) * time.Second)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface for the DurationSeconds
+// type.
+func (d DurationSeconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int64(time.Duration(d) / time.Second))
+}
+
+// Value implements the driver.Valuer interface for the DurationSeconds type.
+func (d DurationSeconds) Value() (driver.Value, error) {
+	return int64(time.Duration(d) / time.Second), nil
+}
+
+// DurationMinutes represents a time.Duration value stored as minutes, which
+// may be fractional.
 type DurationMinutes time.Duration
 
 // Scan implements the sql.Scanner interface for the DurationMinutes type.
 func (d *DurationMinutes) Scan(src interface{}) error {
-	min, err := scanInt64(src)
-	*d = DurationMinutes(time.Duration(min) * time.Minute)
-	return err
+	var min float64
+	switch t := src.(type) {
+	case float64:
+		min = t
+	case int64:
+		min = float64(t)
+	default:
+		return errors.New("Incompatible type for DurationMinutes")
+	}
+	*d = DurationMinutes(time.Duration(min * float64(time.Minute)))
+	return nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface for the
+// DurationMinutes type. Anki permits fractional minutes in learning steps, so
+// the value is not truncated to whole minutes.
+func (d *DurationMinutes) UnmarshalJSON(src []byte) error {
+	var min float64
+	if err := json.Unmarshal(src, &min); err != nil {
+		return err
+	}
+	*d = DurationMinutes(time.Duration(min * float64(time.Minute)))
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface for the DurationMinutes
+// type.
+func (d DurationMinutes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(float64(d) / float64(time.Minute))
+}
+
+// Value implements the driver.Valuer interface for the DurationMinutes type.
+// Whole minutes are stored as integers, and fractional minutes as reals, as
+// in the JSON.
+func (d DurationMinutes) Value() (driver.Value, error) {
+	if time.Duration(d)%time.Minute == 0 {
+		return int64(time.Duration(d) / time.Minute), nil
+	}
+	return float64(d) / float64(time.Minute), nil
 }
 
 // DurationDays represents a duration in days.
 type DurationDays int
 
+// Scan implements the sql.Scanner interface for the DurationDays type.
 func (d *DurationDays) Scan(src interface{}) error {
 	days, err := scanInt64(src)
 	*d = DurationDays(int(days))
 	return err
 }
 
+// MarshalJSON implements the json.Marshaler interface for the DurationDays
+// type.
+func (d DurationDays) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int(d))
+}
+
+// Value implements the driver.Valuer interface for the DurationDays type.
+func (d DurationDays) Value() (driver.Value, error) {
+	return int64(d), nil
+}
+
 // BoolInt represents a boolean value stored as an int
 type BoolInt bool
 
@@ -184,3 +322,19 @@ func (b *BoolInt) UnmarshalJSON(src []byte) error {
 	}
 	return b.Scan(tmp)
 }
+
+// MarshalJSON implements the json.Marshaler interface for the BoolInt type.
+func (b BoolInt) MarshalJSON() ([]byte, error) {
+	if b {
+		return []byte("1"), nil
+	}
+	return []byte("0"), nil
+}
+
+// Value implements the driver.Valuer interface for the BoolInt type.
+func (b BoolInt) Value() (driver.Value, error) {
+	if b {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
@@ -0,0 +1,680 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// usnPending is the update sequence number Anki gives to objects modified
+// locally, which are to be sent to the server at the next sync.
+const usnPending = -1
+
+// The Update methods below write changes back to the package's database,
+// encoding each value as Anki stores it. Each sets the modification time of
+// the object it is passed to the current time, and its update sequence number
+// to -1, to mark it for syncing. The changes are kept in a temporary copy of
+// the database until the package is saved with WriteTo or WriteFile.
+
+// UpdateNote writes note back to the package. Its tags are normalized, and
+// its sort field and checksum are recalculated from its field values.
+func (a *Apkg) UpdateNote(note *Note) error {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	model, ok := col.Models[note.ModelID]
+	if !ok {
+		return fmt.Errorf("Note %d references non-existent note type %d", note.ID, note.ModelID)
+	}
+	if len(note.FieldValues) != len(model.Fields) {
+		return fmt.Errorf("Note %d has %d fields, but note type %d has %d", note.ID, len(note.FieldValues), model.ID, len(model.Fields))
+	}
+	now := time.Now()
+	note.Modified = timestampSeconds(now)
+	note.UpdateSequence = usnPending
+	note.Tags = joinTags(strings.Fields(note.Tags))
+	note.UniqueField, note.Checksum = sortFieldAndChecksum(model, note.FieldValues)
+	result, err := a.db.Exec(`UPDATE notes SET guid=?, mid=?, mod=?, usn=?, tags=?, flds=?, sfld=?, csum=? WHERE id=?`,
+		note.GUID,
+		int64(note.ModelID),
+		seconds(note.Modified),
+		note.UpdateSequence,
+		note.Tags,
+		strings.Join(note.FieldValues, "\x1f"),
+		note.UniqueField,
+		note.Checksum,
+		int64(note.ID),
+	)
+	if err := checkUpdated(result, err, "Note", note.ID); err != nil {
+		return err
+	}
+	return a.touch(now)
+}
+
+// UpdateCard writes card back to the package. Its due time and intervals are
+// converted back to the days or seconds Anki stores for its queue, and new
+// cards keep their Position. If the card is not new, but its Due time is nil,
+// the due value stored is kept. A nil OriginalDue is written as 0, Anki's
+// value for none.
+func (a *Apkg) UpdateCard(card *Card) error {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	for _, did := range []ID{card.DeckID, card.OriginalDeckID} {
+		if _, ok := col.Decks[did]; !ok && did != 0 {
+			return fmt.Errorf("Card %d references non-existent deck %d", card.ID, did)
+		}
+	}
+	crt := seconds(col.Created)
+	pos := int64(card.Position)
+	// A nil due value keeps the one stored.
+	var due interface{}
+	if value, ok := encodeDue(card.Queue, card.Type, card.Due, crt, pos); ok {
+		due = value
+	}
+	var odue int64
+	if card.OriginalDeckID != 0 {
+		odue, _ = encodeDue(card.Queue, card.Type, card.OriginalDue, crt, pos)
+	}
+	var ivl int64
+	if card.Interval != nil {
+		ivl = encodeInterval(*card.Interval)
+	}
+	now := time.Now()
+	card.Modified = timestampSeconds(now)
+	card.UpdateSequence = usnPending
+	result, err := a.db.Exec(`UPDATE cards SET nid=?, did=?, ord=?, mod=?, usn=?, type=?, queue=?, due=COALESCE(?, due), ivl=?, factor=?, reps=?, lapses=?, left=?, odue=?, odid=?, flags=? WHERE id=?`,
+		int64(card.NoteID),
+		int64(card.DeckID),
+		card.TemplateID,
+		seconds(card.Modified),
+		card.UpdateSequence,
+		int(card.Type),
+		int(card.Queue),
+		due,
+		ivl,
+		encodeFactor(card.Factor),
+		card.ReviewCount,
+		card.Lapses,
+		card.Left,
+		odue,
+		int64(card.OriginalDeckID),
+		card.Flags,
+		int64(card.ID),
+	)
+	if err := checkUpdated(result, err, "Card", card.ID); err != nil {
+		return err
+	}
+	return a.touch(now)
+}
+
+// UpdateDeck writes deck back to the package.
+func (a *Apkg) UpdateDeck(deck *Deck) error {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	if _, ok := col.Decks[deck.ID]; !ok {
+		return fmt.Errorf("Deck %d not found", deck.ID)
+	}
+	var conf *DeckConfig
+	if !deck.Dynamic {
+		var ok bool
+		if conf, ok = col.DeckConfigs[deck.ConfigID]; !ok {
+			return fmt.Errorf("Deck %d references non-existent config %d", deck.ID, deck.ConfigID)
+		}
+	}
+	now := time.Now()
+	deck.Modified = timestampSeconds(now)
+	deck.UpdateSequence = usnPending
+	if a.split["decks"] {
+		err = a.updateDeckRow(deck)
+	} else {
+		err = a.updateColObject("decks", deck.ID, deck)
+	}
+	if err != nil {
+		return err
+	}
+	deck.Config = conf
+	col.Decks[deck.ID] = deck
+	return a.touch(now)
+}
+
+// UpdateDeckConfig writes a deck options group back to the package.
+func (a *Apkg) UpdateDeckConfig(dc *DeckConfig) error {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	if _, ok := col.DeckConfigs[dc.ID]; !ok {
+		return fmt.Errorf("Deck config %d not found", dc.ID)
+	}
+	now := time.Now()
+	dc.Modified = timestampSeconds(now)
+	dc.UpdateSequence = usnPending
+	if a.split["deck_config"] {
+		err = a.updateDeckConfigRow(dc)
+	} else {
+		err = a.updateColObject("dconf", dc.ID, dc)
+	}
+	if err != nil {
+		return err
+	}
+	col.DeckConfigs[dc.ID] = dc
+	for _, deck := range col.Decks {
+		if deck.ConfigID == dc.ID && !deck.Dynamic {
+			deck.Config = dc
+		}
+	}
+	return a.touch(now)
+}
+
+// UpdateModel writes a model (note type) back to the package. Adding or
+// removing fields or templates does not update the package's notes or
+// cards; when it does so, the schema modification time is updated, which
+// forces a full sync.
+func (a *Apkg) UpdateModel(model *Model) error {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	old, ok := col.Models[model.ID]
+	if !ok {
+		return fmt.Errorf("Note type %d not found", model.ID)
+	}
+	now := time.Now()
+	model.Modified = timestampSeconds(now)
+	model.UpdateSequence = usnPending
+	if a.split["notetypes"] {
+		err = a.updateNotetypeRows(model, now)
+	} else {
+		err = a.updateColObject("models", model.ID, model)
+	}
+	if err != nil {
+		return err
+	}
+	col.Models[model.ID] = model
+	if len(old.Fields) != len(model.Fields) || len(old.Templates) != len(model.Templates) {
+		if _, err := a.db.Exec("UPDATE col SET scm=?", now.UnixNano()/int64(time.Millisecond)); err != nil {
+			return err
+		}
+	}
+	return a.touch(now)
+}
+
+// UpdateConfig writes the collection's configuration back to the package.
+func (a *Apkg) UpdateConfig(conf *Config) error {
+	col, err := a.cachedCollection()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if a.split["config"] {
+		err = a.updateConfigRows(conf, now)
+	} else {
+		err = a.updateColJSON("conf", func(blob []byte) ([]byte, error) {
+			return mergeJSON(blob, conf)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	col.Config = *conf
+	return a.touch(now)
+}
+
+// cachedCollection returns the collection, which the Update methods use to
+// validate references, and keep up to date.
+func (a *Apkg) cachedCollection() (*Collection, error) {
+	if a.collection != nil {
+		return a.collection, nil
+	}
+	if err := a.findSplitTables(); err != nil {
+		return nil, err
+	}
+	col, err := a.Collection()
+	if err != nil {
+		return nil, err
+	}
+	a.collection = col
+	return col, nil
+}
+
+// findSplitTables records which of the JSON columns of the `col` table are
+// stored in tables of their own.
+func (a *Apkg) findSplitTables() error {
+	tables, err := a.tables()
+	if err != nil {
+		return err
+	}
+	a.split = make(map[string]bool)
+	for _, split := range splitTables {
+		a.split[split.table] = tables[split.table]
+	}
+	return nil
+}
+
+// touch updates the collection's modification time.
+func (a *Apkg) touch(now time.Time) error {
+	_, err := a.db.Exec("UPDATE col SET mod=?", now.UnixNano()/int64(time.Millisecond))
+	return err
+}
+
+func checkUpdated(result sql.Result, err error, kind string, id ID) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s %d not found", kind, id)
+	}
+	return nil
+}
+
+// updateColJSON replaces the JSON stored in a column of the `col` table with
+// the result of update.
+func (a *Apkg) updateColJSON(column string, update func([]byte) ([]byte, error)) error {
+	var blob string
+	if err := a.db.Get(&blob, "SELECT "+column+" FROM col"); err != nil {
+		return err
+	}
+	updated, err := update([]byte(blob))
+	if err != nil {
+		return err
+	}
+	_, err = a.db.Exec("UPDATE col SET "+column+"=?", string(updated))
+	return err
+}
+
+// updateColObject replaces the object with the given ID, in a JSON column of
+// the `col` table which maps IDs to objects.
+func (a *Apkg) updateColObject(column string, id ID, v interface{}) error {
+	return a.updateColJSON(column, func(blob []byte) ([]byte, error) {
+		objects := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(blob, &objects); err != nil {
+			return nil, err
+		}
+		key := strconv.FormatInt(int64(id), 10)
+		merged, err := mergeJSON(objects[key], v)
+		if err != nil {
+			return nil, err
+		}
+		objects[key] = merged
+		return json.Marshal(objects)
+	})
+}
+
+// mergeJSON marshals v over the JSON object existing, so that any keys v does
+// not define are retained.
+func mergeJSON(existing []byte, v interface{}) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(existing) > 0 {
+		if err := json.Unmarshal(existing, &fields); err != nil {
+			return nil, err
+		}
+	}
+	blob, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(blob, &updates); err != nil {
+		return nil, err
+	}
+	for key, value := range updates {
+		fields[key] = value
+	}
+	return json.Marshal(fields)
+}
+
+// updateConfigRows writes each key of conf to the `config` table.
+func (a *Apkg) updateConfigRows(conf *Config, now time.Time) error {
+	blob, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(blob, &values); err != nil {
+		return err
+	}
+	for key, val := range values {
+		if _, err := a.db.Exec("INSERT OR REPLACE INTO config (KEY, usn, mtime_secs, val) VALUES (?, ?, ?, ?)",
+			key, usnPending, now.Unix(), []byte(val)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateDeckRow writes deck to the `decks` table, retaining any fields of its
+// protocol buffers which the Deck type does not represent.
+func (a *Apkg) updateDeckRow(deck *Deck) error {
+	var commonBytes, kindBytes []byte
+	if err := a.db.QueryRow("SELECT common, kind FROM decks WHERE id=?", int64(deck.ID)).Scan(&commonBytes, &kindBytes); err != nil {
+		return err
+	}
+	common, err := decodeProto(commonBytes)
+	if err != nil {
+		return err
+	}
+	kind, err := decodeProto(kindBytes)
+	if err != nil {
+		return err
+	}
+	common.setBool(1, deck.Collapsed)
+	common.setBool(2, deck.BrowserCollapsed)
+	common.setUint(3, uint64(deck.NewToday[0]))
+	common.setInt(4, int64(deck.NewToday[1]))
+	common.setInt(5, int64(deck.ReviewsToday[1]))
+	common.setInt(6, int64(deck.LearnToday[1]))
+	common.setInt(7, int64(deck.TimeToday[1]))
+	if !deck.Dynamic {
+		normal, err := kind.message(1)
+		if err != nil {
+			return err
+		}
+		normal.setInt(1, int64(deck.ConfigID))
+		normal.setUint(2, uint64(deck.ExtendedNewCardLimit))
+		normal.setUint(3, uint64(deck.ExtendedReviewCardLimit))
+		normal.setString(4, deck.Description)
+		delete(kind, 2)
+		kind.setMessage(1, normal)
+	}
+	_, err = a.db.Exec("UPDATE decks SET name=?, mtime_secs=?, usn=?, common=?, kind=? WHERE id=?",
+		strings.ReplaceAll(deck.Name, "::", "\x1f"),
+		seconds(deck.Modified),
+		deck.UpdateSequence,
+		common.encode(),
+		kind.encode(),
+		int64(deck.ID),
+	)
+	return err
+}
+
+// updateDeckConfigRow writes dc to the `deck_config` table, retaining any
+// fields of its protocol buffer which the DeckConfig type does not represent.
+func (a *Apkg) updateDeckConfigRow(dc *DeckConfig) error {
+	var config []byte
+	if err := a.db.QueryRow("SELECT config FROM deck_config WHERE id=?", int64(dc.ID)).Scan(&config); err != nil {
+		return err
+	}
+	if len(config) > 0 && config[0] == '{' {
+		// Schema 14 stores the legacy JSON object.
+		merged, err := mergeJSON(config, dc)
+		if err != nil {
+			return err
+		}
+		config = merged
+	} else {
+		msg, err := decodeProto(config)
+		if err != nil {
+			return err
+		}
+		encodeDeckConfig(msg, dc)
+		config = msg.encode()
+	}
+	_, err := a.db.Exec("UPDATE deck_config SET name=?, mtime_secs=?, usn=?, config=? WHERE id=?",
+		dc.Name, seconds(dc.Modified), usnPending, config, int64(dc.ID))
+	return err
+}
+
+// encodeDeckConfig sets the fields of a DeckConfig.Config protocol buffer
+// from dc. It is the reverse of decodeDeckConfig.
+func encodeDeckConfig(msg protoMessage, dc *DeckConfig) {
+	msg.setFloats(1, stepMinutes(dc.New.Delays))
+	msg.setFloats(2, stepMinutes(dc.Lapses.Delays))
+	msg.setUint(9, uint64(dc.New.PerDay))
+	msg.setUint(10, uint64(dc.Reviews.PerDay))
+	msg.setFloat(11, dc.New.InitialFactor/1000)
+	msg.setFloat(12, dc.Reviews.EasyBonus)
+	msg.setFloat(13, dc.Reviews.HardFactor)
+	msg.setFloat(14, dc.Lapses.NewInterval)
+	msg.setFloat(15, dc.Reviews.IntervalModifier)
+	msg.setUint(16, uint64(dc.Reviews.MaxInterval))
+	msg.setUint(17, uint64(dc.Lapses.MinimumInterval))
+	msg.setUint(18, uint64(dc.New.Intervals[0]))
+	msg.setUint(19, uint64(dc.New.Intervals[1]))
+	msg.setBool(20, dc.New.Order == NewCardOrderRandomOrder)
+	msg.setUint(21, uint64(dc.Lapses.LeechAction))
+	msg.setUint(22, uint64(dc.Lapses.LeechFails))
+	msg.setBool(23, !dc.AutoPlay)
+	msg.setUint(24, uint64(dc.MaxAnswerSeconds))
+	msg.setBool(25, bool(dc.ShowTimer))
+	msg.setBool(26, !dc.ReplayAudio)
+	msg.setBool(27, dc.New.Bury)
+	msg.setBool(28, dc.Reviews.Bury)
+}
+
+// stepMinutes converts learning steps to fractional minutes.
+func stepMinutes(delays []DurationMinutes) []float32 {
+	steps := make([]float32, len(delays))
+	for i, delay := range delays {
+		steps[i] = float32(time.Duration(delay).Minutes())
+	}
+	return steps
+}
+
+// updateNotetypeRows writes model to the `notetypes`, `fields` and
+// `templates` tables, retaining any fields of their protocol buffers which
+// the Model, Field and Template types do not represent. Fields and templates
+// are matched to the existing ones by name.
+func (a *Apkg) updateNotetypeRows(model *Model, now time.Time) error {
+	var configBytes []byte
+	if err := a.db.QueryRow("SELECT config FROM notetypes WHERE id=?", int64(model.ID)).Scan(&configBytes); err != nil {
+		return err
+	}
+	config, err := decodeProto(configBytes)
+	if err != nil {
+		return err
+	}
+	config.setUint(1, uint64(model.Type))
+	config.setUint(2, uint64(model.SortField))
+	config.setString(3, model.CSS)
+	config.setInt(4, int64(model.DeckID))
+	config.setString(5, model.LatexPre)
+	config.setString(6, model.LatexPost)
+	reqs := make([]protoMessage, len(model.RequiredFields))
+	for i, req := range model.RequiredFields {
+		msg := make(protoMessage)
+		msg.setUint(1, uint64(req.Index))
+		switch req.MatchType {
+		case "any":
+			msg.setUint(2, 1)
+		case "all":
+			msg.setUint(2, 2)
+		}
+		ords := make([]uint64, len(req.Fields))
+		for j, ord := range req.Fields {
+			ords[j] = uint64(ord)
+		}
+		msg.setUints(3, ords)
+		reqs[i] = msg
+	}
+	config.setMessages(8, reqs)
+	if _, err := a.db.Exec("UPDATE notetypes SET name=?, mtime_secs=?, usn=?, config=? WHERE id=?",
+		model.Name, seconds(model.Modified), model.UpdateSequence, config.encode(), int64(model.ID)); err != nil {
+		return err
+	}
+
+	fieldConfigs, err := a.configsByName("fields", model.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := a.db.Exec("DELETE FROM fields WHERE ntid=?", int64(model.ID)); err != nil {
+		return err
+	}
+	for _, field := range model.Fields {
+		msg, ok := fieldConfigs[field.Name]
+		if !ok {
+			msg = make(protoMessage)
+		}
+		msg.setBool(1, field.Sticky)
+		msg.setBool(2, field.RTL)
+		msg.setString(3, field.Font)
+		msg.setUint(4, uint64(field.FontSize))
+		if _, err := a.db.Exec("INSERT INTO fields (ntid, ord, name, config) VALUES (?, ?, ?, ?)",
+			int64(model.ID), field.Ordinal, field.Name, msg.encode()); err != nil {
+			return err
+		}
+	}
+
+	templateConfigs, err := a.configsByName("templates", model.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := a.db.Exec("DELETE FROM templates WHERE ntid=?", int64(model.ID)); err != nil {
+		return err
+	}
+	for _, tmpl := range model.Templates {
+		msg, ok := templateConfigs[tmpl.Name]
+		if !ok {
+			msg = make(protoMessage)
+		}
+		msg.setString(1, tmpl.QuestionFormat)
+		msg.setString(2, tmpl.AnswerFormat)
+		msg.setString(3, tmpl.BrowserQuestionFormat)
+		msg.setString(4, tmpl.BrowserAnswerFormat)
+		msg.setInt(5, int64(tmpl.DeckOverride))
+		if _, err := a.db.Exec("INSERT INTO templates (ntid, ord, name, mtime_secs, usn, config) VALUES (?, ?, ?, ?, ?, ?)",
+			int64(model.ID), tmpl.Ordinal, tmpl.Name, now.Unix(), usnPending, msg.encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configsByName returns the decoded configs of a note type's fields or
+// templates, by name.
+func (a *Apkg) configsByName(table string, ntid ID) (map[string]protoMessage, error) {
+	rows, err := a.db.Query("SELECT name, config FROM "+table+" WHERE ntid=?", int64(ntid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	configs := make(map[string]protoMessage)
+	for rows.Next() {
+		var name string
+		var config []byte
+		if err := rows.Scan(&name, &config); err != nil {
+			return nil, err
+		}
+		msg, err := decodeProto(config)
+		if err != nil {
+			return nil, err
+		}
+		configs[name] = msg
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// WriteTo writes the package, including any changes made with the Update
+// methods, to out. A package read from an archive is written as an archive,
+// with its other files copied unchanged; one opened with OpenCollection is
+// written as a bare database, without the media files added to it, which
+// are saved with SaveMedia. It implements the io.WriterTo interface.
+func (a *Apkg) WriteTo(out io.Writer) (int64, error) {
+	cw := &countWriter{w: out}
+	if a.reader == nil {
+		err := a.db.dump(cw)
+		return cw.n, err
+	}
+	z := zip.NewWriter(cw)
+	for _, file := range a.reader.File {
+		if file.Name == "media" && len(a.added) > 0 {
+			// Rewritten below, to list the added files.
+			continue
+		}
+		if file != a.sqlite {
+			if err := z.Copy(file); err != nil {
+				return cw.n, err
+			}
+			continue
+		}
+		f, err := z.CreateHeader(&zip.FileHeader{Name: file.Name, Method: file.Method})
+		if err != nil {
+			return cw.n, err
+		}
+		if err := a.dumpCollection(f); err != nil {
+			return cw.n, err
+		}
+	}
+	if len(a.added) > 0 {
+		if err := a.writeMedia(z); err != nil {
+			return cw.n, err
+		}
+	}
+	err := z.Close()
+	return cw.n, err
+}
+
+// SaveMedia writes the media files added with AddMedia or Import to the
+// directory dir, normally the media folder of a collection opened with
+// OpenCollection, replacing any files of the same names. WriteTo writes
+// them into packages read from an archive, but never writes to the media
+// folder of a collection.
+func (a *Apkg) SaveMedia(dir string) error {
+	for _, file := range a.added {
+		if err := ioutil.WriteFile(filepath.Join(dir, file.name), file.data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpCollection writes the database, compressing it if it was compressed
+// in the package.
+func (a *Apkg) dumpCollection(w io.Writer) error {
+	if a.sqlite.Name != "collection.anki21b" {
+		return a.db.dump(w)
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := a.db.dump(zw); err != nil {
+		_ = zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// WriteFile writes the package to the named file, as WriteTo does. The file
+// is replaced only once the package has been written in full, so it may be
+// the file the package was read from.
+func (a *Apkg) WriteFile(f string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f), ".anki-")
+	if err != nil {
+		return err
+	}
+	if _, err := a.WriteTo(tmp); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f)
+}
@@ -0,0 +1,331 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// reopen saves the package, and reads it back.
+func reopen(t *testing.T, apkg *Apkg) *Apkg {
+	buf := &bytes.Buffer{}
+	if _, err := apkg.WriteTo(buf); err != nil {
+		t.Fatalf("Error writing package: %s", err)
+	}
+	result, err := ReadBytes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error reading written package: %s", err)
+	}
+	return result
+}
+
+func TestUpdate(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := apkg.Notes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes.Next()
+	note, err := notes.Note()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = notes.Close()
+	cards, err := apkg.Cards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cards.Next()
+	card, err := cards.Card()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = cards.Close()
+
+	note.FieldValues[0] = "<b>Hola</b>"
+	note.Tags = "b  a"
+	if err := apkg.UpdateNote(note); err != nil {
+		t.Fatalf("Error updating note: %s", err)
+	}
+	if note.Tags != " b a " || note.UpdateSequence != -1 {
+		t.Errorf("Unexpected note: %+v", note)
+	}
+
+	due := timestampSeconds(time.Time(*collection.Created).AddDate(0, 0, 40))
+	ivl := DurationSeconds(20 * 24 * time.Hour)
+	card.DeckID, card.Due, card.Interval, card.Factor = DefaultDeckID, due, &ivl, 2.3
+	if err := apkg.UpdateCard(card); err != nil {
+		t.Fatalf("Error updating card: %s", err)
+	}
+	card.DeckID = 99
+	if err := apkg.UpdateCard(card); err == nil {
+		t.Errorf("Expected an error moving a card to a non-existent deck")
+	}
+	card.DeckID = DefaultDeckID
+
+	deck := collection.Decks[DefaultDeckID]
+	deck.Description = "Updated"
+	if err := apkg.UpdateDeck(deck); err != nil {
+		t.Fatalf("Error updating deck: %s", err)
+	}
+	dc := collection.DeckConfigs[DefaultDeckConfigID]
+	dc.New.PerDay = 42
+	if err := apkg.UpdateDeckConfig(dc); err != nil {
+		t.Fatalf("Error updating deck config: %s", err)
+	}
+	model := collection.Models[note.ModelID]
+	model.CSS = ".card { color: red }"
+	if err := apkg.UpdateModel(model); err != nil {
+		t.Fatalf("Error updating model: %s", err)
+	}
+	collection.Config.CollapseTime = 600
+	if err := apkg.UpdateConfig(&collection.Config); err != nil {
+		t.Fatalf("Error updating config: %s", err)
+	}
+
+	var row struct {
+		Tags string `db:"tags"`
+		Flds string `db:"flds"`
+		Sfld string `db:"sfld"`
+		Csum int64  `db:"csum"`
+	}
+	if err := apkg.db.Get(&row, "SELECT tags, flds, sfld, csum FROM notes WHERE id=?", int64(note.ID)); err != nil {
+		t.Fatal(err)
+	}
+	sfld, csum := sortFieldAndChecksum(model, note.FieldValues)
+	if row.Tags != " b a " || row.Flds[:12] != "<b>Hola</b>\x1f" || row.Sfld != sfld || row.Csum != csum {
+		t.Errorf("Unexpected note row: %+v", row)
+	}
+	var cardRow struct {
+		Due    int64 `db:"due"`
+		Ivl    int64 `db:"ivl"`
+		Factor int64 `db:"factor"`
+	}
+	if err := apkg.db.Get(&cardRow, "SELECT due, ivl, factor FROM cards WHERE id=?", int64(card.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if cardRow.Due != 40 || cardRow.Ivl != 20 || cardRow.Factor != 2300 {
+		t.Errorf("Unexpected card row: %+v", cardRow)
+	}
+
+	saved := reopen(t, apkg)
+	defer saved.Close()
+	result, err := saved.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Decks[DefaultDeckID].Description != "Updated" || result.DeckConfigs[DefaultDeckConfigID].New.PerDay != 42 ||
+		result.Models[note.ModelID].CSS != model.CSS || result.Config.CollapseTime != 600 {
+		t.Errorf("Collection changes were not saved")
+	}
+	// The test package stores its deck configs in the legacy dconf column.
+	if usn := result.DeckConfigs[DefaultDeckConfigID].UpdateSequence; usn != usnPending {
+		t.Errorf("Expected deck config usn %d, got %d", usnPending, usn)
+	}
+	if len(saved.ListFiles()) != len(apkg.ListFiles()) {
+		t.Errorf("Media files were not saved")
+	}
+	savedCards, err := saved.Cards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer savedCards.Close()
+	savedCards.Next()
+	savedCard, err := savedCards.Card()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if savedCard.DeckID != DefaultDeckID || !time.Time(*savedCard.Due).Equal(time.Time(*due)) || *savedCard.Interval != ivl {
+		t.Errorf("Unexpected card: %+v", savedCard)
+	}
+}
+
+func TestUpdateSuspendedCard(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	if _, err := apkg.db.Exec("UPDATE cards SET queue=-1 WHERE id=1388721683902"); err != nil {
+		t.Fatal(err)
+	}
+	card, err := apkg.CardByID(1388721683902)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.Type != CardTypeReview || card.Due == nil {
+		t.Fatalf("Expected a review card with a due time: %+v", card)
+	}
+	due := func() (due int64) {
+		if err := apkg.db.Get(&due, "SELECT due FROM cards WHERE id=1388721683902"); err != nil {
+			t.Fatal(err)
+		}
+		return due
+	}
+	if err := apkg.UpdateCard(card); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if d := due(); d != 28 {
+		t.Errorf("Expected due 28, got %d", d)
+	}
+
+	// A card without a due time keeps the one stored.
+	card.Due = nil
+	card.Queue = CardQueueReview
+	if err := apkg.UpdateCard(card); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if d := due(); d != 28 {
+		t.Errorf("Expected due 28, got %d", d)
+	}
+}
+
+// TestSaveAnsweredFilteredCard checks that a learning card answered in a
+// filtered deck, whose original due date the scheduler clears, can be saved
+// with both UpdateCard and a Writer.
+func TestSaveAnsweredFilteredCard(t *testing.T) {
+	apkg, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	now := time.Now()
+	if _, err := apkg.db.Exec("UPDATE cards SET type=1, queue=1, due=?, odid=did, odue=1234567 WHERE id=1388721683902", now.Unix()); err != nil {
+		t.Fatal(err)
+	}
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, err := apkg.CardByID(1388721683902)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, _, err := NewScheduler(collection).Answer(card, ReviewEaseWrong, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if updated.OriginalDeckID == 0 || updated.OriginalDue != nil {
+		t.Fatalf("Expected a filtered card without an original due date: %+v", updated)
+	}
+	odue := func(a *Apkg) int64 {
+		var odue int64
+		if err := a.db.Get(&odue, "SELECT odue FROM cards WHERE id=1388721683902"); err != nil {
+			t.Fatal(err)
+		}
+		return odue
+	}
+
+	if err := apkg.UpdateCard(updated); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if o := odue(apkg); o != 0 {
+		t.Errorf("UpdateCard: Expected odue 0, got %d", o)
+	}
+	if card, err := apkg.CardByID(1388721683902); err != nil || card.OriginalDue != nil {
+		t.Errorf("Expected no original due date, got %v (error %v)", card, err)
+	}
+
+	note, err := apkg.NoteByID(1388721680877)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(collection)
+	w.AddNote(note)
+	w.AddCard(updated)
+	buf := &bytes.Buffer{}
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Fatalf("Writer: Unexpected error: %s", err)
+	}
+	written, err := ReadBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer written.Close()
+	if o := odue(written); o != 0 {
+		t.Errorf("Writer: Expected odue 0, got %d", o)
+	}
+}
+
+func TestUpdateSplitSchema(t *testing.T) {
+	apkg, err := ReadBytes(splitSchemaPackage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apkg.Close()
+	collection, err := apkg.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deck := collection.Decks[2]
+	deck.Name = "Lang::Spanish"
+	if err := apkg.UpdateDeck(deck); err != nil {
+		t.Fatalf("Error updating deck: %s", err)
+	}
+	dc := collection.DeckConfigs[1]
+	dc.New.PerDay = 42
+	dc.Lapses.Delays = []DurationMinutes{DurationMinutes(90 * time.Second)}
+	if err := apkg.UpdateDeckConfig(dc); err != nil {
+		t.Fatalf("Error updating deck config: %s", err)
+	}
+	model := collection.Models[1000]
+	model.Fields[1].Font = "Times"
+	model.Fields = append(model.Fields, &Field{Name: "Extra", Ordinal: 2})
+	if err := apkg.UpdateModel(model); err != nil {
+		t.Fatalf("Error updating model: %s", err)
+	}
+	collection.Config.CollapseTime = 600
+	if err := apkg.UpdateConfig(&collection.Config); err != nil {
+		t.Fatalf("Error updating config: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "updated.apkg")
+	if err := apkg.WriteFile(path); err != nil {
+		t.Fatalf("Error writing package: %s", err)
+	}
+	saved, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	result, err := saved.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := result.Decks[2].Name; name != "Lang::Spanish" {
+		t.Errorf("Unexpected deck name %q", name)
+	}
+	resultConf := result.DeckConfigs[1]
+	if resultConf.New.PerDay != 42 || !reflect.DeepEqual(resultConf.Lapses.Delays, dc.Lapses.Delays) ||
+		resultConf.New.InitialFactor != 2500 || resultConf.Reviews.HardFactor != 1.2 {
+		t.Errorf("Unexpected deck config: %+v", resultConf)
+	}
+	var config []byte
+	if err := saved.db.QueryRow("SELECT config FROM deck_config WHERE id=1").Scan(&config); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := decodeProto(config); err != nil || msg.uint(40) != 7 {
+		t.Errorf("Unknown deck config field was not retained")
+	}
+	fields := result.Models[1000].Fields
+	if len(fields) != 3 || fields[1].Font != "Times" || fields[1].FontSize != 20 || fields[2].Name != "Extra" {
+		t.Errorf("Unexpected fields: %+v, %+v", fields[1], fields[len(fields)-1])
+	}
+	if result.Config.CollapseTime != 600 || result.Config.CurrentDeck != 1 {
+		t.Errorf("Unexpected config: %+v", result.Config)
+	}
+}
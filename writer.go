@@ -0,0 +1,483 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schema is the SQL used to create a new, empty collection.anki2 database.
+const schema = `
+CREATE TABLE col (
+    id              integer primary key,
+    crt             integer not null,
+    mod             integer not null,
+    scm             integer not null,
+    ver             integer not null,
+    dty             integer not null,
+    usn             integer not null,
+    ls              integer not null,
+    conf            text not null,
+    models          text not null,
+    decks           text not null,
+    dconf           text not null,
+    tags            text not null
+);
+CREATE TABLE notes (
+    id              integer primary key,
+    guid            text not null,
+    mid             integer not null,
+    mod             integer not null,
+    usn             integer not null,
+    tags            text not null,
+    flds            text not null,
+    sfld            integer not null,
+    csum            integer not null,
+    flags           integer not null,
+    data            text not null
+);
+CREATE TABLE cards (
+    id              integer primary key,
+    nid             integer not null,
+    did             integer not null,
+    ord             integer not null,
+    mod             integer not null,
+    usn             integer not null,
+    type            integer not null,
+    queue           integer not null,
+    due             integer not null,
+    ivl             integer not null,
+    factor          integer not null,
+    reps            integer not null,
+    lapses          integer not null,
+    left            integer not null,
+    odue            integer not null,
+    odid            integer not null,
+    flags           integer not null,
+    data            text not null
+);
+CREATE TABLE revlog (
+    id              integer primary key,
+    cid             integer not null,
+    usn             integer not null,
+    ease            integer not null,
+    ivl             integer not null,
+    lastIvl         integer not null,
+    factor          integer not null,
+    time            integer not null,
+    type            integer not null
+);
+CREATE TABLE graves (
+    usn             integer not null,
+    oid             integer not null,
+    type            integer not null
+);
+CREATE INDEX ix_notes_usn on notes (usn);
+CREATE INDEX ix_cards_usn on cards (usn);
+CREATE INDEX ix_revlog_usn on revlog (usn);
+CREATE INDEX ix_cards_nid on cards (nid);
+CREATE INDEX ix_cards_sched on cards (did, queue, due);
+CREATE INDEX ix_revlog_cid on revlog (cid);
+CREATE INDEX ix_notes_csum on notes (csum);
+`
+
+const secondsPerDay = 24 * 60 * 60
+
+// Writer builds a new *.apkg package file from a Collection, and the Notes,
+// Cards, Reviews and media files added to it.
+type Writer struct {
+	collection *Collection
+	notes      []*Note
+	cards      []*Card
+	reviews    []*Review
+	media      []*mediaFile
+}
+
+type mediaFile struct {
+	name string
+	data []byte
+}
+
+// NewWriter returns a new Writer, which will write the provided collection.
+func NewWriter(collection *Collection) *Writer {
+	return &Writer{collection: collection}
+}
+
+// AddNote adds a note to the package.
+func (w *Writer) AddNote(note *Note) {
+	w.notes = append(w.notes, note)
+}
+
+// AddCard adds a card to the package. Cards which are not new, including
+// suspended and buried ones, must have a Due time, or the package cannot be
+// written. A nil OriginalDue is written as 0, Anki's value for none.
+func (w *Writer) AddCard(card *Card) {
+	w.cards = append(w.cards, card)
+}
+
+// AddReview adds a review log entry to the package. Reviews without a
+// Timestamp are logged when the package is written, each a millisecond apart,
+// as the review log's IDs must be unique.
+func (w *Writer) AddReview(review *Review) {
+	w.reviews = append(w.reviews, review)
+}
+
+// AddMedia adds a media file to the package, to be referenced by notes and
+// templates by the provided filename.
+func (w *Writer) AddMedia(name string, data []byte) {
+	w.media = append(w.media, &mediaFile{name: name, data: data})
+}
+
+// WriteFile writes the package to the named file, creating or truncating it.
+func (w *Writer) WriteFile(f string) error {
+	file, err := os.Create(f)
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteTo(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WriteTo writes the package, as a zip archive, to out. It implements the
+// io.WriterTo interface.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	if w.collection == nil {
+		return 0, errors.New("No collection provided")
+	}
+	cw := &countWriter{w: out}
+	z := zip.NewWriter(cw)
+	if err := w.writeCollection(z); err != nil {
+		return cw.n, err
+	}
+	mediaMap := make(map[string]string, len(w.media))
+	for i, file := range w.media {
+		idx := strconv.Itoa(i)
+		mediaMap[idx] = file.name
+		f, err := z.Create(idx)
+		if err != nil {
+			return cw.n, err
+		}
+		if _, err := f.Write(file.data); err != nil {
+			return cw.n, err
+		}
+	}
+	mediaJSON, err := json.Marshal(mediaMap)
+	if err != nil {
+		return cw.n, err
+	}
+	f, err := z.Create("media")
+	if err != nil {
+		return cw.n, err
+	}
+	if _, err := f.Write(mediaJSON); err != nil {
+		return cw.n, err
+	}
+	err = z.Close()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (w *Writer) writeCollection(z *zip.Writer) (e error) {
+	db, err := newDB()
+	if err != nil {
+		if db != nil {
+			_ = db.Close()
+		}
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil && e == nil {
+			e = err
+		}
+	}()
+	if err := w.populateDB(db); err != nil {
+		return err
+	}
+	f, err := z.Create("collection.anki2")
+	if err != nil {
+		return err
+	}
+	return db.dump(f)
+}
+
+func (w *Writer) populateDB(db *DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := w.insertRows(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (w *Writer) insertRows(tx *sql.Tx) error {
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+	now := time.Now()
+	col := w.collection
+	crt := secondsOrNow(col.Created, now)
+
+	// New cards without a position are due in the order their notes were
+	// added.
+	positions := make(map[ID]int64, len(w.notes))
+	for i, note := range w.notes {
+		positions[note.ID] = int64(i + 1)
+	}
+	conf := col.Config
+	if next := len(w.notes) + 1; conf.NextPos < next {
+		conf.NextPos = next
+	}
+	for _, card := range w.cards {
+		if card.Position >= conf.NextPos {
+			conf.NextPos = card.Position + 1
+		}
+	}
+
+	confJSON, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	modelsJSON, err := json.Marshal(col.Models)
+	if err != nil {
+		return err
+	}
+	decksJSON, err := json.Marshal(col.Decks)
+	if err != nil {
+		return err
+	}
+	dconfJSON, err := json.Marshal(col.DeckConfigs)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO col (id, crt, mod, scm, ver, dty, usn, ls, conf, models, decks, dconf, tags)
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		crt,
+		millisecondsOrNow(col.Modified, now),
+		millisecondsOrNow(col.SchemaModified, now),
+		col.Version,
+		boolToInt(col.Dirty),
+		col.UpdateSequence,
+		milliseconds(col.LastSync),
+		string(confJSON),
+		string(modelsJSON),
+		string(decksJSON),
+		string(dconfJSON),
+		collectionTags(col.Tags),
+	); err != nil {
+		return err
+	}
+
+	for _, note := range w.notes {
+		if _, err := tx.Exec(`INSERT INTO notes (id, guid, mid, mod, usn, tags, flds, sfld, csum, flags, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, '')`,
+			int64(note.ID),
+			note.GUID,
+			int64(note.ModelID),
+			secondsOrNow(note.Modified, now),
+			note.UpdateSequence,
+			joinTags(strings.Fields(note.Tags)),
+			strings.Join(note.FieldValues, "\x1f"),
+			note.UniqueField,
+			note.Checksum,
+		); err != nil {
+			return err
+		}
+	}
+
+	for _, card := range w.cards {
+		pos := int64(card.Position)
+		if pos == 0 {
+			pos = positions[card.NoteID]
+		}
+		due, ok := encodeDue(card.Queue, card.Type, card.Due, crt, pos)
+		if !ok {
+			return fmt.Errorf("Card %d is not new, but has no due time", card.ID)
+		}
+		var odue int64
+		if card.OriginalDeckID != 0 {
+			// A nil OriginalDue is stored as 0, as Anki does once a card in
+			// a filtered deck has been answered.
+			odue, _ = encodeDue(card.Queue, card.Type, card.OriginalDue, crt, pos)
+		}
+		var ivl int64
+		if card.Interval != nil {
+			ivl = encodeInterval(*card.Interval)
+		}
+		if _, err := tx.Exec(`INSERT INTO cards (id, nid, did, ord, mod, usn, type, queue, due, ivl, factor, reps, lapses, left, odue, odid, flags, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, '')`,
+			int64(card.ID),
+			int64(card.NoteID),
+			int64(card.DeckID),
+			card.TemplateID,
+			secondsOrNow(card.Modified, now),
+			card.UpdateSequence,
+			int(card.Type),
+			int(card.Queue),
+			due,
+			ivl,
+			encodeFactor(card.Factor),
+			card.ReviewCount,
+			card.Lapses,
+			card.Left,
+			odue,
+			int64(card.OriginalDeckID),
+			card.Flags,
+		); err != nil {
+			return err
+		}
+	}
+
+	used := make(map[int64]bool, len(w.reviews))
+	for _, review := range w.reviews {
+		if review.Timestamp != nil {
+			used[milliseconds(review.Timestamp)] = true
+		}
+	}
+	nextID := millisecondsOrNow(nil, now)
+	for _, review := range w.reviews {
+		id := millisecondsOrNow(review.Timestamp, now)
+		if review.Timestamp == nil {
+			for used[nextID] {
+				nextID++
+			}
+			id = nextID
+			nextID++
+		}
+		if _, err := tx.Exec(`INSERT INTO revlog (id, cid, usn, ease, ivl, lastIvl, factor, time, type)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id,
+			int64(review.CardID),
+			review.UpdateSequence,
+			int(review.Ease),
+			encodeInterval(review.Interval),
+			encodeInterval(review.LastInterval),
+			encodeFactor(review.Factor),
+			int64(time.Duration(review.ReviewTime)/time.Millisecond),
+			int(review.Type),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeDue converts a due time back to the representation Anki stores,
+// which depends on the card's queue. See the Card type for details. ok is
+// false if the representation is a due time, but due is nil.
+func encodeDue(queue CardQueue, cardType CardType, due *TimestampSeconds, crt, position int64) (value int64, ok bool) {
+	if queue < CardQueueNew || queue > CardQueueRelearning {
+		// Suspended and buried cards retain the due value of their card type.
+		switch cardType {
+		case CardTypeNew:
+			queue = CardQueueNew
+		case CardTypeLearning:
+			queue = CardQueueLearning
+		default:
+			queue = CardQueueReview
+		}
+	}
+	if queue == CardQueueNew {
+		return position, true
+	}
+	if due == nil {
+		return 0, false
+	}
+	if queue == CardQueueLearning {
+		return seconds(due), true
+	}
+	return daysSince(due, crt), true
+}
+
+func daysSince(t *TimestampSeconds, crt int64) int64 {
+	if t == nil {
+		return 0
+	}
+	return (seconds(t) - crt) / secondsPerDay
+}
+
+// encodeInterval converts an interval to Anki's representation: positive
+// days, or negative seconds for intervals which are not a whole number of
+// days.
+func encodeInterval(d DurationSeconds) int64 {
+	secs := int64(time.Duration(d) / time.Second)
+	if secs%secondsPerDay == 0 {
+		return secs / secondsPerDay
+	}
+	return -secs
+}
+
+// encodeFactor converts a factor to Anki's representation, in permille.
+func encodeFactor(f float32) int64 {
+	return int64(math.Round(float64(f) * 1000))
+}
+
+func seconds(t *TimestampSeconds) int64 {
+	if t == nil {
+		return 0
+	}
+	return time.Time(*t).Unix()
+}
+
+func secondsOrNow(t *TimestampSeconds, now time.Time) int64 {
+	if t == nil {
+		return now.Unix()
+	}
+	return seconds(t)
+}
+
+func milliseconds(t *TimestampMilliseconds) int64 {
+	if t == nil {
+		return 0
+	}
+	return time.Time(*t).UnixNano() / int64(time.Millisecond)
+}
+
+func millisecondsOrNow(t *TimestampMilliseconds, now time.Time) int64 {
+	if t == nil {
+		return now.UnixNano() / int64(time.Millisecond)
+	}
+	return milliseconds(t)
+}
+
+func boolToInt(b BoolInt) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// collectionTags returns the tag cache for the `col` table, which Anki
+// expects to be a JSON object.
+func collectionTags(tags string) string {
+	if tags == "" {
+		return "{}"
+	}
+	return tags
+}
@@ -0,0 +1,284 @@
+// Copyright: Jonathan Hall
+// License: GNU AGPL, Version 3 or later; http://www.gnu.org/licenses/agpl.html
+
+package anki
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	src, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatalf("Error opening test file: %s", err)
+	}
+	defer src.Close()
+	collection, err := src.Collection()
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	w := NewWriter(collection)
+
+	var origNotes []*Note
+	notes, err := src.Notes()
+	if err != nil {
+		t.Fatalf("Error fetching notes: %s", err)
+	}
+	for notes.Next() {
+		note, err := notes.Note()
+		if err != nil {
+			t.Fatalf("Error reading note: %s", err)
+		}
+		origNotes = append(origNotes, note)
+		w.AddNote(note)
+	}
+	_ = notes.Close()
+
+	var origCards []*Card
+	cards, err := src.Cards()
+	if err != nil {
+		t.Fatalf("Error fetching cards: %s", err)
+	}
+	for cards.Next() {
+		card, err := cards.Card()
+		if err != nil {
+			t.Fatalf("Error reading card: %s", err)
+		}
+		origCards = append(origCards, card)
+		w.AddCard(card)
+	}
+	_ = cards.Close()
+
+	var origReviews []*Review
+	reviews, err := src.Reviews()
+	if err != nil {
+		t.Fatalf("Error fetching reviews: %s", err)
+	}
+	for reviews.Next() {
+		review, err := reviews.Review()
+		if err != nil {
+			t.Fatalf("Error reading review: %s", err)
+		}
+		origReviews = append(origReviews, review)
+		w.AddReview(review)
+	}
+	_ = reviews.Close()
+
+	for _, name := range src.ListFiles() {
+		data, err := src.ReadMediaFile(name)
+		if err != nil {
+			t.Fatalf("Error reading media file %s: %s", name, err)
+		}
+		w.AddMedia(name, data)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := w.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("Error writing package: %s", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo reported %d bytes, but wrote %d", n, buf.Len())
+	}
+
+	dst, err := ReadBytes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error reading written package: %s", err)
+	}
+	defer dst.Close()
+
+	newCollection, err := dst.Collection()
+	if err != nil {
+		t.Fatalf("Error getting written collection: %s", err)
+	}
+	if !reflect.DeepEqual(collection.Models, newCollection.Models) {
+		t.Errorf("Models differ after round trip")
+	}
+	if !reflect.DeepEqual(collection.DeckConfigs, newCollection.DeckConfigs) {
+		t.Errorf("Deck configs differ after round trip")
+	}
+	if len(collection.Decks) != len(newCollection.Decks) {
+		t.Errorf("Expected %d decks, found %d", len(collection.Decks), len(newCollection.Decks))
+	}
+
+	notes, err = dst.Notes()
+	if err != nil {
+		t.Fatalf("Error fetching written notes: %s", err)
+	}
+	var i int
+	for ; notes.Next(); i++ {
+		note, err := notes.Note()
+		if err != nil {
+			t.Fatalf("Error reading written note: %s", err)
+		}
+		if !reflect.DeepEqual(origNotes[i], note) {
+			t.Errorf("Note differs after round trip.\nExpected: %+v\n  Actual: %+v", origNotes[i], note)
+		}
+	}
+	_ = notes.Close()
+	if i != len(origNotes) {
+		t.Errorf("Expected %d notes, found %d", len(origNotes), i)
+	}
+
+	cards, err = dst.Cards()
+	if err != nil {
+		t.Fatalf("Error fetching written cards: %s", err)
+	}
+	for i = 0; cards.Next(); i++ {
+		card, err := cards.Card()
+		if err != nil {
+			t.Fatalf("Error reading written card: %s", err)
+		}
+		if !reflect.DeepEqual(origCards[i], card) {
+			t.Errorf("Card differs after round trip.\nExpected: %+v\n  Actual: %+v", origCards[i], card)
+		}
+	}
+	_ = cards.Close()
+	if i != len(origCards) {
+		t.Errorf("Expected %d cards, found %d", len(origCards), i)
+	}
+
+	reviews, err = dst.Reviews()
+	if err != nil {
+		t.Fatalf("Error fetching written reviews: %s", err)
+	}
+	for i = 0; reviews.Next(); i++ {
+		review, err := reviews.Review()
+		if err != nil {
+			t.Fatalf("Error reading written review: %s", err)
+		}
+		if !reflect.DeepEqual(origReviews[i], review) {
+			t.Errorf("Review differs after round trip.\nExpected: %+v\n  Actual: %+v", origReviews[i], review)
+		}
+	}
+	_ = reviews.Close()
+	if i != len(origReviews) {
+		t.Errorf("Expected %d reviews, found %d", len(origReviews), i)
+	}
+
+	origFiles, newFiles := src.ListFiles(), dst.ListFiles()
+	sort.Strings(origFiles)
+	sort.Strings(newFiles)
+	if !reflect.DeepEqual(origFiles, newFiles) {
+		t.Fatalf("Media files differ.\nExpected: %v\n  Actual: %v", origFiles, newFiles)
+	}
+	for _, name := range origFiles {
+		orig, _ := src.ReadMediaFile(name)
+		data, err := dst.ReadMediaFile(name)
+		if err != nil {
+			t.Fatalf("Error reading written media file %s: %s", name, err)
+		}
+		if !bytes.Equal(orig, data) {
+			t.Errorf("Media file %s differs after round trip", name)
+		}
+	}
+}
+
+func TestWriterSuspendedCard(t *testing.T) {
+	src, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := src.db.Exec("UPDATE cards SET queue=-1 WHERE id=1388721683902"); err != nil {
+		t.Fatal(err)
+	}
+	collection, err := src.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := src.NoteByID(1388721680877)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, err := src.CardByID(1388721683902)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(collection)
+	w.AddNote(note)
+	w.AddCard(card)
+	buf := &bytes.Buffer{}
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	dst, err := ReadBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	var due int64
+	if err := dst.db.Get(&due, "SELECT due FROM cards WHERE id=1388721683902"); err != nil {
+		t.Fatal(err)
+	}
+	if due != 28 {
+		t.Errorf("Expected due 28, got %d", due)
+	}
+
+	// A card which is not new must have a due time.
+	card.Due = nil
+	if _, err := w.WriteTo(&bytes.Buffer{}); err == nil || err.Error() != "Card 1388721683902 is not new, but has no due time" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestWriterNoteTags(t *testing.T) {
+	src, err := ReadFile(ApkgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	collection, err := src.Collection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := src.NoteByID(1388721680877)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tags are stored space-padded, as Anki searches them.
+	note.Tags = "b  a"
+	w := NewWriter(collection)
+	w.AddNote(note)
+	buf := &bytes.Buffer{}
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	dst, err := ReadBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	var tags string
+	if err := dst.db.Get(&tags, "SELECT tags FROM notes WHERE id=1388721680877"); err != nil {
+		t.Fatal(err)
+	}
+	if tags != " b a " {
+		t.Errorf("Unexpected tags: %q", tags)
+	}
+}
+
+func TestWriterReviewsWithoutTimestamps(t *testing.T) {
+	w := NewWriter(NewBuilder().Collection())
+	w.AddReview(&Review{CardID: 1, Ease: ReviewEaseOK, UpdateSequence: -1})
+	w.AddReview(&Review{CardID: 1, Ease: ReviewEaseEasy, UpdateSequence: -1})
+	buf := &bytes.Buffer{}
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	dst, err := ReadBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	var ids []int64
+	if err := dst.db.Select(&ids, "SELECT id FROM revlog ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[1] != ids[0]+1 {
+		t.Errorf("Unexpected review IDs: %v", ids)
+	}
+}